@@ -0,0 +1,204 @@
+// Package broker connects to the message brokers flows are kept in. The
+// FNAA describes a flow with its broker type, servers and topic; the
+// driver registered for that type produces events to it and consumes them
+// back. It is shared by the flow CLI and the FNAA.
+package broker
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Start positions of a Consumer, besides plain offsets.
+const (
+	Beginning int64 = -2 // the oldest event kept
+	End       int64 = -1 // the events produced from now on
+)
+
+// Descriptor tells where the events of a flow are, as DESCRIBE FLOW
+// answers it.
+type Descriptor struct {
+	Flow    string
+	Type    string
+	Topic   string
+	Servers []string
+	// Options holds the other fields of the description.
+	Options map[string]string
+}
+
+// ParseDescriptor builds a descriptor from the key=value fields of a
+// DESCRIBE FLOW answer. The server field may list several servers, comma
+// separated.
+func ParseDescriptor(fields map[string]string) (Descriptor, error) {
+	d := Descriptor{Options: map[string]string{}}
+	for key, value := range fields {
+		switch key {
+		case "flow":
+			d.Flow = value
+		case "type":
+			d.Type = value
+		case "topic":
+			d.Topic = value
+		case "server":
+			for _, server := range strings.Split(value, ",") {
+				if server = strings.TrimSpace(server); server != "" {
+					d.Servers = append(d.Servers, server)
+				}
+			}
+		default:
+			d.Options[key] = value
+		}
+	}
+	switch {
+	case d.Type == "":
+		return d, errors.New("flow description has no broker type")
+	case d.Topic == "":
+		return d, errors.New("flow description has no topic")
+	case len(d.Servers) == 0:
+		return d, errors.New("flow description has no broker server")
+	}
+	return d, nil
+}
+
+// Header is metadata carried along an event.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Message is an event of a flow. Partition and Offset are set by the
+// broker on the messages consumed.
+type Message struct {
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Time      time.Time
+	Partition int
+	Offset    int64
+}
+
+// Header returns the value of the header named key and whether it is
+// set.
+func (m Message) Header(key string) ([]byte, bool) {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Producer appends events to a flow.
+type Producer interface {
+	// Produce writes messages, returning once the broker stored them.
+	Produce(ctx context.Context, messages ...Message) error
+	Close() error
+}
+
+// Consumer reads the events of a flow.
+type Consumer interface {
+	// Next returns the next event, waiting for one when following the
+	// flow. Without Follow, io.EOF is returned once the events there were
+	// when the consumer was opened have all been read.
+	Next(ctx context.Context) (Message, error)
+	Close() error
+}
+
+// Options tune how a driver connects and consumes.
+type Options struct {
+	// Dial opens the connections to the brokers, net.Dialer when nil.
+	Dial func(ctx context.Context, network string, address string) (net.Conn, error)
+	// Start is where consumers begin: an offset, Beginning or End.
+	Start int64
+	// StartTime, when set, makes consumers begin at the first event
+	// stored at or after it instead.
+	StartTime time.Time
+	// Offsets, when set, is where consumers begin in each partition it
+	// has, such as after the last event read before reconnecting.
+	// Start and StartTime apply to the others.
+	Offsets map[int]int64
+	// Follow keeps consumers waiting for new events.
+	Follow bool
+	// CreateTopics lets producers create the topic of a flow that has
+	// none yet, if the broker allows it.
+	CreateTopics bool
+	// Ordering is the ordering policy of the flow producers write to,
+	// PerKey when empty.
+	Ordering string
+}
+
+// Driver connects to a type of broker.
+type Driver interface {
+	Producer(ctx context.Context, d Descriptor, opts Options) (Producer, error)
+	Consumer(ctx context.Context, d Descriptor, opts Options) (Consumer, error)
+}
+
+// Purger is implemented by the drivers that can drop every event of a
+// flow at once.
+type Purger interface {
+	// Purge drops the events of the flow of d. Producers allowed to
+	// create topics write to it again afterwards.
+	Purge(ctx context.Context, d Descriptor, opts Options) error
+}
+
+// ErrNoTopic is the cause of the errors of consumers of flows whose topic
+// has not been created yet, which have no events.
+var ErrNoTopic = errors.New("flow has no topic yet")
+
+// IsNoTopic reports whether err is because the topic of a flow has not
+// been created yet.
+func IsNoTopic(err error) bool {
+	return errors.Cause(err) == ErrNoTopic
+}
+
+// Progress is where a consumer group got to in a flow.
+type Progress struct {
+	// Offsets is the next offset to read in each partition.
+	Offsets map[int]int64
+	// Metadata is kept by the broker along with the offsets.
+	Metadata string
+}
+
+// Committer is implemented by the drivers that keep on the broker where
+// consumer groups got to in a flow.
+type Committer interface {
+	// Commit records progress as where group got to in the flow of d.
+	Commit(ctx context.Context, d Descriptor, opts Options, group string, progress Progress) error
+	// Committed returns the progress group last committed in the flow of
+	// d, without offsets if there is none.
+	Committed(ctx context.Context, d Descriptor, opts Options, group string) (Progress, error)
+	// Ends returns, for each partition of the flow of d, the offset the
+	// next event written to it gets. A flow without topic has none.
+	Ends(ctx context.Context, d Descriptor, opts Options) (map[int]int64, error)
+}
+
+var drivers = map[string]Driver{}
+
+// Register makes a driver available for the broker type name.
+func Register(name string, driver Driver) {
+	drivers[name] = driver
+}
+
+// Types returns the broker types there is a driver for.
+func Types() []string {
+	var types []string
+	for name := range drivers {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Open returns the driver for the broker of d.
+func Open(d Descriptor) (Driver, error) {
+	driver, ok := drivers[d.Type]
+	if !ok {
+		return nil, errors.Errorf("no driver for broker type %q of flow %v, known types are %v", d.Type, d.Flow, strings.Join(Types(), ", "))
+	}
+	return driver, nil
+}
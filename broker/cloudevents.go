@@ -0,0 +1,260 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// CloudEvents content modes of a flow, after the Kafka protocol binding
+// of CloudEvents 1.0.
+const (
+	// Plain events carry their payload only.
+	Plain = "off"
+	// Structured events are JSON envelopes holding the attributes and
+	// the payload.
+	Structured = "structured"
+	// Binary events carry the payload as is, the attributes in ce_
+	// headers.
+	Binary = "binary"
+)
+
+// ContentModes lists the content modes, the first one being the default.
+var ContentModes = []string{Plain, Structured, Binary}
+
+// SpecVersion is the CloudEvents version events are wrapped with.
+const SpecVersion = "1.0"
+
+// DefaultEventType is the type of the events wrapped without one given.
+const DefaultEventType = "flow.event"
+
+// structuredType is the content type of structured events.
+const structuredType = "application/cloudevents+json"
+
+// ParseContentMode checks a content mode, defaulting to Plain.
+func ParseContentMode(mode string) (string, error) {
+	if mode == "" {
+		return Plain, nil
+	}
+	for _, m := range ContentModes {
+		if strings.EqualFold(mode, m) {
+			return m, nil
+		}
+	}
+	return "", errors.Errorf("unknown content mode %q, use %v", mode, strings.Join(ContentModes, ", "))
+}
+
+// CloudEvent holds the attributes of a CloudEvent.
+type CloudEvent struct {
+	ID     string
+	Source string
+	Type   string
+	// Optional attributes, left out when empty.
+	Subject         string
+	Time            time.Time
+	DataContentType string
+	// Extensions holds the other attributes.
+	Extensions map[string]string
+}
+
+// Wrap returns m with its value as the data of a CloudEvent with the
+// attributes of e, in the content mode given. Plain leaves m as it is.
+func Wrap(m Message, mode string, e CloudEvent) (Message, error) {
+	if e.ID == "" || e.Source == "" || e.Type == "" {
+		return m, errors.New("CloudEvents need an id, a source and a type")
+	}
+	attributes := map[string]string{
+		"specversion": SpecVersion,
+		"id":          e.ID,
+		"source":      e.Source,
+		"type":        e.Type,
+	}
+	if e.Subject != "" {
+		attributes["subject"] = e.Subject
+	}
+	if !e.Time.IsZero() {
+		attributes["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	}
+	for name, value := range e.Extensions {
+		attributes[name] = value
+	}
+
+	out := m
+	out.Headers = append([]Header(nil), m.Headers...)
+	switch mode {
+	case Plain:
+		return m, nil
+	case Binary:
+		for name, value := range attributes {
+			out.Headers = append(out.Headers, Header{Key: "ce_" + name, Value: []byte(value)})
+		}
+		if e.DataContentType != "" {
+			out.Headers = append(out.Headers, Header{Key: "content-type", Value: []byte(e.DataContentType)})
+		}
+	case Structured:
+		envelope := map[string]interface{}{}
+		for name, value := range attributes {
+			envelope[name] = value
+		}
+		if e.DataContentType != "" {
+			envelope["datacontenttype"] = e.DataContentType
+		}
+		switch {
+		case isJSON(e.DataContentType) && json.Valid(m.Value):
+			envelope["data"] = json.RawMessage(m.Value)
+		case strings.HasPrefix(e.DataContentType, "text/") && utf8.Valid(m.Value):
+			envelope["data"] = string(m.Value)
+		default:
+			envelope["data_base64"] = base64.StdEncoding.EncodeToString(m.Value)
+		}
+		value, err := json.Marshal(envelope)
+		if err != nil {
+			return m, errors.Wrap(err, "encoding CloudEvent")
+		}
+		out.Value = value
+		out.Headers = append(out.Headers, Header{Key: "content-type", Value: []byte(structuredType + "; charset=UTF-8")})
+	default:
+		return m, errors.Errorf("unknown content mode %q", mode)
+	}
+	return out, nil
+}
+
+// Unwrap returns the attributes and the data of m if it is a CloudEvent,
+// in either content mode, and false if it is not one.
+func Unwrap(m Message) (CloudEvent, []byte, bool, error) {
+	switch ContentMode(m) {
+	case Binary:
+		e := CloudEvent{Extensions: map[string]string{}}
+		for _, h := range m.Headers {
+			if h.Key == "content-type" {
+				e.DataContentType = string(h.Value)
+			}
+			if !strings.HasPrefix(h.Key, "ce_") {
+				continue
+			}
+			if err := e.set(strings.TrimPrefix(h.Key, "ce_"), string(h.Value)); err != nil {
+				return e, nil, true, err
+			}
+		}
+		return e, m.Value, true, nil
+	case Structured:
+		var envelope map[string]json.RawMessage
+		if err := json.Unmarshal(m.Value, &envelope); err != nil {
+			return CloudEvent{}, nil, true, errors.Wrap(err, "decoding CloudEvent")
+		}
+		e := CloudEvent{Extensions: map[string]string{}}
+		var data []byte
+		for name, raw := range envelope {
+			switch name {
+			case "data":
+				data = raw
+				var text string
+				if !isJSON(envelopeContentType(envelope)) && json.Unmarshal(raw, &text) == nil {
+					data = []byte(text)
+				}
+			case "data_base64":
+				var encoded string
+				if err := json.Unmarshal(raw, &encoded); err != nil {
+					return e, nil, true, errors.Wrap(err, "decoding data_base64")
+				}
+				decoded, err := base64.StdEncoding.DecodeString(encoded)
+				if err != nil {
+					return e, nil, true, errors.Wrap(err, "decoding data_base64")
+				}
+				data = decoded
+			default:
+				var value interface{}
+				if err := json.Unmarshal(raw, &value); err != nil {
+					return e, nil, true, err
+				}
+				text, ok := value.(string)
+				if !ok {
+					text = string(raw)
+				}
+				if err := e.set(name, text); err != nil {
+					return e, nil, true, err
+				}
+			}
+		}
+		return e, data, true, nil
+	}
+	return CloudEvent{}, m.Value, false, nil
+}
+
+// ContentMode tells whether m is a CloudEvent in binary or structured
+// mode, or a plain event.
+func ContentMode(m Message) string {
+	if _, ok := m.Header("ce_specversion"); ok {
+		return Binary
+	}
+	if contentType, ok := m.Header("content-type"); ok {
+		if t, _, err := mime.ParseMediaType(string(contentType)); err == nil && t == structuredType {
+			return Structured
+		}
+	}
+	return Plain
+}
+
+func (e *CloudEvent) set(name string, value string) error {
+	switch name {
+	case "specversion":
+		if value != SpecVersion {
+			return errors.Errorf("unsupported CloudEvents version %v", value)
+		}
+	case "id":
+		e.ID = value
+	case "source":
+		e.Source = value
+	case "type":
+		e.Type = value
+	case "subject":
+		e.Subject = value
+	case "datacontenttype":
+		e.DataContentType = value
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return errors.Wrap(err, "CloudEvent time")
+		}
+		e.Time = t
+	default:
+		e.Extensions[name] = value
+	}
+	return nil
+}
+
+// envelopeContentType returns the datacontenttype of a structured
+// envelope, JSON when absent.
+func envelopeContentType(envelope map[string]json.RawMessage) string {
+	var contentType string
+	if raw, ok := envelope["datacontenttype"]; ok && json.Unmarshal(raw, &contentType) == nil {
+		return contentType
+	}
+	return "application/json"
+}
+
+// isJSON reports whether contentType is a JSON media type.
+func isJSON(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return t == "application/json" || t == "text/json" || strings.HasSuffix(t, "+json")
+}
+
+// DataContentType guesses the content type of an event payload: JSON,
+// UTF-8 text or else bytes.
+func DataContentType(data []byte) string {
+	switch {
+	case json.Valid(data):
+		return "application/json"
+	case utf8.Valid(data):
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,64 @@
+package broker
+
+import "strings"
+
+// Headers the FNAA sets on the events it moves to a dead-letter flow,
+// telling why and where they come from. The source, partition, offset and
+// epoch headers are set on exactly-once copies as well.
+const (
+	HeaderError         = "fnaa-error"          // why the event was not copied
+	HeaderSource        = "fnaa-source"         // the flow it was copied from
+	HeaderPartition     = "fnaa-partition"      // its partition in that flow
+	HeaderOffset        = "fnaa-offset"         // its offset in that flow
+	HeaderStage         = "fnaa-stage"          // one of the stages below
+	HeaderAttempts      = "fnaa-attempts"       // the deliveries tried
+	HeaderFailedAt      = "fnaa-failed-at"      // when, in RFC 3339
+	HeaderSchemaVersion = "fnaa-schema-version" // the schema it failed
+	HeaderEpoch         = "fnaa-epoch"          // the copies since a rewind
+)
+
+// Stages at which copying an event to a subscription fails.
+const (
+	// StageValidate is an event not conforming to the schema of its
+	// flow; what is dead-lettered is the event as it was published.
+	StageValidate = "validate"
+	// StageTransform is a projection or CloudEvents wrapping failing on
+	// the event; the event as it was published is dead-lettered.
+	StageTransform = "transform"
+	// StageVerify is a signed event its signature does not hold for;
+	// the event as it was published is dead-lettered.
+	StageVerify = "verify"
+	// StageDeliver is the copy that could not be written to the
+	// subscription, dead-lettered as it would have been written.
+	StageDeliver = "deliver"
+)
+
+// DeadLetterFlow names the flow the events that could not be copied to
+// subscription are moved to.
+func DeadLetterFlow(subscription string) string {
+	return "dlq." + subscription
+}
+
+// Redelivery returns the event m, read from a dead-letter flow, without
+// the headers the FNAA added to it but its partition key and those of
+// encrypted and signed events, ready to be written again.
+func Redelivery(m Message) Message {
+	out := Message{Key: m.Key, Value: m.Value, Time: m.Time}
+	for _, h := range m.Headers {
+		if !strings.HasPrefix(h.Key, "fnaa-") || kept[h.Key] {
+			out.Headers = append(out.Headers, h)
+		}
+	}
+	return out
+}
+
+// kept are the headers of the FNAA Redelivery keeps.
+var kept = map[string]bool{
+	HeaderPartitionKey: true,
+	HeaderEncryption:   true,
+	HeaderEphemeral:    true,
+	HeaderRecipient:    true,
+	HeaderSignature:    true,
+	HeaderSigner:       true,
+	HeaderOrigin:       true,
+}
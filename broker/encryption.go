@@ -0,0 +1,167 @@
+package broker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encryption is the envelope encryption of the payload of events for a
+// subscriber: a key agreed between an ephemeral X25519 key of the event
+// and the X25519 key of the subscriber, derived with HKDF-SHA256, seals
+// the payload with AES-256-GCM. The key and the headers of the event stay
+// in the clear.
+const Encryption = "x25519-aes-256-gcm"
+
+// Headers of encrypted events.
+const (
+	HeaderEncryption = "fnaa-encryption"    // Encryption
+	HeaderEphemeral  = "fnaa-ephemeral-key" // the ephemeral public key, base64
+	HeaderRecipient  = "fnaa-recipient"     // the KeyID of the subscriber key
+)
+
+// KeySize is the size of X25519 private and public keys.
+const KeySize = curve25519.ScalarSize
+
+// GenerateKey returns a new X25519 private key and its public key.
+func GenerateKey() ([]byte, []byte, error) {
+	private := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, nil, errors.Wrap(err, "generating key")
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "generating key")
+	}
+	return private, public, nil
+}
+
+// PublicKey returns the public key of the X25519 private key.
+func PublicKey(private []byte) ([]byte, error) {
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	return public, errors.Wrap(err, "invalid private key")
+}
+
+// ParseKey decodes a base64 X25519 key.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key")
+	}
+	if len(key) != KeySize {
+		return nil, errors.Errorf("invalid key, %v bytes instead of %v", len(key), KeySize)
+	}
+	return key, nil
+}
+
+// KeyID names a public key by the first bytes of its SHA-256 digest.
+func KeyID(public []byte) string {
+	sum := sha256.Sum256(public)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Encrypted reports whether the payload of m is encrypted.
+func Encrypted(m Message) bool {
+	_, ok := m.Header(HeaderEncryption)
+	return ok
+}
+
+// Encrypt returns m with its payload encrypted for the holder of the
+// private key of public.
+func Encrypt(m Message, public []byte) (Message, error) {
+	private, ephemeral, err := GenerateKey()
+	if err != nil {
+		return Message{}, err
+	}
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return Message{}, errors.Wrap(err, "agreeing key")
+	}
+	aead, err := payloadCipher(shared, ephemeral, public)
+	if err != nil {
+		return Message{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return Message{}, errors.Wrap(err, "generating nonce")
+	}
+	out := m
+	out.Value = aead.Seal(nonce, nonce, m.Value, nil)
+	out.Headers = append(append([]Header(nil), m.Headers...),
+		Header{Key: HeaderEncryption, Value: []byte(Encryption)},
+		Header{Key: HeaderEphemeral, Value: []byte(base64.StdEncoding.EncodeToString(ephemeral))},
+		Header{Key: HeaderRecipient, Value: []byte(KeyID(public))},
+	)
+	return out, nil
+}
+
+// Decrypt returns m with its payload decrypted with the X25519 private
+// key, and without the headers of encrypted events. Events not encrypted
+// are returned as they are.
+func Decrypt(m Message, private []byte) (Message, error) {
+	algorithm, ok := m.Header(HeaderEncryption)
+	if !ok {
+		return m, nil
+	}
+	if string(algorithm) != Encryption {
+		return Message{}, errors.Errorf("unknown encryption %q", algorithm)
+	}
+	public, err := PublicKey(private)
+	if err != nil {
+		return Message{}, err
+	}
+	if recipient, _ := m.Header(HeaderRecipient); string(recipient) != KeyID(public) {
+		return Message{}, errors.Errorf("encrypted for key %s, not %s", recipient, KeyID(public))
+	}
+	value, _ := m.Header(HeaderEphemeral)
+	ephemeral, err := ParseKey(string(value))
+	if err != nil {
+		return Message{}, errors.Wrap(err, "ephemeral key")
+	}
+	shared, err := curve25519.X25519(private, ephemeral)
+	if err != nil {
+		return Message{}, errors.Wrap(err, "agreeing key")
+	}
+	aead, err := payloadCipher(shared, ephemeral, public)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(m.Value) < aead.NonceSize() {
+		return Message{}, errors.New("encrypted payload too short")
+	}
+	nonce, sealed := m.Value[:aead.NonceSize()], m.Value[aead.NonceSize():]
+	out := m
+	if out.Value, err = aead.Open(nil, nonce, sealed, nil); err != nil {
+		return Message{}, errors.Wrap(err, "decrypting payload")
+	}
+	out.Headers = nil
+	for _, h := range m.Headers {
+		if h.Key != HeaderEncryption && h.Key != HeaderEphemeral && h.Key != HeaderRecipient {
+			out.Headers = append(out.Headers, h)
+		}
+	}
+	return out, nil
+}
+
+// payloadCipher derives the AES-256-GCM cipher of a payload from the
+// shared secret and the keys it was agreed between.
+func payloadCipher(shared []byte, ephemeral []byte, public []byte) (cipher.AEAD, error) {
+	info := append(append([]byte(Encryption), ephemeral...), public...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, errors.Wrap(err, "deriving key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
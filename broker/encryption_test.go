@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	private, public, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Message{Key: []byte("order-1"), Value: []byte(`{"id":1}`), Headers: []Header{{Key: "trace", Value: []byte("abc")}}}
+	encrypted, err := Encrypt(m, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Encrypted(encrypted) || bytes.Contains(encrypted.Value, m.Value) {
+		t.Fatalf("payload %q not encrypted", encrypted.Value)
+	}
+	if string(encrypted.Key) != "order-1" {
+		t.Errorf("key %q, want it in the clear", encrypted.Key)
+	}
+	if again, _ := Encrypt(m, public); bytes.Equal(again.Value, encrypted.Value) {
+		t.Error("payload encrypted twice the same")
+	}
+
+	decrypted, err := Decrypt(encrypted, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Value, m.Value) {
+		t.Errorf("decrypted %q, want %q", decrypted.Value, m.Value)
+	}
+	if len(decrypted.Headers) != 1 || decrypted.Headers[0].Key != "trace" || Encrypted(decrypted) {
+		t.Errorf("decrypted headers %v, want only trace", decrypted.Headers)
+	}
+	if plain, err := Decrypt(m, private); err != nil || !bytes.Equal(plain.Value, m.Value) {
+		t.Errorf("event in the clear decrypted to %q, %v", plain.Value, err)
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	_, public, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := Encrypt(Message{Value: []byte("secret")}, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(encrypted, other); err == nil {
+		t.Error("decrypted with the key of another subscriber")
+	}
+
+	// With the right key, tampered or truncated payloads and unknown
+	// encryptions fail too.
+	private, public, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err = Encrypt(Message{Value: []byte("secret")}, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := encrypted
+	tampered.Value = append([]byte(nil), encrypted.Value...)
+	tampered.Value[len(tampered.Value)-1] ^= 1
+	if _, err := Decrypt(tampered, private); err == nil {
+		t.Error("tampered payload decrypted")
+	}
+	tampered = encrypted
+	tampered.Value = tampered.Value[:4]
+	if _, err := Decrypt(tampered, private); err == nil {
+		t.Error("truncated payload decrypted")
+	}
+	tampered = encrypted
+	tampered.Headers = nil
+	for _, h := range encrypted.Headers {
+		if h.Key == HeaderEncryption {
+			h.Value = []byte("rot13")
+		}
+		tampered.Headers = append(tampered.Headers, h)
+	}
+	if _, err := Decrypt(tampered, private); err == nil {
+		t.Error("unknown encryption decrypted")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	_, public, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseKey("c2hvcnQ="); err == nil {
+		t.Error("short key parsed")
+	}
+	if _, err := ParseKey("not base64!"); err == nil {
+		t.Error("invalid base64 parsed")
+	}
+	if KeyID(public) == "" || len(KeyID(public)) != 16 {
+		t.Errorf("key ID %q, want 16 hex digits", KeyID(public))
+	}
+}
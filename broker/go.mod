@@ -0,0 +1,9 @@
+module broker
+
+go 1.13
+
+require (
+	github.com/pkg/errors v0.9.1
+	github.com/segmentio/kafka-go v0.4.47
+	golang.org/x/crypto v0.14.0
+)
@@ -0,0 +1,371 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+func init() {
+	Register("kafka", kafkaDriver{})
+}
+
+// kafkaDriver produces to and consumes from Apache Kafka topics. Events
+// of flows ordered per key go to the partition their partition key hashes
+// to, so the events of a key keep their order, and those without one to
+// any partition. Events of unordered flows go to any partition and those
+// of totally ordered flows to the first one.
+type kafkaDriver struct{}
+
+func (kafkaDriver) dialer(opts Options) *kafka.Dialer {
+	return &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true, DialFunc: opts.Dial}
+}
+
+func (drv kafkaDriver) Producer(ctx context.Context, d Descriptor, opts Options) (Producer, error) {
+	ordering, err := ParseOrdering(opts.Ordering)
+	if err != nil {
+		return nil, err
+	}
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(d.Servers...),
+		Topic:        d.Topic,
+		Balancer:     balancer(ordering),
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+		Transport:    &kafka.Transport{Dial: opts.Dial},
+
+		AllowAutoTopicCreation: opts.CreateTopics,
+	}
+	return &kafkaProducer{w: w}, nil
+}
+
+// balancer returns the balancer spreading the events of a flow with the
+// ordering policy over its partitions.
+func balancer(ordering string) kafka.Balancer {
+	switch ordering {
+	case Unordered:
+		return &kafka.RoundRobin{}
+	case Total:
+		return kafka.BalancerFunc(func(m kafka.Message, partitions ...int) int {
+			first := partitions[0]
+			for _, p := range partitions {
+				if p < first {
+					first = p
+				}
+			}
+			return first
+		})
+	}
+	return &partitionKeyBalancer{}
+}
+
+// partitionKeyBalancer hashes the partition key of events, as PartitionKey
+// returns it.
+type partitionKeyBalancer struct {
+	hash kafka.Hash
+}
+
+func (b *partitionKeyBalancer) Balance(m kafka.Message, partitions ...int) int {
+	for _, h := range m.Headers {
+		if h.Key == HeaderPartitionKey {
+			m.Key = h.Value
+		}
+	}
+	return b.hash.Balance(m, partitions...)
+}
+
+type kafkaProducer struct {
+	w *kafka.Writer
+}
+
+func (p *kafkaProducer) Produce(ctx context.Context, messages ...Message) error {
+	out := make([]kafka.Message, 0, len(messages))
+	for _, m := range messages {
+		km := kafka.Message{Key: m.Key, Value: m.Value, Time: m.Time}
+		for _, h := range m.Headers {
+			km.Headers = append(km.Headers, kafka.Header{Key: h.Key, Value: h.Value})
+		}
+		out = append(out, km)
+	}
+	return errors.Wrap(p.w.WriteMessages(ctx, out...), "producing to kafka")
+}
+
+func (p *kafkaProducer) Close() error {
+	return p.w.Close()
+}
+
+// Purge deletes the topic of the flow, Kafka having no other way for
+// clients to drop the events of a topic whatever their retention.
+func (drv kafkaDriver) Purge(ctx context.Context, d Descriptor, opts Options) error {
+	client := drv.client(d, opts)
+	res, err := client.DeleteTopics(ctx, &kafka.DeleteTopicsRequest{Topics: []string{d.Topic}})
+	if err != nil {
+		return errors.Wrapf(err, "deleting topic %v", d.Topic)
+	}
+	if err := res.Errors[d.Topic]; err != nil && err != kafka.UnknownTopicOrPartition {
+		return errors.Wrapf(err, "deleting topic %v", d.Topic)
+	}
+	return nil
+}
+
+func (kafkaDriver) client(d Descriptor, opts Options) *kafka.Client {
+	return &kafka.Client{Addr: kafka.TCP(d.Servers...), Transport: &kafka.Transport{Dial: opts.Dial}}
+}
+
+// partitions returns the partitions of the topic of the flow, none if it
+// does not exist.
+func (drv kafkaDriver) partitions(ctx context.Context, client *kafka.Client, d Descriptor) ([]int, error) {
+	res, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{d.Topic}})
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading partitions of topic %v", d.Topic)
+	}
+	var partitions []int
+	for _, topic := range res.Topics {
+		if topic.Name != d.Topic || topic.Error == kafka.UnknownTopicOrPartition {
+			continue
+		}
+		if topic.Error != nil {
+			return nil, errors.Wrapf(topic.Error, "reading partitions of topic %v", d.Topic)
+		}
+		for _, partition := range topic.Partitions {
+			partitions = append(partitions, partition.ID)
+		}
+	}
+	return partitions, nil
+}
+
+// Commit commits the offsets of the consumer group to Kafka as a client
+// outside of the group protocol does, each partition carrying the
+// metadata.
+func (drv kafkaDriver) Commit(ctx context.Context, d Descriptor, opts Options, group string, progress Progress) error {
+	var commits []kafka.OffsetCommit
+	for partition, offset := range progress.Offsets {
+		commits = append(commits, kafka.OffsetCommit{Partition: partition, Offset: offset, Metadata: progress.Metadata})
+	}
+	res, err := drv.client(d, opts).OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      group,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{d.Topic: commits},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "committing offsets of group %v in topic %v", group, d.Topic)
+	}
+	for _, partition := range res.Topics[d.Topic] {
+		if partition.Error != nil {
+			return errors.Wrapf(partition.Error, "committing offset of group %v in partition %v of topic %v", group, partition.Partition, d.Topic)
+		}
+	}
+	return nil
+}
+
+func (drv kafkaDriver) Committed(ctx context.Context, d Descriptor, opts Options, group string) (Progress, error) {
+	progress := Progress{Offsets: map[int]int64{}}
+	client := drv.client(d, opts)
+	partitions, err := drv.partitions(ctx, client, d)
+	if err != nil || len(partitions) == 0 {
+		return progress, err
+	}
+	res, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: group, Topics: map[string][]int{d.Topic: partitions}})
+	if err == nil {
+		err = res.Error
+	}
+	if err == kafka.GroupIdNotFound {
+		// Groups only exist once they committed.
+		return progress, nil
+	}
+	if err != nil {
+		return progress, errors.Wrapf(err, "fetching offsets of group %v in topic %v", group, d.Topic)
+	}
+	for _, partition := range res.Topics[d.Topic] {
+		if partition.Error != nil {
+			return progress, errors.Wrapf(partition.Error, "fetching offset of group %v in partition %v of topic %v", group, partition.Partition, d.Topic)
+		}
+		// Partitions without a commit have offset -1.
+		if partition.CommittedOffset >= 0 {
+			progress.Offsets[partition.Partition] = partition.CommittedOffset
+		}
+		if partition.Metadata != "" {
+			progress.Metadata = partition.Metadata
+		}
+	}
+	return progress, nil
+}
+
+func (drv kafkaDriver) Ends(ctx context.Context, d Descriptor, opts Options) (map[int]int64, error) {
+	client := drv.client(d, opts)
+	partitions, err := drv.partitions(ctx, client, d)
+	if err != nil || len(partitions) == 0 {
+		return map[int]int64{}, err
+	}
+	var requests []kafka.OffsetRequest
+	for _, partition := range partitions {
+		requests = append(requests, kafka.LastOffsetOf(partition))
+	}
+	res, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{d.Topic: requests}})
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading offsets of topic %v", d.Topic)
+	}
+	ends := map[int]int64{}
+	for _, partition := range res.Topics[d.Topic] {
+		if partition.Error != nil {
+			return nil, errors.Wrapf(partition.Error, "reading offsets of partition %v of topic %v", partition.Partition, d.Topic)
+		}
+		ends[partition.Partition] = partition.LastOffset
+	}
+	return ends, nil
+}
+
+// Consumer reads every partition of the topic, each from the start
+// position, merging them in the order the events arrive.
+func (drv kafkaDriver) Consumer(ctx context.Context, d Descriptor, opts Options) (Consumer, error) {
+	dialer := drv.dialer(opts)
+	conn, err := dialer.DialContext(ctx, "tcp", d.Servers[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "connecting to kafka")
+	}
+	partitions, err := conn.ReadPartitions(d.Topic)
+	conn.Close()
+	if err == kafka.UnknownTopicOrPartition {
+		err = ErrNoTopic
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading partitions of topic %v", d.Topic)
+	}
+	if len(partitions) == 0 {
+		return nil, errors.Errorf("topic %v has no partition", d.Topic)
+	}
+
+	readCtx, cancel := context.WithCancel(context.Background())
+	c := &kafkaConsumer{messages: make(chan Message), errs: make(chan error, len(partitions)), cancel: cancel}
+	for _, partition := range partitions {
+		start, end := opts.Start, int64(-1)
+		offset, resumed := opts.Offsets[partition.ID]
+		if resumed {
+			start = offset
+		}
+		if !opts.Follow || (!resumed && !opts.StartTime.IsZero()) {
+			// Without following, the partition is read up to the last
+			// offset it has now.
+			leader, err := dialer.DialLeader(ctx, "tcp", d.Servers[0], d.Topic, partition.ID)
+			if err != nil {
+				c.Close()
+				return nil, errors.Wrapf(err, "connecting to the leader of partition %v", partition.ID)
+			}
+			first, last, err := leader.ReadOffsets()
+			if err == nil && !resumed && !opts.StartTime.IsZero() {
+				// No event at or after the time starts at the end.
+				if start, err = leader.ReadOffset(opts.StartTime); err == nil && start < 0 {
+					start = last
+				}
+			}
+			leader.Close()
+			if err != nil {
+				c.Close()
+				return nil, errors.Wrapf(err, "reading offsets of partition %v", partition.ID)
+			}
+			switch start {
+			case Beginning:
+				start = first
+			case End:
+				start = last
+			}
+			if !opts.Follow {
+				if start >= last {
+					continue
+				}
+				end = last
+			}
+		}
+
+		r := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   d.Servers,
+			Topic:     d.Topic,
+			Partition: partition.ID,
+			Dialer:    dialer,
+			MinBytes:  1,
+			MaxBytes:  10e6,
+			MaxWait:   500 * time.Millisecond,
+		})
+		if err := r.SetOffset(start); err != nil {
+			r.Close()
+			c.Close()
+			return nil, errors.Wrapf(err, "seeking partition %v", partition.ID)
+		}
+		c.readers = append(c.readers, r)
+		c.wg.Add(1)
+		go c.read(readCtx, r, end)
+	}
+	go func() {
+		c.wg.Wait()
+		close(c.messages)
+	}()
+	return c, nil
+}
+
+type kafkaConsumer struct {
+	readers  []*kafka.Reader
+	messages chan Message
+	errs     chan error
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// read forwards the messages of a partition until end, if not -1.
+func (c *kafkaConsumer) read(ctx context.Context, r *kafka.Reader, end int64) {
+	defer c.wg.Done()
+	for {
+		km, err := r.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.errs <- errors.Wrap(err, "consuming from kafka")
+			}
+			return
+		}
+		m := Message{Key: km.Key, Value: km.Value, Time: km.Time, Partition: km.Partition, Offset: km.Offset}
+		for _, h := range km.Headers {
+			m.Headers = append(m.Headers, Header{Key: h.Key, Value: h.Value})
+		}
+		select {
+		case c.messages <- m:
+		case <-ctx.Done():
+			return
+		}
+		if end >= 0 && km.Offset >= end-1 {
+			return
+		}
+	}
+}
+
+func (c *kafkaConsumer) Next(ctx context.Context) (Message, error) {
+	select {
+	case m, ok := <-c.messages:
+		if !ok {
+			select {
+			case err := <-c.errs:
+				return Message{}, err
+			default:
+				return Message{}, io.EOF
+			}
+		}
+		return m, nil
+	case err := <-c.errs:
+		return Message{}, err
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (c *kafkaConsumer) Close() error {
+	c.cancel()
+	var err error
+	for _, r := range c.readers {
+		if rerr := r.Close(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
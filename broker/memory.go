@@ -0,0 +1,260 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// Fault is how a write to a Memory flow goes.
+type Fault int
+
+const (
+	// Store stores the event.
+	Store Fault = iota
+	// Refuse fails the write without storing the event.
+	Refuse
+	// Unacknowledged stores the event but fails the write, as when the
+	// acknowledgement of the broker is lost.
+	Unacknowledged
+)
+
+// Memory is a driver keeping flows in memory, for testing the code
+// producing and consuming them without a broker. It is not registered:
+// tests register it under the broker type of the flows they use. Topics
+// are created with their first event and spread their events over their
+// partitions as the kafka driver does. Commits are kept per group and
+// topic.
+type Memory struct {
+	// Partitions is how many partitions topics are created with, 1 if
+	// not set.
+	Partitions int
+	// Faults, when set, tells how writing m to topic goes. It is called
+	// with the driver locked, so it must not use it.
+	Faults func(topic string, m Message) Fault
+
+	mu      sync.Mutex
+	topics  map[string][][]Message
+	groups  map[string]Progress
+	reads   map[string]int
+	changed chan struct{}
+}
+
+// NewMemory returns a Memory driver without flows.
+func NewMemory() *Memory {
+	return &Memory{
+		topics:  map[string][][]Message{},
+		groups:  map[string]Progress{},
+		reads:   map[string]int{},
+		changed: make(chan struct{}),
+	}
+}
+
+// Messages returns the events of topic, partition after partition.
+func (mem *Memory) Messages(topic string) []Message {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	var messages []Message
+	for _, partition := range mem.topics[topic] {
+		messages = append(messages, partition...)
+	}
+	return messages
+}
+
+// Reads returns how many events have been consumed from topic.
+func (mem *Memory) Reads(topic string) int {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	return mem.reads[topic]
+}
+
+func (mem *Memory) Producer(ctx context.Context, d Descriptor, opts Options) (Producer, error) {
+	ordering, err := ParseOrdering(opts.Ordering)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryProducer{mem: mem, d: d, opts: opts, balancer: balancer(ordering)}, nil
+}
+
+type memoryProducer struct {
+	mem      *Memory
+	d        Descriptor
+	opts     Options
+	balancer kafka.Balancer
+}
+
+func (p *memoryProducer) Produce(ctx context.Context, messages ...Message) error {
+	mem := p.mem
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	partitions, ok := mem.topics[p.d.Topic]
+	if !ok {
+		if !p.opts.CreateTopics {
+			return errors.Wrapf(ErrNoTopic, "producing to topic %v", p.d.Topic)
+		}
+		n := mem.Partitions
+		if n < 1 {
+			n = 1
+		}
+		partitions = make([][]Message, n)
+		mem.topics[p.d.Topic] = partitions
+	}
+	ids := make([]int, len(partitions))
+	for i := range ids {
+		ids[i] = i
+	}
+
+	for _, m := range messages {
+		fault := Store
+		if mem.Faults != nil {
+			fault = mem.Faults(p.d.Topic, m)
+		}
+		if fault == Refuse {
+			return errors.Errorf("producing to topic %v: refused", p.d.Topic)
+		}
+		km := kafka.Message{Key: m.Key}
+		for _, h := range m.Headers {
+			km.Headers = append(km.Headers, kafka.Header{Key: h.Key, Value: h.Value})
+		}
+		partition := p.balancer.Balance(km, ids...)
+		m.Partition, m.Offset = partition, int64(len(partitions[partition]))
+		if m.Time.IsZero() {
+			m.Time = time.Now()
+		}
+		partitions[partition] = append(partitions[partition], m)
+		close(mem.changed)
+		mem.changed = make(chan struct{})
+		if fault == Unacknowledged {
+			return errors.Errorf("producing to topic %v: acknowledgement lost", p.d.Topic)
+		}
+	}
+	return nil
+}
+
+func (p *memoryProducer) Close() error {
+	return nil
+}
+
+// Consumer reads the partitions of the topic from the start position,
+// the first partition with an event to read first.
+func (mem *Memory) Consumer(ctx context.Context, d Descriptor, opts Options) (Consumer, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	partitions, ok := mem.topics[d.Topic]
+	if !ok {
+		return nil, errors.Wrapf(ErrNoTopic, "reading partitions of topic %v", d.Topic)
+	}
+	c := &memoryConsumer{mem: mem, topic: d.Topic, follow: opts.Follow, next: map[int]int64{}, end: map[int]int64{}}
+	for partition, messages := range partitions {
+		start, resumed := opts.Offsets[partition]
+		if !resumed {
+			start = opts.Start
+		}
+		if !resumed && !opts.StartTime.IsZero() {
+			start = int64(sort.Search(len(messages), func(i int) bool {
+				return !messages[i].Time.Before(opts.StartTime)
+			}))
+		}
+		switch start {
+		case Beginning:
+			start = 0
+		case End:
+			start = int64(len(messages))
+		}
+		c.next[partition] = start
+		c.end[partition] = int64(len(messages))
+	}
+	return c, nil
+}
+
+type memoryConsumer struct {
+	mem    *Memory
+	topic  string
+	follow bool
+	// next is the offset to read next in each partition and end, without
+	// following, the one to stop at.
+	next, end map[int]int64
+}
+
+func (c *memoryConsumer) Next(ctx context.Context) (Message, error) {
+	for {
+		c.mem.mu.Lock()
+		partitions := c.mem.topics[c.topic]
+		for partition, messages := range partitions {
+			end := int64(len(messages))
+			if !c.follow && c.end[partition] < end {
+				end = c.end[partition]
+			}
+			if next := c.next[partition]; next < end {
+				c.next[partition]++
+				c.mem.reads[c.topic]++
+				c.mem.mu.Unlock()
+				return messages[next], nil
+			}
+		}
+		changed := c.mem.changed
+		c.mem.mu.Unlock()
+		if !c.follow {
+			return Message{}, io.EOF
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	}
+}
+
+func (c *memoryConsumer) Close() error {
+	return nil
+}
+
+func (mem *Memory) Purge(ctx context.Context, d Descriptor, opts Options) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	delete(mem.topics, d.Topic)
+	return nil
+}
+
+func (mem *Memory) Commit(ctx context.Context, d Descriptor, opts Options, group string, progress Progress) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	committed := Progress{Offsets: map[int]int64{}, Metadata: progress.Metadata}
+	for partition, offset := range mem.groups[group+"/"+d.Topic].Offsets {
+		committed.Offsets[partition] = offset
+	}
+	for partition, offset := range progress.Offsets {
+		committed.Offsets[partition] = offset
+	}
+	mem.groups[group+"/"+d.Topic] = committed
+	return nil
+}
+
+func (mem *Memory) Committed(ctx context.Context, d Descriptor, opts Options, group string) (Progress, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	committed := mem.groups[group+"/"+d.Topic]
+	progress := Progress{Offsets: map[int]int64{}, Metadata: committed.Metadata}
+	for partition, offset := range committed.Offsets {
+		// As with Kafka, partitions may be committed offset -1, none.
+		if offset >= 0 {
+			progress.Offsets[partition] = offset
+		}
+	}
+	return progress, nil
+}
+
+func (mem *Memory) Ends(ctx context.Context, d Descriptor, opts Options) (map[int]int64, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	ends := map[int]int64{}
+	for partition, messages := range mem.topics[d.Topic] {
+		ends[partition] = int64(len(messages))
+	}
+	return ends, nil
+}
@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Ordering policies of a flow, telling which events of the flow are read
+// back in the order they were written.
+const (
+	// PerKey events keep their order among those with the same
+	// partition key.
+	PerKey = "per-key"
+	// Unordered events are spread over every partition, none keeping
+	// its order.
+	Unordered = "none"
+	// Total events all keep their order, being written to a single
+	// partition.
+	Total = "total"
+)
+
+// Orderings lists the ordering policies, the first one being the default.
+var Orderings = []string{PerKey, Unordered, Total}
+
+// HeaderPartitionKey, when set on an event, is the key it is partitioned
+// by instead of its own. It is kept when the event is bridged, so copies
+// keep the order of the events they come from.
+const HeaderPartitionKey = "fnaa-partition-key"
+
+// ParseOrdering checks an ordering policy, defaulting to PerKey.
+func ParseOrdering(ordering string) (string, error) {
+	if ordering == "" {
+		return PerKey, nil
+	}
+	for _, o := range Orderings {
+		if strings.EqualFold(ordering, o) {
+			return o, nil
+		}
+	}
+	return "", errors.Errorf("unknown ordering %q, use %v", ordering, strings.Join(Orderings, ", "))
+}
+
+// PartitionKey returns the key m is partitioned by, nil for none.
+func PartitionKey(m Message) []byte {
+	if key, ok := m.Header(HeaderPartitionKey); ok {
+		return key
+	}
+	return m.Key
+}
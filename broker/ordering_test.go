@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var testPartitions = []int{0, 1, 2, 3, 4, 5}
+
+// spread balances 100 events over testPartitions with ordering, keyed
+// by key, returning how many went to each partition.
+func spread(ordering string, key func(i int) kafka.Message) map[int]int {
+	b := balancer(ordering)
+	counts := map[int]int{}
+	for i := 0; i < 100; i++ {
+		counts[b.Balance(key(i), testPartitions...)]++
+	}
+	return counts
+}
+
+func TestBalancerPerKey(t *testing.T) {
+	b := balancer(PerKey)
+	for i := 0; i < 20; i++ {
+		key := []byte("order-" + strconv.Itoa(i))
+		partition := b.Balance(kafka.Message{Key: key}, testPartitions...)
+		for j := 0; j < 5; j++ {
+			if again := b.Balance(kafka.Message{Key: key}, testPartitions...); again != partition {
+				t.Fatalf("key %s went to partition %v and then %v", key, partition, again)
+			}
+		}
+		// The partition key header, which copies keep, wins over the key.
+		m := kafka.Message{Key: []byte("other"), Headers: []kafka.Header{{Key: HeaderPartitionKey, Value: key}}}
+		if keyed := b.Balance(m, testPartitions...); keyed != partition {
+			t.Errorf("partition key %s went to partition %v, its key to %v", key, keyed, partition)
+		}
+	}
+	counts := spread(PerKey, func(i int) kafka.Message {
+		return kafka.Message{Key: []byte("order-" + strconv.Itoa(i))}
+	})
+	if len(counts) < 2 {
+		t.Errorf("different keys all went to one partition: %v", counts)
+	}
+}
+
+func TestBalancerTotal(t *testing.T) {
+	counts := spread(Total, func(i int) kafka.Message {
+		return kafka.Message{Key: []byte("order-" + strconv.Itoa(i))}
+	})
+	if counts[0] != 100 {
+		t.Errorf("events went to partitions %v, want all to 0", counts)
+	}
+	if first := balancer(Total).Balance(kafka.Message{}, 4, 2, 3); first != 2 {
+		t.Errorf("event went to partition %v of 4, 2 and 3, want 2", first)
+	}
+}
+
+func TestBalancerUnordered(t *testing.T) {
+	counts := spread(Unordered, func(i int) kafka.Message {
+		return kafka.Message{Key: []byte("order")}
+	})
+	for _, partition := range testPartitions {
+		if counts[partition] < 100/len(testPartitions) {
+			t.Errorf("events with one key spread as %v, want them even", counts)
+			break
+		}
+	}
+}
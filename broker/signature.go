@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Events are signed by the namespace they come from with an Ed25519 key,
+// the public half of which the namespace publishes in DNS. The signature
+// is detached, in the headers below, and covers the namespace, the flow,
+// the key, the value and the headers of the event but those of the FNAA,
+// which change on the way, and those of encrypted events, which do not.
+const (
+	HeaderSignature = "fnaa-signature" // the Ed25519 signature, base64
+	HeaderSigner    = "fnaa-signer"    // the namespace that signed
+	HeaderOrigin    = "fnaa-origin"    // the flow the event comes from
+)
+
+// signingKeyRecord prefixes the TXT records publishing signing keys.
+const signingKeyRecord = "v=fnaa1; k=ed25519; p="
+
+// SigningKeyName returns the name of the TXT records publishing the
+// signing keys of namespace, one per key when rotating them.
+func SigningKeyName(namespace string) string {
+	return "_fnaa-key." + strings.TrimSuffix(namespace, ".")
+}
+
+// SigningKeyRecord returns the text of the TXT record publishing public.
+func SigningKeyRecord(public ed25519.PublicKey) string {
+	return signingKeyRecord + base64.StdEncoding.EncodeToString(public)
+}
+
+// SigningKeys returns the keys published in the texts of the TXT records
+// of SigningKeyName, skipping the other records.
+func SigningKeys(texts []string) []ed25519.PublicKey {
+	var keys []ed25519.PublicKey
+	for _, text := range texts {
+		if !strings.HasPrefix(text, signingKeyRecord) {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(text, signingKeyRecord))
+		if err == nil && len(key) == ed25519.PublicKeySize {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// GenerateSigningKey returns a new Ed25519 signing key, encoded as its
+// base64 seed.
+func GenerateSigningKey() (string, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", errors.Wrap(err, "generating signing key")
+	}
+	return base64.StdEncoding.EncodeToString(private.Seed()), nil
+}
+
+// ParseSigningKey decodes a signing key GenerateSigningKey encoded.
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signing key")
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("invalid signing key, %v bytes instead of %v", len(seed), ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Signer returns the namespace that signed m, if it is signed.
+func Signer(m Message) (string, bool) {
+	if _, ok := m.Header(HeaderSignature); !ok {
+		return "", false
+	}
+	signer, ok := m.Header(HeaderSigner)
+	return string(signer), ok
+}
+
+// Sign returns m signed with the key of namespace as coming from flow,
+// replacing any signature it had.
+func Sign(m Message, namespace string, flow string, key ed25519.PrivateKey) Message {
+	out := Unsigned(m)
+	signature := ed25519.Sign(key, signed(out, namespace, flow))
+	out.Headers = append(out.Headers,
+		Header{Key: HeaderSignature, Value: []byte(base64.StdEncoding.EncodeToString(signature))},
+		Header{Key: HeaderSigner, Value: []byte(namespace)},
+		Header{Key: HeaderOrigin, Value: []byte(flow)},
+	)
+	return out
+}
+
+// Unsigned returns m without its signature.
+func Unsigned(m Message) Message {
+	out := m
+	out.Headers = nil
+	for _, h := range m.Headers {
+		if h.Key != HeaderSignature && h.Key != HeaderSigner && h.Key != HeaderOrigin {
+			out.Headers = append(out.Headers, h)
+		}
+	}
+	return out
+}
+
+// Verify checks the signature of m against keys, the signing keys of its
+// signer, and that the flow it comes from belongs to the signer. It
+// returns that flow.
+func Verify(m Message, keys []ed25519.PublicKey) (string, error) {
+	signer, ok := Signer(m)
+	if !ok {
+		return "", errors.New("event is not signed")
+	}
+	origin, _ := m.Header(HeaderOrigin)
+	flow := string(origin)
+	if flow != signer && !strings.HasSuffix(flow, "."+signer) {
+		return "", errors.Errorf("flow %v is not part of namespace %v", flow, signer)
+	}
+	value, _ := m.Header(HeaderSignature)
+	signature, err := base64.StdEncoding.DecodeString(string(value))
+	if err != nil {
+		return "", errors.Wrap(err, "invalid signature")
+	}
+	if len(keys) == 0 {
+		return "", errors.Errorf("namespace %v publishes no signing key", signer)
+	}
+	message := signed(Unsigned(m), signer, flow)
+	for _, key := range keys {
+		if ed25519.Verify(key, message, signature) {
+			return flow, nil
+		}
+	}
+	return "", errors.Errorf("signature does not match the keys of %v", signer)
+}
+
+// signed returns what the signature of m covers, each field prefixed with
+// its length.
+func signed(m Message, namespace string, flow string) []byte {
+	var b bytes.Buffer
+	field := func(data []byte) {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+		b.Write(size[:])
+		b.Write(data)
+	}
+	field([]byte("fnaa-signature-v1"))
+	field([]byte(namespace))
+	field([]byte(flow))
+	field(m.Key)
+	field(m.Value)
+	var headers []Header
+	for _, h := range m.Headers {
+		if !strings.HasPrefix(h.Key, "fnaa-") || h.Key == HeaderEncryption || h.Key == HeaderEphemeral || h.Key == HeaderRecipient {
+			headers = append(headers, h)
+		}
+	}
+	sort.SliceStable(headers, func(i, j int) bool {
+		return headers[i].Key < headers[j].Key
+	})
+	for _, h := range headers {
+		field([]byte(h.Key))
+		field(h.Value)
+	}
+	return b.Bytes()
+}
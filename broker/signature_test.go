@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+// signingKey returns a new signing key, as published and as kept.
+func signingKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	encoded, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseSigningKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.Public().(ed25519.PublicKey), key
+}
+
+func TestSignatureRoundTrip(t *testing.T) {
+	public, private := signingKey(t)
+	m := Message{Key: []byte("order-1"), Value: []byte(`{"id":1}`), Headers: []Header{{Key: "trace", Value: []byte("abc")}}}
+	signed := Sign(m, "flow.unix.ar", "orders.flow.unix.ar", private)
+	if signer, ok := Signer(signed); !ok || signer != "flow.unix.ar" {
+		t.Fatalf("signed by %q, %v", signer, ok)
+	}
+	keys := SigningKeys([]string{"v=spf1 -all", SigningKeyRecord(public)})
+	if len(keys) != 1 {
+		t.Fatalf("%v keys published, want 1", len(keys))
+	}
+	origin, err := Verify(signed, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin != "orders.flow.unix.ar" {
+		t.Errorf("origin %v, want orders.flow.unix.ar", origin)
+	}
+
+	// Headers of the FNAA change on the way without breaking it.
+	redelivered := signed
+	redelivered.Headers = append(append([]Header(nil), signed.Headers...), Header{Key: HeaderAttempts, Value: []byte("2")})
+	if _, err := Verify(redelivered, keys); err != nil {
+		t.Errorf("signature broken by FNAA headers: %v", err)
+	}
+	// Signing again replaces the signature.
+	if again := Sign(signed, "flow.unix.ar", "orders.flow.unix.ar", private); len(again.Headers) != len(signed.Headers) {
+		t.Errorf("signed twice has headers %v", again.Headers)
+	}
+	if unsigned := Unsigned(signed); len(unsigned.Headers) != 1 {
+		t.Errorf("unsigned has headers %v, want only trace", unsigned.Headers)
+	}
+}
+
+func TestSignatureRotatedKeys(t *testing.T) {
+	old, _ := signingKey(t)
+	public, private := signingKey(t)
+	signed := Sign(Message{Value: []byte("x")}, "flow.unix.ar", "orders.flow.unix.ar", private)
+	if _, err := Verify(signed, []ed25519.PublicKey{old, public}); err != nil {
+		t.Errorf("not verified with the new key published along the old one: %v", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	public, private := signingKey(t)
+	keys := []ed25519.PublicKey{public}
+	m := Message{Key: []byte("order-1"), Value: []byte(`{"id":1}`), Headers: []Header{{Key: "trace", Value: []byte("abc")}}}
+	signed := Sign(m, "flow.unix.ar", "orders.flow.unix.ar", private)
+
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		m    Message
+		keys []ed25519.PublicKey
+	}{
+		"unsigned":         {m, keys},
+		"no keys":          {signed, nil},
+		"other key":        {signed, []ed25519.PublicKey{other}},
+		"changed value":    {with(signed, func(m *Message) { m.Value = []byte(`{"id":2}`) }), keys},
+		"changed key":      {with(signed, func(m *Message) { m.Key = []byte("order-2") }), keys},
+		"changed header":   {with(signed, func(m *Message) { m.Headers[0].Value = []byte("xyz") }), keys},
+		"other signer":     {with(signed, func(m *Message) { setHeader(m, HeaderSigner, "flow.emiliano.ar") }), keys},
+		"foreign origin":   {Sign(m, "flow.unix.ar", "orders.flow.emiliano.ar", private), keys},
+		"invalid encoding": {with(signed, func(m *Message) { setHeader(m, HeaderSignature, "%%%") }), keys},
+	}
+	for name, test := range tests {
+		if _, err := Verify(test.m, test.keys); err == nil {
+			t.Errorf("%v: verified", name)
+		}
+	}
+}
+
+// with returns a copy of m changed by change.
+func with(m Message, change func(m *Message)) Message {
+	m.Key = append([]byte(nil), m.Key...)
+	m.Value = append([]byte(nil), m.Value...)
+	m.Headers = append([]Header(nil), m.Headers...)
+	change(&m)
+	return m
+}
+
+func setHeader(m *Message, key string, value string) {
+	for i := range m.Headers {
+		if m.Headers[i].Key == key {
+			m.Headers[i].Value = []byte(value)
+		}
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	if _, err := ParseSigningKey("c2hvcnQ="); err == nil {
+		t.Error("short signing key parsed")
+	}
+	if _, err := ParseSigningKey("not base64!"); err == nil {
+		t.Error("invalid base64 parsed")
+	}
+}
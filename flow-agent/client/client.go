@@ -3,11 +3,15 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
+	"io"
 	"log"
 	"net"
+	"resolver"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
@@ -20,39 +24,111 @@ type FNAAClient struct {
 	authenticated bool
 }
 
-func Open(addr string) (*net.Conn, *bufio.ReadWriter, error) {
+// Timeouts bounds the network operations performed against a FNAA.
+// A zero value disables the corresponding timeout.
+type Timeouts struct {
+	Dial  time.Duration
+	Read  time.Duration
+	Write time.Duration
+}
+
+// timeoutConn arms a fresh deadline before every Read and Write, so a
+// stalled peer cannot block a session forever.
+type timeoutConn struct {
+	net.Conn
+	read  time.Duration
+	write time.Duration
+}
+
+// WithTimeouts wraps conn so that every Read and Write fails once the
+// given duration elapses without progress.
+func WithTimeouts(conn net.Conn, read time.Duration, write time.Duration) net.Conn {
+	return &timeoutConn{Conn: conn, read: read, write: write}
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.read > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.read)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.write > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.write)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// watch closes conn if ctx is done before the returned function is called,
+// unblocking any pending I/O on it.
+func watch(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ctxErr prefers the context error over the I/O error it caused.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func Open(ctx context.Context, addr string, timeouts Timeouts) (*net.Conn, *bufio.ReadWriter, error) {
 	// Dial the remote process.
 	// Note that the local port is chosen on the fly. If the local port
 	// must be a specific one, use DialTCP() instead.
 	log.Println("C: Connecting to " + addr)
-	conn, err := net.Dial("tcp", addr)
+	dialer := net.Dialer{Timeout: timeouts.Dial}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "Dialing "+addr+" failed")
 	}
+	conn = WithTimeouts(conn, timeouts.Read, timeouts.Write)
 	return &conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
 }
 
 // client is called if the app is called with -connect=`ip addr`.
 // func Client(ip string, portNumber int) (*FNAAClient, error) {
-func Client(ip string, portNumber int) (*net.Conn, *bufio.ReadWriter, error) {
+func Client(ctx context.Context, ip string, portNumber int, timeouts Timeouts) (*net.Conn, *bufio.ReadWriter, error) {
 
 	port := strconv.Itoa(portNumber)
 	var clientFNAA FNAAClient
 
 	// Open a connection to the server.
-	conn, rw, err := Open(ip + ":" + port)
+	conn, rw, err := Open(ctx, net.JoinHostPort(ip, port), timeouts)
 	if err != nil {
-		// return nil, nil, errors.Wrap(err, "C: Failed to open connection to "+ip+port)
-		return nil, nil, errors.Wrap(err, "C: Failed to open connection to "+ip+port)
+		// return nil, nil, errors.Wrap(err, "C: Failed to open connection to "+net.JoinHostPort(ip, port))
+		return nil, nil, errors.Wrap(err, "C: Failed to open connection to "+net.JoinHostPort(ip, port))
 	}
 
 	clientFNAA.conn = conn
 	clientFNAA.rw = rw
 	clientFNAA.debug = false
 
+	defer watch(ctx, *conn)()
+
 	scanner := bufio.NewScanner(rw)
 	scanner.Split(ScanCRLF)
-	scanner.Scan()
+	if !scanner.Scan() {
+		(*conn).Close()
+		return nil, nil, errors.Wrap(ctxErr(ctx, scannerErr(scanner)), "C: No greeting from "+net.JoinHostPort(ip, port))
+	}
 	response := scanner.Text()
 	log.Println("C: Got a response:", response)
 
@@ -64,38 +140,63 @@ func Client(ip string, portNumber int) (*net.Conn, *bufio.ReadWriter, error) {
 	return conn, rw, nil
 }
 
-func SendCommand(conn *net.Conn, rw *bufio.ReadWriter, command string) (string, error) {
+// scannerErr reports why a scanner stopped, turning a clean EOF into
+// io.ErrUnexpectedEOF since a reply was still expected.
+func scannerErr(scanner *bufio.Scanner) error {
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+func SendCommand(ctx context.Context, conn *net.Conn, rw *bufio.ReadWriter, command string) (string, error) {
 	var response string
 	log.Printf("C: Sending command %v", command)
 
+	defer watch(ctx, *conn)()
+
 	n, err := rw.WriteString(command + "\r\n")
 	if err != nil {
-		return "", errors.Wrap(err, "C: Could not send the command"+command)
+		return "", errors.Wrap(ctxErr(ctx, err), "C: Could not send the command"+command)
 	}
 	log.Println("C: Wrote (" + strconv.Itoa(n) + " bytes written)")
 
 	err = rw.Flush()
 	if err != nil {
-		return "", errors.Wrap(err, "Flush failed.")
+		return "", errors.Wrap(ctxErr(ctx, err), "Flush failed.")
 	}
 
 	scanner := bufio.NewScanner(rw)
 	scanner.Split(ScanCRLF)
-	scanner.Scan()
+	if !scanner.Scan() {
+		return "", errors.Wrap(ctxErr(ctx, scannerErr(scanner)), "C: No response to command "+command)
+	}
 	line := scanner.Text()
 	// log.Println("C: Got a response:", line)
 
+	// Anything but a 2xx reply means the command was refused.
+	if !strings.HasPrefix(line, "2") {
+		return "", errors.New("C: Server replied '" + line + "' to command " + command)
+	}
+
 	if strings.Contains(line, "220 DATA") {
 		// cont := false
-		scanner.Scan()
+		if !scanner.Scan() {
+			return "", errors.Wrap(ctxErr(ctx, scannerErr(scanner)), "C: Truncated response to command "+command)
+		}
 		line = scanner.Text()
 		// log.Printf("C: Got a response:\n%v", line)
 		for !strings.Contains(line, "220 OK") {
 			// log.Println("New line")
 
 			// log.Printf("C: Server sent data line:\n%v", line)
+			if response != "" {
+				response = response + "\n"
+			}
 			response = response + line
-			scanner.Scan()
+			if !scanner.Scan() {
+				return "", errors.Wrap(ctxErr(ctx, scannerErr(scanner)), "C: Truncated response to command "+command)
+			}
 			line = scanner.Text()
 			// log.Println("Finish line")
 		}
@@ -138,10 +239,12 @@ func SendCommand(conn *net.Conn, rw *bufio.ReadWriter, command string) (string,
 	return response, nil
 }
 
-func AuthenticatePlain(conn *net.Conn, rw *bufio.ReadWriter, username string, password string) (string, error) {
+func AuthenticatePlain(ctx context.Context, conn *net.Conn, rw *bufio.ReadWriter, username string, password string) (string, error) {
 	command := "AUTHENTICATE PLAIN"
 	log.Printf("C: Sending command " + command)
 
+	defer watch(ctx, *conn)()
+
 	/* REQUEST AUTH */
 	n, err := rw.WriteString(command + "\r\n")
 	if err != nil {
@@ -156,7 +259,9 @@ func AuthenticatePlain(conn *net.Conn, rw *bufio.ReadWriter, username string, pa
 
 	scanner := bufio.NewScanner(rw)
 	scanner.Split(ScanCRLF)
-	scanner.Scan()
+	if !scanner.Scan() {
+		return "", errors.Wrap(ctxErr(ctx, scannerErr(scanner)), "C: No response to command "+command)
+	}
 	response := scanner.Text()
 	log.Println("C: Got a response:", response)
 
@@ -168,7 +273,7 @@ func AuthenticatePlain(conn *net.Conn, rw *bufio.ReadWriter, username string, pa
 	/* SEND CHALLENGE */
 	data := "\x00" + username + "\x00" + password
 	sEnc := base64.StdEncoding.EncodeToString([]byte(data))
-	log.Println("C: Authentication string sent: " + sEnc)
+	log.Println("C: Authentication string sent (" + strconv.Itoa(len(sEnc)) + " bytes, redacted)")
 	// fmt.Println(sEnc)
 	n, err = rw.WriteString(sEnc + "\r\n")
 	if err != nil {
@@ -183,7 +288,9 @@ func AuthenticatePlain(conn *net.Conn, rw *bufio.ReadWriter, username string, pa
 
 	scanner = bufio.NewScanner(rw)
 	scanner.Split(ScanCRLF)
-	scanner.Scan()
+	if !scanner.Scan() {
+		return "", errors.Wrap(ctxErr(ctx, scannerErr(scanner)), "C: No response to authentication")
+	}
 	response = scanner.Text()
 	log.Println("C: Got a response:", response)
 	if !strings.Contains(response, "220") {
@@ -227,133 +334,37 @@ type fnaaServer struct {
 	Port int
 }
 
-func AddressResolve(fqdn string, nameserver string) (string, bool) {
-	log.Println("**Starting Address resolution")
+// TrustAnchors, when set, make AddressResolve and ServiceResolve validate
+// the answers with DNSSEC, refusing unsigned or bogus ones.
+var TrustAnchors []dns.RR
 
-	var (
-		// qtype  []uint16
-		// qclass []uint16
-		qname []string
-	)
-
-	qname = append(qname, fqdn)
-
-	// if len(nameserver) == 0 {
-	// 	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
-	// 	if err != nil {
-	// 		fmt.Fprintln(os.Stderr, err)
-	// 		os.Exit(2)
-	// 	}
-	// 	nameserver = "@" + conf.Servers[0]
-	// }
-	// nameserver = string([]byte(nameserver)[1:]) // chop off @
-
-	port := 53
-	log.Printf("**Nameserver to be used: %v", nameserver)
-
-	if nameserver[0] == '[' && nameserver[len(nameserver)-1] == ']' {
-		nameserver = nameserver[1 : len(nameserver)-1]
-	}
-	if i := net.ParseIP(nameserver); i != nil {
-		nameserver = net.JoinHostPort(nameserver, strconv.Itoa(port))
-	} else {
-		nameserver = dns.Fqdn(nameserver) + ":" + strconv.Itoa(port)
-	}
-
-	log.Printf("**Resolving A for %v using server %v", fqdn, nameserver)
-
-	var address string
-	answer := ExecuteQuery(nameserver, dns.TypeA, qname[0])
-	for _, a := range answer {
-		if ar, ok := a.(*dns.A); ok {
-			address = string(ar.A.String())
-
-		} else {
-			return address, false
-		}
-	}
-
-	log.Printf("**Resolved A to %v for %v using server %v", address, fqdn, nameserver)
-
-	return address, true
+func newResolver(nameserver string) *resolver.Resolver {
+	r := resolver.New(nameserver)
+	r.Logger = log.New(log.Writer(), log.Prefix(), log.Flags())
+	r.TrustAnchors = TrustAnchors
+	return r
 }
 
-func ExecuteQuery(nameserver string, qtype uint16, qname string) []dns.RR {
-	log.Printf("***Executing query %v IN %v using server %v", qname, qtype, nameserver)
-
-	c := new(dns.Client)
-	m := new(dns.Msg)
-	m.SetQuestion(qname, qtype)
-
-	m.RecursionDesired = true
-	r, _, err := c.Exchange(m, nameserver)
+// AddressResolve returns the first address of fqdn, IPv4 or IPv6, asking
+// nameserver and following CNAMEs. See resolver.Resolver for more.
+func AddressResolve(ctx context.Context, fqdn string, nameserver string) (string, bool) {
+	r := newResolver(nameserver)
+	ips, err := r.LookupHost(ctx, fqdn)
 	if err != nil {
-		log.Printf("***Contacting nameserver resulted in error: %v", err)
-		return nil
+		log.Printf("**Resolving address of %v using server %v failed: %v", fqdn, nameserver, err)
+		return "", false
 	}
-	if r.Rcode != dns.RcodeSuccess {
-		log.Println("***Executing query did not return Rcode Success")
-		return nil
-	}
-
-	log.Printf("***Executing successful: %v", r.Answer)
-
-	return r.Answer
+	return ips[0].String(), true
 }
 
-func ServiceResolve(fqdn string, nameserver string) (fnaaServer, bool) {
-	log.Println("**Starting FQDN resolution with " + nameserver)
-
-	var (
-		// qtype  []uint16
-		// qclass []uint16
-		qname []string
-	)
-
-	qname = append(qname, fqdn)
-
-	port := 53
-	log.Printf("**Nameserver to be used: %v", nameserver)
-
-	if nameserver[0] == '[' && nameserver[len(nameserver)-1] == ']' {
-		nameserver = nameserver[1 : len(nameserver)-1]
-		log.Printf("[] %v", nameserver)
-	}
-	if i := net.ParseIP(nameserver); i != nil {
-		nameserver = net.JoinHostPort(nameserver, strconv.Itoa(port))
-		log.Printf("IP %v", nameserver)
-	} else {
-		nameserver = dns.Fqdn(nameserver) + ":" + strconv.Itoa(port)
-		log.Printf("Else %v", nameserver)
-	}
-
-	server := fnaaServer{}
-	// server.Host = "time.flows.unix.ar"
-	// server.Port = 1
-	log.Printf("**#Resolving SRV for %v using server %v", fqdn, nameserver)
-
-	answer := ExecuteQuery(nameserver, dns.TypeSRV, qname[0])
-	for _, a := range answer {
-		if srv, ok := a.(*dns.SRV); ok {
-			server.Port = int(srv.Port)
-			server.Host = string(srv.Target)
-
-		}
-	}
-
-	if server.Host == "" || server.Port == 0 {
-		log.Printf("**Error Resolving SRV for %v using server %v", "fnaa._flow._tcp."+fqdn, nameserver)
-		answer = ExecuteQuery(nameserver, dns.TypeSRV, "fnaa._flow._tcp."+qname[0])
-		for _, a := range answer {
-			if srv, ok := a.(*dns.SRV); ok {
-				server.Port = int(srv.Port)
-				server.Host = string(srv.Target)
-
-			} else {
-				return server, false
-			}
-		}
+// ServiceResolve returns the SRV target of fqdn to try first, in RFC 2782
+// order, asking nameserver.
+func ServiceResolve(ctx context.Context, fqdn string, nameserver string) (fnaaServer, bool) {
+	r := newResolver(nameserver)
+	records, err := r.LookupSRV(ctx, fqdn)
+	if err != nil {
+		log.Printf("**Resolving SRV for %v using server %v failed: %v", fqdn, nameserver, err)
+		return fnaaServer{}, false
 	}
-
-	return server, true
+	return fnaaServer{Host: records[0].Target, Port: int(records[0].Port)}, true
 }
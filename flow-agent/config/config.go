@@ -1,17 +1,170 @@
 package config
 
+import (
+	"path/filepath"
+	"time"
+)
+
+/*
+	nameserver: 127.0.0.9,127.0.0.10
+	nameserver_transport: dot
+	nameserver_ca: resolver-ca.pem
+	trust_anchor: root.key
+	schema_dir: schemas
+
+Nameserver lists, comma separated, the recursive nameservers remote FNAAs
+and zones are looked up with, tried in order. When empty the ones in
+/etc/resolv.conf are used.
+
+Nameserver transport is udp (the default), tcp, dot for DNS-over-TLS or
+doh for DNS-over-HTTPS, the latter two needing nameserver to be set, to
+hosts or to URLs such as https://dns.unix.ar/dns-query for doh. Their
+certificates are checked against the system CAs or, if set, the PEM file
+nameserver_ca, relative to the configuration file.
+
+Trust anchor is a file of DNSKEY or DS records in zone file format,
+relative to the configuration file. When set, the SRV and address records
+of remote FNAAs must validate with DNSSEC up to one of them, unsigned or
+bogus answers being refused.
+
+Schema dir is where the schemas of flows are saved, one JSON file per
+flow, relative to the configuration file. When empty they are only kept in
+memory.
+*/
 type Config struct {
-	Port        string       `mapstructure:"port"`
-	Nameserver  string       `mapstructure:"nameserver"`
-	Nameservers []Nameserver `mapstructure:"nameservers"`
-	Brokers     []Broker     `mapstructure:"agents"`
-	Namespaces  []Namespace  `mapstructure:"namespaces"`
+	Identity     Identity     `mapstructure:"identity"`
+	Port         string       `mapstructure:"port"`
+	Nameserver   string       `mapstructure:"nameserver"`
+	Transport    string       `mapstructure:"nameserver_transport"`
+	NameserverCA string       `mapstructure:"nameserver_ca"`
+	TrustAnchor  string       `mapstructure:"trust_anchor"`
+	SchemaDir    string       `mapstructure:"schema_dir"`
+	Nameservers  []Nameserver `mapstructure:"nameservers"`
+	Brokers      []Broker     `mapstructure:"brokers"`
+	Namespaces   []Namespace  `mapstructure:"namespaces"`
+	Flows        []Flow       `mapstructure:"flows"`
+	Timeouts     Timeouts     `mapstructure:"timeouts"`
+	Retry        Retry        `mapstructure:"retry"`
+	Users        []User       `mapstructure:"users"`
+	Peers        []Peer       `mapstructure:"peers"`
+}
+
+// TrustAnchorPath returns the path of the trust anchor file, relative
+// paths being looked up in dir, the directory of the configuration file.
+func (c Config) TrustAnchorPath(dir string) string {
+	return relativeTo(dir, c.TrustAnchor)
+}
+
+// NameserverCAPath returns the path of the nameserver CA file, relative
+// paths being looked up in dir, the directory of the configuration file.
+func (c Config) NameserverCAPath(dir string) string {
+	return relativeTo(dir, c.NameserverCA)
+}
+
+// SchemaDirPath returns the path of the schema directory, relative paths
+// being looked up in dir, the directory of the configuration file.
+func (c Config) SchemaDirPath(dir string) string {
+	return relativeTo(dir, c.SchemaDir)
+}
+
+func relativeTo(dir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// User returns the configured user with the given name.
+func (c Config) User(name string) (User, bool) {
+	for _, user := range c.Users {
+		if user.Name == name {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+/*
+	identity:
+	  fqdn: fnaa.unix.ar
+	  srv_target: fnaa.unix.ar
+	  srv_port: 61000
+
+The FQDN names this FNAA in its greeting, in the copies of flows it
+subscribes to and towards the remote FNAAs it talks to. The SRV target
+and port are what the FNAA is published as, and default to the FQDN and
+the listening port.
+*/
+type Identity struct {
+	Fqdn      string `mapstructure:"fqdn"`
+	SrvTarget string `mapstructure:"srv_target"`
+	SrvPort   string `mapstructure:"srv_port"`
+}
+
+// Target returns the host this FNAA is published as in its SRV record.
+func (i Identity) Target() string {
+	if i.SrvTarget != "" {
+		return i.SrvTarget
+	}
+	return i.Fqdn
+}
+
+// AdvertisedPort returns the port this FNAA is published with in its SRV
+// record, falling back to the port it listens on.
+func (i Identity) AdvertisedPort(port string) string {
+	if i.SrvPort != "" {
+		return i.SrvPort
+	}
+	return port
+}
+
+/*
+	timeouts:
+	  dial: 5s
+	  read: 30s
+	  write: 10s
+	  idle: 5m
+	  command: 1m
+	  shutdown: 30s
+
+Dial, read and write apply to connections opened towards remote FNAAs.
+Idle bounds how long an incoming FNUA connection may stay silent, write
+how long a reply may take to be delivered to it, and command how long a
+single command, including the remote calls it makes, may run. Shutdown
+is how long in-flight commands are waited for when stopping.
+*/
+type Timeouts struct {
+	Dial     time.Duration `mapstructure:"dial"`
+	Read     time.Duration `mapstructure:"read"`
+	Write    time.Duration `mapstructure:"write"`
+	Idle     time.Duration `mapstructure:"idle"`
+	Command  time.Duration `mapstructure:"command"`
+	Shutdown time.Duration `mapstructure:"shutdown"`
+}
+
+/*
+	retry:
+	  attempts: 5
+	  backoff: 500ms
+	  max_backoff: 30s
+
+Retry is how flow processors write to subscriptions: a write that fails
+is tried up to attempts times in all, waiting backoff after the first
+failure and twice as long after each of the next, up to max_backoff.
+Events still not written then are moved to the dead-letter flow of the
+subscription, as are those a projection or the CloudEvents wrapping
+fails on.
+*/
+type Retry struct {
+	Attempts   int           `mapstructure:"attempts"`
+	Backoff    time.Duration `mapstructure:"backoff"`
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
 }
 
 /*
    name: kafka_local
    type: kafka
-   servers: kf1.unix.ar:9092
+   bootstrap-servers: kf1.unix.ar:9092
    user: inwx
    password: test
    topic_sufix: fnaa.unix.ar
@@ -20,7 +173,7 @@ type Config struct {
 type Broker struct {
 	Name         string `mapstructure:"name"`
 	Type         string `mapstructure:"type"`
-	Servers      string `mapstructure:"servers"`
+	Servers      string `mapstructure:"bootstrap-servers"`
 	User         string `mapstructure:"user"`
 	Password     string `mapstructure:"password"`
 	Topic_sufix  string `mapstructure:"topic_sufix"`
@@ -32,16 +185,62 @@ type Broker struct {
 	-
 		name: flow.unix.ar
 		broker: kafka_local
-		ns_private: dns-int
-		ns_public: dns-ext
+		ns_private: dns_int
+		ns_public: dns_ext
+		signing_key: flow.unix.ar.signing.key
+
+Signing_key is the file holding the Ed25519 key the events copied from
+the flows of the namespace are signed with, its public half published in
+a _fnaa-key.<name> TXT record. Events are not signed without one.
 */
 type Namespace struct {
 	Name       string `mapstructure:"name"`
 	Broker     string `mapstructure:"broker"`
 	Ns_private string `mapstructure:"ns_private"`
 	Ns_public  string `mapstructure:"ns_public"`
+	SigningKey string `mapstructure:"signing_key"`
+}
+
+// SigningKeyPath returns the path of the signing key file, relative paths
+// being looked up in dir, the directory of the configuration file.
+func (n Namespace) SigningKeyPath(dir string) string {
+	return relativeTo(dir, n.SigningKey)
+}
+
+/*
+	flows:
+	-
+		uri: time.flow.unix.ar
+		namespace: flow.unix.ar
+		cloudevents: binary
+		ordering: per-key
+		processor: distributor
+
+Cloudevents is the CloudEvents content mode of the events of the flow:
+off (the default) for plain events, structured for JSON envelopes or
+binary for ce_ headers around the payload.
+
+Ordering is which events of the flow, and of its subscriptions, keep the
+order they were published in: per-key (the default) those with the same
+partition key, none no event, spreading them over every partition, or
+total every event, keeping them in a single partition.
+
+Processor is how the flow is copied to its subscriptions: bridge (the
+default) runs a flow processor per subscription, each consuming the flow,
+and distributor a single one consuming it for all of them, for flows with
+many subscribers.
+*/
+type Flow struct {
+	Uri         string `mapstructure:"uri"`
+	Namespace   string `mapstructure:"namespace"`
+	CloudEvents string `mapstructure:"cloudevents"`
+	Ordering    string `mapstructure:"ordering"`
+	Processor   string `mapstructure:"processor"`
 }
 
+// Processors lists the flow processors, the first one being the default.
+var Processors = []string{"bridge", "distributor"}
+
 /*
 nameservers:
   -
@@ -55,3 +254,56 @@ type Nameserver struct {
 	Host    string `mapstructure:"host"`
 	Keyfile string `mapstructure:"keyfile"`
 }
+
+// KeyPath returns the path of the TSIG keyfile, relative paths being
+// looked up in dir, the directory of the configuration file.
+func (n Nameserver) KeyPath(dir string) string {
+	if n.Keyfile == "" || filepath.IsAbs(n.Keyfile) {
+		return n.Keyfile
+	}
+	return filepath.Join(dir, n.Keyfile)
+}
+
+/*
+users:
+  -
+      name: test
+      password: test
+      zones:
+        - unix.ar
+  -
+      name: fnaa-emiliano
+      password: secret
+      peer: fnaa.emiliano.ar
+
+Zones lists the DNS zones the user owns. CREATE NAMESPACE accepts names
+in these zones, but not in subdomains delegated to other zones.
+
+Peer makes the user the remote FNAA with that FQDN: its SUBSCRIBE and
+REPLAY commands may name it with PEER, subscribing on its behalf. No
+other user may name a peer.
+*/
+type User struct {
+	Name     string   `mapstructure:"name"`
+	Password string   `mapstructure:"password"`
+	Zones    []string `mapstructure:"zones"`
+	Peer     string   `mapstructure:"peer"`
+}
+
+/*
+peers:
+  -
+      fqdn: fnaa.emiliano.ar
+      user: fnaa-unix
+      password: secret
+
+Peers are the remote FNAAs this FNAA subscribes to flows of and replays
+them with, found by the target of their SRV records, and the user it
+authenticates to each of them as. There, that user must have the FQDN of
+this FNAA as its peer.
+*/
+type Peer struct {
+	Fqdn     string `mapstructure:"fqdn"`
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+}
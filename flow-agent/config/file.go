@@ -0,0 +1,108 @@
+package config
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// fm serializes the rewrites of configuration files, each reading the
+// file, changing it and writing it back whole.
+var fm sync.Mutex
+
+// SaveNamespace adds namespace to the namespaces of the configuration
+// file, replacing the one with the same name if any, so it survives
+// reloads and restarts. The rest of the file is kept as is, although
+// comments are lost.
+func SaveNamespace(file string, namespace Namespace) error {
+	fm.Lock()
+	defer fm.Unlock()
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return errors.Wrap(err, "reading "+file)
+	}
+
+	entry := map[string]interface{}{
+		"name":       namespace.Name,
+		"broker":     namespace.Broker,
+		"ns_private": namespace.Ns_private,
+		"ns_public":  namespace.Ns_public,
+	}
+	if namespace.SigningKey != "" {
+		entry["signing_key"] = namespace.SigningKey
+	}
+	namespaces, _ := v.Get("namespaces").([]interface{})
+	saved := false
+	for i, n := range namespaces {
+		if entryValue(n, "name") == namespace.Name {
+			namespaces[i] = entry
+			saved = true
+		}
+	}
+	if !saved {
+		namespaces = append(namespaces, entry)
+	}
+	v.Set("namespaces", namespaces)
+
+	if err := v.WriteConfig(); err != nil {
+		return errors.Wrap(err, "writing "+file)
+	}
+	return nil
+}
+
+// SaveFlow adds flow to the flows of the configuration file, replacing
+// the one with the same URI if any.
+func SaveFlow(file string, flow Flow) error {
+	fm.Lock()
+	defer fm.Unlock()
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return errors.Wrap(err, "reading "+file)
+	}
+
+	entry := map[string]interface{}{
+		"uri":       flow.Uri,
+		"namespace": flow.Namespace,
+	}
+	if flow.CloudEvents != "" {
+		entry["cloudevents"] = flow.CloudEvents
+	}
+	if flow.Ordering != "" {
+		entry["ordering"] = flow.Ordering
+	}
+	if flow.Processor != "" {
+		entry["processor"] = flow.Processor
+	}
+	flows, _ := v.Get("flows").([]interface{})
+	saved := false
+	for i, f := range flows {
+		if entryValue(f, "uri") == flow.Uri {
+			flows[i] = entry
+			saved = true
+		}
+	}
+	if !saved {
+		flows = append(flows, entry)
+	}
+	v.Set("flows", flows)
+
+	if err := v.WriteConfig(); err != nil {
+		return errors.Wrap(err, "writing "+file)
+	}
+	return nil
+}
+
+// entryValue returns the value of key in an entry of a list of maps, which
+// are read back with keys of either type.
+func entryValue(entry interface{}, key string) interface{} {
+	switch m := entry.(type) {
+	case map[string]interface{}:
+		return m[key]
+	case map[interface{}]interface{}:
+		return m[key]
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package config
+
+import (
+	"broker"
+	"flow-agent/zone"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// BrokerTypes lists the broker types the FNAA knows how to drive.
+var BrokerTypes = []string{"kafka"}
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError []string
+
+func (v ValidationError) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(v, "\n\t")
+}
+
+// Broker returns the configured broker with the given name.
+func (c Config) Broker(name string) (Broker, bool) {
+	for _, broker := range c.Brokers {
+		if broker.Name == name {
+			return broker, true
+		}
+	}
+	return Broker{}, false
+}
+
+// NamespaceByName returns the configured namespace with the given name.
+func (c Config) NamespaceByName(name string) (Namespace, bool) {
+	for _, namespace := range c.Namespaces {
+		if namespace.Name == name {
+			return namespace, true
+		}
+	}
+	return Namespace{}, false
+}
+
+// Flow returns the configured flow with the given URI.
+func (c Config) Flow(uri string) (Flow, bool) {
+	for _, flow := range c.Flows {
+		if flow.Uri == uri {
+			return flow, true
+		}
+	}
+	return Flow{}, false
+}
+
+// NameserverByName returns the configured nameserver with the given name.
+func (c Config) NameserverByName(name string) (Nameserver, bool) {
+	for _, nameserver := range c.Nameservers {
+		if nameserver.Name == name {
+			return nameserver, true
+		}
+	}
+	return Nameserver{}, false
+}
+
+// Peer returns the configured peer with the given FQDN.
+func (c Config) Peer(fqdn string) (Peer, bool) {
+	for _, peer := range c.Peers {
+		if strings.EqualFold(strings.TrimSuffix(peer.Fqdn, "."), strings.TrimSuffix(fqdn, ".")) {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+// Validate checks that every required setting is present and that all
+// references between sections resolve. Relative keyfiles, CAs and trust
+// anchors are looked up in dir, the directory of the configuration file.
+func (c Config) Validate(dir string) error {
+	var problems ValidationError
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Port == "" {
+		add("port: must be set")
+	}
+	if c.Identity.Fqdn == "" {
+		add("identity.fqdn: must be set")
+	}
+
+	timeouts := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"dial", c.Timeouts.Dial}, {"read", c.Timeouts.Read}, {"write", c.Timeouts.Write},
+		{"idle", c.Timeouts.Idle}, {"command", c.Timeouts.Command}, {"shutdown", c.Timeouts.Shutdown},
+	}
+	for _, t := range timeouts {
+		if t.d < 0 {
+			add("timeouts.%v: must not be negative", t.name)
+		}
+	}
+
+	if c.Retry.Attempts < 1 {
+		add("retry.attempts: must be at least 1")
+	}
+	if c.Retry.Backoff < 0 {
+		add("retry.backoff: must not be negative")
+	}
+	if c.Retry.MaxBackoff < c.Retry.Backoff {
+		add("retry.max_backoff: must not be less than retry.backoff")
+	}
+
+	switch c.Transport {
+	case "", "udp", "tcp":
+	case "dot", "doh":
+		if c.Nameserver == "" {
+			add("nameserver_transport %v: nameserver must be set", c.Transport)
+		}
+	default:
+		add("nameserver_transport: unknown transport %q, use udp, tcp, dot or doh", c.Transport)
+	}
+	if c.NameserverCA != "" {
+		path := c.NameserverCAPath(dir)
+		if _, err := os.Stat(path); err != nil {
+			add("nameserver_ca %v: %v", path, err)
+		}
+	}
+	if c.TrustAnchor != "" {
+		path := c.TrustAnchorPath(dir)
+		if _, err := os.Stat(path); err != nil {
+			add("trust_anchor %v: %v", path, err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, nameserver := range c.Nameservers {
+		where := fmt.Sprintf("nameservers[%d]", i)
+		if nameserver.Name == "" {
+			add("%v: name must be set", where)
+		} else if seen[nameserver.Name] {
+			add("%v: duplicate name %q", where, nameserver.Name)
+		}
+		seen[nameserver.Name] = true
+		if nameserver.Host == "" {
+			add("%v (%v): host must be set", where, nameserver.Name)
+		}
+		if nameserver.Keyfile != "" {
+			keyfile := nameserver.KeyPath(dir)
+			if _, err := os.Stat(keyfile); os.IsNotExist(err) {
+				add("%v (%v): keyfile %v does not exist: write the TSIG key the nameserver accepts updates with there, as [hmac-sha256:]name:secret, or remove keyfile to send updates unsigned", where, nameserver.Name, keyfile)
+			} else if _, err := zone.ReadKey(keyfile); err != nil {
+				add("%v (%v): keyfile %v: %v", where, nameserver.Name, keyfile, err)
+			}
+		}
+	}
+
+	seen = map[string]bool{}
+	for i, broker := range c.Brokers {
+		where := fmt.Sprintf("brokers[%d]", i)
+		if broker.Name == "" {
+			add("%v: name must be set", where)
+		} else if seen[broker.Name] {
+			add("%v: duplicate name %q", where, broker.Name)
+		}
+		seen[broker.Name] = true
+		if !contains(BrokerTypes, broker.Type) {
+			add("%v (%v): type %q is not one of %v", where, broker.Name, broker.Type, strings.Join(BrokerTypes, ", "))
+		}
+		if broker.Servers == "" {
+			add("%v (%v): bootstrap-servers must be set", where, broker.Name)
+		}
+	}
+
+	seen = map[string]bool{}
+	for i, namespace := range c.Namespaces {
+		where := fmt.Sprintf("namespaces[%d]", i)
+		if namespace.Name == "" {
+			add("%v: name must be set", where)
+		} else if seen[namespace.Name] {
+			add("%v: duplicate name %q", where, namespace.Name)
+		}
+		seen[namespace.Name] = true
+		if _, ok := c.Broker(namespace.Broker); !ok {
+			add("%v (%v): broker %q is not defined in brokers", where, namespace.Name, namespace.Broker)
+		}
+		if namespace.Ns_private != "" {
+			if _, ok := c.NameserverByName(namespace.Ns_private); !ok {
+				add("%v (%v): ns_private %q is not defined in nameservers", where, namespace.Name, namespace.Ns_private)
+			}
+		}
+		if namespace.Ns_public != "" {
+			if _, ok := c.NameserverByName(namespace.Ns_public); !ok {
+				add("%v (%v): ns_public %q is not defined in nameservers", where, namespace.Name, namespace.Ns_public)
+			}
+		}
+		if namespace.SigningKey != "" {
+			path := namespace.SigningKeyPath(dir)
+			if data, err := ioutil.ReadFile(path); err != nil {
+				add("%v (%v): signing_key %v: %v", where, namespace.Name, path, err)
+			} else if _, err := broker.ParseSigningKey(string(data)); err != nil {
+				add("%v (%v): signing_key %v: %v", where, namespace.Name, path, err)
+			}
+		}
+	}
+
+	for i, flow := range c.Flows {
+		where := fmt.Sprintf("flows[%d]", i)
+		if flow.Uri == "" {
+			add("%v: uri must be set", where)
+		}
+		if _, ok := c.NamespaceByName(flow.Namespace); !ok {
+			add("%v (%v): namespace %q is not defined in namespaces", where, flow.Uri, flow.Namespace)
+		} else if !strings.HasSuffix(flow.Uri, "."+flow.Namespace) {
+			add("%v (%v): uri is not part of namespace %v", where, flow.Uri, flow.Namespace)
+		}
+		if _, err := broker.ParseContentMode(flow.CloudEvents); err != nil {
+			add("%v (%v): cloudevents: %v", where, flow.Uri, err)
+		}
+		if _, err := broker.ParseOrdering(flow.Ordering); err != nil {
+			add("%v (%v): ordering: %v", where, flow.Uri, err)
+		}
+		if flow.Processor != "" && flow.Processor != Processors[0] && flow.Processor != Processors[1] {
+			add("%v (%v): unknown processor %q, use %v", where, flow.Uri, flow.Processor, strings.Join(Processors, ", "))
+		}
+	}
+
+	seen = map[string]bool{}
+	for i, user := range c.Users {
+		where := fmt.Sprintf("users[%d]", i)
+		if user.Name == "" {
+			add("%v: name must be set", where)
+		} else if seen[user.Name] {
+			add("%v: duplicate name %q", where, user.Name)
+		}
+		seen[user.Name] = true
+		if user.Password == "" {
+			add("%v (%v): password must be set", where, user.Name)
+		}
+	}
+
+	seen = map[string]bool{}
+	for i, peer := range c.Peers {
+		where := fmt.Sprintf("peers[%d]", i)
+		fqdn := strings.ToLower(strings.TrimSuffix(peer.Fqdn, "."))
+		if fqdn == "" {
+			add("%v: fqdn must be set", where)
+		} else if seen[fqdn] {
+			add("%v: duplicate fqdn %q", where, peer.Fqdn)
+		}
+		seen[fqdn] = true
+		if peer.User == "" || peer.Password == "" {
+			add("%v (%v): user and password must be set", where, peer.Fqdn)
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
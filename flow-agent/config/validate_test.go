@@ -0,0 +1,170 @@
+package config
+
+import (
+	"broker"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestSampleConfigs(t *testing.T) {
+	samples, err := filepath.Glob("../fnaad_*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Fatal("no sample configuration found")
+	}
+	for _, sample := range samples {
+		v := viper.New()
+		v.SetConfigFile(sample)
+		if err := v.ReadInConfig(); err != nil {
+			t.Fatal(err)
+		}
+		var cfg Config
+		if err := v.UnmarshalExact(&cfg); err != nil {
+			t.Errorf("%v: %v", sample, err)
+			continue
+		}
+		if err := cfg.Validate(filepath.Dir(sample)); err != nil {
+			t.Errorf("%v: %v", sample, err)
+		}
+	}
+}
+
+// validConfig returns a configuration using every section, its files
+// written to a new directory, and a function removing it.
+func validConfig(t *testing.T) (Config, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey, err := broker.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"tsig.key":         "hmac-sha256:fnaa.unix.ar.:c2VjcmV0",
+		"bad.key":          "hmac-sha512:fnaa.unix.ar.:c2VjcmV0",
+		"ns.signing.key":   signingKey + "\n",
+		"bad.signing.key":  "c2hvcnQ=\n",
+		"ca.pem":           "",
+		"trust-anchor.key": "",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := Config{
+		Identity:     Identity{Fqdn: "fnaa.unix.ar"},
+		Port:         "61000",
+		Nameserver:   "9.9.9.9",
+		Transport:    "dot",
+		NameserverCA: "ca.pem",
+		TrustAnchor:  "trust-anchor.key",
+		Timeouts:     Timeouts{Dial: 5 * time.Second, Read: 30 * time.Second},
+		Retry:        Retry{Attempts: 5, Backoff: 500 * time.Millisecond, MaxBackoff: 30 * time.Second},
+		Nameservers: []Nameserver{
+			{Name: "dns_int", Host: "ns1.unix.ar", Keyfile: "tsig.key"},
+			{Name: "dns_ext", Host: "ns2.unix.ar"},
+		},
+		Brokers: []Broker{{Name: "kafka_local", Type: "kafka", Servers: "kf1.unix.ar:9092"}},
+		Namespaces: []Namespace{
+			{Name: "flow.unix.ar", Broker: "kafka_local", Ns_private: "dns_int", Ns_public: "dns_ext", SigningKey: "ns.signing.key"},
+		},
+		Flows: []Flow{
+			{Uri: "orders.flow.unix.ar", Namespace: "flow.unix.ar", CloudEvents: "structured", Ordering: "per-key", Processor: "distributor"},
+		},
+		Users: []User{{Name: "test", Password: "test", Zones: []string{"unix.ar"}}},
+		Peers: []Peer{{Fqdn: "fnaa.emiliano.ar", User: "fnaa-unix", Password: "test"}},
+	}
+	return cfg, dir, func() { os.RemoveAll(dir) }
+}
+
+func TestValidate(t *testing.T) {
+	cfg, dir, remove := validConfig(t)
+	defer remove()
+	if err := cfg.Validate(dir); err != nil {
+		t.Fatalf("valid configuration: %v", err)
+	}
+
+	// Each change breaks one rule, reported with the given text, <dir>
+	// standing for the directory of the configuration.
+	tests := []struct {
+		problem string
+		change  func(c *Config)
+	}{
+		{"port: must be set", func(c *Config) { c.Port = "" }},
+		{"identity.fqdn: must be set", func(c *Config) { c.Identity.Fqdn = "" }},
+		{"timeouts.read: must not be negative", func(c *Config) { c.Timeouts.Read = -time.Second }},
+		{"retry.attempts: must be at least 1", func(c *Config) { c.Retry.Attempts = 0 }},
+		{"retry.backoff: must not be negative", func(c *Config) { c.Retry.Backoff = -time.Second }},
+		{"retry.max_backoff: must not be less than retry.backoff", func(c *Config) { c.Retry.MaxBackoff = time.Millisecond }},
+		{"nameserver_transport dot: nameserver must be set", func(c *Config) { c.Nameserver = "" }},
+		{`nameserver_transport: unknown transport "quic"`, func(c *Config) { c.Transport = "quic" }},
+		{"nameserver_ca <dir>/missing.pem: ", func(c *Config) { c.NameserverCA = "missing.pem" }},
+		{"trust_anchor <dir>/missing.key: ", func(c *Config) { c.TrustAnchor = "missing.key" }},
+
+		{"nameservers[1]: name must be set", func(c *Config) { c.Nameservers[1].Name = ""; c.Namespaces[0].Ns_public = "dns_int" }},
+		{`nameservers[1]: duplicate name "dns_int"`, func(c *Config) { c.Nameservers[1].Name = "dns_int"; c.Namespaces[0].Ns_public = "dns_int" }},
+		{"nameservers[1] (dns_ext): host must be set", func(c *Config) { c.Nameservers[1].Host = "" }},
+		{"nameservers[1] (dns_ext): keyfile <dir>/missing.key does not exist", func(c *Config) { c.Nameservers[1].Keyfile = "missing.key" }},
+		{"unknown algorithm hmac-sha512", func(c *Config) { c.Nameservers[1].Keyfile = "bad.key" }},
+
+		{"brokers[1]: name must be set", func(c *Config) { c.Brokers = append(c.Brokers, Broker{Type: "kafka", Servers: "kf2.unix.ar:9092"}) }},
+		{`brokers[1]: duplicate name "kafka_local"`, func(c *Config) { c.Brokers = append(c.Brokers, c.Brokers[0]) }},
+		{`brokers[0] (kafka_local): type "pulsar" is not one of kafka`, func(c *Config) { c.Brokers[0].Type = "pulsar" }},
+		{"brokers[0] (kafka_local): bootstrap-servers must be set", func(c *Config) { c.Brokers[0].Servers = "" }},
+
+		{"namespaces[1]: name must be set", func(c *Config) { c.Namespaces = append(c.Namespaces, Namespace{Broker: "kafka_local"}) }},
+		{`namespaces[1]: duplicate name "flow.unix.ar"`, func(c *Config) { c.Namespaces = append(c.Namespaces, c.Namespaces[0]) }},
+		{`namespaces[0] (flow.unix.ar): broker "kafka_remote" is not defined in brokers`, func(c *Config) { c.Namespaces[0].Broker = "kafka_remote" }},
+		{`namespaces[0] (flow.unix.ar): ns_private "dns_other" is not defined in nameservers`, func(c *Config) { c.Namespaces[0].Ns_private = "dns_other" }},
+		{`namespaces[0] (flow.unix.ar): ns_public "dns_other" is not defined in nameservers`, func(c *Config) { c.Namespaces[0].Ns_public = "dns_other" }},
+		{"namespaces[0] (flow.unix.ar): signing_key <dir>/missing.signing.key: ", func(c *Config) { c.Namespaces[0].SigningKey = "missing.signing.key" }},
+		{"namespaces[0] (flow.unix.ar): signing_key <dir>/bad.signing.key: invalid signing key", func(c *Config) { c.Namespaces[0].SigningKey = "bad.signing.key" }},
+
+		{`flows[0] (orders.flow.unix.ar): namespace "flow.emiliano.ar" is not defined in namespaces`, func(c *Config) { c.Flows[0].Namespace = "flow.emiliano.ar" }},
+		{"flows[0] (orders.flow.emiliano.ar): uri is not part of namespace flow.unix.ar", func(c *Config) { c.Flows[0].Uri = "orders.flow.emiliano.ar" }},
+		{"flows[0] (orders.flow.unix.ar): cloudevents:", func(c *Config) { c.Flows[0].CloudEvents = "xml" }},
+		{"flows[0] (orders.flow.unix.ar): ordering:", func(c *Config) { c.Flows[0].Ordering = "random" }},
+		{`flows[0] (orders.flow.unix.ar): unknown processor "fanout"`, func(c *Config) { c.Flows[0].Processor = "fanout" }},
+
+		{"users[1]: name must be set", func(c *Config) { c.Users = append(c.Users, User{Password: "test"}) }},
+		{`users[1]: duplicate name "test"`, func(c *Config) { c.Users = append(c.Users, c.Users[0]) }},
+		{"users[0] (test): password must be set", func(c *Config) { c.Users[0].Password = "" }},
+
+		{"peers[1]: fqdn must be set", func(c *Config) { c.Peers = append(c.Peers, Peer{User: "u", Password: "p"}) }},
+		{`peers[1]: duplicate fqdn "FNAA.emiliano.ar."`, func(c *Config) { c.Peers = append(c.Peers, Peer{Fqdn: "FNAA.emiliano.ar.", User: "u", Password: "p"}) }},
+		{"peers[0] (fnaa.emiliano.ar): user and password must be set", func(c *Config) { c.Peers[0].Password = "" }},
+	}
+	for _, test := range tests {
+		c, dir, remove := validConfig(t)
+		test.change(&c)
+		err := c.Validate(dir)
+		remove()
+		problems, ok := err.(ValidationError)
+		if !ok {
+			t.Errorf("%v: got %v", test.problem, err)
+			continue
+		}
+		want := strings.Replace(test.problem, "<dir>", dir, -1)
+		if len(problems) != 1 || !strings.Contains(problems[0], want) {
+			t.Errorf("got %q, want only %q", []string(problems), want)
+		}
+	}
+
+	// A flow without uri is not part of its namespace either.
+	cfg.Flows[0].Uri = ""
+	problems, _ := cfg.Validate(dir).(ValidationError)
+	if len(problems) == 0 || problems[0] != "flows[0]: uri must be set" {
+		t.Errorf("flow without uri gave %q", []string(problems))
+	}
+}
@@ -0,0 +1,345 @@
+// Package filter selects and reshapes the events copied to subscriptions.
+// A subscriber may give a filter expression, a predicate events must
+// match to be copied, and a projection, the parts of their payload that
+// are copied.
+//
+// Expressions compare paths and literals:
+//
+//	$.amount > 100 && ($.country == "AR" || @headers.priority == "high")
+//	!$.internal && @ce.type =~ "^ar\.unix\."
+//
+// $ is the JSON payload of the event, the data of CloudEvents, with
+// .name, ["name"] and [index] steps. @key is the key of the event,
+// @headers.<name> one of its headers and @ce.<attribute> one of its
+// CloudEvents attributes. Literals are "strings" or 'strings', numbers,
+// true, false and null. Comparisons are ==, !=, <, <=, >, >= and =~, a
+// regular expression match; a path alone is true if it is there and is
+// not false, null or "". Paths that are not there compare unequal to
+// every literal but null.
+//
+// Projections are comma separated payload paths made of names, such as
+// "$.id, $.customer.name": the copy holds those fields only, nested as in
+// the payload.
+package filter
+
+import (
+	"broker"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Expr is a compiled filter expression.
+type Expr struct {
+	text string
+	root node
+}
+
+// Compile parses a filter expression.
+func Compile(text string) (*Expr, error) {
+	tokens, err := lex(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, errors.Errorf("unexpected %q at %v", t.text, t.pos)
+	}
+	return &Expr{text: text, root: root}, nil
+}
+
+// String returns the expression as it was compiled.
+func (x *Expr) String() string {
+	return x.text
+}
+
+// Match reports whether m matches the expression.
+func (x *Expr) Match(m broker.Message) bool {
+	return truthy(x.root.eval(newEvent(m)))
+}
+
+// event is what paths are resolved against, the payload being decoded
+// the first time it is needed.
+type event struct {
+	m       broker.Message
+	ce      broker.CloudEvent
+	isCE    bool
+	data    []byte
+	payload interface{}
+	decoded bool
+}
+
+func newEvent(m broker.Message) *event {
+	e := &event{m: m, data: m.Value}
+	if ce, data, ok, err := broker.Unwrap(m); ok && err == nil {
+		e.ce, e.isCE, e.data = ce, true, data
+	}
+	return e
+}
+
+// json returns the payload decoded, nil if it is not JSON.
+func (e *event) json() interface{} {
+	if !e.decoded {
+		e.payload, _ = decodeJSON(e.data)
+		e.decoded = true
+	}
+	return e.payload
+}
+
+// attribute returns a CloudEvents attribute of the event.
+func (e *event) attribute(name string) (interface{}, bool) {
+	if !e.isCE {
+		return nil, false
+	}
+	var value string
+	switch name {
+	case "specversion":
+		value = broker.SpecVersion
+	case "id":
+		value = e.ce.ID
+	case "source":
+		value = e.ce.Source
+	case "type":
+		value = e.ce.Type
+	case "subject":
+		value = e.ce.Subject
+	case "datacontenttype":
+		value = e.ce.DataContentType
+	case "time":
+		if !e.ce.Time.IsZero() {
+			value = e.ce.Time.Format(time.RFC3339Nano)
+		}
+	default:
+		value = e.ce.Extensions[name]
+	}
+	return value, value != ""
+}
+
+// node is a part of an expression, evaluating to a value: nil when a
+// path is not there, a string, a float64, a bool or a decoded JSON value.
+type node interface {
+	eval(e *event) interface{}
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n literal) eval(e *event) interface{} {
+	return n.value
+}
+
+type not struct {
+	operand node
+}
+
+func (n not) eval(e *event) interface{} {
+	return !truthy(n.operand.eval(e))
+}
+
+type and struct {
+	left, right node
+}
+
+func (n and) eval(e *event) interface{} {
+	return truthy(n.left.eval(e)) && truthy(n.right.eval(e))
+}
+
+type or struct {
+	left, right node
+}
+
+func (n or) eval(e *event) interface{} {
+	return truthy(n.left.eval(e)) || truthy(n.right.eval(e))
+}
+
+type comparison struct {
+	op          string
+	left, right node
+	re          *regexp.Regexp
+}
+
+func (n comparison) eval(e *event) interface{} {
+	a, b := n.left.eval(e), n.right.eval(e)
+	switch n.op {
+	case "==":
+		return equal(a, b)
+	case "!=":
+		return !equal(a, b)
+	case "=~":
+		s, ok := a.(string)
+		return ok && n.re.MatchString(s)
+	}
+	c, ok := compare(a, b)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// path is a reference to a part of the event.
+type path struct {
+	root  string
+	steps []step
+}
+
+// step is a .name, ["name"] or [index] step of a path.
+type step struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+func (p path) eval(e *event) interface{} {
+	switch p.root {
+	case "@key":
+		if e.m.Key == nil {
+			return nil
+		}
+		return string(e.m.Key)
+	case "@headers":
+		var value interface{}
+		for _, h := range e.m.Headers {
+			if h.Key == p.steps[0].name {
+				value = string(h.Value)
+			}
+		}
+		return value
+	case "@ce":
+		value, ok := e.attribute(p.steps[0].name)
+		if !ok {
+			return nil
+		}
+		return value
+	}
+	value, _ := p.lookup(e.json())
+	return value
+}
+
+// lookup walks the steps of p from value.
+func (p path) lookup(value interface{}) (interface{}, bool) {
+	for _, s := range p.steps {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if s.isIndex {
+				return nil, false
+			}
+			var ok bool
+			if value, ok = v[s.name]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i := s.index
+			if i < 0 {
+				i += len(v)
+			}
+			if !s.isIndex || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// truthy reports whether value counts as true on its own.
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+// number returns value as a number, numeric strings included.
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func isNumber(value interface{}) bool {
+	switch value.(type) {
+	case float64, json.Number:
+		return true
+	}
+	return false
+}
+
+func equal(a interface{}, b interface{}) bool {
+	if isNumber(a) || isNumber(b) {
+		x, ok := number(a)
+		y, ok2 := number(b)
+		return ok && ok2 && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compare orders two numbers or two strings, ok being false for any
+// other pair.
+func compare(a interface{}, b interface{}) (int, bool) {
+	if isNumber(a) || isNumber(b) {
+		x, ok := number(a)
+		y, ok2 := number(b)
+		if !ok || !ok2 {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	x, ok := a.(string)
+	y, ok2 := b.(string)
+	if !ok || !ok2 {
+		return 0, false
+	}
+	return strings.Compare(x, y), true
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("trailing data after the JSON value")
+	}
+	return v, nil
+}
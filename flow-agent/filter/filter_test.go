@@ -0,0 +1,271 @@
+package filter
+
+import (
+	"broker"
+	"testing"
+)
+
+// message returns a plain event with payload, key order-1 and a priority
+// header.
+func message(payload string) broker.Message {
+	return broker.Message{
+		Key:     []byte("order-1"),
+		Value:   []byte(payload),
+		Headers: []broker.Header{{Key: "priority", Value: []byte("high")}},
+	}
+}
+
+const order = `{"id": 7, "amount": 150, "country": "AR", "code": "0042", "internal": false, "note": "",
+	"customer": {"name": "Ana", "tags": ["vip", "new"]}, "items": [{"sku": "a"}, {"sku": "b"}], "deleted": null}`
+
+func TestCompileErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"$.amount >",
+		"> 100",
+		"$.amount > 100 &&",
+		"($.amount > 100",
+		"$.amount > 100)",
+		"$.amount 100",
+		"$.",
+		"$.items[0",
+		"$.items[x]",
+		`$.customer["name`,
+		"@body",
+		"@key.name",
+		"@headers",
+		"@headers[0]",
+		"@ce.type.name",
+		"$.country == AR",
+		`$.country == "AR`,
+		"$.amount > 1.2.3",
+		"$.amount # 1",
+		"$.country =~ 1",
+		"$.country =~ $.code",
+		`$.country =~ "("`,
+		"$.amount == 1, $.id == 2",
+	}
+	for _, text := range tests {
+		if x, err := Compile(text); err == nil {
+			t.Errorf("%q compiled to %v", text, x)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr    string
+		payload string
+		want    bool
+	}{
+		// Comparisons.
+		{"$.amount > 100", order, true},
+		{"$.amount >= 150", order, true},
+		{"$.amount < 150", order, false},
+		{"$.amount <= 150", order, true},
+		{"$.amount == 150", order, true},
+		{"$.amount != 150", order, false},
+		{"$.amount == 1.5e2", order, true},
+		{"$.amount > -1", order, true},
+		{`$.country == "AR"`, order, true},
+		{`$.country == 'AR'`, order, true},
+		{`$.country < "BR"`, order, true},
+		{`$.country =~ "^A"`, order, true},
+		{`$.country =~ "^B"`, order, false},
+		{`$["country"] == "AR"`, order, true},
+		{`$.customer.name == "Ana"`, order, true},
+		{`$.customer["name"] == "Ana"`, order, true},
+		{`$.customer.tags[0] == "vip"`, order, true},
+		{`$.customer.tags[-1] == "new"`, order, true},
+		{`$.items[1].sku == "b"`, order, true},
+		{`$.customer == "Ana"`, order, false},
+
+		// Precedence: && binds tighter than ||, ! tighter than both.
+		{`$.amount > 1000 && $.id == 7 || $.country == "AR"`, order, true},
+		{`$.amount > 1000 && ($.id == 7 || $.country == "AR")`, order, false},
+		{`$.country == "AR" || $.id == 7 && $.amount > 1000`, order, true},
+		{`($.country == "AR" || $.id == 7) && $.amount > 1000`, order, false},
+		{`!$.internal && $.id == 7`, order, true},
+		{`!($.internal || $.id == 7)`, order, false},
+		{`!!$.id`, order, true},
+
+		// Type mismatches: numbers compare with numeric strings only,
+		// and ordering needs two numbers or two strings.
+		{`$.code == 42`, order, true},
+		{`$.code > 41`, order, true},
+		{`$.country == 1`, order, false},
+		{`$.country > 1`, order, false},
+		{`$.country != 1`, order, true},
+		{`$.amount == "150"`, order, true},
+		{`$.amount =~ "150"`, order, false},
+		{`$.internal == "false"`, order, false},
+		{`$.internal == false`, order, true},
+		{`$.customer > 1`, order, false},
+		{`$.id == true`, order, false},
+
+		// Paths that are not there, and values that are not true.
+		{`$.missing`, order, false},
+		{`$.missing == null`, order, true},
+		{`$.deleted == null`, order, true},
+		{`$.missing != "x"`, order, true},
+		{`$.missing == "x"`, order, false},
+		{`$.missing > 0`, order, false},
+		{`$.missing < 0`, order, false},
+		{`$.customer.missing.name == null`, order, true},
+		{`$.items[5] == null`, order, true},
+		{`$.items.sku == null`, order, true},
+		{`$.customer[0] == null`, order, true},
+		{`$.internal`, order, false},
+		{`$.note`, order, false},
+		{`$.deleted`, order, false},
+		{`$.customer`, order, true},
+		{`!$.missing`, order, true},
+		{`$.id == 7`, `not json`, false},
+		{`$.id == null`, `not json`, true},
+		{`$.id == 7`, `{"id": 7} {"id": 8}`, false},
+
+		// Keys and headers.
+		{`@key == "order-1"`, order, true},
+		{`@key =~ "^order-"`, order, true},
+		{`@headers.priority == "high"`, order, true},
+		{`@headers.missing == null`, order, true},
+		{`@ce.type == null`, order, true},
+		{`true`, order, true},
+		{`false || null`, order, false},
+	}
+	for _, test := range tests {
+		x, err := Compile(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if got := x.Match(message(test.payload)); got != test.want {
+			t.Errorf("%q on %s = %v, want %v", test.expr, test.payload, got, test.want)
+		}
+	}
+}
+
+func TestMatchCloudEvents(t *testing.T) {
+	for _, mode := range []string{broker.Structured, broker.Binary} {
+		m, err := broker.Wrap(message(`{"amount": 150}`), mode, broker.CloudEvent{
+			ID:         "1",
+			Source:     "orders.flow.unix.ar",
+			Type:       "ar.unix.order",
+			Extensions: map[string]string{"region": "south"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := map[string]bool{
+			`$.amount == 150`:                     true,
+			`@ce.type =~ "^ar\.unix\."`:           true,
+			`@ce.source == "orders.flow.unix.ar"`: true,
+			`@ce.specversion == "1.0"`:            true,
+			`@ce.region == "south"`:               true,
+			`@ce.subject == null`:                 true,
+			`@ce.time`:                            false,
+		}
+		for expr, want := range tests {
+			x, err := Compile(expr)
+			if err != nil {
+				t.Fatalf("%q: %v", expr, err)
+			}
+			if got := x.Match(m); got != want {
+				t.Errorf("%v: %q = %v, want %v", mode, expr, got, want)
+			}
+		}
+	}
+}
+
+func TestParseProjectionErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"$",
+		"$.id,",
+		",$.id",
+		"$.id $.name",
+		"$.id,,$.name",
+		"$.items[0]",
+		"@key",
+		"@headers.priority",
+		`"id"`,
+		"$.id == 1",
+	}
+	for _, text := range tests {
+		if p, err := ParseProjection(text); err == nil {
+			t.Errorf("%q parsed to %v", text, p)
+		}
+	}
+}
+
+func TestProjection(t *testing.T) {
+	tests := []struct {
+		projection string
+		payload    string
+		want       string
+	}{
+		{"$.id", order, `{"id":7}`},
+		{"$.id, $.customer.name", order, `{"customer":{"name":"Ana"},"id":7}`},
+		{`$.customer["name"], $.customer.tags`, order, `{"customer":{"name":"Ana","tags":["vip","new"]}}`},
+		{"$.customer", order, `{"customer":{"name":"Ana","tags":["vip","new"]}}`},
+		{"$.id, $.missing, $.customer.missing", order, `{"id":7}`},
+		{"$.missing", order, `{}`},
+		{"$.deleted", order, `{"deleted":null}`},
+		{"$.amount", `{"amount": 1.50}`, `{"amount":1.50}`},
+	}
+	for _, test := range tests {
+		p, err := ParseProjection(test.projection)
+		if err != nil {
+			t.Errorf("%q: %v", test.projection, err)
+			continue
+		}
+		out, err := p.Apply(message(test.payload))
+		if err != nil {
+			t.Errorf("%q: %v", test.projection, err)
+			continue
+		}
+		if string(out.Value) != test.want {
+			t.Errorf("%q gave %s, want %s", test.projection, out.Value, test.want)
+		}
+		if string(out.Key) != "order-1" || len(out.Headers) != 1 {
+			t.Errorf("%q changed the key or headers: %+v", test.projection, out)
+		}
+	}
+
+	p, err := ParseProjection("$.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{`not json`, `[1, 2]`, `"id"`} {
+		if out, err := p.Apply(message(payload)); err == nil {
+			t.Errorf("%s projected to %s", payload, out.Value)
+		}
+	}
+}
+
+func TestProjectionCloudEvents(t *testing.T) {
+	p, err := ParseProjection("$.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{broker.Structured, broker.Binary} {
+		m, err := broker.Wrap(message(`{"id": 7, "secret": "x"}`), mode, broker.CloudEvent{ID: "1", Source: "orders.flow.unix.ar", Type: "ar.unix.order"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := p.Apply(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if broker.ContentMode(out) != mode {
+			t.Errorf("%v projected to content mode %v", mode, broker.ContentMode(out))
+		}
+		ce, data, ok, err := broker.Unwrap(out)
+		if err != nil || !ok {
+			t.Fatalf("%v projection is not a CloudEvent: %v", mode, err)
+		}
+		if string(data) != `{"id":7}` || ce.Type != "ar.unix.order" || ce.ID != "1" {
+			t.Errorf("%v projected to %+v %s", mode, ce, data)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package filter
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPath
+	tokLiteral
+	tokOp
+	tokNot
+	tokAnd
+	tokOr
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	pos   int
+	value interface{}
+	path  path
+}
+
+// lex splits text into tokens.
+func lex(text string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == '$' || c == '@':
+			p, end, err := lexPath(text, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokPath, text: text[i:end], pos: i, path: p})
+			i = end
+			continue
+		case c == '"' || c == '\'':
+			s, end, err := lexString(text, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokLiteral, text: text[i:end], pos: i, value: s})
+			i = end
+			continue
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(text) && strings.IndexByte("0123456789.eE+-", text[end]) >= 0 {
+				end++
+			}
+			f, err := strconv.ParseFloat(text[i:end], 64)
+			if err != nil {
+				return nil, errors.Errorf("bad number %q at %v", text[i:end], i)
+			}
+			tokens = append(tokens, token{kind: tokLiteral, text: text[i:end], pos: i, value: f})
+			i = end
+			continue
+		case unicode.IsLetter(rune(c)):
+			end := i
+			for end < len(text) && unicode.IsLetter(rune(text[end])) {
+				end++
+			}
+			word := text[i:end]
+			var value interface{}
+			switch word {
+			case "true":
+				value = true
+			case "false":
+				value = false
+			case "null":
+			default:
+				return nil, errors.Errorf("unknown word %q at %v, quote strings", word, i)
+			}
+			tokens = append(tokens, token{kind: tokLiteral, text: word, pos: i, value: value})
+			i = end
+			continue
+		}
+
+		two := text[i:]
+		if len(two) > 2 {
+			two = two[:2]
+		}
+		switch two {
+		case "&&":
+			tokens = append(tokens, token{kind: tokAnd, text: two, pos: i})
+		case "||":
+			tokens = append(tokens, token{kind: tokOr, text: two, pos: i})
+		case "==", "!=", "<=", ">=", "=~":
+			tokens = append(tokens, token{kind: tokOp, text: two, pos: i})
+		default:
+			kind := map[byte]tokenKind{'<': tokOp, '>': tokOp, '!': tokNot, '(': tokLParen, ')': tokRParen, ',': tokComma}
+			k, ok := kind[c]
+			if !ok {
+				return nil, errors.Errorf("unexpected %q at %v", c, i)
+			}
+			tokens = append(tokens, token{kind: k, text: string(c), pos: i})
+			i++
+			continue
+		}
+		i += 2
+	}
+	return append(tokens, token{kind: tokEOF, text: "end", pos: len(text)}), nil
+}
+
+// lexPath reads the path starting at text[start].
+func lexPath(text string, start int) (path, int, error) {
+	i := start + 1
+	p := path{root: "$"}
+	if text[start] == '@' {
+		end := i
+		for end < len(text) && isNameByte(text[end]) {
+			end++
+		}
+		p.root = text[start:end]
+		i = end
+		if p.root != "@key" && p.root != "@headers" && p.root != "@ce" {
+			return p, i, errors.Errorf("unknown %q at %v, use $, @key, @headers or @ce", p.root, start)
+		}
+	}
+	for i < len(text) {
+		switch text[i] {
+		case '.':
+			end := i + 1
+			for end < len(text) && isNameByte(text[end]) {
+				end++
+			}
+			if end == i+1 {
+				return p, i, errors.Errorf("missing name after . at %v", i)
+			}
+			p.steps = append(p.steps, step{name: text[i+1 : end]})
+			i = end
+		case '[':
+			end := strings.IndexByte(text[i:], ']')
+			if end < 0 {
+				return p, i, errors.Errorf("unclosed [ at %v", i)
+			}
+			inside := strings.TrimSpace(text[i+1 : i+end])
+			if inside != "" && (inside[0] == '"' || inside[0] == '\'') {
+				name, stop, err := lexString(text, strings.Index(text[i:], inside)+i)
+				if err != nil {
+					return p, i, err
+				}
+				end = strings.IndexByte(text[stop:], ']')
+				if end < 0 || strings.TrimSpace(text[stop:stop+end]) != "" {
+					return p, i, errors.Errorf("unclosed [ at %v", i)
+				}
+				p.steps = append(p.steps, step{name: name})
+				i = stop + end + 1
+				continue
+			}
+			index, err := strconv.Atoi(inside)
+			if err != nil {
+				return p, i, errors.Errorf("bad index %q at %v", inside, i)
+			}
+			p.steps = append(p.steps, step{index: index, isIndex: true})
+			i += end + 1
+		default:
+			return p, i, p.check(start)
+		}
+	}
+	return p, i, p.check(start)
+}
+
+// check tells whether the steps fit the root of p.
+func (p path) check(pos int) error {
+	switch p.root {
+	case "@key":
+		if len(p.steps) > 0 {
+			return errors.Errorf("@key at %v has no fields", pos)
+		}
+	case "@headers", "@ce":
+		if len(p.steps) != 1 || p.steps[0].isIndex {
+			return errors.Errorf("%v at %v needs a name, as in %v.name", p.root, pos, p.root)
+		}
+	}
+	return nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// lexString reads the quoted string starting at text[start], with
+// backslash escapes.
+func lexString(text string, start int) (string, int, error) {
+	quote := text[start]
+	var b strings.Builder
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			if i+1 < len(text) {
+				i++
+				switch text[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				case quote, '\\':
+					b.WriteByte(text[i])
+				default:
+					// Other escapes are kept, for regular expressions.
+					b.WriteByte('\\')
+					b.WriteByte(text[i])
+				}
+				continue
+			}
+		}
+		b.WriteByte(text[i])
+	}
+	return "", len(text), errors.Errorf("unclosed string at %v", start)
+}
+
+// parser is a recursive descent parser over the tokens of an expression:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" or ")" | comparison
+//	comparison = operand [ op operand ]
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (node, error) {
+	switch t := p.peek(); t.kind {
+	case tokNot:
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{operand}, nil
+	case tokLParen:
+		p.next()
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokRParen {
+			return nil, errors.Errorf("expected ) at %v, got %q", t.pos, t.text)
+		}
+		return inner, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokOp {
+		return left, nil
+	}
+	op := p.next()
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	c := comparison{op: op.text, left: left, right: right}
+	if c.op == "=~" {
+		lit, _ := right.(literal)
+		pattern, ok := lit.value.(string)
+		if !ok {
+			return nil, errors.Errorf("=~ at %v needs a string regular expression", op.pos)
+		}
+		if c.re, err = regexp.Compile(pattern); err != nil {
+			return nil, errors.Wrapf(err, "regular expression at %v", op.pos)
+		}
+	}
+	return c, nil
+}
+
+func (p *parser) operand() (node, error) {
+	switch t := p.next(); t.kind {
+	case tokPath:
+		return t.path, nil
+	case tokLiteral:
+		return literal{t.value}, nil
+	default:
+		return nil, errors.Errorf("expected a path or a literal at %v, got %q", t.pos, t.text)
+	}
+}
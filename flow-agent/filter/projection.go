@@ -0,0 +1,108 @@
+package filter
+
+import (
+	"broker"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Projection is a compiled projection.
+type Projection struct {
+	text  string
+	paths []path
+}
+
+// ParseProjection parses a comma separated list of payload paths.
+func ParseProjection(text string) (*Projection, error) {
+	tokens, err := lex(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &Projection{text: text}
+	for i, t := range tokens {
+		if t.kind == tokEOF {
+			break
+		}
+		if i%2 == 1 {
+			if t.kind != tokComma {
+				return nil, errors.Errorf("expected , at %v, got %q", t.pos, t.text)
+			}
+			continue
+		}
+		if t.kind != tokPath || t.path.root != "$" || len(t.path.steps) == 0 {
+			return nil, errors.Errorf("expected a payload field, such as $.name, at %v, got %q", t.pos, t.text)
+		}
+		for _, s := range t.path.steps {
+			if s.isIndex {
+				return nil, errors.Errorf("%v: projections take fields only", t.text)
+			}
+		}
+		p.paths = append(p.paths, t.path)
+	}
+	if len(p.paths) == 0 || tokens[len(tokens)-2].kind == tokComma {
+		return nil, errors.New("expected a comma separated list of payload fields")
+	}
+	return p, nil
+}
+
+// String returns the projection as it was parsed.
+func (p *Projection) String() string {
+	return p.text
+}
+
+// Apply returns m with the projected fields of its JSON payload only. The
+// data of CloudEvents is projected, their attributes being kept. Events
+// whose payload is not a JSON object cannot be projected.
+func (p *Projection) Apply(m broker.Message) (broker.Message, error) {
+	ce, data, isCE, err := broker.Unwrap(m)
+	if err != nil {
+		return m, err
+	}
+	payload, err := decodeJSON(data)
+	if err != nil {
+		return m, errors.Wrap(err, "payload is not JSON")
+	}
+	if _, ok := payload.(map[string]interface{}); !ok {
+		return m, errors.New("payload is not a JSON object")
+	}
+
+	projected := map[string]interface{}{}
+	for _, path := range p.paths {
+		value, ok := path.lookup(payload)
+		if !ok {
+			continue
+		}
+		parent := projected
+		for _, s := range path.steps[:len(path.steps)-1] {
+			child, ok := parent[s.name].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				parent[s.name] = child
+			}
+			parent = child
+		}
+		parent[path.steps[len(path.steps)-1].name] = value
+	}
+	value, err := json.Marshal(projected)
+	if err != nil {
+		return m, err
+	}
+
+	out := m
+	out.Value = value
+	if !isCE {
+		return out, nil
+	}
+	// CloudEvents are wrapped again around the projected data, in their
+	// content mode.
+	out.Headers = nil
+	for _, h := range m.Headers {
+		if h.Key != "content-type" && !strings.HasPrefix(h.Key, "ce_") {
+			out.Headers = append(out.Headers, h)
+		}
+	}
+	ce.DataContentType = "application/json"
+	return broker.Wrap(out, broker.ContentMode(m), ce)
+}
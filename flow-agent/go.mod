@@ -3,11 +3,20 @@ module flow-agent
 go 1.13
 
 require (
+	broker v0.0.0
 	github.com/bgentry/speakeasy v0.1.0
 	github.com/emersion/go-sasl v0.0.0-20211008083017-0b9dcfb154ac
+	github.com/linkedin/goavro/v2 v2.12.0
 	github.com/miekg/dns v1.1.41
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/msteinert/pam v1.0.0
 	github.com/pkg/errors v0.9.1
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	github.com/spf13/viper v1.10.1
+	google.golang.org/protobuf v1.28.1
+	resolver v0.0.0
 )
+
+replace broker => ../broker
+
+replace resolver => ../resolver
@@ -3,11 +3,15 @@ package main
 // install libpam0g-dev in ubuntu
 
 import (
+	"context"
 	"flag"
 	"flow-agent/config"
 	"flow-agent/server"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
@@ -33,6 +37,8 @@ Try "localhost" or "127.0.0.1" when running both processes on the same machine.
 func main() {
 
 	cfgFile := flag.String("config", "", "Configuration file")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration file and exit")
+	signNamespace := flag.String("sign-namespace", "", "Generate and publish the signing key of a namespace and exit")
 
 	// flag.String("nameserver", "", "Nameserver to use")
 	// flag.String("user", "", "Nameserver to use")
@@ -59,20 +65,78 @@ func main() {
 		viper.SetConfigName("/etc/fnaa/fnaad.yml")
 	}
 
+	if hostname, err := os.Hostname(); err == nil {
+		viper.SetDefault("identity.fqdn", hostname)
+	}
+	viper.SetDefault("timeouts.dial", "5s")
+	viper.SetDefault("timeouts.read", "30s")
+	viper.SetDefault("timeouts.write", "10s")
+	viper.SetDefault("timeouts.idle", "5m")
+	viper.SetDefault("timeouts.command", "1m")
+	viper.SetDefault("timeouts.shutdown", "30s")
+	viper.SetDefault("retry.attempts", 5)
+	viper.SetDefault("retry.backoff", "500ms")
+	viper.SetDefault("retry.max_backoff", "30s")
+
 	viper.AutomaticEnv() // read in environment variables that match
 	// log.Println(viper.ReadInConfig())
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		log.Println("\tUsing config file:", viper.ConfigFileUsed())
-	}
-	cfg := config.Config{}
-	err := viper.Unmarshal(&cfg)
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Println("Error:", errors.WithStack(err))
+		log.Println("Error:", err)
+		os.Exit(1)
+	}
+	log.Println("\tUsing config file:", viper.ConfigFileUsed())
+
+	if *checkConfig {
+		log.Println("Configuration OK")
+		return
+	}
+	if *signNamespace != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Command)
+		defer cancel()
+		if err := server.SignNamespace(ctx, cfg, viper.ConfigFileUsed(), *signNamespace); err != nil {
+			log.Println("Error:", err)
+			os.Exit(1)
+		}
+		log.Printf("Namespace %v signs its events", *signNamespace)
+		return
 	}
 
+	// SIGTERM and SIGINT stop accepting connections and drain the
+	// in-flight sessions, SIGHUP reloads the configuration file and
+	// restarts the flow processors it changes.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	endpoint := server.NewServer()
+	endpoint.ConfigFile = viper.ConfigFileUsed()
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				log.Printf("Received %v, shutting down", sig)
+				stop()
+				return
+			}
+			log.Println("Received SIGHUP, reloading configuration")
+			cfg, err := loadConfig()
+			if err != nil {
+				log.Println("Error: keeping current configuration,", err)
+				continue
+			}
+			endpoint.SetConfig(cfg)
+			log.Println("Configuration reloaded from", viper.ConfigFileUsed())
+		}
+	}()
+
+	log.Printf("Running as %v, publish as: %v. IN SRV 0 0 %v %v.", cfg.Identity.Fqdn,
+		cfg.Identity.Fqdn, cfg.Identity.AdvertisedPort(cfg.Port), cfg.Identity.Target())
+
 	// Go into server mode.
-	err = server.Server(cfg)
+	err = endpoint.Listen(ctx, cfg)
 	if err != nil {
 		log.Println("Error:", errors.WithStack(err))
 	}
@@ -80,6 +144,22 @@ func main() {
 	log.Println("Server done.")
 }
 
+// loadConfig reads and validates the configuration file. Keys that do not
+// map to any setting are reported as errors rather than silently ignored.
+func loadConfig() (config.Config, error) {
+	cfg := config.Config{}
+	if err := viper.ReadInConfig(); err != nil {
+		return cfg, errors.Wrap(err, "reading config file")
+	}
+	if err := viper.UnmarshalExact(&cfg); err != nil {
+		return cfg, errors.Wrap(err, "decoding "+viper.ConfigFileUsed())
+	}
+	if err := cfg.Validate(filepath.Dir(viper.ConfigFileUsed())); err != nil {
+		return cfg, errors.Wrap(err, viper.ConfigFileUsed())
+	}
+	return cfg, nil
+}
+
 // The Lshortfile flag includes file name and line number in log messages.
 func init() {
 	log.SetFlags(log.Lshortfile)
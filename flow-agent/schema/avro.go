@@ -0,0 +1,269 @@
+package schema
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/pkg/errors"
+)
+
+// avroSchema validates events that are Avro binary encoded datums of a
+// schema.
+type avroSchema struct {
+	codec *goavro.Codec
+	root  *avroType
+}
+
+func compileAvro(definition []byte) (checker, error) {
+	codec, err := goavro.NewCodec(string(definition))
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(definition, &doc); err != nil {
+		return nil, err
+	}
+	root, err := (&avroParser{names: map[string]*avroType{}}).parse(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	return &avroSchema{codec: codec, root: root}, nil
+}
+
+func (s *avroSchema) Validate(event []byte) error {
+	_, rest, err := s.codec.NativeFromBinary(event)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.Errorf("%v bytes left after the datum", len(rest))
+	}
+	return nil
+}
+
+func (s *avroSchema) reads(writer checker) error {
+	w, ok := writer.(*avroSchema)
+	if !ok {
+		return errors.New("schema types differ")
+	}
+	return avroReads(s.root, w.root, map[[2]*avroType]bool{})
+}
+
+// avroType is the part of an Avro schema schema resolution looks at.
+type avroType struct {
+	kind    string // a primitive type, record, enum, array, map, fixed or union
+	name    string // full name of named types
+	aliases []string
+	fields  []avroField
+	symbols []string
+	// hasDefault is set on enums with a default symbol.
+	hasDefault bool
+	items      *avroType // of arrays and maps
+	size       int
+	branches   []*avroType
+}
+
+type avroField struct {
+	name       string
+	aliases    []string
+	t          *avroType
+	hasDefault bool
+}
+
+var avroPrimitives = []string{"null", "boolean", "int", "long", "float", "double", "bytes", "string"}
+
+// avroParser parses a schema, keeping the named types it defines so later
+// references resolve to them.
+type avroParser struct {
+	names map[string]*avroType
+}
+
+func (p *avroParser) parse(v interface{}, namespace string) (*avroType, error) {
+	switch v := v.(type) {
+	case string:
+		if containsString(avroPrimitives, v) {
+			return &avroType{kind: v}, nil
+		}
+		if t, ok := p.names[avroFullName(v, namespace)]; ok {
+			return t, nil
+		}
+		if t, ok := p.names[v]; ok {
+			return t, nil
+		}
+		return nil, errors.Errorf("unknown type %v", v)
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, branch := range v {
+			b, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			t.branches = append(t.branches, b)
+		}
+		return t, nil
+	case map[string]interface{}:
+		kind, _ := v["type"].(string)
+		if kind == "" {
+			return p.parse(v["type"], namespace)
+		}
+		t := &avroType{kind: kind}
+		switch kind {
+		case "record", "error", "enum", "fixed":
+			name, _ := v["name"].(string)
+			if ns, ok := v["namespace"].(string); ok && !strings.Contains(name, ".") {
+				namespace = ns
+			}
+			t.name = avroFullName(name, namespace)
+			if i := strings.LastIndex(t.name, "."); i >= 0 {
+				namespace = t.name[:i]
+			}
+			for _, alias := range jsonStrings(v["aliases"]) {
+				t.aliases = append(t.aliases, avroFullName(alias, namespace))
+			}
+			p.names[t.name] = t
+		}
+		switch kind {
+		case "record", "error":
+			t.kind = "record"
+			fields, _ := v["fields"].([]interface{})
+			for _, f := range fields {
+				field, _ := f.(map[string]interface{})
+				name, _ := field["name"].(string)
+				ft, err := p.parse(field["type"], namespace)
+				if err != nil {
+					return nil, errors.Wrapf(err, "field %v of %v", name, t.name)
+				}
+				_, hasDefault := field["default"]
+				t.fields = append(t.fields, avroField{name: name, aliases: jsonStrings(field["aliases"]), t: ft, hasDefault: hasDefault})
+			}
+		case "enum":
+			t.symbols = jsonStrings(v["symbols"])
+			_, t.hasDefault = v["default"]
+		case "fixed":
+			size, _ := v["size"].(float64)
+			t.size = int(size)
+		case "array", "map":
+			key := "items"
+			if kind == "map" {
+				key = "values"
+			}
+			items, err := p.parse(v[key], namespace)
+			if err != nil {
+				return nil, err
+			}
+			t.items = items
+		default:
+			if !containsString(avroPrimitives, kind) {
+				return p.parse(kind, namespace)
+			}
+		}
+		return t, nil
+	}
+	return nil, errors.Errorf("invalid type %v", v)
+}
+
+func avroFullName(name string, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// avroPromotions lists the types the values of a type can be read as,
+// besides itself.
+var avroPromotions = map[string][]string{
+	"int":    {"long", "float", "double"},
+	"long":   {"float", "double"},
+	"float":  {"double"},
+	"string": {"bytes"},
+	"bytes":  {"string"},
+}
+
+// avroReads returns why data written with writer cannot be read with
+// reader, following the schema resolution rules of the Avro
+// specification. seen holds the pairs being compared, for recursive
+// types.
+func avroReads(reader *avroType, writer *avroType, seen map[[2]*avroType]bool) error {
+	pair := [2]*avroType{reader, writer}
+	if seen[pair] {
+		return nil
+	}
+	seen[pair] = true
+
+	if writer.kind == "union" {
+		for _, branch := range writer.branches {
+			if err := avroReads(reader, branch, seen); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if reader.kind == "union" {
+		for _, branch := range reader.branches {
+			if avroReads(branch, writer, seen) == nil {
+				return nil
+			}
+		}
+		return errors.Errorf("no branch of the union reads %v", writer.describe())
+	}
+	if reader.kind != writer.kind {
+		if containsString(avroPromotions[writer.kind], reader.kind) {
+			return nil
+		}
+		return errors.Errorf("%v cannot be read as %v", writer.describe(), reader.describe())
+	}
+	if reader.name != "" && reader.name != writer.name && !containsString(reader.aliases, writer.name) {
+		return errors.Errorf("%v cannot be read as %v", writer.describe(), reader.describe())
+	}
+
+	switch reader.kind {
+	case "record":
+		for _, field := range reader.fields {
+			written, ok := writer.field(field)
+			if !ok {
+				if !field.hasDefault {
+					return errors.Errorf("field %v of %v has no default and is not written", field.name, reader.name)
+				}
+				continue
+			}
+			if err := avroReads(field.t, written.t, seen); err != nil {
+				return errors.Wrapf(err, "field %v of %v", field.name, reader.name)
+			}
+		}
+	case "enum":
+		if !reader.hasDefault {
+			for _, symbol := range writer.symbols {
+				if !containsString(reader.symbols, symbol) {
+					return errors.Errorf("symbol %v of %v is not known", symbol, reader.name)
+				}
+			}
+		}
+	case "fixed":
+		if reader.size != writer.size {
+			return errors.Errorf("%v changes size from %v to %v", reader.name, writer.size, reader.size)
+		}
+	case "array", "map":
+		if err := avroReads(reader.items, writer.items, seen); err != nil {
+			return errors.Wrapf(err, "%v items", reader.kind)
+		}
+	}
+	return nil
+}
+
+// field returns the field of record t that field reads, by name or alias.
+func (t *avroType) field(field avroField) (avroField, bool) {
+	for _, f := range t.fields {
+		if f.name == field.name || containsString(field.aliases, f.name) {
+			return f, true
+		}
+	}
+	return avroField{}, false
+}
+
+func (t *avroType) describe() string {
+	if t.name != "" {
+		return t.kind + " " + t.name
+	}
+	return t.kind
+}
@@ -0,0 +1,273 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// jsonSchema validates JSON events against a JSON Schema document. The
+// document must be self-contained: references to other documents are
+// not fetched.
+type jsonSchema struct {
+	compiled *jsonschema.Schema
+	doc      interface{}
+}
+
+func compileJSON(definition []byte) (checker, error) {
+	doc, err := decodeJSON(definition)
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, errors.Errorf("reference to %v, only references within the schema are allowed", url)
+	}
+	if err := compiler.AddResource("mem:///flow.json", bytes.NewReader(definition)); err != nil {
+		return nil, err
+	}
+	compiled, err := compiler.Compile("mem:///flow.json")
+	if err != nil {
+		return nil, err
+	}
+	return &jsonSchema{compiled: compiled, doc: doc}, nil
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("trailing data after the JSON value")
+	}
+	return v, nil
+}
+
+func (s *jsonSchema) Validate(event []byte) error {
+	v, err := decodeJSON(event)
+	if err != nil {
+		return errors.Wrap(err, "event is not JSON")
+	}
+	return s.compiled.Validate(v)
+}
+
+func (s *jsonSchema) reads(writer checker) error {
+	w, ok := writer.(*jsonSchema)
+	if !ok {
+		return errors.New("schema types differ")
+	}
+	return jsonReads("#", s.doc, w.doc)
+}
+
+// jsonReads returns why some document valid against writer may be invalid
+// against reader. It understands the keywords constraining types, enums,
+// object properties, array items and bounds; parts of the schemas using
+// other keywords, such as references or combinators, must be equal.
+func jsonReads(path string, reader interface{}, writer interface{}) error {
+	if reflect.DeepEqual(reader, writer) {
+		return nil
+	}
+	r, w := jsonObject(reader), jsonObject(writer)
+	if r == nil || len(r) == 0 {
+		// true or {} accept anything.
+		if b, ok := reader.(bool); !ok || b {
+			return nil
+		}
+	}
+	if b, ok := writer.(bool); ok && !b {
+		return nil
+	}
+	if r == nil {
+		return errors.Errorf("%v: accepts nothing", path)
+	}
+	if w == nil {
+		w = map[string]interface{}{}
+	}
+	for _, keyword := range []string{"$ref", "$dynamicRef", "allOf", "anyOf", "oneOf", "not", "if", "dependentSchemas", "patternProperties"} {
+		if !reflect.DeepEqual(r[keyword], w[keyword]) {
+			return errors.Errorf("%v: %v differs and cannot be checked, use compatibility none", path, keyword)
+		}
+	}
+
+	if rt := jsonTypes(r["type"]); rt != nil {
+		wt := jsonTypes(w["type"])
+		if wt == nil {
+			return errors.Errorf("%v: only accepts %v", path, strings.Join(rt, ", "))
+		}
+		for _, t := range wt {
+			if !containsString(rt, t) && !(t == "integer" && containsString(rt, "number")) {
+				return errors.Errorf("%v: does not accept %v", path, t)
+			}
+		}
+	}
+	if err := jsonEnum(path, r, w); err != nil {
+		return err
+	}
+	if err := jsonBounds(path, r, w); err != nil {
+		return err
+	}
+	if p, ok := r["pattern"]; ok && p != w["pattern"] {
+		return errors.Errorf("%v: pattern %v is not the one written", path, p)
+	}
+	if p, ok := r["format"]; ok && p != w["format"] {
+		return errors.Errorf("%v: format %v is not the one written", path, p)
+	}
+
+	// Objects.
+	for _, name := range jsonStrings(r["required"]) {
+		if !containsString(jsonStrings(w["required"]), name) {
+			return errors.Errorf("%v: property %v is required but may be missing", path, name)
+		}
+	}
+	rp, wp := jsonObject(r["properties"]), jsonObject(w["properties"])
+	for _, name := range sortedKeys(wp) {
+		if sub, ok := rp[name]; ok {
+			if err := jsonReads(path+"/properties/"+name, sub, wp[name]); err != nil {
+				return err
+			}
+		} else if err := jsonReads(path+"/properties/"+name, jsonAdditional(r), wp[name]); err != nil {
+			return errors.Wrapf(err, "%v: property %v is not accepted", path, name)
+		}
+	}
+	if !jsonAccepts(jsonAdditional(r)) && jsonAccepts(jsonAdditional(w)) {
+		return errors.Errorf("%v: additional properties are not accepted but may be written", path)
+	}
+
+	// Arrays.
+	if items, ok := r["items"]; ok {
+		written, ok := w["items"]
+		if !ok {
+			written = true
+		}
+		if err := jsonReads(path+"/items", items, written); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonEnum checks that every value writer allows is in the enum or
+// const of reader.
+func jsonEnum(path string, r map[string]interface{}, w map[string]interface{}) error {
+	allowed := func(s map[string]interface{}) ([]interface{}, bool) {
+		if c, ok := s["const"]; ok {
+			return []interface{}{c}, true
+		}
+		e, ok := s["enum"].([]interface{})
+		return e, ok
+	}
+	readable, ok := allowed(r)
+	if !ok {
+		return nil
+	}
+	written, ok := allowed(w)
+	if !ok {
+		return errors.Errorf("%v: only accepts the values of its enum", path)
+	}
+	for _, v := range written {
+		found := false
+		for _, candidate := range readable {
+			if reflect.DeepEqual(v, candidate) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("%v: does not accept %v", path, v)
+		}
+	}
+	return nil
+}
+
+// jsonBounds checks that the bounds of reader are no narrower than those
+// of writer.
+func jsonBounds(path string, r map[string]interface{}, w map[string]interface{}) error {
+	lower := []string{"minimum", "exclusiveMinimum", "minLength", "minItems", "minProperties"}
+	upper := []string{"maximum", "exclusiveMaximum", "maxLength", "maxItems", "maxProperties"}
+	for i, keywords := range [][]string{lower, upper} {
+		for _, keyword := range keywords {
+			rb, ok := jsonNumber(r[keyword])
+			if !ok {
+				continue
+			}
+			wb, ok := jsonNumber(w[keyword])
+			if !ok || (i == 0 && wb < rb) || (i == 1 && wb > rb) {
+				return errors.Errorf("%v: %v %v is narrower than what is written", path, keyword, rb)
+			}
+		}
+	}
+	return nil
+}
+
+// jsonAdditional returns the schema of the properties of s that are not
+// listed in its properties.
+func jsonAdditional(s map[string]interface{}) interface{} {
+	if additional, ok := s["additionalProperties"]; ok {
+		return additional
+	}
+	return true
+}
+
+// jsonAccepts reports whether s accepts at least some value.
+func jsonAccepts(s interface{}) bool {
+	b, ok := s.(bool)
+	return !ok || b
+}
+
+func jsonObject(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func jsonTypes(v interface{}) []string {
+	if t, ok := v.(string); ok {
+		return []string{t}
+	}
+	return jsonStrings(v)
+}
+
+func jsonStrings(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var out []string
+	for _, item := range list {
+		out = append(out, fmt.Sprint(item))
+	}
+	return out
+}
+
+func jsonNumber(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package schema
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufSchema validates events that are Protobuf encoded messages of a
+// type of a descriptor set, as protoc --descriptor_set_out
+// --include_imports writes it.
+type protobufSchema struct {
+	message protoreflect.MessageDescriptor
+}
+
+func compileProtobuf(definition []byte, message string) (checker, error) {
+	if message == "" {
+		return nil, errors.New("the message events are must be given")
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(definition, set); err != nil {
+		return nil, errors.Wrap(err, "reading descriptor set")
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, errors.Wrapf(err, "message %v", message)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, errors.Errorf("%v is not a message", message)
+	}
+	return &protobufSchema{message: md}, nil
+}
+
+func (s *protobufSchema) Validate(event []byte) error {
+	m := dynamicpb.NewMessage(s.message)
+	return proto.Unmarshal(event, m)
+}
+
+func (s *protobufSchema) reads(writer checker) error {
+	w, ok := writer.(*protobufSchema)
+	if !ok {
+		return errors.New("schema types differ")
+	}
+	return protobufReads(s.message, w.message, map[[2]protoreflect.FullName]bool{})
+}
+
+// protobufWireTypes groups the field kinds whose values are encoded alike
+// and may replace one another.
+var protobufWireTypes = map[protoreflect.Kind]string{
+	protoreflect.BoolKind:     "varint",
+	protoreflect.EnumKind:     "varint",
+	protoreflect.Int32Kind:    "varint",
+	protoreflect.Int64Kind:    "varint",
+	protoreflect.Uint32Kind:   "varint",
+	protoreflect.Uint64Kind:   "varint",
+	protoreflect.Sint32Kind:   "zigzag",
+	protoreflect.Sint64Kind:   "zigzag",
+	protoreflect.Fixed32Kind:  "fixed32",
+	protoreflect.Sfixed32Kind: "fixed32",
+	protoreflect.FloatKind:    "float",
+	protoreflect.Fixed64Kind:  "fixed64",
+	protoreflect.Sfixed64Kind: "fixed64",
+	protoreflect.DoubleKind:   "double",
+	protoreflect.StringKind:   "string",
+	protoreflect.BytesKind:    "string",
+}
+
+// protobufReads returns why messages written as writer cannot be read as
+// reader. Fields are matched by number: those in both must keep a wire
+// compatible kind and their cardinality, and fields reader requires must
+// be written. Fields only one side knows are skipped by the other.
+func protobufReads(reader protoreflect.MessageDescriptor, writer protoreflect.MessageDescriptor, seen map[[2]protoreflect.FullName]bool) error {
+	pair := [2]protoreflect.FullName{reader.FullName(), writer.FullName()}
+	if seen[pair] {
+		return nil
+	}
+	seen[pair] = true
+
+	fields := reader.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		rf := fields.Get(i)
+		wf := writer.Fields().ByNumber(rf.Number())
+		if wf == nil {
+			if rf.Cardinality() == protoreflect.Required {
+				return errors.Errorf("%v: required field %v is not written", reader.FullName(), rf.Name())
+			}
+			continue
+		}
+		if (wf.Cardinality() == protoreflect.Repeated) != (rf.Cardinality() == protoreflect.Repeated) || wf.IsMap() != rf.IsMap() {
+			return errors.Errorf("%v: field %v changes cardinality", reader.FullName(), rf.Number())
+		}
+		if rf.Cardinality() == protoreflect.Required && wf.Cardinality() != protoreflect.Required {
+			return errors.Errorf("%v: field %v is required but may not be written", reader.FullName(), rf.Number())
+		}
+		rm, wm := rf.Message(), wf.Message()
+		switch {
+		case rm != nil && wm != nil:
+			if err := protobufReads(rm, wm, seen); err != nil {
+				return errors.Wrapf(err, "%v: field %v", reader.FullName(), rf.Number())
+			}
+		case rm != nil || wm != nil:
+			// Messages and bytes share their encoding, but not their
+			// meaning.
+			return errors.Errorf("%v: field %v changes from %v to %v", reader.FullName(), rf.Number(), wf.Kind(), rf.Kind())
+		case protobufWireTypes[rf.Kind()] != protobufWireTypes[wf.Kind()]:
+			return errors.Errorf("%v: field %v changes from %v to %v", reader.FullName(), rf.Number(), wf.Kind(), rf.Kind())
+		}
+	}
+	return nil
+}
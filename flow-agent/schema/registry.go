@@ -0,0 +1,257 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned by the registry.
+var (
+	ErrExists   = errors.New("flow already has a schema")
+	ErrNotFound = errors.New("flow has no schema")
+)
+
+// InvalidError is returned when a schema does not parse.
+type InvalidError struct {
+	Err error
+}
+
+func (e *InvalidError) Error() string {
+	return e.Err.Error()
+}
+
+// IncompatibleError is returned when a new version breaks the
+// compatibility mode of its flow.
+type IncompatibleError struct {
+	Err error
+}
+
+func (e *IncompatibleError) Error() string {
+	return e.Err.Error()
+}
+
+// Subject is the schema of a flow with all its versions.
+type Subject struct {
+	Flow          string   `json:"flow"`
+	Compatibility string   `json:"compatibility"`
+	Validation    string   `json:"validation"`
+	Versions      []Schema `json:"versions"`
+}
+
+// Latest returns the current version.
+func (s Subject) Latest() Schema {
+	return s.Versions[len(s.Versions)-1]
+}
+
+// Version returns the version numbered n.
+func (s Subject) Version(n int) (Schema, bool) {
+	for _, version := range s.Versions {
+		if version.Version == n {
+			return version, true
+		}
+	}
+	return Schema{}, false
+}
+
+// Changes are what Register applies to the subject of a flow. Empty fields
+// are left as they are, or set to their default for new subjects.
+type Changes struct {
+	// Schema is registered as a new version, unless it has no
+	// definition or is the latest version already.
+	Schema        Schema
+	Compatibility string
+	Validation    string
+}
+
+// Registry keeps the subjects of the flows, each saved as
+// <dir>/<flow>.json. They are only kept in memory if dir is empty.
+type Registry struct {
+	dir        string
+	m          sync.Mutex
+	subjects   map[string]*Subject
+	validators map[string]*compiledVersion
+}
+
+type compiledVersion struct {
+	version   int
+	validator Validator
+}
+
+// NewRegistry returns a registry keeping its subjects in dir.
+func NewRegistry(dir string) *Registry {
+	return &Registry{dir: dir, subjects: map[string]*Subject{}, validators: map[string]*compiledVersion{}}
+}
+
+// Subject returns the subject of flow, reading it from disk the first
+// time.
+func (r *Registry) Subject(flow string) (Subject, bool, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	s, err := r.load(flow)
+	if err != nil || s == nil {
+		return Subject{}, false, err
+	}
+	return *s, true, nil
+}
+
+// Register creates the subject of flow, if create is set, or updates it.
+// A new version must be compatible with the latest one under the
+// compatibility mode the subject has after the changes.
+func (r *Registry) Register(flow string, changes Changes, create bool) (Subject, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	current, err := r.load(flow)
+	if err != nil {
+		return Subject{}, err
+	}
+	if create && current != nil {
+		return Subject{}, ErrExists
+	}
+
+	s := Subject{Flow: flow, Compatibility: Compatibilities[0], Validation: Validations[0]}
+	if current != nil {
+		s = *current
+		s.Versions = append([]Schema(nil), current.Versions...)
+	}
+	if changes.Compatibility != "" {
+		s.Compatibility = changes.Compatibility
+	}
+	if changes.Validation != "" {
+		s.Validation = changes.Validation
+	}
+
+	next := changes.Schema
+	switch {
+	case next.Definition == nil:
+		if current == nil {
+			return Subject{}, ErrNotFound
+		}
+	case current != nil && sameSchema(current.Latest(), next):
+		// Registering the latest version again changes nothing.
+	default:
+		if _, err := compile(next); err != nil {
+			return Subject{}, &InvalidError{Err: err}
+		}
+		if current != nil {
+			if err := Compatible(s.Compatibility, current.Latest(), next); err != nil {
+				return Subject{}, &IncompatibleError{Err: err}
+			}
+			next.Version = current.Latest().Version + 1
+		} else {
+			next.Version = 1
+		}
+		next.Created = time.Now().UTC()
+		s.Versions = append(s.Versions, next)
+	}
+
+	if err := r.save(s); err != nil {
+		return Subject{}, err
+	}
+	r.subjects[flow] = &s
+	return s, nil
+}
+
+// Validator returns the validator of the latest version of the schema of
+// flow, with the subject, and false if flow has no schema.
+func (r *Registry) Validator(flow string) (Validator, Subject, bool, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	s, err := r.load(flow)
+	if err != nil || s == nil {
+		return nil, Subject{}, false, err
+	}
+	latest := s.Latest()
+	if c, ok := r.validators[flow]; ok && c.version == latest.Version {
+		return c.validator, *s, true, nil
+	}
+	v, err := Compile(latest)
+	if err != nil {
+		return nil, Subject{}, false, errors.Wrapf(err, "schema version %v of %v", latest.Version, flow)
+	}
+	r.validators[flow] = &compiledVersion{version: latest.Version, validator: v}
+	return v, *s, true, nil
+}
+
+func sameSchema(a Schema, b Schema) bool {
+	return a.Type == b.Type && a.Message == b.Message && bytes.Equal(a.Definition, b.Definition)
+}
+
+// load returns the subject of flow, nil if it has none.
+func (r *Registry) load(flow string) (*Subject, error) {
+	if s, ok := r.subjects[flow]; ok {
+		return s, nil
+	}
+	if r.dir == "" {
+		return nil, nil
+	}
+	path, err := r.path(flow)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading schema")
+	}
+	s := &Subject{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrap(err, "decoding "+path)
+	}
+	if len(s.Versions) == 0 {
+		return nil, errors.Errorf("%v has no version", path)
+	}
+	r.subjects[flow] = s
+	return s, nil
+}
+
+// save writes s to its file, through a temporary file so a crash never
+// leaves it half written.
+func (r *Registry) save(s Subject) error {
+	if r.dir == "" {
+		return nil
+	}
+	path, err := r.path(s.Flow)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return errors.Wrap(err, "creating schema directory")
+	}
+	tmp, err := ioutil.TempFile(r.dir, ".schema")
+	if err != nil {
+		return errors.Wrap(err, "saving schema")
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "saving schema")
+	}
+	return nil
+}
+
+func (r *Registry) path(flow string) (string, error) {
+	if flow == "" || strings.ContainsAny(flow, `/\`) || strings.HasPrefix(flow, ".") {
+		return "", errors.Errorf("invalid flow name %q", flow)
+	}
+	return filepath.Join(r.dir, flow+".json"), nil
+}
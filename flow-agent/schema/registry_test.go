@@ -0,0 +1,148 @@
+package schema
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// tempRegistry returns a registry keeping its subjects in a new directory,
+// and a function removing it.
+func tempRegistry(t *testing.T) (*Registry, string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRegistry(dir), dir, func() { os.RemoveAll(dir) }
+}
+
+func jsonChanges(definition string) Changes {
+	return Changes{Schema: Schema{Type: TypeJSON, Definition: []byte(definition)}}
+}
+
+func TestRegisterVersions(t *testing.T) {
+	r, dir, remove := tempRegistry(t)
+	defer remove()
+	const flow = "orders.flow.unix.ar"
+
+	if _, err := r.Register(flow, Changes{Validation: DeadLetter}, false); err != ErrNotFound {
+		t.Errorf("updating a flow without schema gave %v, want %v", err, ErrNotFound)
+	}
+	s, err := r.Register(flow, jsonChanges(jsonOrder), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Latest().Version != 1 || s.Compatibility != Backward || s.Validation != Off {
+		t.Errorf("created %+v, want version 1, backward, off", s)
+	}
+	if _, err := r.Register(flow, jsonChanges(jsonOrderNamed), true); err != ErrExists {
+		t.Errorf("creating again gave %v, want %v", err, ErrExists)
+	}
+	if s, err = r.Register(flow, jsonChanges(jsonOrderNamed), false); err != nil {
+		t.Fatal(err)
+	}
+	// The latest version registered again is not a new one.
+	if s, err = r.Register(flow, jsonChanges(jsonOrderNamed), false); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = r.Register(flow, Changes{Validation: DeadLetter}, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Versions) != 2 || s.Latest().Version != 2 || s.Validation != DeadLetter {
+		t.Fatalf("subject %+v, want versions 1 and 2, dead-letter", s)
+	}
+	for i, version := range s.Versions {
+		if version.Version != i+1 {
+			t.Errorf("version %v at %v", version.Version, i)
+		}
+		if i > 0 && version.Created.Before(s.Versions[i-1].Created) {
+			t.Errorf("version %v created before version %v", version.Version, i)
+		}
+	}
+	if v, ok := s.Version(1); !ok || string(v.Definition) != jsonOrder {
+		t.Errorf("version 1 is %s, %v", v.Definition, ok)
+	}
+	if _, ok := s.Version(3); ok {
+		t.Error("version 3 found")
+	}
+
+	// The subject is read back from its file by another registry, and
+	// validates with its latest version.
+	saved, ok, err := NewRegistry(dir).Subject(flow)
+	if err != nil || !ok {
+		t.Fatalf("subject not read back: %v", err)
+	}
+	if len(saved.Versions) != 2 || saved.Validation != DeadLetter {
+		t.Errorf("read back %+v", saved)
+	}
+	v, _, ok, err := NewRegistry(dir).Validator(flow)
+	if err != nil || !ok {
+		t.Fatalf("no validator: %v", err)
+	}
+	if err := v.Validate([]byte(`{"id": 7, "name": 3}`)); err == nil {
+		t.Error("event validated against version 1, not the latest")
+	}
+	if _, ok, err := r.Subject("customers.flow.unix.ar"); ok || err != nil {
+		t.Errorf("flow without schema found, %v", err)
+	}
+}
+
+func TestRegisterCompatibility(t *testing.T) {
+	r, _, remove := tempRegistry(t)
+	defer remove()
+	const flow = "orders.flow.unix.ar"
+	if _, err := r.Register(flow, jsonChanges(jsonOrder), true); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := r.Register(flow, jsonChanges(jsonOrderRequired), false)
+	if _, ok := err.(*IncompatibleError); !ok {
+		t.Fatalf("incompatible version gave %v", err)
+	}
+	_, err = r.Register(flow, Changes{Schema: Schema{Type: TypeJSON, Definition: []byte(`{"type": 7}`)}}, false)
+	if _, ok := err.(*InvalidError); !ok {
+		t.Fatalf("invalid version gave %v", err)
+	}
+	if s, _, _ := r.Subject(flow); len(s.Versions) != 1 {
+		t.Fatalf("refused versions registered: %+v", s)
+	}
+
+	// The compatibility mode a version is checked under is the one it
+	// is registered with, and is kept for the next ones.
+	_, err = r.Register(flow, Changes{Schema: Schema{Type: TypeJSON, Definition: []byte(jsonOrderRequired)}, Compatibility: Forward}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Register(flow, jsonChanges(jsonOrderNamed), false)
+	if _, ok := err.(*IncompatibleError); !ok {
+		t.Fatalf("version breaking forward compatibility gave %v", err)
+	}
+	s, err := r.Register(flow, Changes{Schema: Schema{Type: TypeAvro, Definition: []byte(avroOrder)}, Compatibility: None}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Latest().Version != 3 || s.Latest().Type != TypeAvro || s.Compatibility != None {
+		t.Errorf("subject %+v, want avro version 3 under none", s)
+	}
+}
+
+func TestRegisterInMemory(t *testing.T) {
+	r := NewRegistry("")
+	if _, err := r.Register("orders.flow.unix.ar", jsonChanges(jsonOrder), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := r.Subject("orders.flow.unix.ar"); !ok || err != nil {
+		t.Errorf("subject not kept in memory: %v", err)
+	}
+}
+
+func TestRegisterFlowNames(t *testing.T) {
+	r, _, remove := tempRegistry(t)
+	defer remove()
+	for _, flow := range []string{"", "../orders", "orders/flow", `orders\flow`, ".hidden"} {
+		if _, err := r.Register(flow, jsonChanges(jsonOrder), true); err == nil {
+			t.Errorf("schema of %q registered", flow)
+		}
+	}
+}
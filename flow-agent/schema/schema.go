@@ -0,0 +1,161 @@
+// Package schema keeps the schemas events of flows are described with.
+// A flow gets a schema when it is created and new versions when it is
+// updated, each checked for compatibility with the previous one so the
+// consumers of the flow keep being able to read it. Schemas are JSON
+// Schema documents, Avro schemas or Protobuf descriptor sets.
+package schema
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Schema types.
+const (
+	TypeJSON     = "json"
+	TypeAvro     = "avro"
+	TypeProtobuf = "protobuf"
+)
+
+// Types lists the schema types events can be described with.
+var Types = []string{TypeJSON, TypeAvro, TypeProtobuf}
+
+// Compatibility modes, telling what a new version must be compatible with
+// the previous one for.
+const (
+	// Backward versions read the events written with the previous one,
+	// so consumers upgrade first.
+	Backward = "backward"
+	// Forward versions write events the previous one reads, so
+	// producers upgrade first.
+	Forward = "forward"
+	// Full versions are both backward and forward compatible.
+	Full = "full"
+	// None skips the check.
+	None = "none"
+)
+
+// Compatibilities lists the compatibility modes, the first one being the
+// default.
+var Compatibilities = []string{Backward, Forward, Full, None}
+
+// Validation policies, telling what the bridge processor does with the
+// events that do not conform to the schema of their flow.
+const (
+	// Off lets every event through.
+	Off = "off"
+	// Drop discards non-conforming events.
+	Drop = "drop"
+	// DeadLetter moves non-conforming events to the dead-letter flow.
+	DeadLetter = "dead-letter"
+)
+
+// Validations lists the validation policies, the first one being the
+// default.
+var Validations = []string{Off, Drop, DeadLetter}
+
+// Schema is a version of the schema of a flow.
+type Schema struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	// Message is the fully qualified name of the message events are, for
+	// Protobuf descriptor sets.
+	Message    string    `json:"message,omitempty"`
+	Definition []byte    `json:"definition"`
+	Created    time.Time `json:"created"`
+}
+
+// Validator checks events against a schema.
+type Validator interface {
+	// Validate returns why event does not conform to the schema, if it
+	// does not.
+	Validate(event []byte) error
+}
+
+// checker is a parsed schema, able to validate events and to tell
+// whether the events written with another schema of its type read with
+// it.
+type checker interface {
+	Validator
+	// reads returns why the events of writer cannot be read with the
+	// schema, if they cannot.
+	reads(writer checker) error
+}
+
+// Compile parses the definition of s.
+func Compile(s Schema) (Validator, error) {
+	return compile(s)
+}
+
+func compile(s Schema) (checker, error) {
+	var (
+		c   checker
+		err error
+	)
+	switch s.Type {
+	case TypeJSON:
+		c, err = compileJSON(s.Definition)
+	case TypeAvro:
+		c, err = compileAvro(s.Definition)
+	case TypeProtobuf:
+		c, err = compileProtobuf(s.Definition, s.Message)
+	default:
+		return nil, errors.Errorf("unknown schema type %q, use %v", s.Type, strings.Join(Types, ", "))
+	}
+	return c, errors.Wrapf(err, "invalid %v schema", s.Type)
+}
+
+// Compatible returns why next cannot follow previous under the
+// compatibility mode, if it cannot. Schemas of different types are only
+// compatible under None.
+func Compatible(mode string, previous Schema, next Schema) error {
+	if mode == None {
+		return nil
+	}
+	if previous.Type != next.Type {
+		return errors.Errorf("schema type changes from %v to %v", previous.Type, next.Type)
+	}
+	old, err := compile(previous)
+	if err != nil {
+		return errors.Wrapf(err, "version %v", previous.Version)
+	}
+	c, err := compile(next)
+	if err != nil {
+		return err
+	}
+	if mode == Backward || mode == Full {
+		if err := c.reads(old); err != nil {
+			return errors.Wrapf(err, "not backward compatible with version %v", previous.Version)
+		}
+	}
+	if mode == Forward || mode == Full {
+		if err := old.reads(c); err != nil {
+			return errors.Wrapf(err, "not forward compatible with version %v", previous.Version)
+		}
+	}
+	return nil
+}
+
+// ParseCompatibility checks a compatibility mode, defaulting to Backward.
+func ParseCompatibility(mode string) (string, error) {
+	return parseChoice("compatibility", mode, Compatibilities)
+}
+
+// ParseValidation checks a validation policy, defaulting to Off.
+func ParseValidation(policy string) (string, error) {
+	return parseChoice("validation", policy, Validations)
+}
+
+func parseChoice(what string, value string, choices []string) (string, error) {
+	if value == "" {
+		return choices[0], nil
+	}
+	for _, choice := range choices {
+		if strings.EqualFold(value, choice) {
+			return choice, nil
+		}
+	}
+	return "", errors.Errorf("unknown %v %q, use %v", what, value, strings.Join(choices, ", "))
+}
@@ -0,0 +1,196 @@
+package schema
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// descriptorSet returns a descriptor set with the message Order of package
+// shop, made of fields.
+func descriptorSet(t *testing.T, fields ...*descriptorpb.FieldDescriptorProto) []byte {
+	t.Helper()
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:        proto.String("order.proto"),
+		Package:     proto.String("shop"),
+		Syntax:      proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Order"), Field: fields}},
+	}}}
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// field returns an optional field of a proto3 message.
+func field(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{
+		Name:     proto.String(name),
+		JsonName: proto.String(name),
+		Number:   proto.Int32(number),
+		Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:     kind.Enum(),
+	}
+}
+
+const (
+	jsonOrder         = `{"type": "object", "properties": {"id": {"type": "integer"}}, "required": ["id"]}`
+	jsonOrderNamed    = `{"type": "object", "properties": {"id": {"type": "integer"}, "name": {"type": "string"}}, "required": ["id"]}`
+	jsonOrderRequired = `{"type": "object", "properties": {"id": {"type": "integer"}, "name": {"type": "string"}}, "required": ["id", "name"]}`
+	jsonOrderText     = `{"type": "object", "properties": {"id": {"type": "string"}}, "required": ["id"]}`
+	jsonOrderClosed   = `{"type": "object", "properties": {"id": {"type": "integer"}}, "required": ["id"], "additionalProperties": false}`
+
+	avroOrder         = `{"type": "record", "name": "Order", "namespace": "shop", "fields": [{"name": "id", "type": "long"}, {"name": "name", "type": "string"}]}`
+	avroOrderInt      = `{"type": "record", "name": "Order", "namespace": "shop", "fields": [{"name": "id", "type": "int"}, {"name": "name", "type": "string"}]}`
+	avroOrderDefault  = `{"type": "record", "name": "Order", "namespace": "shop", "fields": [{"name": "id", "type": "long"}, {"name": "name", "type": "string"}, {"name": "note", "type": "string", "default": ""}]}`
+	avroOrderRequired = `{"type": "record", "name": "Order", "namespace": "shop", "fields": [{"name": "id", "type": "long"}, {"name": "name", "type": "string"}, {"name": "note", "type": "string"}]}`
+	avroOrderRenamed  = `{"type": "record", "name": "Purchase", "namespace": "shop", "fields": [{"name": "id", "type": "long"}, {"name": "name", "type": "string"}]}`
+)
+
+func TestValidate(t *testing.T) {
+	protobuf := descriptorSet(t,
+		field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+		field("name", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+	)
+	tests := []struct {
+		name   string
+		schema Schema
+		event  string
+		valid  bool
+	}{
+		{"json", Schema{Type: TypeJSON, Definition: []byte(jsonOrder)}, `{"id": 7}`, true},
+		{"json extra property", Schema{Type: TypeJSON, Definition: []byte(jsonOrder)}, `{"id": 7, "name": "Ana"}`, true},
+		{"json missing required", Schema{Type: TypeJSON, Definition: []byte(jsonOrder)}, `{"name": "Ana"}`, false},
+		{"json wrong type", Schema{Type: TypeJSON, Definition: []byte(jsonOrder)}, `{"id": "7"}`, false},
+		{"json not json", Schema{Type: TypeJSON, Definition: []byte(jsonOrder)}, `id=7`, false},
+		{"json trailing data", Schema{Type: TypeJSON, Definition: []byte(jsonOrder)}, `{"id": 7} {"id": 8}`, false},
+		{"json closed", Schema{Type: TypeJSON, Definition: []byte(jsonOrderClosed)}, `{"id": 7, "name": "Ana"}`, false},
+
+		// Avro datums: id 7 as a zigzag long, then "Ana" prefixed by its
+		// length.
+		{"avro", Schema{Type: TypeAvro, Definition: []byte(avroOrder)}, "\x0e\x06Ana", true},
+		{"avro truncated", Schema{Type: TypeAvro, Definition: []byte(avroOrder)}, "\x0e\x06An", false},
+		{"avro missing field", Schema{Type: TypeAvro, Definition: []byte(avroOrder)}, "\x0e", false},
+		{"avro trailing bytes", Schema{Type: TypeAvro, Definition: []byte(avroOrder)}, "\x0e\x06Ana\x00", false},
+
+		// Protobuf messages: field 1 as a varint, field 2 length
+		// delimited.
+		{"protobuf", Schema{Type: TypeProtobuf, Message: "shop.Order", Definition: protobuf}, "\x08\x07\x12\x03Ana", true},
+		{"protobuf empty", Schema{Type: TypeProtobuf, Message: "shop.Order", Definition: protobuf}, "", true},
+		{"protobuf truncated", Schema{Type: TypeProtobuf, Message: "shop.Order", Definition: protobuf}, "\x08\x07\x12\x05Ana", false},
+		{"protobuf invalid string", Schema{Type: TypeProtobuf, Message: "shop.Order", Definition: protobuf}, "\x12\x03\xff\xfe\xfd", false},
+	}
+	for _, test := range tests {
+		v, err := Compile(test.schema)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if err := v.Validate([]byte(test.event)); (err == nil) != test.valid {
+			t.Errorf("%v: validated with %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestCompileRejects(t *testing.T) {
+	protobuf := descriptorSet(t, field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64))
+	tests := map[string]Schema{
+		"unknown type":           {Type: "xml", Definition: []byte(`<order/>`)},
+		"json not json":          {Type: TypeJSON, Definition: []byte(`{"type": `)},
+		"json invalid keyword":   {Type: TypeJSON, Definition: []byte(`{"type": 7}`)},
+		"json remote reference":  {Type: TypeJSON, Definition: []byte(`{"$ref": "http://example.com/order.json"}`)},
+		"avro not json":          {Type: TypeAvro, Definition: []byte(`{"type": `)},
+		"avro unknown type":      {Type: TypeAvro, Definition: []byte(`{"type": "decimal128"}`)},
+		"avro record no fields":  {Type: TypeAvro, Definition: []byte(`{"type": "record", "name": "Order"}`)},
+		"protobuf no message":    {Type: TypeProtobuf, Definition: protobuf},
+		"protobuf not a set":     {Type: TypeProtobuf, Message: "shop.Order", Definition: []byte("\xff\xff")},
+		"protobuf other message": {Type: TypeProtobuf, Message: "shop.Invoice", Definition: protobuf},
+		"protobuf not a message": {Type: TypeProtobuf, Message: "shop.Order.id", Definition: protobuf},
+	}
+	for name, s := range tests {
+		if _, err := Compile(s); err == nil {
+			t.Errorf("%v: compiled", name)
+		}
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	protobuf := descriptorSet(t, field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64))
+	protobufNamed := descriptorSet(t,
+		field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+		field("name", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+	)
+	protobufText := descriptorSet(t, field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING))
+	protobufUnsigned := descriptorSet(t, field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_UINT64))
+	protobufZigzag := descriptorSet(t, field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_SINT64))
+
+	js := func(definition string) Schema {
+		return Schema{Version: 1, Type: TypeJSON, Definition: []byte(definition)}
+	}
+	avro := func(definition string) Schema {
+		return Schema{Version: 1, Type: TypeAvro, Definition: []byte(definition)}
+	}
+	pb := func(definition []byte) Schema {
+		return Schema{Version: 1, Type: TypeProtobuf, Message: "shop.Order", Definition: definition}
+	}
+
+	// Whether next follows previous under backward and forward
+	// compatibility; full needs both and none neither.
+	tests := []struct {
+		name           string
+		previous, next Schema
+		backward       bool
+		forward        bool
+	}{
+		{"json same", js(jsonOrder), js(jsonOrder), true, true},
+		{"json optional property", js(jsonOrder), js(jsonOrderNamed), true, true},
+		{"json required property", js(jsonOrder), js(jsonOrderRequired), false, true},
+		{"json dropped requirement", js(jsonOrderRequired), js(jsonOrder), true, false},
+		{"json changed type", js(jsonOrder), js(jsonOrderText), false, false},
+		{"json closed", js(jsonOrder), js(jsonOrderClosed), false, true},
+
+		{"avro field with default", avro(avroOrder), avro(avroOrderDefault), true, true},
+		{"avro field without default", avro(avroOrder), avro(avroOrderRequired), false, true},
+		{"avro promoted", avro(avroOrderInt), avro(avroOrder), true, false},
+		{"avro renamed", avro(avroOrder), avro(avroOrderRenamed), false, false},
+
+		{"protobuf new field", pb(protobuf), pb(protobufNamed), true, true},
+		{"protobuf same wire type", pb(protobuf), pb(protobufUnsigned), true, true},
+		{"protobuf other wire type", pb(protobuf), pb(protobufZigzag), false, false},
+		{"protobuf changed type", pb(protobuf), pb(protobufText), false, false},
+
+		{"other schema type", js(jsonOrder), avro(avroOrder), false, false},
+	}
+	for _, test := range tests {
+		for mode, want := range map[string]bool{
+			Backward: test.backward,
+			Forward:  test.forward,
+			Full:     test.backward && test.forward,
+			None:     true,
+		} {
+			if err := Compatible(mode, test.previous, test.next); (err == nil) != want {
+				t.Errorf("%v under %v: %v, want compatible %v", test.name, mode, err, want)
+			}
+		}
+	}
+}
+
+func TestParseChoices(t *testing.T) {
+	if mode, err := ParseCompatibility(""); err != nil || mode != Backward {
+		t.Errorf("default compatibility %q, %v", mode, err)
+	}
+	if mode, err := ParseCompatibility("FULL"); err != nil || mode != Full {
+		t.Errorf("FULL parsed as %q, %v", mode, err)
+	}
+	if policy, err := ParseValidation(""); err != nil || policy != Off {
+		t.Errorf("default validation %q, %v", policy, err)
+	}
+	if _, err := ParseCompatibility("transitive"); err == nil {
+		t.Error("unknown compatibility parsed")
+	}
+	if _, err := ParseValidation("reject"); err == nil {
+		t.Error("unknown validation parsed")
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"broker"
+	"flow-agent/config"
+	"log"
+	"strconv"
+)
+
+// contentModeOption reads the "CLOUDEVENTS <mode>" option of a CREATE
+// FLOW or UPDATE FLOW command. ok is false if there is none.
+func contentModeOption(line string) (mode string, ok bool, err error) {
+	option, found := commandOption(line, "CLOUDEVENTS")
+	if !found {
+		return "", false, nil
+	}
+	if mode, err = broker.ParseContentMode(option); err != nil {
+		return "", false, replyError(CodeSyntax, "Unknown CloudEvents content mode "+option, err)
+	}
+	return mode, true, nil
+}
+
+// flowContentMode returns the CloudEvents content mode of flow, Plain
+// unless it is configured.
+func flowContentMode(cfg config.Config, flow string) string {
+	if f, ok := cfg.Flow(flow); ok && f.CloudEvents != "" {
+		return f.CloudEvents
+	}
+	return broker.Plain
+}
+
+// setContentMode sets the CloudEvents content mode of flow, which must
+// belong to a local namespace, and saves it in the configuration file.
+func (e *Endpoint) setContentMode(cfg config.Config, flow string, mode string) error {
+	err := e.saveFlow(cfg, flow, func(f *config.Flow) {
+		f.CloudEvents = ""
+		if mode != broker.Plain {
+			f.CloudEvents = mode
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Flow %v in CloudEvents content mode %v", flow, flowContentMode(e.Config(), flow))
+	return nil
+}
+
+// saveFlow applies change to the settings of flow, which must belong to a
+// local namespace, and saves them in the configuration file.
+func (e *Endpoint) saveFlow(cfg config.Config, flow string, change func(f *config.Flow)) error {
+	namespace, ok := flowNamespace(cfg, flow)
+	if !ok {
+		return replyError(CodeNotFound, "Flow "+flow+" is not in a namespace of this FNAA", nil)
+	}
+	f, ok := e.Config().Flow(flow)
+	if !ok {
+		f = config.Flow{Uri: flow}
+	}
+	f.Namespace = namespace.Name
+	change(&f)
+	old := e.Config()
+	e.setFlow(f)
+	// Processors of the flow copying with what changed start again.
+	e.reloadProcessors(old, e.Config())
+
+	if e.ConfigFile != "" {
+		if err := config.SaveFlow(e.ConfigFile, f); err != nil {
+			// The running configuration has it already, so it is kept
+			// until the next reload rather than failing the command.
+			log.Println("Error: flow not saved,", err)
+		}
+	}
+	return nil
+}
+
+// setFlow adds flow to the running configuration, replacing the one with
+// the same URI if any.
+func (e *Endpoint) setFlow(flow config.Flow) {
+	e.cm.Lock()
+	defer e.cm.Unlock()
+	flows := make([]config.Flow, 0, len(e.cfg.Flows)+1)
+	for _, f := range e.cfg.Flows {
+		if f.Uri != flow.Uri {
+			flows = append(flows, f)
+		}
+	}
+	e.cfg.Flows = append(flows, flow)
+}
+
+// asCloudEvent wraps out, the copy of m, an event of flow, in mode unless
+// m is a CloudEvent already, in which case its attributes, source
+// included, are kept as they are. The event ID is the position of m in
+// flow.
+func asCloudEvent(m broker.Message, out broker.Message, flow string, mode string) (broker.Message, error) {
+	if mode == broker.Plain || broker.ContentMode(m) != broker.Plain {
+		return out, nil
+	}
+	return broker.Wrap(out, mode, broker.CloudEvent{
+		ID:              strconv.Itoa(m.Partition) + "-" + strconv.FormatInt(m.Offset, 10),
+		Source:          flow,
+		Type:            broker.DefaultEventType,
+		Time:            m.Time,
+		DataContentType: broker.DataContentType(out.Value),
+	})
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"broker"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delivery modes of a subscription. At least once, the default, may copy
+// an event twice when a write is retried after the broker stored it, or
+// when the processor starts again. Exactly once tags each copy with the
+// position of the event in the source flow, its ID, and the epoch of the
+// copies, bumped by rewinds. The processor commits to the broker of the
+// source flow, as the consumer group fnaa.<subscription>, the offsets it
+// copied up to with the epoch. Before starting, and before retrying a
+// write, it reads back the copies made in the subscription and its
+// dead-letter flow since the last commit, and skips the events of the
+// current epoch already there. Kafka transactions would avoid reading
+// them back, but the client the kafka driver uses does not produce
+// transactionally.
+const (
+	atLeastOnce = "at-least-once"
+	exactlyOnce = "exactly-once"
+)
+
+// deliveryMode reads the "DELIVERY AT-LEAST-ONCE|EXACTLY-ONCE" option of a
+// SUBSCRIBE command, at least once if there is none.
+func deliveryMode(line string) (string, error) {
+	mode, ok := commandOption(line, "DELIVERY")
+	if !ok {
+		return atLeastOnce, nil
+	}
+	switch mode = strings.ToLower(mode); mode {
+	case atLeastOnce, exactlyOnce:
+		return mode, nil
+	}
+	return "", replyError(CodeSyntax, "Unknown delivery "+mode+", use AT-LEAST-ONCE or EXACTLY-ONCE", nil)
+}
+
+// commitInterval is how often processors delivering exactly once commit
+// their progress, if they copied events since the last time.
+var commitInterval = time.Second
+
+// checkpoint is the metadata of the progress processors delivering exactly
+// once commit, with the offsets of the source flow copied up to: the epoch
+// of the copies, and where the subscription and its dead-letter flow ended
+// then. Copies of the events after the offsets committed are past those
+// ends, so resuming only reads them back from there.
+type checkpoint struct {
+	Epoch       int           `json:"epoch"`
+	Copies      map[int]int64 `json:"copies"`
+	DeadLetters map[int]int64 `json:"dead-letters"`
+}
+
+// group names the consumer group the progress of the processor is
+// committed as.
+func (p *processor) group() string {
+	return "fnaa." + p.dst.Flow
+}
+
+// committer returns the driver of the broker of d if it keeps commits.
+func committer(d broker.Descriptor) (broker.Committer, bool) {
+	driver, err := broker.Open(d)
+	if err != nil {
+		return nil, false
+	}
+	c, ok := driver.(broker.Committer)
+	return c, ok
+}
+
+// copied maps the epochs of the copies of the source flow in the flow of d
+// to where each partition of the source was copied up to, reading the
+// flow from the offsets in from, or from the beginning. A flow without
+// topic has no copies.
+func (p *processor) copied(ctx context.Context, d broker.Descriptor, from map[int]int64) (map[int]map[int]int64, error) {
+	epochs := map[int]map[int]int64{}
+	driver, err := broker.Open(d)
+	if err != nil {
+		return nil, err
+	}
+	opts := p.opts
+	opts.Start, opts.Follow, opts.Offsets = broker.Beginning, false, from
+	consumer, err := driver.Consumer(ctx, d, opts)
+	if broker.IsNoTopic(err) {
+		return epochs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	for {
+		m, err := consumer.Next(ctx)
+		if err == io.EOF {
+			return epochs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if source, _ := m.Header(broker.HeaderSource); string(source) != p.src.Flow {
+			continue
+		}
+		epoch, err1 := strconv.Atoi(header(m, broker.HeaderEpoch))
+		partition, err2 := strconv.Atoi(header(m, broker.HeaderPartition))
+		offset, err3 := strconv.ParseInt(header(m, broker.HeaderOffset), 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			// Not an exactly-once copy.
+			continue
+		}
+		if epochs[epoch] == nil {
+			epochs[epoch] = map[int]int64{}
+		}
+		if offset+1 > epochs[epoch][partition] {
+			epochs[epoch][partition] = offset + 1
+		}
+	}
+}
+
+// committed returns the offsets of the source flow the processor last
+// committed, and the checkpoint committed with them. Brokers that do not
+// keep commits have none.
+func (p *processor) committed(ctx context.Context) (map[int]int64, checkpoint, error) {
+	var cp checkpoint
+	c, ok := committer(p.src)
+	if !ok {
+		return nil, cp, nil
+	}
+	progress, err := c.Committed(ctx, p.src, p.opts, p.group())
+	if err != nil || progress.Metadata == "" {
+		return progress.Offsets, cp, err
+	}
+	if err := json.Unmarshal([]byte(progress.Metadata), &cp); err != nil {
+		// The copies are all read back instead.
+		log.Printf("Error: ignoring the progress committed by %v in %v: %v", p.group(), p.src.Flow, err)
+		return nil, checkpoint{}, nil
+	}
+	return progress.Offsets, cp, nil
+}
+
+// since returns where to read the copies in the flow of d from: the ends
+// committed, except in partitions holding less events now, the flow having
+// been purged since.
+func since(ctx context.Context, d broker.Descriptor, opts broker.Options, ends map[int]int64) (map[int]int64, error) {
+	c, ok := committer(d)
+	if !ok || len(ends) == 0 {
+		return nil, nil
+	}
+	now, err := c.Ends(ctx, d, opts)
+	if err != nil {
+		return nil, err
+	}
+	from := map[int]int64{}
+	for partition, end := range ends {
+		if end <= now[partition] {
+			from[partition] = end
+		}
+	}
+	return from, nil
+}
+
+// resume makes the processor start after the events of the current epoch
+// it committed, or found in the subscription or its dead-letter flow past
+// what it committed, starting a new epoch after a rewind. Nothing changes
+// if the processor was rewound since the bridge of generation started.
+func (p *processor) resume(ctx context.Context, generation int) error {
+	offsets, cp, err := p.committed(ctx)
+	if err != nil {
+		return err
+	}
+	found := map[int]map[int]int64{cp.Epoch: {}}
+	for partition, next := range offsets {
+		found[cp.Epoch][partition] = next
+	}
+	ends := map[string]map[int]int64{p.dst.Flow: cp.Copies, p.deadLetter.Flow: cp.DeadLetters}
+	for _, d := range []broker.Descriptor{p.dst, p.deadLetter} {
+		from, err := since(ctx, d, p.opts, ends[d.Flow])
+		if err != nil {
+			return err
+		}
+		ends[d.Flow] = from
+		epochs, err := p.copied(ctx, d, from)
+		if err != nil {
+			return err
+		}
+		for epoch, offsets := range epochs {
+			if found[epoch] == nil {
+				found[epoch] = map[int]int64{}
+			}
+			for partition, next := range offsets {
+				if next > found[epoch][partition] {
+					found[epoch][partition] = next
+				}
+			}
+		}
+	}
+
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	if p.generation != generation {
+		return nil
+	}
+	p.ends = ends
+	for epoch := range found {
+		if epoch > p.epoch {
+			p.epoch = epoch
+		}
+	}
+	if p.newEpoch {
+		p.epoch++
+		p.newEpoch = false
+		return nil
+	}
+	for partition, next := range found[p.epoch] {
+		if offset, ok := p.offsets[partition]; !ok || next > offset {
+			p.offsets[partition] = next
+		}
+	}
+	return nil
+}
+
+// commit records in the broker of the source flow where the bridge of
+// generation copied it up to, in which epoch, and where the subscription
+// and its dead-letter flow end. It is called between events, so the
+// copies of those committed are all before these ends.
+func (p *processor) commit(ctx context.Context, generation int) error {
+	c, ok := committer(p.src)
+	if !ok {
+		return nil
+	}
+	p.sm.Lock()
+	if p.generation != generation {
+		p.sm.Unlock()
+		return nil
+	}
+	cp := checkpoint{Epoch: p.epoch}
+	offsets := map[int]int64{}
+	for partition, offset := range p.offsets {
+		offsets[partition] = offset
+	}
+	p.sm.Unlock()
+
+	ends := map[string]map[int]int64{}
+	for _, d := range []broker.Descriptor{p.dst, p.deadLetter} {
+		if c, ok := committer(d); ok {
+			end, err := c.Ends(ctx, d, p.opts)
+			if err != nil {
+				return err
+			}
+			ends[d.Flow] = end
+		}
+	}
+	cp.Copies, cp.DeadLetters = ends[p.dst.Flow], ends[p.deadLetter.Flow]
+	// Every partition is committed, so none keeps the checkpoint of an
+	// earlier epoch; -1 commits no offset.
+	partitions, err := c.Ends(ctx, p.src, p.opts)
+	if err != nil {
+		return err
+	}
+	for partition := range partitions {
+		if _, ok := offsets[partition]; !ok {
+			offsets[partition] = -1
+		}
+	}
+	metadata, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := c.Commit(ctx, p.src, p.opts, p.group(), broker.Progress{Offsets: offsets, Metadata: string(metadata)}); err != nil {
+		return err
+	}
+
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	if p.generation == generation {
+		p.ends = ends
+	}
+	return nil
+}
+
+// stored reports whether the copy of m made in the current epoch is in
+// the flow of d already, reading the copies made since the last commit.
+func (p *processor) stored(ctx context.Context, d broker.Descriptor, m broker.Message) (bool, error) {
+	p.sm.Lock()
+	from, epoch := p.ends[d.Flow], p.epoch
+	p.sm.Unlock()
+	epochs, err := p.copied(ctx, d, from)
+	if err != nil {
+		return false, err
+	}
+	next, ok := epochs[epoch][m.Partition]
+	return ok && next > m.Offset, nil
+}
+
+// uncertainError is the error of a write that failed and may have been
+// stored after all, checking it having failed too. The event is neither
+// written again nor dead-lettered: the bridge starts again, and resuming
+// tells whether it was.
+type uncertainError struct {
+	err error
+}
+
+func (e *uncertainError) Error() string {
+	return "could not tell whether a failed write was stored: " + e.err.Error()
+}
+
+// tag sets the headers of exactly-once copies on out, a copy of m.
+func (p *processor) tag(out broker.Message, m broker.Message) broker.Message {
+	p.sm.Lock()
+	epoch := p.epoch
+	p.sm.Unlock()
+	out.Headers = append(broker.Redelivery(out).Headers,
+		broker.Header{Key: broker.HeaderSource, Value: []byte(p.src.Flow)},
+		broker.Header{Key: broker.HeaderPartition, Value: []byte(strconv.Itoa(m.Partition))},
+		broker.Header{Key: broker.HeaderOffset, Value: []byte(strconv.FormatInt(m.Offset, 10))},
+		broker.Header{Key: broker.HeaderEpoch, Value: []byte(strconv.Itoa(epoch))},
+	)
+	return out
+}
+
+func header(m broker.Message, key string) string {
+	value, _ := m.Header(key)
+	return string(value)
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"broker"
+	"context"
+	"crypto/ed25519"
+	"flow-agent/config"
+	"flow-agent/schema"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testSource       = "orders.flow.unix.ar"
+	testSubscription = "fnaa-emiliano-ar.orders.flow.unix.ar"
+)
+
+// memoryFlow describes flow as kept by the memory driver.
+func memoryFlow(flow string) broker.Descriptor {
+	return broker.Descriptor{Flow: flow, Type: "memory", Topic: flow, Servers: []string{"memory"}}
+}
+
+// newMemory registers a memory driver with 3 partitions per topic, and
+// publishes n events to the source flow.
+func newMemory(t *testing.T, n int) *broker.Memory {
+	t.Helper()
+	mem := broker.NewMemory()
+	mem.Partitions = 3
+	broker.Register("memory", mem)
+	publish(t, mem, 0, n)
+	return mem
+}
+
+// publish writes the events numbered from to to-1 to the source flow.
+func publish(t *testing.T, mem *broker.Memory, from int, to int) {
+	t.Helper()
+	producer, err := mem.Producer(context.Background(), memoryFlow(testSource), broker.Options{CreateTopics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := from; i < to; i++ {
+		m := broker.Message{Key: []byte("order-" + strconv.Itoa(i)), Value: []byte(`{"id":` + strconv.Itoa(i) + `}`)}
+		if err := producer.Produce(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testProcessor returns a processor copying the source flow, exactly
+// once and from its beginning, as it is after the FNAA starts.
+func testProcessor() *processor {
+	return &processor{
+		src:        memoryFlow(testSource),
+		dst:        memoryFlow(testSubscription),
+		deadLetter: memoryFlow(broker.DeadLetterFlow(testSubscription)),
+		schemas:    schema.NewRegistry(""),
+		opts:       broker.Options{CreateTopics: true},
+		retry:      config.Retry{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond},
+		mode:       func() string { return broker.Plain },
+		ordering:   func() string { return broker.PerKey },
+		loadSigningKey: func() (string, ed25519.PrivateKey, error) {
+			return "", nil, nil
+		},
+		signingKeys: func(ctx context.Context, namespace string) ([]ed25519.PublicKey, error) {
+			return nil, nil
+		},
+		done:     make(chan struct{}),
+		delivery: exactlyOnce,
+		from:     position{start: broker.Beginning},
+		offsets:  map[int]int64{},
+	}
+}
+
+func stop(p *processor) {
+	p.cancel()
+	<-p.done
+}
+
+// waitCopies waits for n events in the subscription.
+func waitCopies(t *testing.T, mem *broker.Memory, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mem.Messages(testSubscription)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v events copied, want %v", len(mem.Messages(testSubscription)), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give a duplicate the time to show up.
+	time.Sleep(50 * time.Millisecond)
+}
+
+// checkCopies checks that the subscription has a single copy of each of
+// the n events of the source flow in each of epochs, and that none was
+// dead-lettered.
+func checkCopies(t *testing.T, mem *broker.Memory, n int, epochs int) {
+	t.Helper()
+	seen := map[string]int{}
+	for _, m := range mem.Messages(testSubscription) {
+		seen[header(m, broker.HeaderEpoch)+"/"+header(m, broker.HeaderPartition)+"/"+header(m, broker.HeaderOffset)]++
+	}
+	for id, copies := range seen {
+		if copies != 1 {
+			t.Errorf("event %v copied %v times", id, copies)
+		}
+	}
+	if len(seen) != n*epochs {
+		t.Errorf("%v events copied, want %v", len(seen), n*epochs)
+	}
+	if dead := mem.Messages(broker.DeadLetterFlow(testSubscription)); len(dead) > 0 {
+		t.Errorf("%v events dead-lettered", len(dead))
+	}
+}
+
+func TestExactlyOnceCrash(t *testing.T) {
+	mem := newMemory(t, 30)
+	first := testProcessor()
+	// The FNAA stops right after the broker stored the 10th copy, before
+	// the processor learns about it or commits anything.
+	var writes int32
+	mem.Faults = func(topic string, m broker.Message) broker.Fault {
+		if topic == testSubscription && atomic.AddInt32(&writes, 1) == 10 {
+			first.cancel()
+			return broker.Unacknowledged
+		}
+		return broker.Store
+	}
+	first.start()
+	<-first.done
+	if copies := len(mem.Messages(testSubscription)); copies != 10 {
+		t.Fatalf("%v events copied before the crash, want 10", copies)
+	}
+
+	second := testProcessor()
+	second.start()
+	defer stop(second)
+	waitCopies(t, mem, 30)
+	checkCopies(t, mem, 30, 1)
+}
+
+func TestExactlyOnceResumesFromCommit(t *testing.T) {
+	defer func(interval time.Duration) { commitInterval = interval }(commitInterval)
+	commitInterval = 0
+	mem := newMemory(t, 20)
+
+	first := testProcessor()
+	first.start()
+	waitCopies(t, mem, 20)
+	stop(first)
+
+	publish(t, mem, 20, 25)
+	reads := mem.Reads(testSubscription)
+	second := testProcessor()
+	second.start()
+	defer stop(second)
+	waitCopies(t, mem, 25)
+	checkCopies(t, mem, 25, 1)
+	// Everything copied was committed, so nothing is read back.
+	if read := mem.Reads(testSubscription) - reads; read > 0 {
+		t.Errorf("%v copies read back resuming, want none", read)
+	}
+
+	progress, err := mem.Committed(context.Background(), memoryFlow(testSource), broker.Options{}, second.group())
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := int64(0)
+	for _, offset := range progress.Offsets {
+		committed += offset
+	}
+	if committed != 25 {
+		t.Errorf("%v events committed, want 25", committed)
+	}
+}
+
+func TestExactlyOnceUnacknowledgedWrite(t *testing.T) {
+	mem := newMemory(t, 10)
+	var writes int32
+	mem.Faults = func(topic string, m broker.Message) broker.Fault {
+		if topic == testSubscription && atomic.AddInt32(&writes, 1) == 5 {
+			return broker.Unacknowledged
+		}
+		return broker.Store
+	}
+	p := testProcessor()
+	p.start()
+	defer stop(p)
+	waitCopies(t, mem, 10)
+	checkCopies(t, mem, 10, 1)
+}
+
+func TestExactlyOnceLastAttemptUnacknowledged(t *testing.T) {
+	mem := newMemory(t, 10)
+	mem.Faults = func(topic string, m broker.Message) broker.Fault {
+		if topic == testSubscription && string(m.Key) == "order-3" {
+			return broker.Unacknowledged
+		}
+		return broker.Store
+	}
+	p := testProcessor()
+	p.retry.Attempts = 1
+	p.start()
+	defer stop(p)
+	waitCopies(t, mem, 10)
+	checkCopies(t, mem, 10, 1)
+}
+
+func TestExactlyOnceRewindAndCrash(t *testing.T) {
+	mem := newMemory(t, 10)
+	first := testProcessor()
+	first.start()
+	waitCopies(t, mem, 10)
+	first.rewind(position{start: broker.Beginning})
+	waitCopies(t, mem, 20)
+	stop(first)
+
+	second := testProcessor()
+	second.start()
+	defer stop(second)
+	time.Sleep(100 * time.Millisecond)
+	checkCopies(t, mem, 10, 2)
+}
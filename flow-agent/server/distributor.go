@@ -0,0 +1,222 @@
+package server
+
+import (
+	"broker"
+	"context"
+	"flow-agent/config"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// distributorProcessor is the flow processor consuming a flow once for
+// all its subscriptions.
+const distributorProcessor = "distributor"
+
+// flowProcessor returns how flow is copied to its subscriptions, bridge
+// unless it says otherwise.
+func flowProcessor(cfg config.Config, flow string) string {
+	if f, ok := cfg.Flow(flow); ok && f.Processor != "" {
+		return f.Processor
+	}
+	return config.Processors[0]
+}
+
+// distributor copies a flow to every subscription consuming it once,
+// instead of a bridge per subscription each consuming it. Subscriptions
+// keep their processor, which copies the events as its bridge would, with
+// its selection, delivery mode and key, from where it is up to; the
+// distributor consumes the flow from where the first of them is.
+type distributor struct {
+	src    broker.Descriptor
+	opts   broker.Options
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// The processors of the subscriptions, by subscription, and the stop
+	// of the running bridge, closing stopped once it returns, guarded by
+	// dm. Adding or removing one, or rewinding it, restarts the bridge.
+	members map[string]*processor
+	stop    context.CancelFunc
+	stopped chan struct{}
+	dm      sync.Mutex
+}
+
+func newDistributor(src broker.Descriptor, opts broker.Options) *distributor {
+	return &distributor{src: src, opts: opts, done: make(chan struct{}), members: map[string]*processor{}}
+}
+
+// start runs the distributor until it is cancelled.
+func (d *distributor) start() {
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	go d.run(ctx)
+}
+
+// add makes the distributor copy to the subscription of p too.
+func (d *distributor) add(p *processor) {
+	d.dm.Lock()
+	defer d.dm.Unlock()
+	d.members[p.dst.Flow] = p
+	if d.stop != nil {
+		d.stop()
+	}
+}
+
+// remove stops copying to the subscription dst, waiting for the bridge
+// copying to it to return. It reports whether subscriptions are left.
+func (d *distributor) remove(dst string) bool {
+	d.dm.Lock()
+	delete(d.members, dst)
+	left := len(d.members) > 0
+	stop, stopped := d.stop, d.stopped
+	d.dm.Unlock()
+	if stop != nil {
+		stop()
+		<-stopped
+	}
+	return left
+}
+
+// run bridges the flow to the subscriptions until ctx is cancelled,
+// connecting again after failures, and at once when they change.
+func (d *distributor) run(ctx context.Context) {
+	defer close(d.done)
+	for {
+		bridgeCtx, stop := context.WithCancel(ctx)
+		stopped := make(chan struct{})
+		d.dm.Lock()
+		d.stop, d.stopped = stop, stopped
+		members := make([]*processor, 0, len(d.members))
+		for _, p := range d.members {
+			members = append(members, p)
+		}
+		d.dm.Unlock()
+
+		err := d.bridge(bridgeCtx, stop, members)
+		restarted := bridgeCtx.Err() != nil
+		stop()
+		close(stopped)
+		if ctx.Err() != nil {
+			return
+		}
+		if restarted {
+			log.Printf("Distributor of %v restarting", d.src.Flow)
+			continue
+		}
+		log.Printf("Distributor of %v failed, restarting in %v: %v", d.src.Flow, processorRetry, err)
+		select {
+		case <-time.After(processorRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *distributor) bridge(ctx context.Context, stop context.CancelFunc, members []*processor) error {
+	if len(members) == 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	driver, err := broker.Open(d.src)
+	if err != nil {
+		return err
+	}
+	// Subscriptions copying the latest events start where the flow ends.
+	c, ok := driver.(broker.Committer)
+	if !ok {
+		return errors.Errorf("broker type %v of %v does not tell where flows end, it cannot be distributed", d.src.Type, d.src.Flow)
+	}
+	ends, err := c.Ends(ctx, d.src, d.opts)
+	if err != nil {
+		return err
+	}
+
+	var copiers []*copier
+	defer func() {
+		for _, c := range copiers {
+			c.close()
+		}
+	}()
+	opts := d.opts
+	opts.Follow, opts.Start, opts.Offsets = true, broker.Beginning, map[int]int64{}
+	first := map[int]int64{}
+	copying := map[int]int{}
+	for _, p := range members {
+		p.sm.Lock()
+		p.stop = stop
+		generation := p.generation
+		p.sm.Unlock()
+		c, err := p.connect(ctx, generation)
+		if err != nil {
+			return err
+		}
+		copiers = append(copiers, c)
+		var offsets map[int]int64
+		offsets, c.wants = p.joining(generation, ends)
+		for partition, offset := range offsets {
+			if n, ok := first[partition]; !ok || offset < n {
+				first[partition] = offset
+			}
+			copying[partition]++
+		}
+	}
+	// Partitions some subscription has no offset for are read from the
+	// beginning, the events it does not want being skipped.
+	for partition, offset := range first {
+		if copying[partition] == len(members) {
+			opts.Offsets[partition] = offset
+		}
+	}
+	consumer, err := driver.Consumer(ctx, d.src, opts)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	return deliver(ctx, consumer, copiers)
+}
+
+// joining returns where p copies the flow a distributor consumes from, in
+// the bridge of generation, and which events it wants. Copying the latest
+// events, it starts at ends, where the flow ends, in the partitions it
+// copied nothing from yet.
+func (p *processor) joining(generation int, ends map[int]int64) (map[int]int64, func(m broker.Message) bool) {
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	if p.generation == generation && p.from.time.IsZero() && p.from.start == broker.End {
+		for partition, end := range ends {
+			if _, ok := p.offsets[partition]; !ok {
+				p.offsets[partition] = end
+			}
+		}
+	}
+	offsets := map[int]int64{}
+	for partition, offset := range p.offsets {
+		offsets[partition] = offset
+	}
+	from := p.from
+	if from.time.IsZero() && from.start >= 0 {
+		for partition := range ends {
+			if _, ok := offsets[partition]; !ok {
+				offsets[partition] = from.start
+			}
+		}
+	}
+
+	// Copying from a time, a partition is copied from its first event
+	// stored at or after it on, as brokers look it up.
+	started := map[int]bool{}
+	wants := func(m broker.Message) bool {
+		if next, ok := offsets[m.Partition]; ok {
+			return m.Offset >= next
+		}
+		if !from.time.IsZero() && !started[m.Partition] {
+			started[m.Partition] = !m.Time.Before(from.time)
+			return started[m.Partition]
+		}
+		return true
+	}
+	return offsets, wants
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"broker"
+	"flow-agent/filter"
+	"testing"
+	"time"
+)
+
+// subscriber returns a processor copying the source flow to dst, exactly
+// once and from from.
+func subscriber(t *testing.T, dst string, text string, from position) *processor {
+	t.Helper()
+	p := testProcessor()
+	p.dst, p.deadLetter = memoryFlow(dst), memoryFlow(broker.DeadLetterFlow(dst))
+	p.from = from
+	if text != "" {
+		var err error
+		if p.sel.filter, err = filter.Compile(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// waitEvents waits for n events in topic, and checks that it has no more
+// and that none is there twice.
+func waitEvents(t *testing.T, mem *broker.Memory, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(mem.Messages(topic)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v events in %v, want %v", len(mem.Messages(topic)), topic, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	seen := map[string]bool{}
+	for _, m := range mem.Messages(topic) {
+		id := header(m, broker.HeaderPartition) + "/" + header(m, broker.HeaderOffset)
+		if seen[id] {
+			t.Errorf("event %v copied twice to %v", id, topic)
+		}
+		seen[id] = true
+	}
+	if len(seen) != n {
+		t.Errorf("%v events copied to %v, want %v", len(seen), topic, n)
+	}
+}
+
+func stopDistributor(d *distributor) {
+	d.cancel()
+	<-d.done
+}
+
+func TestDistributorConsumesOnce(t *testing.T) {
+	mem := newMemory(t, 20)
+	d := newDistributor(memoryFlow(testSource), broker.Options{})
+	d.add(subscriber(t, "all.orders", "", position{start: broker.Beginning}))
+	d.add(subscriber(t, "first.orders", "$.id < 5", position{start: broker.Beginning}))
+	d.start()
+	defer stopDistributor(d)
+
+	waitEvents(t, mem, "all.orders", 20)
+	waitEvents(t, mem, "first.orders", 5)
+	if reads := mem.Reads(testSource); reads != 20 {
+		t.Errorf("source flow read %v times, want 20", reads)
+	}
+}
+
+func TestDistributorJoinAndLeave(t *testing.T) {
+	mem := newMemory(t, 10)
+	d := newDistributor(memoryFlow(testSource), broker.Options{})
+	d.add(subscriber(t, "all.orders", "", position{start: broker.Beginning}))
+	d.start()
+	defer stopDistributor(d)
+	waitEvents(t, mem, "all.orders", 10)
+
+	// A subscription to the latest events gets only those published
+	// after it joined, and the others go on where they were.
+	d.add(subscriber(t, "new.orders", "", latest))
+	time.Sleep(100 * time.Millisecond)
+	publish(t, mem, 10, 15)
+	waitEvents(t, mem, "all.orders", 15)
+	waitEvents(t, mem, "new.orders", 5)
+	if reads := mem.Reads(testSource); reads != 15 {
+		t.Errorf("source flow read %v times, want 15", reads)
+	}
+
+	// One copying from the beginning makes the distributor read the flow
+	// again, without the others copying what they have.
+	d.add(subscriber(t, "replay.orders", "", position{start: broker.Beginning}))
+	waitEvents(t, mem, "replay.orders", 15)
+	waitEvents(t, mem, "all.orders", 15)
+	waitEvents(t, mem, "new.orders", 5)
+
+	if !d.remove("all.orders") {
+		t.Fatal("no subscription left")
+	}
+	publish(t, mem, 15, 20)
+	waitEvents(t, mem, "new.orders", 10)
+	waitEvents(t, mem, "replay.orders", 20)
+	waitEvents(t, mem, "all.orders", 15)
+	d.remove("replay.orders")
+	if d.remove("new.orders") {
+		t.Error("subscriptions left after removing every one")
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"broker"
+)
+
+// encryptionKey reads the "ENCRYPT <key>" option of a SUBSCRIBE command,
+// the base64 X25519 public key of the subscriber, nil if there is none.
+func encryptionKey(line string) ([]byte, error) {
+	encoded, ok := commandOption(line, "ENCRYPT")
+	if !ok {
+		return nil, nil
+	}
+	key, err := broker.ParseKey(encoded)
+	if err != nil {
+		return nil, replyError(CodeSyntax, "Invalid encryption key", err)
+	}
+	return key, nil
+}
+
+// encryption describes how copies are written for the subscriber with
+// key.
+func encryption(key []byte) string {
+	if key == nil {
+		return "in the clear"
+	}
+	return "encrypted for " + broker.KeyID(key)
+}
+
+// sealed returns out with its payload encrypted for the subscriber, if it
+// gave a key and out is not encrypted already.
+func (p *processor) sealed(out broker.Message) (broker.Message, error) {
+	p.sm.Lock()
+	recipient := p.recipient
+	p.sm.Unlock()
+	if recipient == nil || broker.Encrypted(out) {
+		return out, nil
+	}
+	return broker.Encrypt(out, recipient)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/base64"
+	"flow-agent/filter"
+	"strings"
+)
+
+// selection is what a subscription gets of the events of its flow: those
+// matching filter, if any, with the fields of projection only, if any.
+type selection struct {
+	filter     *filter.Expr
+	projection *filter.Projection
+}
+
+// String describes s for the logs.
+func (s selection) String() string {
+	var parts []string
+	if s.filter != nil {
+		parts = append(parts, "filter="+s.filter.String())
+	}
+	if s.projection != nil {
+		parts = append(parts, "projection="+s.projection.String())
+	}
+	if len(parts) == 0 {
+		return "every event"
+	}
+	return strings.Join(parts, " ")
+}
+
+// subscriptionSelection reads the "FILTER <base64 expression>" and
+// "PROJECT <base64 fields>" options of a SUBSCRIBE command.
+func subscriptionSelection(line string) (selection, error) {
+	var s selection
+	if encoded, ok := commandOption(line, "FILTER"); ok {
+		text, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return s, replyError(CodeSyntax, "Filter is not base64", err)
+		}
+		if s.filter, err = filter.Compile(string(text)); err != nil {
+			return s, replyError(CodeSyntax, "Invalid filter: "+oneLine(err.Error()), nil)
+		}
+	}
+	if encoded, ok := commandOption(line, "PROJECT"); ok {
+		text, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return s, replyError(CodeSyntax, "Projection is not base64", err)
+		}
+		if s.projection, err = filter.ParseProjection(string(text)); err != nil {
+			return s, replyError(CodeSyntax, "Invalid projection: "+oneLine(err.Error()), nil)
+		}
+	}
+	return s, nil
+}
+
+// selectionOptions returns the SUBSCRIBE options selecting what s does,
+// for the FNAA of a remote flow.
+func selectionOptions(s selection) string {
+	var options []string
+	if s.filter != nil {
+		options = append(options, "FILTER", base64.StdEncoding.EncodeToString([]byte(s.filter.String())))
+	}
+	if s.projection != nil {
+		options = append(options, "PROJECT", base64.StdEncoding.EncodeToString([]byte(s.projection.String())))
+	}
+	return strings.Join(options, " ")
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"flow-agent/config"
+	"flow-agent/zone"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"resolver"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// handleCreateNamespace handles "CREATE NAMESPACE <name> BROKER <broker>
+// [NAMESERVER <nameserver>]". The namespace must be part of a DNS zone the
+// authenticated user owns. It is published in that zone with a
+// _fnaa._tcp.<name> SRV record pointing at this FNAA, sent as a dynamic
+// update to the given nameserver, or the first one configured, and bound
+// to the broker its flows will be stored in. A signing key is generated
+// for it and published alongside, in a _fnaa-key.<name> TXT record.
+func handleCreateNamespace(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, cfg config.Config) error {
+	line := scanner.Text()
+	name, err := commandArg(line, 2, "namespace")
+	if err != nil {
+		return err
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	brokerName, ok := commandOption(line, "BROKER")
+	if !ok {
+		return replyError(CodeSyntax, "Missing argument BROKER <broker>", nil)
+	}
+
+	s, err := e.authenticated(conn)
+	if err != nil {
+		return err
+	}
+	user, _ := cfg.User(s.user)
+
+	if _, ok := cfg.NamespaceByName(name); ok {
+		return replyError(CodeForbidden, "Namespace "+name+" already exists", nil)
+	}
+	if _, ok := cfg.Broker(brokerName); !ok {
+		return replyError(CodeNotFound, "Broker "+brokerName+" not found", nil)
+	}
+
+	nameserverName, ok := commandOption(line, "NAMESERVER")
+	if !ok {
+		if len(cfg.Nameservers) == 0 {
+			return replyError(CodeUnavailable, "No nameserver configured to publish namespaces", nil)
+		}
+		nameserverName = cfg.Nameservers[0].Name
+	}
+	nameserver, ok := cfg.NameserverByName(nameserverName)
+	if !ok {
+		return replyError(CodeNotFound, "Nameserver "+nameserverName+" not found", nil)
+	}
+
+	// The zone is looked up rather than derived from the name, so a
+	// user owning unix.ar cannot claim a namespace in a zone delegated
+	// to someone else below it.
+	r := resolver.New(nameserver.Host)
+	if cfg.Nameserver != "" {
+		if r, err = newResolver(cfg, filepath.Dir(e.ConfigFile)); err != nil {
+			return replyError(CodeUnavailable, "Could not find the DNS zone of "+name, err)
+		}
+	}
+	apex, err := zone.Apex(ctx, r, name)
+	if err != nil {
+		return replyError(CodeUnavailable, "Could not find the DNS zone of "+name, err)
+	}
+	if !owns(user, apex) {
+		return replyError(CodeForbidden, "User "+user.Name+" does not own zone "+apex, nil)
+	}
+
+	var key *zone.Key
+	if nameserver.Keyfile != "" {
+		key, err = zone.ReadKey(nameserver.KeyPath(filepath.Dir(e.ConfigFile)))
+		if err != nil {
+			return replyError(CodeUnavailable, "Could not publish namespace "+name, err)
+		}
+	}
+
+	port, err := strconv.Atoi(cfg.Identity.AdvertisedPort(cfg.Port))
+	if err != nil {
+		return replyError(CodeUnavailable, "Could not publish namespace "+name, errors.Wrap(err, "advertised port"))
+	}
+	record := &dns.SRV{
+		Hdr:      dns.RR_Header{Name: "_fnaa._tcp." + dns.Fqdn(name), Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 300},
+		Priority: 0,
+		Weight:   0,
+		Port:     uint16(port),
+		Target:   dns.Fqdn(cfg.Identity.Target()),
+	}
+	namespace := config.Namespace{
+		Name:       name,
+		Broker:     brokerName,
+		Ns_private: nameserver.Name,
+		Ns_public:  nameserver.Name,
+	}
+
+	// The namespace may have been created by another session since cfg
+	// was taken, so it is looked for again once no other can be.
+	e.nm.Lock()
+	defer e.nm.Unlock()
+	if _, ok := e.Config().NamespaceByName(name); ok {
+		return replyError(CodeForbidden, "Namespace "+name+" already exists", nil)
+	}
+	signing, generated, err := signingKeyRecord(filepath.Dir(e.ConfigFile), &namespace)
+	if err != nil {
+		return replyError(CodeUnavailable, "Could not publish namespace "+name, err)
+	}
+	// A signing key generated for a namespace that is not created
+	// after all is removed, so it is not taken for its key later.
+	discardKey := func() {
+		if generated {
+			os.Remove(namespace.SigningKeyPath(filepath.Dir(e.ConfigFile)))
+		}
+	}
+	records := []dns.RR{record, signing}
+	if err := zone.Update(ctx, nameserver.Host, apex, key, records); err != nil {
+		discardKey()
+		return replyError(CodeUnavailable, "Could not publish namespace "+name+" in zone "+apex, err)
+	}
+	// A namespace that cannot be saved would be lost on the next
+	// reload while still published, so it is withdrawn instead.
+	if e.ConfigFile != "" {
+		if err := config.SaveNamespace(e.ConfigFile, namespace); err != nil {
+			if err := zone.Remove(ctx, nameserver.Host, apex, key, records); err != nil {
+				log.Printf("Error: namespace %v not withdrawn from zone %v, %v", name, apex, err)
+			}
+			discardKey()
+			return replyError(CodeUnavailable, "Could not save namespace "+name, err)
+		}
+	}
+	e.addNamespace(namespace)
+	log.Printf("Namespace %v created by %v in zone %v, bound to broker %v", name, user.Name, apex, brokerName)
+
+	if err := writeReply(rw, "220 DATA"); err != nil {
+		return err
+	}
+	if err := writeReply(rw, "namespace="+name+" broker="+brokerName+" zone="+apex+" nameserver="+nameserver.Name); err != nil {
+		return err
+	}
+	return writeReply(rw, "220 OK")
+}
+
+// owns reports whether apex is one of the zones of user.
+func owns(user config.User, apex string) bool {
+	for _, z := range user.Zones {
+		if strings.EqualFold(strings.TrimSuffix(z, "."), apex) {
+			return true
+		}
+	}
+	return false
+}
+
+// addNamespace adds namespace to the running configuration, unless a
+// reload already brought it in.
+func (e *Endpoint) addNamespace(namespace config.Namespace) {
+	e.cm.Lock()
+	defer e.cm.Unlock()
+	if _, ok := e.cfg.NamespaceByName(namespace.Name); ok {
+		return
+	}
+	namespaces := make([]config.Namespace, 0, len(e.cfg.Namespaces)+1)
+	namespaces = append(namespaces, e.cfg.Namespaces...)
+	e.cfg.Namespaces = append(namespaces, namespace)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"broker"
+	"flow-agent/config"
+	"log"
+	"strconv"
+)
+
+// orderingOption reads the "ORDERING <policy>" option of a CREATE FLOW or
+// UPDATE FLOW command. ok is false if there is none.
+func orderingOption(line string) (ordering string, ok bool, err error) {
+	option, found := commandOption(line, "ORDERING")
+	if !found {
+		return "", false, nil
+	}
+	if ordering, err = broker.ParseOrdering(option); err != nil {
+		return "", false, replyError(CodeSyntax, "Unknown ordering "+option, err)
+	}
+	return ordering, true, nil
+}
+
+// flowOrdering returns the ordering policy of flow, per key unless it is
+// configured.
+func flowOrdering(cfg config.Config, flow string) string {
+	if f, ok := cfg.Flow(flow); ok && f.Ordering != "" {
+		return f.Ordering
+	}
+	return broker.PerKey
+}
+
+// setOrdering sets the ordering policy of flow, which must belong to a
+// local namespace, and saves it in the configuration file.
+func (e *Endpoint) setOrdering(cfg config.Config, flow string, ordering string) error {
+	err := e.saveFlow(cfg, flow, func(f *config.Flow) {
+		f.Ordering = ""
+		if ordering != broker.PerKey {
+			f.Ordering = ordering
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Flow %v ordered %v", flow, flowOrdering(e.Config(), flow))
+	return nil
+}
+
+// partitioned returns out, the copy of m, partitioned as the flow of m
+// is ordered. The partition key of m, kept in out, partitions copies too;
+// under per-key ordering, copies of events without one are partitioned
+// by the partition of m, so they keep the order they had in it.
+func partitioned(m broker.Message, out broker.Message, ordering string) broker.Message {
+	if ordering != broker.PerKey || broker.PartitionKey(out) != nil {
+		return out
+	}
+	out.Headers = append(append([]broker.Header(nil), out.Headers...),
+		broker.Header{Key: broker.HeaderPartitionKey, Value: []byte(strconv.Itoa(m.Partition))})
+	return out
+}
@@ -0,0 +1,782 @@
+package server
+
+import (
+	"broker"
+	"context"
+	"crypto/ed25519"
+	"flow-agent/config"
+	"flow-agent/schema"
+	"log"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// processorRetry is how long a failed flow processor waits before
+// connecting again.
+const processorRetry = 5 * time.Second
+
+// flowNamespace returns the local namespace flow belongs to.
+func flowNamespace(cfg config.Config, flow string) (config.Namespace, bool) {
+	for _, namespace := range cfg.Namespaces {
+		if flow == namespace.Name || strings.HasSuffix(flow, "."+namespace.Name) {
+			return namespace, true
+		}
+	}
+	return config.Namespace{}, false
+}
+
+// flowDescriptor returns where the events of flow are kept: a topic named
+// after it in the broker of its namespace. It is false for flows outside
+// the namespaces of this FNAA, which it knows nothing about.
+func flowDescriptor(cfg config.Config, flow string) (broker.Descriptor, bool) {
+	namespace, ok := flowNamespace(cfg, flow)
+	if !ok {
+		return broker.Descriptor{}, false
+	}
+	b, ok := cfg.Broker(namespace.Broker)
+	if !ok {
+		return broker.Descriptor{}, false
+	}
+	d := broker.Descriptor{Flow: flow, Type: b.Type, Topic: flow}
+	for _, server := range strings.Split(b.Servers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			d.Servers = append(d.Servers, server)
+		}
+	}
+	return d, true
+}
+
+// processor is a flow processor, bridging the events of a source flow to
+// a subscription. When the source flow has a schema with a validation
+// policy, events that do not conform to its latest version are dropped
+// or moved to the dead-letter flow of the subscription. Plain events of a
+// source flow in a CloudEvents content mode are wrapped on the way, with
+// the source flow as their source. Only the events the selection of the
+// subscription lets through are copied, or dead-lettered. Copies keep the
+// partition key of their event and are ordered as the source flow.
+//
+// Events are not lost on the way: failed writes are tried again as the
+// retry policy says, and events that still cannot be written, or that
+// cannot be projected or wrapped, go to the dead-letter flow too. When
+// that fails as well the bridge starts again from them. Subscriptions
+// delivered exactly once do not get them twice either. When the
+// subscriber gave a public key, the payload of copies, and of the events
+// dead-lettered, is encrypted for it, so only the subscriber reads them.
+// Copies are signed by the namespace of the source flow when it has a
+// signing key, unless they keep a signature from upstream; signed events
+// whose signature does not hold are dead-lettered.
+type processor struct {
+	src, dst   broker.Descriptor
+	deadLetter broker.Descriptor
+	schemas    *schema.Registry
+	opts       broker.Options
+	retry      config.Retry
+	// mode and ordering return the current content mode and ordering
+	// policy of the source flow.
+	mode     func() string
+	ordering func() string
+	// loadSigningKey returns the namespace of the source flow and its
+	// signing key, and signingKeys the keys a namespace publishes.
+	loadSigningKey func() (string, ed25519.PrivateKey, error)
+	signingKeys    func(ctx context.Context, namespace string) ([]ed25519.PublicKey, error)
+	cancel         context.CancelFunc
+	done           chan struct{}
+	// distributed is set for the processors a distributor runs, which
+	// are not started themselves.
+	distributed bool
+	// verifying is set for the processors bridging the copy a remote FNAA
+	// keeps for this one to a local flow, to the namespace its events
+	// must be signed by: unsigned events, and those signed by any other,
+	// are dead-lettered too.
+	verifying string
+	// signer and signingKey are those loadSigningKey returned when the
+	// running bridge connected, used by it alone.
+	signer     string
+	signingKey ed25519.PrivateKey
+
+	// The selection, delivery mode and key of the subscriber, changed
+	// when it subscribes again, and where the processor copies from,
+	// guarded by
+	// sm. offsets are where to resume in each partition; rewinds bump
+	// generation, stop the running bridge and, delivering exactly once,
+	// start a new epoch of copies. ends are where the subscription and
+	// its dead-letter flow ended at the last commit, keyed by flow.
+	sel        selection
+	delivery   string
+	recipient  []byte
+	from       position
+	offsets    map[int]int64
+	generation int
+	epoch      int
+	newEpoch   bool
+	ends       map[string]map[int]int64
+	stop       context.CancelFunc
+	sm         sync.Mutex
+}
+
+// startProcessor starts the processor bridging src to dst with sel and
+// delivery, encrypting copies for recipient if not nil, from position
+// from, or from the latest events if it is nil. If it is running already
+// it switches to sel, delivery and recipient, and is rewound to from if
+// given.
+func (e *Endpoint) startProcessor(cfg config.Config, src string, dst string, sel selection, delivery string, recipient []byte, from *position) error {
+	e.pm.Lock()
+	defer e.pm.Unlock()
+	if p, ok := e.processors[dst]; ok {
+		p.resubscribe(sel, delivery, recipient)
+		log.Printf("Flow processor src=%v dst=%v already running, now copying %v %v %v", src, dst, sel, delivery, encryption(recipient))
+		if from != nil {
+			p.rewind(*from)
+		}
+		return nil
+	}
+	start := latest
+	if from != nil {
+		start = *from
+	}
+	d, ok := flowDescriptor(cfg, src)
+	if !ok {
+		return errors.Errorf("flow %v is not in a namespace of this FNAA", src)
+	}
+	p, err := e.newProcessor(cfg, d, dst, sel, delivery, recipient, start)
+	if err != nil {
+		return err
+	}
+	for _, d := range []broker.Descriptor{p.src, p.dst} {
+		if _, err := broker.Open(d); err != nil {
+			return err
+		}
+	}
+	e.processors[dst] = p
+	e.launch(cfg, p)
+	log.Printf("Flow processor started src=%v dst=%v copying %v %v %v from %v", src, dst, sel, delivery, encryption(recipient), start)
+	return nil
+}
+
+// startVerifier starts the processor bridging src, the copy of a remote
+// flow a remote FNAA keeps for this one, to the local flow dst with
+// delivery, so subscribers only get the events signed by namespace whose
+// signature holds. If it is running already it keeps copying from where
+// it is.
+func (e *Endpoint) startVerifier(cfg config.Config, src broker.Descriptor, dst string, delivery string, namespace string) error {
+	e.pm.Lock()
+	defer e.pm.Unlock()
+	if _, ok := e.processors[dst]; ok {
+		log.Printf("Flow processor src=%v dst=%v already running, verifying signatures", src.Flow, dst)
+		return nil
+	}
+	// The copy holds what the subscription asked for from where it asked.
+	p, err := e.newProcessor(cfg, src, dst, selection{}, delivery, nil, position{start: broker.Beginning})
+	if err != nil {
+		return err
+	}
+	p.verifying = namespace
+	if _, err := broker.Open(p.dst); err != nil {
+		return err
+	}
+	if _, err := broker.Open(p.src); err != nil {
+		return err
+	}
+	e.processors[dst] = p
+	e.launch(cfg, p)
+	log.Printf("Flow processor started src=%v dst=%v verifying signatures of %v %v", src.Flow, dst, namespace, delivery)
+	return nil
+}
+
+// newProcessor returns the processor bridging the flow src describes to
+// dst with cfg, not started yet. dst and its dead-letter flow must be in
+// a namespace of this FNAA.
+func (e *Endpoint) newProcessor(cfg config.Config, src broker.Descriptor, dst string, sel selection, delivery string, recipient []byte, from position) (*processor, error) {
+	d, ok := flowDescriptor(cfg, dst)
+	if !ok {
+		return nil, errors.Errorf("flow %v is not in a namespace of this FNAA", dst)
+	}
+	deadLetter, ok := flowDescriptor(cfg, broker.DeadLetterFlow(dst))
+	if !ok {
+		return nil, errors.Errorf("flow %v is not in a namespace of this FNAA", broker.DeadLetterFlow(dst))
+	}
+	return &processor{
+		src:        src,
+		dst:        d,
+		deadLetter: deadLetter,
+		schemas:    e.schemas,
+		opts:       brokerOptions(cfg, filepath.Dir(e.ConfigFile)),
+		retry:      cfg.Retry,
+		mode: func() string {
+			return flowContentMode(e.Config(), src.Flow)
+		},
+		ordering: func() string {
+			return flowOrdering(e.Config(), src.Flow)
+		},
+		loadSigningKey: func() (string, ed25519.PrivateKey, error) {
+			return signingKey(e.Config(), filepath.Dir(e.ConfigFile), src.Flow)
+		},
+		signingKeys: func(ctx context.Context, namespace string) ([]ed25519.PublicKey, error) {
+			r, err := newResolver(e.Config(), filepath.Dir(e.ConfigFile))
+			if err != nil {
+				return nil, err
+			}
+			return lookupSigningKeys(ctx, r, namespace)
+		},
+		done:      make(chan struct{}),
+		sel:       sel,
+		delivery:  delivery,
+		recipient: recipient,
+		from:      from,
+		offsets:   map[int]int64{},
+	}, nil
+}
+
+// start runs the processor until it is cancelled.
+func (p *processor) start() {
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	go p.run(ctx)
+}
+
+// launch starts copying to the subscription of p, with e.pm held: it
+// starts p, or adds it to the distributor of its source flow, started
+// with the first of them.
+func (e *Endpoint) launch(cfg config.Config, p *processor) {
+	if flowProcessor(cfg, p.src.Flow) != distributorProcessor {
+		p.start()
+		return
+	}
+	d, ok := e.distributors[p.src.Flow]
+	if !ok {
+		d = newDistributor(p.src, p.opts)
+		e.distributors[p.src.Flow] = d
+		d.start()
+		log.Printf("Distributor of %v started", p.src.Flow)
+	}
+	p.distributed = true
+	d.add(p)
+}
+
+// halt stops copying to the subscription of p and waits for it, with e.pm
+// held: it stops p, or takes it out of its distributor, stopped with the
+// last of them.
+func (e *Endpoint) halt(p *processor) {
+	if !p.distributed {
+		p.cancel()
+		<-p.done
+		return
+	}
+	d := e.distributors[p.src.Flow]
+	if !d.remove(p.dst.Flow) {
+		d.cancel()
+		<-d.done
+		delete(e.distributors, p.src.Flow)
+		log.Printf("Distributor of %v stopped", p.src.Flow)
+	}
+}
+
+// processorSettings is what a running processor took from the
+// configuration when it started.
+type processorSettings struct {
+	src, dst, deadLetter broker.Descriptor
+	retry                config.Retry
+	ordering             string
+	processor            string
+	signer               string
+	signingKey           ed25519.PrivateKey
+	signingErr           string
+	// The resolver brokers are found with.
+	nameserver, transport, nameserverCA, trustAnchor string
+	dial                                             time.Duration
+}
+
+func settings(cfg config.Config, dir string, src string, dst string) processorSettings {
+	describe := func(flow string) broker.Descriptor {
+		d, _ := flowDescriptor(cfg, flow)
+		return d
+	}
+	s := processorSettings{
+		src:          describe(src),
+		dst:          describe(dst),
+		deadLetter:   describe(broker.DeadLetterFlow(dst)),
+		retry:        cfg.Retry,
+		ordering:     flowOrdering(cfg, src),
+		processor:    flowProcessor(cfg, src),
+		nameserver:   cfg.Nameserver,
+		transport:    cfg.Transport,
+		nameserverCA: cfg.NameserverCA,
+		trustAnchor:  cfg.TrustAnchor,
+		dial:         cfg.Timeouts.Dial,
+	}
+	var err error
+	if s.signer, s.signingKey, err = signingKey(cfg, dir, src); err != nil {
+		s.signingErr = err.Error()
+	}
+	return s
+}
+
+// reloadProcessors restarts the processors whose settings changed from
+// old to cfg, so they do not keep copying with the brokers, retry policy,
+// ordering, signing key or flow processor they started with. They resume
+// where they were, in the same epoch. Every changed one is stopped before
+// any restarts, so distributors start again with the new settings too.
+func (e *Endpoint) reloadProcessors(old config.Config, cfg config.Config) {
+	dir := filepath.Dir(e.ConfigFile)
+	e.pm.Lock()
+	defer e.pm.Unlock()
+	var changed []*processor
+	for dst, p := range e.processors {
+		if reflect.DeepEqual(settings(old, dir, p.src.Flow, dst), settings(cfg, dir, p.src.Flow, dst)) {
+			continue
+		}
+		e.halt(p)
+		changed = append(changed, p)
+	}
+	for _, p := range changed {
+		dst := p.dst.Flow
+		p.sm.Lock()
+		src := p.src
+		if p.verifying == "" {
+			src, _ = flowDescriptor(cfg, p.src.Flow)
+		}
+		restarted, err := e.newProcessor(cfg, src, dst, p.sel, p.delivery, p.recipient, p.from)
+		if err != nil || src.Flow == "" {
+			p.sm.Unlock()
+			delete(e.processors, dst)
+			log.Printf("Flow processor src=%v dst=%v stopped, its flows are no longer in a namespace of this FNAA", p.src.Flow, dst)
+			continue
+		}
+		for partition, offset := range p.offsets {
+			restarted.offsets[partition] = offset
+		}
+		restarted.epoch, restarted.newEpoch = p.epoch, p.newEpoch
+		restarted.verifying = p.verifying
+		p.sm.Unlock()
+		e.processors[dst] = restarted
+		e.launch(cfg, restarted)
+		log.Printf("Flow processor src=%v dst=%v restarted with the new configuration", p.src.Flow, dst)
+	}
+}
+
+// stopProcessors stops every flow processor and waits for them.
+func (e *Endpoint) stopProcessors() {
+	e.pm.Lock()
+	defer e.pm.Unlock()
+	for dst, p := range e.processors {
+		e.halt(p)
+		delete(e.processors, dst)
+	}
+}
+
+// brokerOptions returns the options processors connect to brokers with,
+// resolving their hosts with the resolver of the FNAA.
+func brokerOptions(cfg config.Config, dir string) broker.Options {
+	r, err := newResolver(cfg, dir)
+	if err != nil {
+		log.Println("Error: resolving brokers with the system resolver,", err)
+		return broker.Options{CreateTopics: true}
+	}
+	dialer := &net.Dialer{Timeout: cfg.Timeouts.Dial}
+	return broker.Options{
+		// Subscriptions and dead-letter flows get their topic with
+		// their first event.
+		CreateTopics: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := r.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				var conn net.Conn
+				conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
+
+// run bridges the flows until ctx is cancelled, connecting again after
+// failures and resuming after the last event handled in each partition.
+// A rewind restarts it at once from the new position.
+func (p *processor) run(ctx context.Context) {
+	defer close(p.done)
+	for {
+		bridgeCtx, stop := context.WithCancel(ctx)
+		p.sm.Lock()
+		p.stop = stop
+		generation := p.generation
+		p.sm.Unlock()
+
+		err := p.bridge(bridgeCtx, generation)
+		stop()
+		if ctx.Err() != nil {
+			return
+		}
+		if p.rewound(generation) {
+			log.Printf("Flow processor src=%v dst=%v rewound to %v", p.src.Flow, p.dst.Flow, p.position())
+			continue
+		}
+		log.Printf("Flow processor src=%v dst=%v failed, restarting in %v: %v", p.src.Flow, p.dst.Flow, processorRetry, err)
+		select {
+		case <-time.After(processorRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *processor) bridge(ctx context.Context, generation int) error {
+	srcDriver, err := broker.Open(p.src)
+	if err != nil {
+		return err
+	}
+	c, err := p.connect(ctx, generation)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	opts := p.opts
+	opts.Follow = true
+	p.sm.Lock()
+	opts.Start, opts.StartTime = p.from.start, p.from.time
+	opts.Offsets = map[int]int64{}
+	for partition, offset := range p.offsets {
+		opts.Offsets[partition] = offset
+	}
+	p.sm.Unlock()
+	consumer, err := srcDriver.Consumer(ctx, p.src, opts)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	return deliver(ctx, consumer, []*copier{c})
+}
+
+// copier copies the events a bridge consumes to the subscription of a
+// processor.
+type copier struct {
+	p                     *processor
+	generation            int
+	producer, deadLetters broker.Producer
+	// wants tells whether an event is to be copied, every one if nil.
+	wants       func(m broker.Message) bool
+	committed   time.Time
+	uncommitted bool
+}
+
+// connect gets p ready to copy in the bridge of generation: it loads the
+// signing key, resumes delivering exactly once, and opens the
+// subscription.
+func (p *processor) connect(ctx context.Context, generation int) (*copier, error) {
+	dstDriver, err := broker.Open(p.dst)
+	if err != nil {
+		return nil, err
+	}
+	if p.signer, p.signingKey, err = p.loadSigningKey(); err != nil {
+		return nil, err
+	}
+	if p.deliveryMode() == exactlyOnce {
+		if err := p.resume(ctx, generation); err != nil {
+			return nil, err
+		}
+		// A new epoch is committed before anything is copied in it.
+		if err := p.commit(ctx, generation); err != nil {
+			log.Printf("Error: flow processor src=%v dst=%v could not commit its progress: %v", p.src.Flow, p.dst.Flow, err)
+		}
+	}
+	// Subscriptions are ordered as their flow.
+	dstOpts := p.opts
+	dstOpts.Ordering = p.ordering()
+	producer, err := dstDriver.Producer(ctx, p.dst, dstOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &copier{p: p, generation: generation, producer: producer, committed: time.Now()}, nil
+}
+
+func (c *copier) close() {
+	c.producer.Close()
+	if c.deadLetters != nil {
+		c.deadLetters.Close()
+	}
+}
+
+// deliver copies the events of consumer with copiers until one fails.
+// Delivering exactly once, they commit their progress every
+// commitInterval, and once no event came for as long.
+func deliver(ctx context.Context, consumer broker.Consumer, copiers []*copier) error {
+	for {
+		next, cancel := ctx, context.CancelFunc(func() {})
+		for _, c := range copiers {
+			if c.uncommitted {
+				next, cancel = context.WithTimeout(ctx, commitInterval)
+				break
+			}
+		}
+		m, err := consumer.Next(next)
+		cancel()
+		idle := err == context.DeadlineExceeded && ctx.Err() == nil
+		if err != nil && !idle {
+			return err
+		}
+		for _, c := range copiers {
+			if !idle && (c.wants == nil || c.wants(m)) {
+				if err := c.p.copy(ctx, m, c.producer, &c.deadLetters); err != nil {
+					return err
+				}
+				c.p.handled(c.generation, m)
+				c.uncommitted = c.p.deliveryMode() == exactlyOnce
+			}
+			if c.uncommitted && (idle || time.Since(c.committed) >= commitInterval) {
+				if err := c.p.commit(ctx, c.generation); err != nil {
+					log.Printf("Error: flow processor src=%v dst=%v could not commit its progress: %v", c.p.src.Flow, c.p.dst.Flow, err)
+				}
+				c.committed, c.uncommitted = time.Now(), false
+			}
+		}
+	}
+}
+
+// copy writes m to the subscription, or drops it or moves it to the
+// dead-letter flow, opening deadLetters the first time.
+func (p *processor) copy(ctx context.Context, m broker.Message, producer broker.Producer, deadLetters *broker.Producer) error {
+	// published is m as it was published, without its position.
+	published := broker.Message{Key: m.Key, Value: m.Value, Headers: m.Headers, Time: m.Time}
+	sel := p.selection()
+	exactly := p.deliveryMode() == exactlyOnce
+	if sel.filter != nil && !sel.filter.Match(m) {
+		return nil
+	}
+
+	invalid, err := p.verify(ctx, m)
+	if err != nil {
+		return err
+	}
+	if invalid != nil {
+		return p.moveToDeadLetter(ctx, deadLetters, m, published, exactly, failure{stage: broker.StageVerify, err: invalid})
+	}
+
+	version, policy, reason := p.validate(m)
+	if reason != nil && policy != schema.Off {
+		if policy == schema.Drop {
+			log.Printf("Dropping event %v/%v of %v: %v", m.Partition, m.Offset, p.src.Flow, reason)
+			return nil
+		}
+		return p.moveToDeadLetter(ctx, deadLetters, m, published, exactly, failure{stage: broker.StageValidate, err: reason, version: version})
+	}
+
+	out := published
+	if sel.projection != nil {
+		projected, err := sel.projection.Apply(out)
+		if err != nil {
+			return p.moveToDeadLetter(ctx, deadLetters, m, published, exactly, failure{stage: broker.StageTransform, err: errors.Wrap(err, "projecting")})
+		}
+		out = projected
+	}
+	wrapped, err := asCloudEvent(m, out, p.src.Flow, p.mode())
+	if err != nil {
+		return p.moveToDeadLetter(ctx, deadLetters, m, published, exactly, failure{stage: broker.StageTransform, err: errors.Wrap(err, "wrapping as a CloudEvent")})
+	}
+	if wrapped, err = p.sealed(wrapped); err != nil {
+		return p.moveToDeadLetter(ctx, deadLetters, m, published, exactly, failure{stage: broker.StageTransform, err: errors.Wrap(err, "encrypting")})
+	}
+	wrapped = p.sign(ctx, wrapped)
+	wrapped = partitioned(m, wrapped, p.ordering())
+	var stored func() (bool, error)
+	if exactly {
+		wrapped = p.tag(wrapped, m)
+		stored = func() (bool, error) {
+			return p.stored(ctx, p.dst, m)
+		}
+	}
+	attempts, err := p.produce(ctx, producer, p.dst.Flow, wrapped, stored)
+	if _, uncertain := err.(*uncertainError); err != nil && !uncertain && ctx.Err() == nil {
+		return p.moveToDeadLetter(ctx, deadLetters, m, wrapped, exactly, failure{stage: broker.StageDeliver, err: err, attempts: attempts})
+	}
+	return err
+}
+
+// failure tells why an event was not copied to the subscription.
+type failure struct {
+	stage    string
+	err      error
+	attempts int
+	// version is the schema version validation failed with.
+	version int
+}
+
+// moveToDeadLetter writes out, m or what it became before failing, to the
+// dead-letter flow with headers telling why, opening deadLetters the
+// first time. Delivering exactly once, it is not written again if it is
+// there already. Subscribers with a key get it encrypted, and it is signed
+// as copies are, unless its signature is why it failed.
+func (p *processor) moveToDeadLetter(ctx context.Context, deadLetters *broker.Producer, m broker.Message, out broker.Message, exactly bool, f failure) error {
+	log.Printf("Moving event %v/%v of %v to %v, %v failed: %v", m.Partition, m.Offset, p.src.Flow, p.deadLetter.Flow, f.stage, f.err)
+	out, err := p.sealed(out)
+	if err != nil {
+		return errors.Wrapf(err, "encrypting event %v/%v of %v for %v", m.Partition, m.Offset, p.src.Flow, p.deadLetter.Flow)
+	}
+	if f.stage != broker.StageVerify {
+		out = p.sign(ctx, out)
+	}
+	if *deadLetters == nil {
+		driver, err := broker.Open(p.deadLetter)
+		if err != nil {
+			return err
+		}
+		if *deadLetters, err = driver.Producer(ctx, p.deadLetter, p.opts); err != nil {
+			return err
+		}
+	}
+	// The headers of exactly-once copies are replaced.
+	out.Headers = append(broker.Redelivery(out).Headers,
+		broker.Header{Key: broker.HeaderError, Value: []byte(f.err.Error())},
+		broker.Header{Key: broker.HeaderSource, Value: []byte(p.src.Flow)},
+		broker.Header{Key: broker.HeaderPartition, Value: []byte(strconv.Itoa(m.Partition))},
+		broker.Header{Key: broker.HeaderOffset, Value: []byte(strconv.FormatInt(m.Offset, 10))},
+		broker.Header{Key: broker.HeaderStage, Value: []byte(f.stage)},
+		broker.Header{Key: broker.HeaderAttempts, Value: []byte(strconv.Itoa(f.attempts))},
+		broker.Header{Key: broker.HeaderFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+	if f.stage == broker.StageValidate {
+		out.Headers = append(out.Headers, broker.Header{Key: broker.HeaderSchemaVersion, Value: []byte(strconv.Itoa(f.version))})
+	}
+	var stored func() (bool, error)
+	if exactly {
+		p.sm.Lock()
+		out.Headers = append(out.Headers, broker.Header{Key: broker.HeaderEpoch, Value: []byte(strconv.Itoa(p.epoch))})
+		p.sm.Unlock()
+		stored = func() (bool, error) {
+			return p.stored(ctx, p.deadLetter, m)
+		}
+	}
+	_, err = p.produce(ctx, *deadLetters, p.deadLetter.Flow, out, stored)
+	return errors.Wrapf(err, "moving event %v/%v of %v to %v", m.Partition, m.Offset, p.src.Flow, p.deadLetter.Flow)
+}
+
+// produce writes out to flow, trying again with exponential backoff as
+// the retry policy says. When given, stored tells after each failed
+// attempt whether the write was stored after all, an *uncertainError
+// being returned if it cannot. It returns the attempts made.
+func (p *processor) produce(ctx context.Context, producer broker.Producer, flow string, out broker.Message, stored func() (bool, error)) (int, error) {
+	backoff := p.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := producer.Produce(ctx, out)
+		if err == nil || ctx.Err() != nil {
+			return attempt, err
+		}
+		last := attempt >= p.retry.Attempts
+		if !last {
+			log.Printf("Writing to %v failed, attempt %v of %v, trying again in %v: %v", flow, attempt, p.retry.Attempts, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return attempt, ctx.Err()
+			}
+		}
+		if stored != nil {
+			ok, err := stored()
+			if err != nil {
+				return attempt, &uncertainError{err: err}
+			}
+			if ok {
+				log.Printf("Writing to %v at attempt %v was stored after all", flow, attempt)
+				return attempt, nil
+			}
+		}
+		if last {
+			return attempt, err
+		}
+		if backoff *= 2; backoff > p.retry.MaxBackoff {
+			backoff = p.retry.MaxBackoff
+		}
+	}
+}
+
+func (p *processor) selection() selection {
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	return p.sel
+}
+
+func (p *processor) resubscribe(sel selection, delivery string, recipient []byte) {
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	p.sel = sel
+	p.delivery = delivery
+	p.recipient = recipient
+}
+
+func (p *processor) deliveryMode() string {
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	return p.delivery
+}
+
+func (p *processor) position() position {
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	return p.from
+}
+
+// handled records that m was handled by the bridge of generation, so it
+// is not copied again when connecting again, unless the processor was
+// rewound since.
+func (p *processor) handled(generation int, m broker.Message) {
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	if p.generation == generation {
+		p.offsets[m.Partition] = m.Offset + 1
+	}
+}
+
+// rewind makes the processor copy the events of its flow again from
+// position from.
+func (p *processor) rewind(from position) {
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	p.from = from
+	p.offsets = map[int]int64{}
+	p.generation++
+	p.newEpoch = true
+	if p.stop != nil {
+		p.stop()
+	}
+}
+
+// rewound reports whether the processor was rewound since the bridge of
+// generation started.
+func (p *processor) rewound(generation int) bool {
+	p.sm.Lock()
+	defer p.sm.Unlock()
+	return p.generation != generation
+}
+
+// validate checks m against the schema of the source flow. It returns the
+// schema version and the validation policy of the flow, with why m does
+// not conform. The data of CloudEvents is what is validated.
+func (p *processor) validate(m broker.Message) (int, string, error) {
+	v, s, ok, err := p.schemas.Validator(p.src.Flow)
+	if err != nil {
+		log.Printf("Error: not validating %v: %v", p.src.Flow, err)
+		return 0, schema.Off, nil
+	}
+	if !ok || s.Validation == schema.Off {
+		return 0, schema.Off, nil
+	}
+	_, data, _, err := broker.Unwrap(m)
+	if err != nil {
+		return s.Latest().Version, s.Validation, err
+	}
+	return s.Latest().Version, s.Validation, v.Validate(data)
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"flow-agent/config"
+	"reflect"
+	"testing"
+)
+
+func TestFlowDescriptor(t *testing.T) {
+	cfg := config.Config{
+		Brokers:    []config.Broker{{Name: "kafka_local", Type: "kafka", Servers: "kf1.unix.ar:9092, kf2.unix.ar:9092"}},
+		Namespaces: []config.Namespace{{Name: "flow.unix.ar", Broker: "kafka_local"}, {Name: "orphan.unix.ar", Broker: "missing"}},
+	}
+	d, ok := flowDescriptor(cfg, "time.flow.unix.ar")
+	if !ok {
+		t.Fatal("time.flow.unix.ar not described")
+	}
+	if d.Type != "kafka" || d.Topic != "time.flow.unix.ar" || !reflect.DeepEqual(d.Servers, []string{"kf1.unix.ar:9092", "kf2.unix.ar:9092"}) {
+		t.Errorf("time.flow.unix.ar described as %+v", d)
+	}
+	for _, flow := range []string{"time.flow.emiliano.ar", "time.xflow.unix.ar", "time.orphan.unix.ar"} {
+		if d, ok := flowDescriptor(cfg, flow); ok {
+			t.Errorf("%v described as %+v, outside the namespaces of the FNAA", flow, d)
+		}
+	}
+}
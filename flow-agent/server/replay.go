@@ -0,0 +1,186 @@
+package server
+
+import (
+	"broker"
+	"bufio"
+	"context"
+	"flow-agent/client"
+	"flow-agent/config"
+	"log"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// position is where a flow processor starts copying the events of its
+// flow.
+type position struct {
+	// start is an offset, in every partition, broker.Beginning or
+	// broker.End.
+	start int64
+	// time, when set, starts at the first event stored at or after it.
+	time time.Time
+}
+
+// latest copies the events published from now on, as subscriptions do
+// unless told otherwise.
+var latest = position{start: broker.End}
+
+// String names f as earliest, latest, offset:<n> or timestamp:<t>.
+func (f position) String() string {
+	switch {
+	case !f.time.IsZero():
+		return "timestamp:" + f.time.UTC().Format(time.RFC3339Nano)
+	case f.start == broker.Beginning:
+		return "earliest"
+	case f.start == broker.End:
+		return "latest"
+	}
+	return "offset:" + strconv.FormatInt(f.start, 10)
+}
+
+// options returns the FROM option selecting f.
+func (f position) options() string {
+	switch {
+	case !f.time.IsZero():
+		return "FROM TIMESTAMP " + f.time.UTC().Format(time.RFC3339Nano)
+	case f.start == broker.Beginning:
+		return "FROM EARLIEST"
+	case f.start == broker.End:
+		return "FROM LATEST"
+	}
+	return "FROM OFFSET " + strconv.FormatInt(f.start, 10)
+}
+
+// startPosition reads the "FROM EARLIEST|LATEST|TIMESTAMP <t>|OFFSET <n>"
+// option of a SUBSCRIBE or REPLAY command, nil if there is none. Times
+// are RFC 3339 or milliseconds since the epoch.
+func startPosition(line string) (*position, error) {
+	args := strings.Fields(line)
+	for i := 1; i < len(args); i++ {
+		if !strings.EqualFold(args[i], "FROM") {
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, replyError(CodeSyntax, "Missing argument FROM EARLIEST|LATEST|TIMESTAMP <t>|OFFSET <n>", nil)
+		}
+		value := ""
+		if i+2 < len(args) {
+			value = args[i+2]
+		}
+		switch strings.ToUpper(args[i+1]) {
+		case "EARLIEST":
+			return &position{start: broker.Beginning}, nil
+		case "LATEST":
+			return &position{start: broker.End}, nil
+		case "OFFSET":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return nil, replyError(CodeSyntax, "FROM OFFSET needs an offset, not "+value, err)
+			}
+			return &position{start: n}, nil
+		case "TIMESTAMP":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				ms, merr := strconv.ParseInt(value, 10, 64)
+				if merr != nil {
+					return nil, replyError(CodeSyntax, "FROM TIMESTAMP needs an RFC 3339 time or milliseconds since the epoch, not "+value, err)
+				}
+				t = time.Unix(0, ms*int64(time.Millisecond))
+			}
+			return &position{start: broker.End, time: t}, nil
+		}
+		return nil, replyError(CodeSyntax, "Unknown position FROM "+args[i+1]+", use EARLIEST, LATEST, TIMESTAMP <t> or OFFSET <n>", nil)
+	}
+	return nil, nil
+}
+
+// handleReplay handles "REPLAY <subscription> FROM EARLIEST|LATEST|
+// TIMESTAMP <t>|OFFSET <n>", rewinding the flow processor copying to a
+// subscription. Subscriptions to remote flows are rewound by the FNAA of
+// the flow, which only lets their subscriber, named with PEER by the user
+// acting for it, do it.
+func handleReplay(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) error {
+	line := scanner.Text()
+	log.Println("FULL COMMAND: " + line)
+	if _, err := e.authenticated(conn); err != nil {
+		return err
+	}
+	subscription, err := commandArg(line, 1, "subscription")
+	if err != nil {
+		return err
+	}
+	from, err := startPosition(line)
+	if err != nil {
+		return err
+	}
+	if from == nil {
+		return replyError(CodeSyntax, "Missing argument FROM EARLIEST|LATEST|TIMESTAMP <t>|OFFSET <n>", nil)
+	}
+
+	e.pm.Lock()
+	p, ok := e.processors[subscription]
+	e.pm.Unlock()
+	var reply string
+	switch {
+	case ok:
+		subscriber, err := e.subscriber(conn, config, line)
+		if err != nil {
+			return err
+		}
+		if subscriptionName(subscriber, p.src.Flow) != subscription {
+			return replyError(CodeForbidden, "Subscription "+subscription+" is not one of "+subscriber, nil)
+		}
+		p.rewind(*from)
+		log.Printf("Subscription %v of %v rewound to %v by %v", subscription, p.src.Flow, from, subscriber)
+		reply = "subscription=" + subscription + " flow=" + p.src.Flow + " from=" + from.String()
+	default:
+		if _, local := flowNamespace(config, subscription); local {
+			return replyError(CodeNotFound, "Subscription "+subscription+" not found", nil)
+		}
+		reply, err = e.forward(ctx, config, subscription, "REPLAY "+subscription+" "+from.options()+" PEER "+config.Identity.Fqdn)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, line := range []string{"220 DATA", reply, "220 OK"} {
+		if err := writeReply(rw, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forward runs command in the FNAA of the remote flow, returning its
+// answer.
+func (e *Endpoint) forward(ctx context.Context, config config.Config, flow string, command string) (string, error) {
+	r, err := newResolver(config, filepath.Dir(e.ConfigFile))
+	if err != nil {
+		return "", replyError(CodeUnavailable, "No nameserver available on this FNAA", err)
+	}
+	rconn, rrw, host, err := dialFlow(ctx, r, flow, client.Timeouts{
+		Dial:  config.Timeouts.Dial,
+		Read:  config.Timeouts.Read,
+		Write: config.Timeouts.Write,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer (*rconn).Close()
+
+	if err := authenticatePeer(ctx, config, rconn, rrw, host); err != nil {
+		return "", err
+	}
+	log.Printf("Executing command %v in FNAA %v", command, host)
+	response, err := client.SendCommand(ctx, rconn, rrw, command)
+	if err != nil {
+		return "", replyError(CodeUnavailable, "Command "+strings.Fields(command)[0]+" in FNAA "+host+" failed", err)
+	}
+	if _, err := client.SendCommand(ctx, rconn, rrw, "QUIT"); err != nil {
+		log.Printf("Error: Send command QUIT to FNAA %v failed, %v", host, err)
+	}
+	return response, nil
+}
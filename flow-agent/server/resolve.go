@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"flow-agent/client"
+	"flow-agent/config"
+	"log"
+	"net"
+	"resolver"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// answers are shared by the resolvers of every command, so remote FNAAs
+// are not looked up again until the TTL of their records runs out.
+var answers = resolver.NewMemoryCache()
+
+// newResolver returns the resolver names are looked up with: the
+// configured nameservers or else the system ones, over the configured
+// transport, caching answers and validating them with DNSSEC when a trust
+// anchor is configured. dir is the directory of the configuration file.
+func newResolver(cfg config.Config, dir string) (*resolver.Resolver, error) {
+	var (
+		r   *resolver.Resolver
+		err error
+	)
+	if cfg.Nameserver == "" {
+		r, err = resolver.FromResolvConf("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r = resolver.New(strings.Split(cfg.Nameserver, ",")...)
+	}
+	r.Logger = log.New(log.Writer(), log.Prefix(), log.Flags())
+	r.Cache = answers
+	if r.Transport, err = resolver.ParseTransport(cfg.Transport); err != nil {
+		return nil, err
+	}
+	if cfg.NameserverCA != "" {
+		if r.TLSConfig, err = resolver.TLSConfigFromCA(cfg.NameserverCAPath(dir)); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TrustAnchor != "" {
+		if r.TrustAnchors, err = resolver.ReadTrustAnchors(cfg.TrustAnchorPath(dir)); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// dialFlow connects to the FNAA serving flow, found through the
+// _fnaa._tcp.<namespace> SRV records of the closest parent domain of flow
+// having them. Targets are tried in RFC 2782 order until one accepts the
+// connection. It returns the FNAA host name it connected to.
+func dialFlow(ctx context.Context, r *resolver.Resolver, flow string, timeouts client.Timeouts) (*net.Conn, *bufio.ReadWriter, string, error) {
+	labels := dns.SplitDomainName(flow)
+	for i := 1; i < len(labels)-1; i++ {
+		namespace := strings.Join(labels[i:], ".")
+		records, err := r.LookupSRV(ctx, "_fnaa._tcp."+namespace)
+		if resolver.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, "", replyError(CodeUnavailable, "Could not discover FNAA for "+flow, err)
+		}
+		log.Printf("Flow %v belongs to remote namespace %v", flow, namespace)
+
+		endpoints, err := r.Endpoints(ctx, records)
+		if err != nil {
+			return nil, nil, "", replyError(CodeNotFound, "Could not resolve the FNAA of "+namespace, err)
+		}
+		for _, endpoint := range endpoints {
+			log.Printf("FNAA FQDN Resolved to %v port %v, connecting to %v", endpoint.Target, endpoint.Port, endpoint.IP)
+			conn, rw, err := client.Client(ctx, endpoint.IP.String(), endpoint.Port, timeouts)
+			if err == nil {
+				return conn, rw, endpoint.Target, nil
+			}
+			if ctx.Err() != nil {
+				return nil, nil, "", replyError(CodeUnavailable, "Connection to FNAA "+endpoint.Target+" failed", err)
+			}
+			log.Printf("Connection to FNAA %v failed: %v", endpoint.Address(), err)
+		}
+		return nil, nil, "", replyError(CodeUnavailable, "Connection to the FNAA of "+namespace+" failed", nil)
+	}
+	return nil, nil, "", replyError(CodeNotFound, "Could not discover FNAA for "+flow, nil)
+}
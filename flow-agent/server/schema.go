@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"flow-agent/config"
+	"flow-agent/schema"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// schemaChanges reads the schema options of a CREATE FLOW or UPDATE FLOW
+// command: "SCHEMA <type> <base64 definition> [MESSAGE <name>]",
+// "COMPATIBILITY <mode>" and "VALIDATE <policy>". ok is false if there is
+// none.
+func schemaChanges(line string) (changes schema.Changes, ok bool, err error) {
+	if typ, found := commandOption(line, "SCHEMA"); found {
+		args := strings.Fields(line)
+		definition := ""
+		for i := 1; i < len(args)-2; i++ {
+			if strings.EqualFold(args[i], "SCHEMA") {
+				definition = args[i+2]
+				break
+			}
+		}
+		if definition == "" {
+			return changes, false, replyError(CodeSyntax, "Missing argument SCHEMA <type> <definition>", nil)
+		}
+		changes.Schema.Type = strings.ToLower(typ)
+		changes.Schema.Definition, err = base64.StdEncoding.DecodeString(definition)
+		if err != nil {
+			return changes, false, replyError(CodeSyntax, "Schema definition is not base64", err)
+		}
+		changes.Schema.Message, _ = commandOption(line, "MESSAGE")
+		ok = true
+	}
+	if mode, found := commandOption(line, "COMPATIBILITY"); found {
+		if changes.Compatibility, err = schema.ParseCompatibility(mode); err != nil {
+			return changes, false, replyError(CodeSyntax, "Unknown compatibility "+mode, err)
+		}
+		ok = true
+	}
+	if policy, found := commandOption(line, "VALIDATE"); found {
+		if changes.Validation, err = schema.ParseValidation(policy); err != nil {
+			return changes, false, replyError(CodeSyntax, "Unknown validation "+policy, err)
+		}
+		ok = true
+	}
+	return changes, ok, nil
+}
+
+// registerSchema applies changes to the schema of flow, turning registry
+// errors into replies.
+func (e *Endpoint) registerSchema(flow string, changes schema.Changes, create bool) (schema.Subject, error) {
+	s, err := e.schemas.Register(flow, changes, create)
+	switch cause := errors.Cause(err).(type) {
+	case nil:
+		log.Printf("Schema of flow %v at version %v, compatibility %v, validation %v", flow, s.Latest().Version, s.Compatibility, s.Validation)
+		return s, nil
+	case *schema.InvalidError:
+		return s, replyError(CodeSyntax, "Invalid schema: "+oneLine(cause.Error()), nil)
+	case *schema.IncompatibleError:
+		return s, replyError(CodeForbidden, "Schema is incompatible: "+oneLine(cause.Error()), nil)
+	}
+	switch errors.Cause(err) {
+	case schema.ErrExists:
+		return s, replyError(CodeForbidden, "Flow "+flow+" already has a schema, use UPDATE FLOW", err)
+	case schema.ErrNotFound:
+		return s, replyError(CodeNotFound, "Flow "+flow+" has no schema", err)
+	}
+	return s, replyError(CodeUnavailable, "Could not save the schema of "+flow, err)
+}
+
+// oneLine joins the lines of a message, for it to fit in a reply.
+func oneLine(message string) string {
+	return strings.Join(strings.Fields(message), " ")
+}
+
+// handleUpdate handles "UPDATE FLOW <flow> [SCHEMA <type> <base64
+// definition> [MESSAGE <name>]] [COMPATIBILITY <mode>] [VALIDATE
+// <policy>] [CLOUDEVENTS <mode>] [ORDERING <policy>]". A new schema
+// becomes the next version of the schema of the flow if it is compatible
+// with the latest one, under the compatibility mode given or else the
+// current one. Only flows of local namespaces are updated.
+func handleUpdate(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) error {
+	line := scanner.Text()
+	log.Println("FULL COMMAND: " + line)
+	// Only users of this FNAA change the settings of its flows.
+	if _, err := e.authenticated(conn); err != nil {
+		return err
+	}
+	if resource, _ := commandArg(line, 1, "resource"); !strings.EqualFold(resource, "FLOW") {
+		return replyError(CodeNotFound, "Resource unavailable", nil)
+	}
+	flowName, err := commandArg(line, 2, "flow")
+	if err != nil {
+		return err
+	}
+	changes, withSchema, err := schemaChanges(line)
+	if err != nil {
+		return err
+	}
+	mode, withMode, err := contentModeOption(line)
+	if err != nil {
+		return err
+	}
+	ordering, withOrdering, err := orderingOption(line)
+	if err != nil {
+		return err
+	}
+	if !withSchema && !withMode && !withOrdering {
+		return replyError(CodeSyntax, "Missing argument SCHEMA, COMPATIBILITY, VALIDATE, CLOUDEVENTS or ORDERING", nil)
+	}
+	if _, local := flowNamespace(config, flowName); !local {
+		return replyError(CodeNotFound, "Flow "+flowName+" is not in a namespace of this FNAA", nil)
+	}
+
+	var s schema.Subject
+	found := false
+	if withSchema {
+		if s, err = e.registerSchema(flowName, changes, false); err != nil {
+			return err
+		}
+		found = true
+	} else if s, found, err = e.schemas.Subject(flowName); err != nil {
+		return replyError(CodeUnavailable, "Could not read the schema of "+flowName, err)
+	}
+	if withMode {
+		if err := e.setContentMode(config, flowName, mode); err != nil {
+			return err
+		}
+	}
+	if withOrdering {
+		if err := e.setOrdering(config, flowName, ordering); err != nil {
+			return err
+		}
+	}
+
+	fields := []string{"flow=" + flowName}
+	if found {
+		fields = append(fields, schemaFields(s, s.Latest(), false)...)
+	}
+	fields = append(fields, "cloudevents="+flowContentMode(e.Config(), flowName), "ordering="+flowOrdering(e.Config(), flowName))
+	for _, line := range []string{"220 DATA", strings.Join(fields, " "), "220 OK"} {
+		if err := writeReply(rw, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaFields describes version of the schema of a flow as key=value
+// fields, with its definition in base64 if withDefinition is set.
+func schemaFields(s schema.Subject, version schema.Schema, withDefinition bool) []string {
+	fields := []string{
+		"schema_type=" + version.Type,
+		"schema_version=" + strconv.Itoa(version.Version),
+	}
+	if version.Message != "" {
+		fields = append(fields, "schema_message="+version.Message)
+	}
+	fields = append(fields,
+		"schema_compatibility="+s.Compatibility,
+		"schema_validation="+s.Validation,
+	)
+	if withDefinition {
+		fields = append(fields, "schema="+base64.StdEncoding.EncodeToString(version.Definition))
+	}
+	return fields
+}
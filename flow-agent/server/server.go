@@ -1,23 +1,29 @@
 package server
 
 import (
+	"broker"
 	"bufio"
+	"context"
 	"encoding/base64"
 	"flow-agent/client"
 	"flow-agent/commons"
 	"flow-agent/config"
+	"flow-agent/schema"
 	"log"
 	"net"
-	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/pkg/errors"
 )
 
-// A function that creates SASL servers.
-type SASLServerFactory func(*Endpoint) sasl.Server
+// A function that creates SASL servers for a connection.
+type SASLServerFactory func(*Endpoint, net.Conn) sasl.Server
 
 // A struct with a mix of fields, used for the GOB example.
 // type complexData struct {
@@ -47,24 +53,125 @@ create an `Endpoint` object with the following properties:
 // It receives the open connection wrapped in a `ReadWriter` interface.
 // type HandleFunc func(*bufio.ReadWriter)
 
-type HandleFunc func(*Endpoint, net.Conn, *bufio.ReadWriter, *bufio.Scanner, config.Config)
+// The context is cancelled when the command exceeds the configured
+// command timeout, and must be passed on to any outbound I/O. A returned
+// error is logged and reported to the FNUA as an error reply; the handler
+// must not have written a final reply in that case.
+type HandleFunc func(context.Context, *Endpoint, net.Conn, *bufio.ReadWriter, *bufio.Scanner, config.Config) error
+
+// ReplyError is a command failure with the FNAP reply that describes it
+// to the FNUA. The wrapped error carries the details that are only logged.
+type ReplyError struct {
+	Code    int
+	Message string
+	Err     error
+}
+
+func (r *ReplyError) Error() string {
+	if r.Err == nil {
+		return r.Message
+	}
+	return r.Message + ": " + r.Err.Error()
+}
+
+// ProtocolVersion is the FNAP version spoken by this FNAA.
+const ProtocolVersion = "FNAP/0.1"
+
+// Formats lists the data formats replies can be encoded in.
+var Formats = []string{"kv"}
+
+// Reply codes used for failed commands.
+const (
+	CodeSyntax       = 501
+	CodeNotFound     = 404
+	CodeUnavailable  = 451
+	CodeAuthRequired = 530
+	CodeForbidden    = 550
+)
+
+// replyError builds a ReplyError with the given code and message.
+func replyError(code int, message string, err error) error {
+	return &ReplyError{Code: code, Message: message, Err: err}
+}
+
+// writeReply writes a single reply line and flushes it.
+func writeReply(rw *bufio.ReadWriter, line string) error {
+	if _, err := rw.WriteString(line + "\r\n"); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// commandOption returns the word following keyword in a command line,
+// such as the destination in "SUBSCRIBE <flow> LOCAL <dst>".
+func commandOption(line string, keyword string) (string, bool) {
+	args := strings.Fields(line)
+	for i := 1; i < len(args)-1; i++ {
+		if strings.EqualFold(args[i], keyword) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// commandArg returns the n-th space separated word of a command line, or
+// a syntax error naming the missing argument.
+func commandArg(line string, n int, name string) (string, error) {
+	args := strings.Fields(line)
+	if n >= len(args) {
+		return "", replyError(CodeSyntax, "Missing argument "+name, nil)
+	}
+	return args[n], nil
+}
 
 // Endpoint provides an endpoint to other processess
 // that they can send data to.
 type Endpoint struct {
-	listener      net.Listener
-	handler       map[string]HandleFunc
-	auths         map[string]SASLServerFactory
-	connection    net.Conn
-	rw            *bufio.ReadWriter
-	authenticated bool
+	listener   net.Listener
+	handler    map[string]HandleFunc
+	auths      map[string]SASLServerFactory
+	connection net.Conn
+	rw         *bufio.ReadWriter
 	// Maps are not threadsafe, so we need a mutex to control access.
 	m sync.RWMutex
+
+	// cfg is swapped on reload, guarded by cm.
+	cfg config.Config
+	cm  sync.RWMutex
+
+	// Open sessions and the shutdown state, guarded by sm. wg counts
+	// the connections that are still being handled.
+	sessions map[net.Conn]*session
+	closing  bool
+	sm       sync.Mutex
+	wg       sync.WaitGroup
+
+	// Namespaces are created one at a time, guarded by nm, so two
+	// sessions cannot publish the same one.
+	nm sync.Mutex
+
+	// ConfigFile is where namespaces created at runtime are saved. They
+	// are only kept in memory if it is empty.
+	ConfigFile string
+
+	// schemas holds the schemas of the flows, opened by Listen.
+	schemas *schema.Registry
+
+	// Running flow processors by destination flow, guarded by pm.
+	processors map[string]*processor
+	// Running distributors by source flow, guarded by pm.
+	distributors map[string]*distributor
+	pm           sync.Mutex
 }
 
 // server listens for incoming requests and dispatches them to
-// registered handler functions.
-func Server(config config.Config) error {
+// registered handler functions until ctx is cancelled.
+func Server(ctx context.Context, config config.Config) error {
+	return NewServer().Listen(ctx, config)
+}
+
+// NewServer creates an endpoint with all FNAP commands registered.
+func NewServer() *Endpoint {
 	endpoint := NewEndpoint()
 
 	// Add the handle funcs.
@@ -73,13 +180,15 @@ func Server(config config.Config) error {
 	endpoint.AddHandleFunc("quit", handleQuit)
 	endpoint.AddHandleFunc("authenticate", handleAuth)
 	endpoint.AddHandleFunc("create", handleCreate)
+	endpoint.AddHandleFunc("update", handleUpdate)
 	endpoint.AddHandleFunc("subscribe", handleSubscribe)
+	endpoint.AddHandleFunc("replay", handleReplay)
 	endpoint.AddHandleFunc("describe", handleDescribe)
 	endpoint.AddHandleFunc("desc", handleDescribe)
 	endpoint.AddHandleFunc("get", handleGet)
+	endpoint.AddHandleFunc("capability", handleCapability)
 
-	// Start listening.
-	return endpoint.Listen(config)
+	return endpoint
 }
 
 // NewEndpoint creates a new endpoint. To keep things simple,
@@ -87,17 +196,20 @@ func Server(config config.Config) error {
 func NewEndpoint() *Endpoint {
 	// Create a new Endpoint with an empty list of handler funcs.
 	return &Endpoint{
-		handler:       map[string]HandleFunc{},
-		authenticated: false,
+		handler:      map[string]HandleFunc{},
+		sessions:     map[net.Conn]*session{},
+		processors:   map[string]*processor{},
+		distributors: map[string]*distributor{},
 		// auths:   nil,
 		auths: map[string]SASLServerFactory{
-			sasl.Plain: func(e *Endpoint) sasl.Server {
+			sasl.Plain: func(e *Endpoint, conn net.Conn) sasl.Server {
 				return sasl.NewPlainServer(func(identity, username, password string) error {
 					if identity != "" && identity != username {
 						log.Println("Identities not supported")
 					}
 
-					if username != "test" || password != "test" {
+					user, ok := e.Config().User(username)
+					if !ok || user.Password != password {
 						return errors.New("Invalid credentials")
 					}
 					// if username != "test" {
@@ -120,7 +232,7 @@ func NewEndpoint() *Endpoint {
 					// 	log.Println("identity: " + identity)
 
 					// }
-					e.authenticated = true
+					e.authenticate(conn, username)
 
 					return nil
 				})
@@ -139,33 +251,75 @@ func (e *Endpoint) AddHandleFunc(name string, f HandleFunc) {
 // Listen starts listening on the endpoint port on all interfaces.
 // At least one handler function must have been added
 // through AddHandleFunc() before.
-func (e *Endpoint) Listen(config config.Config) error {
+// Once ctx is cancelled it stops accepting connections and returns after
+// the in-flight sessions have been drained.
+func (e *Endpoint) Listen(ctx context.Context, config config.Config) error {
+	e.SetConfig(config)
+	if e.schemas == nil {
+		dir := ""
+		if e.ConfigFile != "" {
+			dir = config.SchemaDirPath(filepath.Dir(e.ConfigFile))
+		}
+		e.schemas = schema.NewRegistry(dir)
+	}
+
 	var err error
 	e.listener, err = net.Listen("tcp", ":"+config.Port)
 	if err != nil {
 		return errors.Wrapf(err, "Unable to listen on port %s\n", config.Port)
 	}
 	log.Println("Listen on", e.listener.Addr().String())
+
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down, no longer accepting connections.")
+		e.listener.Close()
+	}()
+
+	// Sessions outlive ctx so they can be drained; they are only
+	// cancelled when draining takes too long.
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	for {
 		log.Println("Accept a connection request.")
 		conn, err := e.listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			log.Println("Failed accepting a connection request:", err)
 			continue
 		}
+		s := e.track(conn)
+		if s == nil {
+			conn.Close()
+			continue
+		}
 		log.Println("Handle incoming messages.")
-		go e.handleMessages(conn, config)
+		go e.handleMessages(sessionCtx, s)
 	}
+
+	e.drain(cancel)
+	e.stopProcessors()
+	return nil
 }
 
 // handleMessages reads the connection up to the first newline.
 // Based on this string, it calls the appropriate HandleFunc.
-func (e *Endpoint) handleMessages(conn net.Conn, config config.Config) {
+func (e *Endpoint) handleMessages(ctx context.Context, s *session) {
+	defer e.untrack(s)
+
+	// Drop connections that stay silent for longer than the idle timeout
+	// or stop accepting our replies.
+	timeouts := e.Config().Timeouts
+	conn := client.WithTimeouts(s.conn, timeouts.Idle, timeouts.Write)
+
 	// Wrap the connection into a buffered reader for easier reading.
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	defer conn.Close()
 
-	_, err := rw.WriteString("220 fnaa.unix.ar FNAA\r\n")
+	_, err := rw.WriteString("220 " + e.Config().Identity.Fqdn + " FNAA\r\n")
 	if err != nil {
 		log.Println("Welcome failed.", err)
 	}
@@ -180,6 +334,7 @@ func (e *Endpoint) handleMessages(conn net.Conn, config config.Config) {
 		log.Printf("Invalid input: %s", err)
 	}
 
+	draining := false
 	for scanner.Scan() {
 		cmd := strings.Split(scanner.Text(), " ")[0]
 		cmd = strings.ToLower(cmd)
@@ -202,11 +357,28 @@ func (e *Endpoint) handleMessages(conn net.Conn, config config.Config) {
 			// return
 		} else {
 			//handleCommand(rw)
-			handleCommand(e, conn, rw, scanner, config)
+			if draining = !e.begin(s); draining {
+				break
+			}
+			e.runCommand(ctx, handleCommand, cmd, s.conn, rw, scanner, e.Config())
+			if draining = e.end(s); draining {
+				break
+			}
 		}
 
 	}
 
+	if draining {
+		if err := writeReply(rw, "421 FNAA shutting down"); err != nil {
+			log.Println("Writing shutdown reply failed.", err)
+		}
+		return
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Println("Closing connection from "+conn.RemoteAddr().String()+":", err)
+	}
+
 	// Read from the connection until EOF. Expect a command name as the
 	// next input. Call the handler that is registered for this command.
 	// for {
@@ -236,6 +408,48 @@ func (e *Endpoint) handleMessages(conn net.Conn, config config.Config) {
 	// }
 }
 
+// runCommand calls a handler and turns both returned errors and panics
+// into an error reply, so a failing command never takes the FNAA down.
+func (e *Endpoint) runCommand(ctx context.Context, handleCommand HandleFunc, cmd string, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) {
+	ctx, cancel := commandContext(ctx, config.Timeouts.Command)
+	defer cancel()
+
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.Errorf("panic: %v", r)
+			}
+		}()
+		err = handleCommand(ctx, e, conn, rw, scanner, config)
+	}()
+	if err == nil {
+		return
+	}
+
+	reply, ok := errors.Cause(err).(*ReplyError)
+	if !ok {
+		if ctx.Err() == context.DeadlineExceeded {
+			reply = &ReplyError{Code: CodeUnavailable, Message: "Command timed out"}
+		} else {
+			reply = &ReplyError{Code: CodeUnavailable, Message: "Command failed"}
+		}
+	}
+	log.Printf("Command '%v' from %v failed: %v", cmd, conn.RemoteAddr(), err)
+
+	if err := writeReply(rw, strconv.Itoa(reply.Code)+" "+reply.Message); err != nil {
+		log.Println("Writing error reply failed.", err)
+	}
+}
+
+// commandContext derives the context a single command runs under.
+func commandContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
 /* Now let's create two handler functions. The easiest case is where our
 ad-hoc protocol only sends string data.
 
@@ -249,23 +463,18 @@ AHRlc3QAdGVzdA==
 */
 
 /*********************** HANDLERS ***********************/
-func handleAuth(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) {
+func handleAuth(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) error {
 	// Receive a string.
 	// rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 
 	log.Println("FULL COMMAND: " + scanner.Text())
-	mech := strings.Split(scanner.Text(), " ")[1]
+	mech, err := commandArg(scanner.Text(), 1, "mechanism")
+	if err != nil {
+		return err
+	}
 	mech = strings.ToLower(mech)
 	if mech != "plain" {
-		_, err := rw.WriteString("404 Authentication method not available\r\n")
-		if err != nil {
-			log.Println("Authentication method not available", err)
-		}
-		err = rw.Flush()
-		if err != nil {
-			log.Println("Authentication method not available flush failed.", err)
-		}
-		return
+		return replyError(CodeNotFound, "Authentication method not available", nil)
 	} else {
 		_, err := rw.WriteString("220 OK\r\n")
 		if err != nil {
@@ -312,7 +521,7 @@ func handleAuth(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio
 		log.Printf("Invalid input: %s", err)
 	}
 
-	saslServer := e.auths[sasl.Plain](e)
+	saslServer := e.auths[sasl.Plain](e, conn)
 	challenge, done, err := saslServer.Next(nil)
 	if err != nil {
 		log.Println("Error while starting server:", err)
@@ -326,19 +535,11 @@ func handleAuth(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio
 
 	if scanner.Scan() {
 		token := scanner.Text()
-		log.Println("Received token " + token)
+		log.Println("Received token (" + strconv.Itoa(len(token)) + " bytes, redacted)")
 
 		data, err := base64.StdEncoding.DecodeString(token)
 		if err != nil {
-			_, err := rw.WriteString("404 Authentication failed\r\n")
-			if err != nil {
-				log.Println("Authentication failed.", err)
-			}
-			err = rw.Flush()
-			if err != nil {
-				log.Println("Authentication failed flush failed.", err)
-			}
-			return
+			return replyError(CodeNotFound, "Authentication failed", err)
 		}
 		// expected := []byte{105, 100, 101, 110, 116, 105, 116, 121, 0, 117, 115, 101, 114, 110, 97, 109, 101, 0, 112, 97, 115, 115, 119, 111, 114, 100}
 
@@ -354,17 +555,8 @@ func handleAuth(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio
 			log.Println("Invalid non-empty final challenge:", challenge)
 		}
 
-		if !e.authenticated {
-			log.Println("Not authenticated")
-			_, err := rw.WriteString("404 Authentication failed\r\n")
-			if err != nil {
-				log.Println("Authentication failed.", err)
-			}
-			err = rw.Flush()
-			if err != nil {
-				log.Println("Authentication failed flush failed.", err)
-			}
-
+		if s := e.session(conn); s == nil || !s.authenticated {
+			return replyError(CodeNotFound, "Authentication failed", err)
 		} else {
 			log.Println("User authenticated")
 
@@ -379,52 +571,59 @@ func handleAuth(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio
 		}
 	}
 
-	return
+	return scanner.Err()
 }
 
 // handleStrings handles the "STRING" request.
-func handleGet(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) {
+func handleGet(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) error {
 	// Receive a string.
 	// rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	log.Println("FULL COMMAND: " + scanner.Text())
 	log.Println(strings.Split(scanner.Text(), " "))
 
-	response := ""
-	resourceName := strings.Split(scanner.Text(), " ")[1]
+	resourceName, err := commandArg(scanner.Text(), 1, "resource")
+	if err != nil {
+		return err
+	}
 
-	switch resourceName {
+	// Every item is sent as a line of space separated key=value pairs.
+	var items []string
+	switch strings.ToLower(resourceName) {
 	case "namespaces", "ns":
-		response += "220 DATA \n"
-		response += "namespace=flow.unix.ar\n"
-		response += "220 OK"
+		for _, namespace := range config.Namespaces {
+			items = append(items, "namespace="+namespace.Name+" broker="+namespace.Broker)
+		}
 
 	case "flows", "fl":
-		response += "220 DATA \n"
-		response += "flow=time.flow.unix.ar\n"
-		response += "220 OK"
+		for _, flow := range config.Flows {
+			items = append(items, "flow="+flow.Uri+" namespace="+flow.Namespace)
+		}
 
 	default:
-		response += "404 Resource unavailable"
+		return replyError(CodeNotFound, "Resource unavailable", nil)
 	}
 
-	_, err := rw.WriteString(response + "\r\n")
-	if err != nil {
-		log.Println("Write DATA failed.", err)
-	}
-	err = rw.Flush()
-	if err != nil {
-		log.Println("Flush failed.", err)
+	lines := append([]string{"220 DATA"}, items...)
+	lines = append(lines, "220 OK")
+	for _, line := range lines {
+		if err := writeReply(rw, line); err != nil {
+			log.Println("Write DATA failed.", err)
+			return nil
+		}
 	}
-	return
+	return nil
 }
 
 // handleStrings handles the "STRING" request.
-func handleDescribe(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) {
+func handleDescribe(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) error {
 	// Receive a string.
 	// rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	log.Println("FULL COMMAND: " + scanner.Text())
 	log.Println(strings.Split(scanner.Text(), " "))
-	flowName := strings.Split(scanner.Text(), " ")[2]
+	flowName, err := commandArg(scanner.Text(), 2, "flow")
+	if err != nil {
+		return err
+	}
 	log.Println("Resolving flow endpoint " + flowName)
 	// Considering ksdj898
 
@@ -438,12 +637,44 @@ func handleDescribe(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *b
 	// response = response + "time.flow.unix.ar IN PTR _fnaa._tcp.time.flow.unix.ar\r\n"
 	// response = response + "queue._fnaa._tcp.time.flow.unix.ar IN SRV kf1.unix.ar\r\n"
 	// response = response + "queue._fnaa._tcp.time.flow.unix.ar IN TXT type=kafka topic=ksdj898.time.flow.unix.ar\r\n"
+	d, ok := flowDescriptor(config, flowName)
+	if !ok {
+		return replyError(CodeNotFound, "Flow "+flowName+" is not in a namespace of this FNAA", nil)
+	}
 	response := "flow=" + flowName + "\n"
-	response += "type=kafka\n"
-	response += "topic=" + flowName + "\n"
-	response += "server=kf1.unix.ar:9092\n"
+	response += "type=" + d.Type + "\n"
+	response += "topic=" + d.Topic + "\n"
+	response += "server=" + strings.Join(d.Servers, ",") + "\n"
 
-	_, err := rw.WriteString("220 DATA \r\n")
+	// The schema is described at its latest version, or the one asked
+	// for with "VERSION <n>".
+	s, ok, err := e.schemas.Subject(flowName)
+	if err != nil {
+		return replyError(CodeUnavailable, "Could not read the schema of "+flowName, err)
+	}
+	requested, versioned := commandOption(scanner.Text(), "VERSION")
+	if versioned && !ok {
+		return replyError(CodeNotFound, "Flow "+flowName+" has no schema", nil)
+	}
+	if ok {
+		version := s.Latest()
+		if versioned {
+			n, err := strconv.Atoi(requested)
+			if err != nil {
+				return replyError(CodeSyntax, "VERSION needs a version number, not "+requested, err)
+			}
+			if version, ok = s.Version(n); !ok {
+				return replyError(CodeNotFound, "Schema version "+requested+" of "+flowName+" not found", nil)
+			}
+		}
+		response += strings.Join(schemaFields(s, version, true), "\n") + "\n"
+	}
+	if mode := flowContentMode(config, flowName); mode != broker.Plain {
+		response += "cloudevents=" + mode + "\n"
+	}
+	response += "ordering=" + flowOrdering(config, flowName) + "\n"
+
+	_, err = rw.WriteString("220 DATA \r\n")
 	if err != nil {
 		log.Println("Write DATA failed.", err)
 	}
@@ -468,44 +699,76 @@ func handleDescribe(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *b
 	if err != nil {
 		log.Println("Flush failed.", err)
 	}
-	return
+	return nil
 }
 
 // handleStrings handles the "STRING" request.
-func handleSubscribe(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) {
+func handleSubscribe(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) error {
 	// Receive a string.
 	// rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	log.Println("FULL COMMAND: " + scanner.Text())
 	log.Println(strings.Split(scanner.Text(), " "))
-	flowNameSrc := strings.Split(scanner.Text(), " ")[1]
+	// Subscriptions have this FNAA copy flows, and peer with remote ones
+	// for them, so only its users and the peers acting through them ask
+	// for them. Anonymous sessions only describe and list.
+	if _, err := e.authenticated(conn); err != nil {
+		return err
+	}
+	flowNameSrc, err := commandArg(scanner.Text(), 1, "flow")
+	if err != nil {
+		return err
+	}
+	// The FNAA of the flow filters and projects the events it copies,
+	// from the position asked for and as many times as asked for.
+	sel, err := subscriptionSelection(scanner.Text())
+	if err != nil {
+		return err
+	}
+	delivery, err := deliveryMode(scanner.Text())
+	if err != nil {
+		return err
+	}
+	recipient, err := encryptionKey(scanner.Text())
+	if err != nil {
+		return err
+	}
+	verify := verifyOption(scanner.Text())
+	from, err := startPosition(scanner.Text())
+	if err != nil {
+		return err
+	}
 
 	// nameserver := flag.String("nameserver", "", "Nameserver to use")
 	// user := flag.String("user", "", "Nameserver to use")
 	// password := flag.String("password", "", "Nameserver to use")
-	nameserver := config.Nameserver
-	if nameserver == "" {
-		log.Println("No Nameserver specified, use --nameserver")
-		os.Exit(1)
-	}
-
 	// First, check if namespace if local
-	local := false
-	for _, namespace := range config.Namespaces {
-		if strings.Contains(flowNameSrc, namespace.Name) {
-			local = true
-		}
-	}
+	_, local := flowNamespace(config, flowNameSrc)
 
 	if local {
 		//Namespace is local, creating subscription
-		log.Println("Creating flow endpoint " + flowNameSrc)
-		log.Println("Creating new topic ksdj898." + flowNameSrc + " in Apache Kafka instance kafka_local")
-		log.Println("Creating Flow Processor src=" + flowNameSrc + " dst=ksdj898." + flowNameSrc)
-		log.Println("Adding DNS Records for ksdj898." + flowNameSrc)
+		// Copies requested by a remote FNAA are named after it, local
+		// ones after this FNAA.
+		subscriber, err := e.subscriber(conn, config, scanner.Text())
+		if err != nil {
+			return err
+		}
+		subscription := subscriptionName(subscriber, flowNameSrc)
+		if verify {
+			if _, key, err := signingKey(config, filepath.Dir(e.ConfigFile), flowNameSrc); err != nil || key == nil {
+				return replyError(CodeForbidden, "Flow "+flowNameSrc+" is not signed", err)
+			}
+		}
+		log.Println("Creating flow endpoint " + flowNameSrc + " for " + subscriber)
+		log.Println("Creating new topic " + subscription + " in Apache Kafka instance kafka_local")
+		log.Println("Creating Flow Processor src=" + flowNameSrc + " dst=" + subscription)
+		if err := e.startProcessor(config, flowNameSrc, subscription, sel, delivery, recipient, from); err != nil {
+			return replyError(CodeUnavailable, "Could not create the flow processor of "+subscription, err)
+		}
+		log.Println("Adding DNS Records for " + subscription)
 
-		log.Println("Flow enabled ksdj898." + flowNameSrc)
+		log.Println("Flow enabled " + subscription)
 
-		_, err := rw.WriteString("220 DATA\r\n")
+		_, err = rw.WriteString("220 DATA\r\n")
 		if err != nil {
 			log.Println("Write BYE failed.", err)
 		}
@@ -514,7 +777,7 @@ func handleSubscribe(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *
 			log.Println("Flush failed.", err)
 		}
 
-		_, err = rw.WriteString("ksdj898." + flowNameSrc + "\r\n")
+		_, err = rw.WriteString(subscription + "\r\n")
 		if err != nil {
 			log.Println("Write BYE failed.", err)
 		}
@@ -533,7 +796,15 @@ func handleSubscribe(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *
 		}
 	} else {
 		log.Println("Flow is REMOTE")
-		flowNameDst := strings.Split(scanner.Text(), " ")[3]
+		flowNameDst, err := commandArg(scanner.Text(), 3, "local flow")
+		if err != nil {
+			return err
+		}
+		// Verified copies are written to the local flow by this FNAA,
+		// which only keeps the flows of its namespaces.
+		if _, ok := flowDescriptor(config, flowNameDst); verify && !ok {
+			return replyError(CodeNotFound, "Flow "+flowNameDst+" is not in a namespace of this FNAA", nil)
+		}
 
 		//Discover FNAA
 		//Connect to FNAA
@@ -541,42 +812,39 @@ func handleSubscribe(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *
 		//Subscribe to flow
 		//Create local flow
 		//Launch FP
-		server, result := client.ServiceResolve(flowNameSrc+".", nameserver)
-
-		if !result {
-			log.Printf("Error: Could not resolve SRV RR for FQDN %v", flowNameSrc)
-			os.Exit(1)
+		r, err := newResolver(config, filepath.Dir(e.ConfigFile))
+		if err != nil {
+			return replyError(CodeUnavailable, "No nameserver available on this FNAA", err)
 		}
-
-		// log.Printf("DNS Resolution result: %v:%v", server.Host, server.Port)
-
-		log.Printf("FNAA FQDN Resolved to %v port %v", server.Host, server.Port)
-
-		address, result := client.AddressResolve(server.Host, nameserver)
-		if !result {
-			log.Printf("Error: Could not resolve A RR for FQDN %v", server.Host)
-			os.Exit(1)
+		// Copies are only asked for if they can be verified, and must be
+		// signed by the namespace publishing the keys.
+		var signer string
+		if verify {
+			namespace, keys, err := remoteSigningKeys(ctx, r, flowNameSrc)
+			if err != nil {
+				return replyError(CodeUnavailable, "Could not look up the signing keys of "+flowNameSrc, err)
+			}
+			if len(keys) == 0 {
+				return replyError(CodeForbidden, "Flow "+flowNameSrc+" is not signed, its namespace publishes no signing key", nil)
+			}
+			log.Printf("Flow %v is signed by namespace %v with %v keys", flowNameSrc, namespace, len(keys))
+			signer = namespace
 		}
-		// log.Printf("Connecting to %v port %v", address, server.Port)
-
-		// conn, rw, err := client.Client(address, server.Port)
-		Rconn, Rrw, Rerr := client.Client(address, server.Port)
-
+		Rconn, Rrw, host, Rerr := dialFlow(ctx, r, flowNameSrc, client.Timeouts{
+			Dial:  config.Timeouts.Dial,
+			Read:  config.Timeouts.Read,
+			Write: config.Timeouts.Write,
+		})
 		if Rerr != nil {
-			log.Printf("Error: Connection to FNAA %v failed, %v", server.Host, Rerr)
-			os.Exit(1)
+			return Rerr
 		}
-
 		c := *Rconn
 		defer c.Close()
 
 		log.Printf("Connected to FNAA")
 		log.Printf("Authenticating with PLAIN mechanism")
-		_, Rerr = client.AuthenticatePlain(Rconn, Rrw, "test", "test")
-
-		if Rerr != nil {
-			log.Printf("Error: Authentication to FNAA %v failed, %v", server.Host, Rerr)
-			os.Exit(1)
+		if err := authenticatePeer(ctx, config, Rconn, Rrw, host); err != nil {
+			return err
 		}
 
 		log.Printf("Authenticated")
@@ -584,23 +852,52 @@ func handleSubscribe(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *
 		/* EXECUTING COMMAND CREATE FLOW */
 		log.Printf("Executing command SUBSCRIBE " + flowNameSrc)
 
-		command := "SUBSCRIBE " + flowNameSrc
-		response, err := client.SendCommand(Rconn, Rrw, command)
+		// Identify ourselves so the remote FNAA names the copy after us.
+		command := "SUBSCRIBE " + flowNameSrc + " PEER " + config.Identity.Fqdn
+		if options := selectionOptions(sel); options != "" {
+			command += " " + options
+		}
+		if delivery != atLeastOnce {
+			command += " DELIVERY " + strings.ToUpper(delivery)
+		}
+		if recipient != nil {
+			command += " ENCRYPT " + base64.StdEncoding.EncodeToString(recipient)
+		}
+		if verify {
+			command += " VERIFY"
+		}
+		if from != nil {
+			command += " " + from.options()
+		}
+		response, err := client.SendCommand(ctx, Rconn, Rrw, command)
 
 		if err != nil {
-			log.Printf("Error: Create Flow %v in FNAA %v failed, %v", flowNameSrc, server.Host, err)
-			os.Exit(1)
+			return replyError(CodeUnavailable, "Subscription to "+flowNameSrc+" in FNAA "+host+" failed", err)
 		}
 
 		log.Printf("Flow %v subscribed successfully", flowNameSrc)
 		log.Printf("Server responded: %v", response)
 
+		// Verified copies reach the local flow through a processor
+		// checking their signature against the keys their namespace
+		// publishes, the remote FNAA not being trusted to.
+		if verify {
+			d, err := describeCopy(ctx, Rconn, Rrw, response)
+			if err != nil {
+				return replyError(CodeUnavailable, "Could not describe "+response+" in FNAA "+host, err)
+			}
+			if err := e.startVerifier(config, d, flowNameDst, delivery, signer); err != nil {
+				return replyError(CodeUnavailable, "Could not create the flow processor of "+flowNameDst, err)
+			}
+		}
+
 		log.Printf("Quitting")
 		command = "QUIT"
-		_, err = client.SendCommand(Rconn, Rrw, command)
+		_, err = client.SendCommand(ctx, Rconn, Rrw, command)
 		if err != nil {
-			log.Printf("Error: Send command %v to FNAA %v failed, %v", command, server.Host, err)
-			os.Exit(1)
+			// The subscription already exists remotely, so a failed
+			// goodbye is not worth failing the command for.
+			log.Printf("Error: Send command %v to FNAA %v failed, %v", command, host, err)
 		}
 
 		c.Close()
@@ -638,22 +935,68 @@ func handleSubscribe(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *
 
 	//Namespace is not local, creating a new remote
 
-	return
+	return nil
 }
 
 // handleStrings handles the "STRING" request.
-func handleCreate(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) {
+func handleCreate(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) error {
 	// Receive a string.
 	// rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	log.Println("FULL COMMAND: " + scanner.Text())
 	log.Println(strings.Split(scanner.Text(), " "))
-	flowName := strings.Split(scanner.Text(), " ")[2]
+	if resource, _ := commandArg(scanner.Text(), 1, "resource"); strings.EqualFold(resource, "NAMESPACE") {
+		return handleCreateNamespace(ctx, e, conn, rw, scanner, config)
+	}
+	// Only users of this FNAA create flows in it.
+	if _, err := e.authenticated(conn); err != nil {
+		return err
+	}
+	flowName, err := commandArg(scanner.Text(), 2, "flow")
+	if err != nil {
+		return err
+	}
+	changes, withSchema, err := schemaChanges(scanner.Text())
+	if err != nil {
+		return err
+	}
+	mode, withMode, err := contentModeOption(scanner.Text())
+	if err != nil {
+		return err
+	}
+	ordering, withOrdering, err := orderingOption(scanner.Text())
+	if err != nil {
+		return err
+	}
 	log.Println("Creating flow " + flowName)
+	reply := "220 OK " + flowName
+	_, local := flowNamespace(config, flowName)
+	if (withSchema || withMode || withOrdering) && !local {
+		return replyError(CodeNotFound, "Flow "+flowName+" is not in a namespace of this FNAA", nil)
+	}
+	if withSchema {
+		s, err := e.registerSchema(flowName, changes, true)
+		if err != nil {
+			return err
+		}
+		reply += " SCHEMA VERSION " + strconv.Itoa(s.Latest().Version)
+	}
+	// Flows of local namespaces are recorded, for their content mode
+	// and ordering policy.
+	if _, recorded := config.Flow(flowName); local && (withMode || !recorded) {
+		if err := e.setContentMode(config, flowName, mode); err != nil {
+			return err
+		}
+	}
+	if withOrdering {
+		if err := e.setOrdering(config, flowName, ordering); err != nil {
+			return err
+		}
+	}
 	log.Println("Creating new topic " + flowName + ".local in Apache Kafka instance kafka_local")
 	log.Println("Adding DNS Records for " + flowName)
 	log.Println("Flow enabled " + flowName)
 
-	_, err := rw.WriteString("220 OK " + flowName + "\r\n")
+	_, err = rw.WriteString(reply + "\r\n")
 	if err != nil {
 		log.Println("Write BYE failed.", err)
 	}
@@ -661,11 +1004,11 @@ func handleCreate(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *buf
 	if err != nil {
 		log.Println("Flush failed.", err)
 	}
-	return
+	return nil
 }
 
 // handleStrings handles the "STRING" request.
-func handleQuit(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) {
+func handleQuit(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) error {
 	// Receive a string.
 	// rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	log.Println("FULL COMMAND: " + scanner.Text())
@@ -678,7 +1021,7 @@ func handleQuit(e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio
 		log.Println("Flush failed.", err)
 	}
 	conn.Close()
-	return
+	return nil
 }
 
 // handleStrings handles the "STRING" request.
@@ -701,3 +1044,47 @@ func handleStrings(e *Endpoint, rw *bufio.ReadWriter) {
 		log.Println("Flush failed.", err)
 	}
 }
+
+// subscriptionName names the copy of flow created for subscriber, turning
+// the subscriber FQDN into a single DNS label in front of the flow name.
+func subscriptionName(subscriber string, flow string) string {
+	label := strings.Replace(strings.TrimSuffix(subscriber, "."), ".", "-", -1)
+	return label + "." + flow
+}
+
+// handleCapability lists the protocol version, identity, authentication
+// mechanisms, data formats and commands supported by this FNAA.
+func handleCapability(ctx context.Context, e *Endpoint, conn net.Conn, rw *bufio.ReadWriter, scanner *bufio.Scanner, config config.Config) error {
+	log.Println("FULL COMMAND: " + scanner.Text())
+
+	e.m.RLock()
+	var commands []string
+	for name := range e.handler {
+		commands = append(commands, strings.ToUpper(name))
+	}
+	var mechanisms []string
+	for name := range e.auths {
+		mechanisms = append(mechanisms, strings.ToUpper(name))
+	}
+	e.m.RUnlock()
+	sort.Strings(commands)
+	sort.Strings(mechanisms)
+
+	lines := []string{
+		"220 DATA",
+		"version=" + ProtocolVersion,
+		"fqdn=" + config.Identity.Fqdn,
+		"target=" + net.JoinHostPort(config.Identity.Target(), config.Identity.AdvertisedPort(config.Port)),
+		"mechanisms=" + strings.Join(mechanisms, ","),
+		"formats=" + strings.Join(Formats, ","),
+		"commands=" + strings.Join(commands, ","),
+		"220 OK",
+	}
+	for _, line := range lines {
+		if err := writeReply(rw, line); err != nil {
+			log.Println("Write DATA failed.", err)
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"flow-agent/client"
+	"flow-agent/config"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// session is the state of a single FNUA connection.
+type session struct {
+	conn net.Conn
+	// busy is set while a command is being executed.
+	busy          bool
+	authenticated bool
+	user          string
+}
+
+// Config returns the configuration new commands are executed with.
+func (e *Endpoint) Config() config.Config {
+	e.cm.RLock()
+	defer e.cm.RUnlock()
+	return e.cfg
+}
+
+// SetConfig replaces the configuration of a running endpoint. Commands
+// already being executed finish with the configuration they started
+// with, and open connections are kept. Flow processors whose settings
+// changed are restarted with it.
+func (e *Endpoint) SetConfig(cfg config.Config) {
+	e.cm.Lock()
+	old := e.cfg
+	e.cfg = cfg
+	e.cm.Unlock()
+
+	if old.Port != "" && old.Port != cfg.Port {
+		log.Printf("Port change from %v to %v requires a restart", old.Port, cfg.Port)
+	}
+	e.reloadProcessors(old, cfg)
+}
+
+// track registers a new connection. It returns nil once the endpoint is
+// shutting down.
+func (e *Endpoint) track(conn net.Conn) *session {
+	e.sm.Lock()
+	defer e.sm.Unlock()
+	if e.closing {
+		return nil
+	}
+	s := &session{conn: conn}
+	e.sessions[conn] = s
+	e.wg.Add(1)
+	return s
+}
+
+// untrack forgets a connection once its handler returned.
+func (e *Endpoint) untrack(s *session) {
+	e.sm.Lock()
+	delete(e.sessions, s.conn)
+	e.sm.Unlock()
+	e.wg.Done()
+}
+
+// session returns the session a connection belongs to.
+func (e *Endpoint) session(conn net.Conn) *session {
+	e.sm.Lock()
+	defer e.sm.Unlock()
+	return e.sessions[conn]
+}
+
+// begin marks a session busy before a command is executed. It returns
+// false if the endpoint is shutting down and no new command may start.
+func (e *Endpoint) begin(s *session) bool {
+	e.sm.Lock()
+	defer e.sm.Unlock()
+	if e.closing {
+		return false
+	}
+	s.busy = true
+	return true
+}
+
+// end marks a session idle again. It returns true if the endpoint started
+// shutting down while the command was executed.
+func (e *Endpoint) end(s *session) bool {
+	e.sm.Lock()
+	defer e.sm.Unlock()
+	s.busy = false
+	return e.closing
+}
+
+// authenticate records the user a session authenticated as.
+func (e *Endpoint) authenticate(conn net.Conn, user string) {
+	e.sm.Lock()
+	defer e.sm.Unlock()
+	if s, ok := e.sessions[conn]; ok {
+		s.authenticated = true
+		s.user = user
+	}
+}
+
+// authenticated returns the session of conn if it authenticated, and
+// otherwise the error commands needing an authenticated user reply.
+func (e *Endpoint) authenticated(conn net.Conn) (*session, error) {
+	s := e.session(conn)
+	if s == nil || !s.authenticated {
+		return nil, replyError(CodeAuthRequired, "Authentication required", nil)
+	}
+	return s, nil
+}
+
+// subscriber returns the FQDN of the FNAA a SUBSCRIBE or REPLAY command is
+// executed for: the peer named with PEER, which the authenticated user
+// must be configured to act for, or else this FNAA.
+func (e *Endpoint) subscriber(conn net.Conn, config config.Config, line string) (string, error) {
+	peer, ok := commandOption(line, "PEER")
+	if !ok {
+		return config.Identity.Fqdn, nil
+	}
+	s, err := e.authenticated(conn)
+	if err != nil {
+		return "", err
+	}
+	user, _ := config.User(s.user)
+	if user.Peer == "" || !strings.EqualFold(strings.TrimSuffix(user.Peer, "."), strings.TrimSuffix(peer, ".")) {
+		return "", replyError(CodeForbidden, "User "+s.user+" may not act for FNAA "+peer, nil)
+	}
+	return peer, nil
+}
+
+// authenticatePeer authenticates to the remote FNAA host with the
+// credentials configured for it in peers.
+func authenticatePeer(ctx context.Context, config config.Config, conn *net.Conn, rw *bufio.ReadWriter, host string) error {
+	peer, ok := config.Peer(host)
+	if !ok {
+		return replyError(CodeUnavailable, "No credentials for FNAA "+host+", add it to peers", nil)
+	}
+	if _, err := client.AuthenticatePlain(ctx, conn, rw, peer.User, peer.Password); err != nil {
+		return replyError(CodeUnavailable, "Authentication to FNAA "+host+" failed", err)
+	}
+	return nil
+}
+
+// drain stops new commands from starting, closes idle connections and
+// waits for in-flight commands to finish. Once the shutdown timeout
+// elapses, cancel is called to abort the remaining commands.
+func (e *Endpoint) drain(cancel context.CancelFunc) {
+	e.sm.Lock()
+	e.closing = true
+	busy := 0
+	for conn, s := range e.sessions {
+		if s.busy {
+			busy++
+			continue
+		}
+		conn.Close()
+	}
+	e.sm.Unlock()
+	log.Printf("Draining %v in-flight sessions", busy)
+
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	timeout := e.Config().Timeouts.Shutdown
+	if timeout <= 0 {
+		<-done
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("Shutdown timeout reached, aborting in-flight sessions")
+		cancel()
+		e.sm.Lock()
+		for conn := range e.sessions {
+			conn.Close()
+		}
+		e.sm.Unlock()
+		<-done
+	}
+}
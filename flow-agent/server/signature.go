@@ -0,0 +1,221 @@
+package server
+
+import (
+	"broker"
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"flow-agent/client"
+	"flow-agent/config"
+	"flow-agent/zone"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"resolver"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// verifyOption reports whether a SUBSCRIBE command has the VERIFY option,
+// asking for copies signed by the namespace of the flow.
+func verifyOption(line string) bool {
+	for _, arg := range strings.Fields(line)[1:] {
+		if strings.EqualFold(arg, "VERIFY") {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKey returns the namespace of the local flow and the key the
+// events copied from it are signed with, nil if it has none.
+func signingKey(cfg config.Config, dir string, flow string) (string, ed25519.PrivateKey, error) {
+	namespace, ok := flowNamespace(cfg, flow)
+	if !ok || namespace.SigningKey == "" {
+		return "", nil, nil
+	}
+	data, err := ioutil.ReadFile(namespace.SigningKeyPath(dir))
+	if err != nil {
+		return "", nil, errors.Wrap(err, "reading the signing key of "+namespace.Name)
+	}
+	key, err := broker.ParseSigningKey(string(data))
+	return namespace.Name, key, errors.Wrap(err, "reading the signing key of "+namespace.Name)
+}
+
+// lookupSigningKeys returns the signing keys namespace publishes, none if
+// it publishes none.
+func lookupSigningKeys(ctx context.Context, r *resolver.Resolver, namespace string) ([]ed25519.PublicKey, error) {
+	texts, err := r.LookupTXT(ctx, broker.SigningKeyName(namespace))
+	if resolver.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "looking up the signing keys of "+namespace)
+	}
+	return broker.SigningKeys(texts), nil
+}
+
+// remoteSigningKeys returns the signing keys published by the closest
+// parent domain of the remote flow publishing any, and that domain.
+func remoteSigningKeys(ctx context.Context, r *resolver.Resolver, flow string) (string, []ed25519.PublicKey, error) {
+	labels := dns.SplitDomainName(flow)
+	for i := 1; i < len(labels)-1; i++ {
+		namespace := strings.Join(labels[i:], ".")
+		keys, err := lookupSigningKeys(ctx, r, namespace)
+		if err != nil || len(keys) > 0 {
+			return namespace, keys, err
+		}
+	}
+	return "", nil, nil
+}
+
+// signingKeyRecord returns the TXT record publishing the signing key of
+// namespace, generating the key first if the namespace has none, in which
+// case namespace is changed to use it. dir is the directory of the
+// configuration file. generated reports whether the key file was written
+// now, for callers to remove it if the key is not published after all.
+func signingKeyRecord(dir string, namespace *config.Namespace) (record dns.RR, generated bool, err error) {
+	if namespace.SigningKey == "" {
+		namespace.SigningKey = namespace.Name + ".signing.key"
+	}
+	path := namespace.SigningKeyPath(dir)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		encoded, err := broker.GenerateSigningKey()
+		if err != nil {
+			return nil, false, err
+		}
+		data = []byte(encoded + "\n")
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, false, errors.Wrap(err, "saving the signing key of "+namespace.Name)
+		}
+		log.Printf("Generated the signing key of %v in %v", namespace.Name, path)
+		generated = true
+	} else if err != nil {
+		return nil, false, errors.Wrap(err, "reading the signing key of "+namespace.Name)
+	}
+	key, err := broker.ParseSigningKey(string(data))
+	if err != nil {
+		return nil, false, errors.Wrap(err, "reading the signing key of "+namespace.Name)
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(broker.SigningKeyName(namespace.Name)), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+		Txt: []string{broker.SigningKeyRecord(key.Public().(ed25519.PublicKey))},
+	}, generated, nil
+}
+
+// SignNamespace makes the events copied from the flows of the namespace
+// name signed: its signing key is generated if it has none, published in
+// its zone through its public nameserver, and saved in the configuration
+// file.
+func SignNamespace(ctx context.Context, cfg config.Config, file string, name string) error {
+	namespace, ok := cfg.NamespaceByName(name)
+	if !ok {
+		return errors.Errorf("namespace %v not found", name)
+	}
+	nameserverName := namespace.Ns_public
+	if nameserverName == "" {
+		nameserverName = namespace.Ns_private
+	}
+	nameserver, ok := cfg.NameserverByName(nameserverName)
+	if !ok {
+		return errors.Errorf("namespace %v has no nameserver to publish its signing key", name)
+	}
+	dir := filepath.Dir(file)
+	r := resolver.New(nameserver.Host)
+	if cfg.Nameserver != "" {
+		var err error
+		if r, err = newResolver(cfg, dir); err != nil {
+			return err
+		}
+	}
+	apex, err := zone.Apex(ctx, r, name)
+	if err != nil {
+		return err
+	}
+	var key *zone.Key
+	if nameserver.Keyfile != "" {
+		if key, err = zone.ReadKey(nameserver.KeyPath(dir)); err != nil {
+			return err
+		}
+	}
+
+	record, generated, err := signingKeyRecord(dir, &namespace)
+	if err != nil {
+		return err
+	}
+	if err := zone.Update(ctx, nameserver.Host, apex, key, []dns.RR{record}); err != nil {
+		if generated {
+			os.Remove(namespace.SigningKeyPath(dir))
+		}
+		return err
+	}
+	return config.SaveNamespace(file, namespace)
+}
+
+// describeCopy asks the remote FNAA of the session on conn where it keeps
+// flow, with DESCRIBE FLOW.
+func describeCopy(ctx context.Context, conn *net.Conn, rw *bufio.ReadWriter, flow string) (broker.Descriptor, error) {
+	response, err := client.SendCommand(ctx, conn, rw, "DESCRIBE FLOW "+flow)
+	if err != nil {
+		return broker.Descriptor{}, err
+	}
+	// The description comes as key=value lines, the schema and settings
+	// of the flow after its broker.
+	fields := map[string]string{}
+	for _, line := range strings.Split(response, "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		switch {
+		case len(kv) < 2:
+		case kv[0] == "flow", kv[0] == "type", kv[0] == "topic", kv[0] == "server":
+			fields[kv[0]] = kv[1]
+		}
+	}
+	return broker.ParseDescriptor(fields)
+}
+
+// verify checks the signature of m, if it is signed, against the keys its
+// signer publishes. reason tells why it does not hold, or that m is not
+// signed by the namespace p is verifying; err is a failure to look them
+// up, which the bridge starts again from.
+func (p *processor) verify(ctx context.Context, m broker.Message) (reason error, err error) {
+	signer, ok := broker.Signer(m)
+	if !ok && p.verifying != "" {
+		return errors.New("event is not signed"), nil
+	}
+	if !ok {
+		return nil, nil
+	}
+	// A valid signature of another namespace does not make an event
+	// come from the flow subscribed to.
+	if p.verifying != "" && signer != p.verifying {
+		return errors.Errorf("event is signed by %v, not by %v", signer, p.verifying), nil
+	}
+	keys, err := p.signingKeys(ctx, signer)
+	if err != nil {
+		return nil, err
+	}
+	_, reason = broker.Verify(m, keys)
+	return reason, nil
+}
+
+// sign returns out signed. A signature still holding for out is kept, so
+// copies tell the flow they first came from; otherwise out is signed by
+// the namespace of the source flow, if it has a key, or left unsigned.
+func (p *processor) sign(ctx context.Context, out broker.Message) broker.Message {
+	if signer, ok := broker.Signer(out); ok {
+		if keys, err := p.signingKeys(ctx, signer); err == nil {
+			if _, err := broker.Verify(out, keys); err == nil {
+				return out
+			}
+		}
+	}
+	if p.signingKey == nil {
+		return broker.Unsigned(out)
+	}
+	return broker.Sign(out, p.signer, p.src.Flow, p.signingKey)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"broker"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func TestVerifierDeadLettersUnverified(t *testing.T) {
+	mem := newMemory(t, 0)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := broker.Sign(broker.Message{Key: []byte("order-1"), Value: []byte(`{"id":1}`)}, "flow.unix.ar", "orders.flow.unix.ar", private)
+	tampered := signed
+	tampered.Value = []byte(`{"id":2}`)
+	unsigned := broker.Message{Key: []byte("order-3"), Value: []byte(`{"id":3}`)}
+	producer, err := mem.Producer(context.Background(), memoryFlow(testSource), broker.Options{CreateTopics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Produce(context.Background(), signed, tampered, unsigned); err != nil {
+		t.Fatal(err)
+	}
+
+	p := testProcessor()
+	p.verifying = "flow.unix.ar"
+	p.signingKeys = func(ctx context.Context, namespace string) ([]ed25519.PublicKey, error) {
+		if namespace == "flow.unix.ar" {
+			return []ed25519.PublicKey{public}, nil
+		}
+		return nil, nil
+	}
+	p.start()
+	defer stop(p)
+	waitEvents(t, mem, testSubscription, 1)
+	waitEvents(t, mem, broker.DeadLetterFlow(testSubscription), 2)
+
+	copied := mem.Messages(testSubscription)[0]
+	if _, err := broker.Verify(copied, []ed25519.PublicKey{public}); err != nil {
+		t.Errorf("copy does not keep its signature: %v", err)
+	}
+	for _, m := range mem.Messages(broker.DeadLetterFlow(testSubscription)) {
+		if stage := header(m, broker.HeaderStage); stage != broker.StageVerify {
+			t.Errorf("event %s dead-lettered at stage %v, want %v", m.Value, stage, broker.StageVerify)
+		}
+	}
+}
+
+func TestVerifierDeadLettersOtherSigners(t *testing.T) {
+	mem := newMemory(t, 0)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both signatures hold against the keys their namespace publishes,
+	// but only one namespace is the one subscribed to.
+	expected := broker.Sign(broker.Message{Key: []byte("order-1"), Value: []byte(`{"id":1}`)}, "flow.unix.ar", "orders.flow.unix.ar", private)
+	other := broker.Sign(broker.Message{Key: []byte("order-2"), Value: []byte(`{"id":2}`)}, "flow.emiliano.ar", "orders.flow.emiliano.ar", otherPrivate)
+	producer, err := mem.Producer(context.Background(), memoryFlow(testSource), broker.Options{CreateTopics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Produce(context.Background(), expected, other); err != nil {
+		t.Fatal(err)
+	}
+
+	p := testProcessor()
+	p.verifying = "flow.unix.ar"
+	p.signingKeys = func(ctx context.Context, namespace string) ([]ed25519.PublicKey, error) {
+		switch namespace {
+		case "flow.unix.ar":
+			return []ed25519.PublicKey{public}, nil
+		case "flow.emiliano.ar":
+			return []ed25519.PublicKey{otherPublic}, nil
+		}
+		return nil, nil
+	}
+	p.start()
+	defer stop(p)
+	waitEvents(t, mem, testSubscription, 1)
+	waitEvents(t, mem, broker.DeadLetterFlow(testSubscription), 1)
+
+	if copied := mem.Messages(testSubscription)[0]; string(copied.Key) != "order-1" {
+		t.Errorf("copied %s, want order-1", copied.Key)
+	}
+	dead := mem.Messages(broker.DeadLetterFlow(testSubscription))[0]
+	if string(dead.Key) != "order-2" || header(dead, broker.HeaderStage) != broker.StageVerify {
+		t.Errorf("dead-lettered %s at stage %v, want order-2 at %v", dead.Key, header(dead, broker.HeaderStage), broker.StageVerify)
+	}
+}
+
+func TestProcessorPassesUnsigned(t *testing.T) {
+	mem := newMemory(t, 5)
+	p := testProcessor()
+	p.start()
+	defer stop(p)
+	waitCopies(t, mem, 5)
+	checkCopies(t, mem, 5, 1)
+}
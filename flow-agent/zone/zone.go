@@ -0,0 +1,114 @@
+package zone
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"resolver"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// Key is a TSIG key updates are signed with.
+type Key struct {
+	Algorithm string
+	Name      string
+	Secret    string
+}
+
+// ReadKey reads a TSIG keyfile. The file holds a single line in the
+// [hmac:]name:secret form also accepted by the -tsig flag of q, hmac being
+// one of hmac-md5 (the default), hmac-sha1 or hmac-sha256.
+func ReadKey(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading TSIG keyfile")
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(string(data)), ":", 3)
+	switch len(fields) {
+	case 2:
+		return &Key{Algorithm: dns.HmacMD5, Name: dns.Fqdn(fields[0]), Secret: fields[1]}, nil
+	case 3:
+		algorithms := map[string]string{
+			"hmac-md5":    dns.HmacMD5,
+			"hmac-sha1":   dns.HmacSHA1,
+			"hmac-sha256": dns.HmacSHA256,
+		}
+		if algorithm, ok := algorithms[fields[0]]; ok {
+			return &Key{Algorithm: algorithm, Name: dns.Fqdn(fields[1]), Secret: fields[2]}, nil
+		}
+		return nil, errors.Errorf("TSIG keyfile %v: unknown algorithm %v", path, fields[0])
+	}
+	return nil, errors.Errorf("TSIG keyfile %v: expected [hmac:]name:secret", path)
+}
+
+// Apex returns the name of the zone name belongs to, taken from the SOA
+// record the nameservers of r answer with, either as the answer itself or
+// in the authority section.
+func Apex(ctx context.Context, r *resolver.Resolver, name string) (string, error) {
+	in, err := r.Query(ctx, name, dns.TypeSOA)
+	if err != nil {
+		return "", errors.Wrap(err, "querying SOA of "+name)
+	}
+	if in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		return "", errors.Errorf("querying SOA of %v: %v", name, dns.RcodeToString[in.Rcode])
+	}
+
+	for _, section := range [][]dns.RR{in.Answer, in.Ns} {
+		for _, rr := range section {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return strings.TrimSuffix(soa.Hdr.Name, "."), nil
+			}
+		}
+	}
+	return "", errors.Errorf("no SOA found for %v", name)
+}
+
+// Update replaces the RRsets of records in zone with records, through a
+// dynamic update (RFC 2136) sent to nameserver. The update is signed if
+// key is not nil.
+func Update(ctx context.Context, nameserver string, zone string, key *Key, records []dns.RR) error {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.RemoveRRset(records)
+	m.Insert(records)
+	for _, rr := range records {
+		log.Printf("Updating %v in zone %v at %v", rr, zone, nameserver)
+	}
+	return send(ctx, nameserver, zone, key, m)
+}
+
+// Remove deletes the RRsets of records from zone, undoing an Update.
+func Remove(ctx context.Context, nameserver string, zone string, key *Key, records []dns.RR) error {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.RemoveRRset(records)
+	for _, rr := range records {
+		log.Printf("Removing %v from zone %v at %v", rr, zone, nameserver)
+	}
+	return send(ctx, nameserver, zone, key, m)
+}
+
+// send sends the dynamic update m of zone to nameserver, signed if key is
+// not nil.
+func send(ctx context.Context, nameserver string, zone string, key *Key, m *dns.Msg) error {
+	c := new(dns.Client)
+	c.Net = "tcp"
+	if key != nil {
+		m.SetTsig(key.Name, key.Algorithm, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+
+	r, _, err := c.ExchangeContext(ctx, m, resolver.Address(nameserver))
+	if err != nil {
+		return errors.Wrap(err, "updating zone "+zone)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return errors.Errorf("updating zone %v: %v", zone, dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
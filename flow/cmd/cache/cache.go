@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"flow/cmd/cmdutil"
+	"flow/fnaa"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// CacheCmd groups the commands that manage the discovery cache.
+var CacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the cache of DNS answers used to discover FNAAs",
+	Long: `Manage the cache of DNS answers used to discover FNAAs. The SRV, address
+and TXT records looked up, and the names found not to exist, are kept in
+~/.flow.discovery until their TTL runs out, so repeated commands against
+the same FNAA do not query the nameservers again.`,
+}
+
+var clearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Forget every cached DNS answer",
+	Long: `Forget every cached DNS answer, for instance after the records of a FNAA
+changed before their TTL ran out.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 0 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "clear takes no arguments"))
+		}
+		cache := fnaa.Cache()
+		if cache == nil {
+			return
+		}
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitError, cache.Clear(), "clearing discovery cache"))
+		fmt.Println("Discovery cache cleared.")
+	},
+}
+
+func init() {
+	CacheCmd.AddCommand(clearCmd)
+}
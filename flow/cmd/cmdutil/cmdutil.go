@@ -0,0 +1,100 @@
+package cmdutil
+
+import (
+	"flow/client"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Exit codes, one per class of failure, so scripts can tell them apart.
+const (
+	ExitError      = 1 // Unclassified failure
+	ExitUsage      = 2 // Invalid arguments or flags
+	ExitConfig     = 3 // Missing or inconsistent config file
+	ExitDiscovery  = 4 // The FNAA could not be discovered through DNS
+	ExitConnection = 5 // The FNAA could not be reached or timed out
+	ExitAuth       = 6 // The FNAA refused the credentials
+	ExitRefused    = 7 // The FNAA refused the command
+)
+
+// Error is an error that maps to a specific exit code.
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Errorf returns an error that exits with code.
+func Errorf(code int, format string, args ...interface{}) error {
+	return &Error{Code: code, Err: errors.Errorf(format, args...)}
+}
+
+// Wrap annotates err with message and makes it exit with code, unless err
+// already maps to a code of its own.
+func Wrap(code int, err error, message string) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := errors.Cause(err).(*Error); ok {
+		code = e.Code
+	}
+	return &Error{Code: code, Err: errors.Wrap(err, message)}
+}
+
+// Code returns the exit code err maps to.
+func Code(err error) int {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.Code
+	}
+	return ExitError
+}
+
+// SetVerbosity routes diagnostics according to level. At 0 only errors
+// and the command output are shown, 1 adds the progress of each command
+// and 2 the protocol trace with the FNAA and the nameservers.
+func SetVerbosity(level int) {
+	if level < 1 {
+		log.SetOutput(ioutil.Discard)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+	if level < 2 {
+		client.Logger.SetOutput(ioutil.Discard)
+	} else {
+		client.Logger.SetOutput(os.Stderr)
+	}
+}
+
+// PrintErr prints err to stderr without exiting.
+func PrintErr(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+}
+
+// CheckErrs prints every error in errs and exits with the code the first
+// one maps to. It does nothing if errs is empty.
+func CheckErrs(errs []error) {
+	if len(errs) == 0 {
+		return
+	}
+	for _, err := range errs {
+		PrintErr(err)
+	}
+	os.Exit(Code(errs[0]))
+}
+
+// CheckErr prints err to stderr and exits with the code it maps to. It
+// does nothing if err is nil.
+func CheckErr(err error) {
+	if err == nil {
+		return
+	}
+	PrintErr(err)
+	os.Exit(Code(err))
+}
@@ -1,8 +1,29 @@
 package config
 
+import "strings"
+
+/*
+	current-context: unix
+	contexts:
+	  -
+	    name: unix
+	    agent: fnaa-unix
+	    namespace: flow.unix.ar
+	    credentials: test-unix
+
+The current context selects the agent commands are sent to when --agent
+is not given, the namespace short flow names are completed with, and the
+credentials used towards that agent instead of the ones in its entry.
+*/
 type Config struct {
-	Agents     []Agent     `mapstructure:"agents"`
-	Namespaces []Namespace `mapstructure:"namespaces"`
+	CurrentContext string       `mapstructure:"current-context" yaml:"current-context,omitempty" json:"current-context,omitempty"`
+	Contexts       []Context    `mapstructure:"contexts" yaml:"contexts,omitempty" json:"contexts,omitempty"`
+	Agents         []Agent      `mapstructure:"agents" yaml:"agents" json:"agents"`
+	Namespaces     []Namespace  `mapstructure:"namespaces" yaml:"namespaces" json:"namespaces"`
+	Credentials    []Credential `mapstructure:"credentials" yaml:"credentials,omitempty" json:"credentials,omitempty"`
+
+	// Current is the context in effect once Use has been called.
+	Current Context `mapstructure:"-" yaml:"-" json:"-"`
 }
 
 // type Agents struct {
@@ -10,12 +31,35 @@ type Config struct {
 // 	Name  string             `mapstructure:"name"`
 // }
 
+/*
+	agents:
+	  -
+	    name: fnaa-unix
+	    fqdn: fnaa.unix.ar
+	    username: test
+	    credentials: test-unix
+
+The password is better left out of the agent entry: flow login stores it
+in the encrypted keyring instead, and credentials may name an entry of
+credentials that runs a plugin to obtain it.
+*/
 type Agent struct {
-	Name     string `mapstructure:"name"`
-	Fqdn     string `mapstructure:"fqdn"`
-	Username string `mapstructure:"username"`
-	Password string `mapstructure:"password"`
-	Prefix   string `mapstructure:"prefix"`
+	Name        string `mapstructure:"name" yaml:"name" json:"name"`
+	Fqdn        string `mapstructure:"fqdn" yaml:"fqdn" json:"fqdn"`
+	Username    string `mapstructure:"username" yaml:"username,omitempty" json:"username,omitempty"`
+	Password    string `mapstructure:"password" yaml:"password,omitempty" json:"password,omitempty"`
+	Prefix      string `mapstructure:"prefix" yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	Credentials string `mapstructure:"credentials" yaml:"credentials,omitempty" json:"credentials,omitempty"`
+
+	// Exec is the credential plugin of the agent once Use has been called.
+	Exec *Exec `mapstructure:"-" yaml:"-" json:"-"`
+	// Keyring is the keyring entry holding the password of the agent once
+	// Use has been called, the agent name when empty.
+	Keyring string `mapstructure:"-" yaml:"-" json:"-"`
+	// Anonymous is set on agents discovered rather than configured, when
+	// the current context has no credentials for them, which are
+	// contacted without authenticating.
+	Anonymous bool `mapstructure:"-" yaml:"-" json:"-"`
 }
 
 // type Namespaces struct {
@@ -24,7 +68,98 @@ type Agent struct {
 // }
 
 type Namespace struct {
-	Name      string `mapstructure:"name"`
-	AgentName string `mapstructure:"agent"`
-	Password  string `mapstructure:"password"`
+	Name      string `mapstructure:"name" yaml:"name" json:"name"`
+	AgentName string `mapstructure:"agent" yaml:"agent" json:"agent"`
+	Password  string `mapstructure:"password" yaml:"password,omitempty" json:"password,omitempty"`
+}
+
+type Context struct {
+	Name        string `mapstructure:"name" yaml:"name" json:"name"`
+	Agent       string `mapstructure:"agent" yaml:"agent,omitempty" json:"agent,omitempty"`
+	Namespace   string `mapstructure:"namespace" yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	Credentials string `mapstructure:"credentials" yaml:"credentials,omitempty" json:"credentials,omitempty"`
+}
+
+/*
+	credentials:
+	  -
+	    name: test-unix
+	    username: test
+	    keyring: credentials/test-unix
+	  -
+	    name: vault-unix
+	    exec:
+	      command: flow-vault
+	      args: [unix]
+	      env:
+	        VAULT_ADDR: https://vault.unix.ar
+
+Keyring names the entry of the encrypted keyring the password is kept in,
+where flow config set-credentials --password stores it; a password in the
+config file itself is read in plain text by anyone who can read the file.
+With exec the username and password are obtained by running command,
+which gets the agent in FLOW_AGENT and FLOW_AGENT_FQDN and must print
+{"username": "...", "password": "..."} on its standard output.
+*/
+type Credential struct {
+	Name     string `mapstructure:"name" yaml:"name" json:"name"`
+	Username string `mapstructure:"username" yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `mapstructure:"password" yaml:"password,omitempty" json:"password,omitempty"`
+	Keyring  string `mapstructure:"keyring" yaml:"keyring,omitempty" json:"keyring,omitempty"`
+	Exec     *Exec  `mapstructure:"exec" yaml:"exec,omitempty" json:"exec,omitempty"`
+}
+
+type Exec struct {
+	Command string            `mapstructure:"command" yaml:"command" json:"command"`
+	Args    []string          `mapstructure:"args" yaml:"args,omitempty" json:"args,omitempty"`
+	Env     map[string]string `mapstructure:"env" yaml:"env,omitempty" json:"env,omitempty"`
+}
+
+// Agent returns the configured agent with the given name.
+func (c Config) Agent(name string) (Agent, bool) {
+	for _, agent := range c.Agents {
+		if agent.Name == name {
+			return agent, true
+		}
+	}
+	return Agent{}, false
+}
+
+// NamespaceByName returns the configured namespace with the given name.
+func (c Config) NamespaceByName(name string) (Namespace, bool) {
+	for _, namespace := range c.Namespaces {
+		if namespace.Name == name {
+			return namespace, true
+		}
+	}
+	return Namespace{}, false
+}
+
+// Context returns the configured context with the given name.
+func (c Config) Context(name string) (Context, bool) {
+	for _, context := range c.Contexts {
+		if context.Name == name {
+			return context, true
+		}
+	}
+	return Context{}, false
+}
+
+// Credential returns the configured credentials with the given name.
+func (c Config) Credential(name string) (Credential, bool) {
+	for _, credential := range c.Credentials {
+		if credential.Name == name {
+			return credential, true
+		}
+	}
+	return Credential{}, false
+}
+
+// Qualify completes a short flow name, one without dots, with the
+// namespace of the current context.
+func (c Config) Qualify(flow string) string {
+	if strings.Contains(flow, ".") || c.Current.Namespace == "" {
+		return flow
+	}
+	return flow + "." + c.Current.Namespace
 }
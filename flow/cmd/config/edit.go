@@ -0,0 +1,236 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SetAgent adds agent, or updates the agent with the same name with the
+// fields of agent that are set.
+func (c *Config) SetAgent(agent Agent) {
+	for i := range c.Agents {
+		if c.Agents[i].Name != agent.Name {
+			continue
+		}
+		existing := &c.Agents[i]
+		if agent.Fqdn != "" {
+			existing.Fqdn = agent.Fqdn
+		}
+		if agent.Username != "" {
+			existing.Username = agent.Username
+		}
+		if agent.Password != "" {
+			existing.Password = agent.Password
+		}
+		if agent.Prefix != "" {
+			existing.Prefix = agent.Prefix
+		}
+		if agent.Credentials != "" {
+			existing.Credentials = agent.Credentials
+		}
+		return
+	}
+	c.Agents = append(c.Agents, agent)
+}
+
+// DeleteAgent removes the agent with the given name. It fails if the agent
+// does not exist or is still used by a namespace or a context.
+func (c *Config) DeleteAgent(name string) error {
+	var users []string
+	for _, namespace := range c.Namespaces {
+		if namespace.AgentName == name {
+			users = append(users, "namespace "+namespace.Name)
+		}
+	}
+	for _, context := range c.Contexts {
+		if context.Agent == name {
+			users = append(users, "context "+context.Name)
+		}
+	}
+	if len(users) > 0 {
+		return errors.Errorf("agent %v is used by %v", name, strings.Join(users, ", "))
+	}
+
+	for i, agent := range c.Agents {
+		if agent.Name == name {
+			c.Agents = append(c.Agents[:i], c.Agents[i+1:]...)
+			return nil
+		}
+	}
+	return errors.Errorf("agent %v not found", name)
+}
+
+// SetNamespace adds namespace, or updates the namespace with the same
+// name with the fields of namespace that are set.
+func (c *Config) SetNamespace(namespace Namespace) {
+	for i := range c.Namespaces {
+		if c.Namespaces[i].Name != namespace.Name {
+			continue
+		}
+		if namespace.AgentName != "" {
+			c.Namespaces[i].AgentName = namespace.AgentName
+		}
+		if namespace.Password != "" {
+			c.Namespaces[i].Password = namespace.Password
+		}
+		return
+	}
+	c.Namespaces = append(c.Namespaces, namespace)
+}
+
+// SetContext adds context, or updates the context with the same name with
+// the fields of context that are set.
+func (c *Config) SetContext(context Context) {
+	for i := range c.Contexts {
+		if c.Contexts[i].Name != context.Name {
+			continue
+		}
+		existing := &c.Contexts[i]
+		if context.Agent != "" {
+			existing.Agent = context.Agent
+		}
+		if context.Namespace != "" {
+			existing.Namespace = context.Namespace
+		}
+		if context.Credentials != "" {
+			existing.Credentials = context.Credentials
+		}
+		return
+	}
+	c.Contexts = append(c.Contexts, context)
+}
+
+// SetCredential adds credential, or updates the credentials with the same
+// name with the fields of credential that are set.
+func (c *Config) SetCredential(credential Credential) {
+	for i := range c.Credentials {
+		if c.Credentials[i].Name != credential.Name {
+			continue
+		}
+		if credential.Username != "" {
+			c.Credentials[i].Username = credential.Username
+		}
+		if credential.Password != "" {
+			c.Credentials[i].Password = credential.Password
+		}
+		if credential.Keyring != "" {
+			// The keyring replaces the password kept in the file.
+			c.Credentials[i].Keyring = credential.Keyring
+			c.Credentials[i].Password = ""
+		}
+		if credential.Exec != nil {
+			c.Credentials[i].Exec = credential.Exec
+		}
+		return
+	}
+	c.Credentials = append(c.Credentials, credential)
+}
+
+// UseContext makes the context with the given name the current one.
+func (c *Config) UseContext(name string) error {
+	if _, ok := c.Context(name); !ok {
+		return errors.Errorf("context %v not found", name)
+	}
+	c.CurrentContext = name
+	return nil
+}
+
+// Use resolves the credentials agents refer to and puts the context with
+// the given name, or the current context if name is empty, in effect: its
+// credentials replace those of its agent.
+func (c *Config) Use(name string) error {
+	for i := range c.Agents {
+		if c.Agents[i].Credentials == "" {
+			continue
+		}
+		credential, ok := c.Credential(c.Agents[i].Credentials)
+		if !ok {
+			return errors.Errorf("agent %v: credentials %v not found", c.Agents[i].Name, c.Agents[i].Credentials)
+		}
+		c.Agents[i].apply(credential)
+	}
+
+	if name == "" {
+		name = c.CurrentContext
+	}
+	if name == "" {
+		return nil
+	}
+
+	context, ok := c.Context(name)
+	if !ok {
+		return errors.Errorf("context %v not found", name)
+	}
+	if context.Agent != "" {
+		if _, ok := c.Agent(context.Agent); !ok {
+			return errors.Errorf("context %v: agent %v not found", name, context.Agent)
+		}
+	}
+	if context.Credentials != "" {
+		credential, ok := c.Credential(context.Credentials)
+		if !ok {
+			return errors.Errorf("context %v: credentials %v not found", name, context.Credentials)
+		}
+		for i := range c.Agents {
+			if c.Agents[i].Name == context.Agent {
+				c.Agents[i].apply(credential)
+			}
+		}
+	}
+	c.Current = context
+	return nil
+}
+
+// Discovered returns the agent of a FNAA found through DNS rather than
+// configured, named name and looked up at fqdn. It authenticates with the
+// credentials of the current context, and is anonymous if it has none.
+func (c Config) Discovered(name string, fqdn string) Agent {
+	agent := Agent{Name: name, Fqdn: fqdn}
+	credential, ok := c.Credential(c.Current.Credentials)
+	if c.Current.Credentials == "" || !ok {
+		agent.Anonymous = true
+		return agent
+	}
+	agent.apply(credential)
+	return agent
+}
+
+// apply makes credential the one the agent authenticates with.
+func (a *Agent) apply(credential Credential) {
+	if credential.Username != "" || credential.Exec == nil {
+		a.Username = credential.Username
+	}
+	a.Password = credential.Password
+	a.Keyring = credential.Keyring
+	a.Exec = credential.Exec
+}
+
+// Minify returns a copy of the config holding only the context in effect
+// and the agent, namespaces and credentials it uses. Without a context in
+// effect the config is returned as is.
+func (c *Config) Minify() *Config {
+	if c.Current.Name == "" {
+		return c
+	}
+
+	min := &Config{CurrentContext: c.Current.Name, Contexts: []Context{c.Current}, Current: c.Current}
+	credentials := []string{c.Current.Credentials}
+	if agent, ok := c.Agent(c.Current.Agent); ok {
+		min.Agents = append(min.Agents, agent)
+		if agent.Credentials != c.Current.Credentials {
+			credentials = append(credentials, agent.Credentials)
+		}
+	}
+	for _, namespace := range c.Namespaces {
+		if namespace.AgentName == c.Current.Agent {
+			min.Namespaces = append(min.Namespaces, namespace)
+		}
+	}
+	for _, name := range credentials {
+		if credential, ok := c.Credential(name); ok {
+			min.Credentials = append(min.Credentials, credential)
+		}
+	}
+	return min
+}
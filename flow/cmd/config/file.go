@@ -0,0 +1,77 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Load reads the config file. A file that does not exist yet yields an
+// empty config, so the first set-agent can create it. Unknown keys are
+// rejected so that saving the file back never drops settings.
+func Load(file string) (*Config, error) {
+	cfg := &Config{}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading "+file)
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, errors.Wrap(err, "decoding "+file)
+	}
+	return cfg, nil
+}
+
+// Save writes the config file.
+func (c *Config) Save(file string) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "encoding config")
+	}
+	return WriteFile(file, data)
+}
+
+// WriteFile writes data to file through a temporary file in the same
+// directory that is then renamed over the original, so readers never see a
+// partial file. The file is only readable by its owner since it holds
+// credentials.
+func WriteFile(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		return errors.Wrap(err, "writing "+file)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing "+file)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing "+file)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "writing "+file)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return errors.Wrap(err, "writing "+file)
+	}
+	return nil
+}
+
+// Update loads the config file, applies change to it and saves it back.
+func Update(file string, change func(*Config) error) error {
+	cfg, err := Load(file)
+	if err != nil {
+		return err
+	}
+	if err := change(cfg); err != nil {
+		return err
+	}
+	return cfg.Save(file)
+}
@@ -0,0 +1,98 @@
+package configure
+
+import (
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"flow/credentials"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var deleteAgentCmd = &cobra.Command{
+	Use:   "delete-agent <name>",
+	Short: "Remove an agent from the config file",
+	Long: `Remove an agent from the config file. Agents still used by a namespace or a
+context are kept, so the file never references a missing agent.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := oneArg(args, "agent name")
+		update(func(c *config.Config) error {
+			return c.DeleteAgent(name)
+		})
+		fmt.Printf("Agent %q deleted.\n", name)
+	},
+}
+
+var setNamespaceCmd = &cobra.Command{
+	Use:   "set-namespace <name> --agent <agent>",
+	Short: "Add a namespace to the config file, or update it",
+	Long: `Add a namespace to the config file, or update an existing one. Flows in the
+namespace are sent to its agent.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		namespace := config.Namespace{Name: oneArg(args, "namespace name")}
+		namespace.AgentName, _ = cmd.Flags().GetString("agent")
+
+		update(func(c *config.Config) error {
+			if _, ok := c.NamespaceByName(namespace.Name); !ok && namespace.AgentName == "" {
+				return cmdutil.Errorf(cmdutil.ExitUsage, "--agent is required for a new namespace")
+			}
+			if namespace.AgentName != "" {
+				if _, ok := c.Agent(namespace.AgentName); !ok {
+					return cmdutil.Errorf(cmdutil.ExitConfig, "agent %v not found", namespace.AgentName)
+				}
+			}
+			c.SetNamespace(namespace)
+			return nil
+		})
+		fmt.Printf("Namespace %q set.\n", namespace.Name)
+	},
+}
+
+var setCredentialsCmd = &cobra.Command{
+	Use:   "set-credentials <name>",
+	Short: "Add credentials to the config file, or update them",
+	Long: `Add credentials to the config file, or update them. The password is stored
+in the encrypted keyring, under credentials/<name>, and the config file only
+refers to that entry.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		credential := config.Credential{Name: oneArg(args, "credentials name")}
+		credential.Username, _ = cmd.Flags().GetString("username")
+		if password, _ := cmd.Flags().GetString("password"); password != "" {
+			credential.Keyring = "credentials/" + credential.Name
+			_, err := credentials.Store(credential.Keyring, credentials.Entry{Username: credential.Username, Password: password})
+			cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, err, "storing password in keyring"))
+		}
+		if command, _ := cmd.Flags().GetString("exec-command"); command != "" {
+			credential.Exec = &config.Exec{Command: command}
+			credential.Exec.Args, _ = cmd.Flags().GetStringSlice("exec-arg")
+			env, _ := cmd.Flags().GetStringSlice("exec-env")
+			for _, pair := range env {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "--exec-env %q is not NAME=VALUE", pair))
+				}
+				if credential.Exec.Env == nil {
+					credential.Exec.Env = map[string]string{}
+				}
+				credential.Exec.Env[kv[0]] = kv[1]
+			}
+		}
+
+		update(func(c *config.Config) error {
+			c.SetCredential(credential)
+			return nil
+		})
+		fmt.Printf("Credentials %q set.\n", credential.Name)
+	},
+}
+
+func init() {
+	setNamespaceCmd.Flags().String("agent", "", "Agent managing the namespace")
+
+	setCredentialsCmd.Flags().String("username", "", "Username to authenticate with")
+	setCredentialsCmd.Flags().String("password", "", "Password to authenticate with, stored in the encrypted keyring")
+	setCredentialsCmd.Flags().String("exec-command", "", "Credential plugin printing the username and password")
+	setCredentialsCmd.Flags().StringSlice("exec-arg", nil, "Argument of the credential plugin")
+	setCredentialsCmd.Flags().StringSlice("exec-env", nil, "NAME=VALUE set in the environment of the credential plugin")
+}
@@ -0,0 +1,54 @@
+package configure
+
+import (
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"flow/cmd/set/agent"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// ConfigCmd groups the commands that read and edit the config file.
+var ConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "View and edit the flow config file",
+	Long: `View and edit the flow config file: the agents, their namespaces, the
+credentials used with them and the contexts that tie them together.
+
+Changes are written to a temporary file that then replaces the config file,
+so a failed write never leaves it half written.`,
+}
+
+func init() {
+	ConfigCmd.AddCommand(viewCmd)
+	ConfigCmd.AddCommand(getContextsCmd)
+	ConfigCmd.AddCommand(currentContextCmd)
+	ConfigCmd.AddCommand(useContextCmd)
+	ConfigCmd.AddCommand(setContextCmd)
+	ConfigCmd.AddCommand(setCredentialsCmd)
+	ConfigCmd.AddCommand(agent.NewAgentSetCmd("set-agent"))
+	ConfigCmd.AddCommand(deleteAgentCmd)
+	ConfigCmd.AddCommand(setNamespaceCmd)
+}
+
+// load reads the config file in use, exiting on failure.
+func load() *config.Config {
+	cfg, err := config.Load(viper.ConfigFileUsed())
+	cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, err, "loading config"))
+	return cfg
+}
+
+// update applies change to the config file in use, exiting on failure.
+func update(change func(*config.Config) error) {
+	err := config.Update(viper.ConfigFileUsed(), change)
+	cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, err, "updating config"))
+}
+
+// oneArg fails with a usage error unless exactly one argument was given.
+func oneArg(args []string, name string) string {
+	if len(args) != 1 {
+		cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "expected one argument, the %v", name))
+	}
+	return args[0]
+}
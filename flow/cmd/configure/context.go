@@ -0,0 +1,109 @@
+package configure
+
+import (
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"flow/cmd/printer"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var contextKind = printer.Kind{
+	Name:    "context",
+	NameKey: "name",
+	Columns: []printer.Column{
+		{Header: "CURRENT", Key: "current"},
+		{Header: "NAME", Key: "name"},
+		{Header: "AGENT", Key: "agent"},
+		{Header: "NAMESPACE", Key: "namespace"},
+		{Header: "CREDENTIALS", Key: "credentials"},
+	},
+}
+
+var getContextsCmd = &cobra.Command{
+	Use:   "get-contexts",
+	Short: "List the contexts in the config file",
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := printer.New(cmd)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "--output"))
+
+		cfg := load()
+		var items []map[string]string
+		for _, context := range cfg.Contexts {
+			item := map[string]string{
+				"name":        context.Name,
+				"agent":       context.Agent,
+				"namespace":   context.Namespace,
+				"credentials": context.Credentials,
+			}
+			if context.Name == cfg.CurrentContext {
+				item["current"] = "*"
+			}
+			items = append(items, item)
+		}
+		cmdutil.CheckErr(p.PrintList(os.Stdout, contextKind, items))
+	},
+}
+
+var currentContextCmd = &cobra.Command{
+	Use:   "current-context",
+	Short: "Print the name of the current context",
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := load()
+		if cfg.CurrentContext == "" {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitConfig, "current-context is not set"))
+		}
+		fmt.Println(cfg.CurrentContext)
+	},
+}
+
+var useContextCmd = &cobra.Command{
+	Use:   "use-context <name>",
+	Short: "Make a context the current one",
+	Run: func(cmd *cobra.Command, args []string) {
+		name := oneArg(args, "context name")
+		update(func(c *config.Config) error {
+			return c.UseContext(name)
+		})
+		fmt.Printf("Switched to context %q.\n", name)
+	},
+}
+
+var setContextCmd = &cobra.Command{
+	Use:   "set-context <name>",
+	Short: "Add a context to the config file, or update it",
+	Long: `Add a context to the config file, or update the fields given as flags of an
+existing one. The agent and credentials must already be in the config file.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		context := config.Context{Name: oneArg(args, "context name")}
+		context.Agent, _ = cmd.Flags().GetString("agent")
+		context.Namespace, _ = cmd.Flags().GetString("namespace")
+		context.Credentials, _ = cmd.Flags().GetString("credentials")
+
+		update(func(c *config.Config) error {
+			if context.Agent != "" {
+				if _, ok := c.Agent(context.Agent); !ok {
+					return cmdutil.Errorf(cmdutil.ExitConfig, "agent %v not found", context.Agent)
+				}
+			}
+			if context.Credentials != "" {
+				if _, ok := c.Credential(context.Credentials); !ok {
+					return cmdutil.Errorf(cmdutil.ExitConfig, "credentials %v not found", context.Credentials)
+				}
+			}
+			c.SetContext(context)
+			return nil
+		})
+		fmt.Printf("Context %q set.\n", context.Name)
+	},
+}
+
+func init() {
+	printer.AddFlags(getContextsCmd)
+
+	setContextCmd.Flags().String("agent", "", "Agent commands are sent to")
+	setContextCmd.Flags().String("namespace", "", "Namespace short flow names are completed with")
+	setContextCmd.Flags().String("credentials", "", "Credentials used with the agent")
+}
@@ -0,0 +1,64 @@
+package configure
+
+import (
+	"encoding/json"
+	"flow/cmd/cmdutil"
+	"flow/credentials"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var viewCmd = &cobra.Command{
+	Use:   "view",
+	Short: "Print the config file",
+	Long: `Print the config file, with passwords redacted unless --raw is given.
+With --minify only the agent, namespaces and credentials of the current
+context are shown.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString("output")
+		raw, _ := cmd.Flags().GetBool("raw")
+		minify, _ := cmd.Flags().GetBool("minify")
+
+		cfg := load()
+		if minify {
+			context, _ := cmd.Flags().GetString("context")
+			if err := cfg.Use(context); err != nil {
+				cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, err, "selecting context"))
+			}
+			cfg = cfg.Minify()
+		}
+		if !raw {
+			for i := range cfg.Agents {
+				cfg.Agents[i].Password = credentials.Redact(cfg.Agents[i].Password)
+			}
+			for i := range cfg.Namespaces {
+				cfg.Namespaces[i].Password = credentials.Redact(cfg.Namespaces[i].Password)
+			}
+			for i := range cfg.Credentials {
+				cfg.Credentials[i].Password = credentials.Redact(cfg.Credentials[i].Password)
+			}
+		}
+
+		switch output {
+		case "yaml":
+			out, err := yaml.Marshal(cfg)
+			cmdutil.CheckErr(err)
+			os.Stdout.Write(out)
+		case "json":
+			out, err := json.MarshalIndent(cfg, "", "  ")
+			cmdutil.CheckErr(err)
+			fmt.Println(string(out))
+		default:
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "unknown output format %q, use one of yaml|json", output))
+		}
+	},
+}
+
+func init() {
+	viewCmd.Flags().StringP("output", "o", "yaml", "Output format, one of yaml|json")
+	viewCmd.Flags().Bool("raw", false, "Show passwords")
+	viewCmd.Flags().Bool("minify", false, "Only show what the current context uses")
+}
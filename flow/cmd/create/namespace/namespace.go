@@ -1,22 +1,93 @@
 package namespace
 
 import (
-	"fmt"
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"flow/cmd/printer"
+	"flow/fnaa"
+	"log"
+	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
+var kind = printer.Kind{
+	Name:    "namespace",
+	NameKey: "namespace",
+	Columns: []printer.Column{
+		{Header: "NAMESPACE", Key: "namespace"},
+		{Header: "AGENT", Key: "agent"},
+		{Header: "BROKER", Key: "broker"},
+		{Header: "ZONE", Key: "zone", Wide: true},
+		{Header: "NAMESERVER", Key: "nameserver", Wide: true},
+	},
+}
+
 var NamespaceCreateCmd = &cobra.Command{
-	Use:   "namespace",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Use:   "namespace <name> --broker <broker>",
+	Short: "Create a namespace in an agent",
+	Long: `Create a namespace in an agent with CREATE NAMESPACE. The FNAA checks that
+the user owns the DNS zone of the namespace, publishes the namespace in it
+and binds it to the given broker. On success the namespace is added to the
+config file, so flows in it are sent to the agent.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("create namespace called")
+		if len(args) != 1 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "expected one argument, the namespace name"))
+		}
+		name := args[0]
+		broker, _ := cmd.Flags().GetString("broker")
+		if broker == "" {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "--broker is required"))
+		}
+
+		p, err := printer.New(cmd)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "--output"))
+		opts, err := fnaa.OptionsFromFlags(cmd)
+		cmdutil.CheckErr(err)
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+
+		selectedAgent, _ := cmd.Flags().GetString("agent")
+		agentConfig, err := fnaa.SelectAgent(cfg, selectedAgent)
+		cmdutil.CheckErr(err)
+
+		command := "CREATE NAMESPACE " + name + " BROKER " + broker
+		if nameserver, _ := cmd.Flags().GetString("dns"); nameserver != "" {
+			command += " NAMESERVER " + nameserver
+		}
 
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+
+		log.Printf("Creating namespace %v in agent %v", name, agentConfig.Name)
+		session, err := fnaa.Dial(ctx, agentConfig, opts)
+		cmdutil.CheckErr(err)
+
+		response, err := session.Command(ctx, command)
+		session.Close()
+		cmdutil.CheckErr(err)
+
+		item := map[string]string{"namespace": name, "agent": agentConfig.Name, "broker": broker}
+		for _, reply := range fnaa.ParseItems(response) {
+			for key, value := range reply {
+				item[key] = value
+			}
+		}
+		cmdutil.CheckErr(p.PrintObject(os.Stdout, kind, item))
+
+		err = config.Update(viper.ConfigFileUsed(), func(c *config.Config) error {
+			c.SetNamespace(config.Namespace{Name: item["namespace"], AgentName: agentConfig.Name})
+			return nil
+		})
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, err, "namespace created but not saved to the config file"))
 	},
 }
+
+func init() {
+	NamespaceCreateCmd.Flags().String("broker", "", "Broker of the agent the flows of the namespace are stored in")
+	NamespaceCreateCmd.Flags().String("agent", "", "Select FNAA")
+	NamespaceCreateCmd.Flags().String("dns", "", "Nameserver of the agent to publish the namespace in, as named in its config")
+	NamespaceCreateCmd.Flags().String("nameserver", "", "Override system nameserver")
+	printer.AddFlags(NamespaceCreateCmd)
+}
@@ -0,0 +1,104 @@
+package dlq
+
+import (
+	"broker"
+	"context"
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"flow/fnaa"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+// DlqCmd groups the commands that handle the dead-letter flows of
+// subscriptions.
+var DlqCmd = &cobra.Command{
+	Use:   "dlq",
+	Short: "Inspect, replay and purge the dead-letter flows of subscriptions",
+	Long: `Inspect, replay and purge the dead-letter flows of subscriptions. The flow
+processor copying to a subscription moves to dlq.<subscription> the events
+it could not copy: those failing validation with the dead-letter policy,
+those a projection or the CloudEvents wrapping fails on, and those it
+could not write to the subscription after retrying. Headers tell why:
+fnaa-error, fnaa-stage (validate, transform or deliver), fnaa-attempts,
+fnaa-source with fnaa-partition and fnaa-offset, and fnaa-failed-at.
+
+Subscriptions are named as the FNAA of their flow names them, as in the
+UPSTREAM column of flow subscribe. Dead-letter flows are read and purged
+through the broker their FNAA describes them in.`,
+}
+
+// deadLetter is the dead-letter flow of a subscription, opened from
+// agent, the FNAA of both.
+type deadLetter struct {
+	subscription string
+	flow         string
+	agent        config.Agent
+	driver       broker.Driver
+	descriptor   broker.Descriptor
+	opts         fnaa.Options
+}
+
+// openDeadLetter checks the single subscription argument and describes
+// its dead-letter flow.
+func openDeadLetter(ctx context.Context, cmd *cobra.Command, args []string) deadLetter {
+	if len(args) == 0 {
+		cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too few arguments, specify subscription"))
+	} else if len(args) > 1 {
+		cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too many arguments, only subscription allowed"))
+	}
+	opts, err := fnaa.OptionsFromFlags(cmd)
+	cmdutil.CheckErr(err)
+	cfg, err := fnaa.LoadConfig(cmd)
+	cmdutil.CheckErr(err)
+	subscription := cfg.Qualify(args[0])
+	d := deadLetter{subscription: subscription, flow: broker.DeadLetterFlow(subscription), opts: opts}
+
+	selectedAgent, _ := cmd.Flags().GetString("agent")
+	d.agent, err = fnaa.AgentForFlow(ctx, cfg, d.flow, selectedAgent, opts)
+	cmdutil.CheckErr(err)
+	d.driver, d.descriptor, err = fnaa.OpenFlow(ctx, d.agent, d.flow, opts)
+	cmdutil.CheckErr(err)
+	return d
+}
+
+// each calls f with every event of the dead-letter flow, from the oldest.
+func (d deadLetter) each(ctx context.Context, f func(m broker.Message) error) error {
+	brokerOpts := d.opts.Broker()
+	brokerOpts.Start = broker.Beginning
+	consumer, err := d.driver.Consumer(ctx, d.descriptor, brokerOpts)
+	if err != nil {
+		return cmdutil.Wrap(cmdutil.ExitConnection, err, "connecting to the broker of "+d.flow)
+	}
+	defer consumer.Close()
+	for {
+		m, err := consumer.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return cmdutil.Wrap(cmdutil.ExitConnection, err, "reading "+d.flow)
+		}
+		if err := f(m); err != nil {
+			return err
+		}
+	}
+}
+
+// purge drops every event of the dead-letter flow.
+func (d deadLetter) purge(ctx context.Context) error {
+	purger, ok := d.driver.(broker.Purger)
+	if !ok {
+		return cmdutil.Errorf(cmdutil.ExitError, "%v brokers cannot purge flows", d.descriptor.Type)
+	}
+	return cmdutil.Wrap(cmdutil.ExitConnection, purger.Purge(ctx, d.descriptor, d.opts.Broker()), "purging "+d.flow)
+}
+
+func init() {
+	DlqCmd.PersistentFlags().String("nameserver", "", "Override system nameserver")
+	DlqCmd.PersistentFlags().String("agent", "", "Select FNAA")
+	DlqCmd.AddCommand(listCmd)
+	DlqCmd.AddCommand(replayCmd)
+	DlqCmd.AddCommand(purgeCmd)
+}
@@ -0,0 +1,91 @@
+package dlq
+
+import (
+	"broker"
+	"flow/cmd/cmdutil"
+	"flow/cmd/printer"
+	"flow/fnaa"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var kind = printer.Kind{
+	Name:    "event",
+	NameKey: "event",
+	Columns: []printer.Column{
+		{Header: "EVENT", Key: "event"},
+		{Header: "STAGE", Key: "stage"},
+		{Header: "ATTEMPTS", Key: "attempts"},
+		{Header: "FAILED", Key: "failed"},
+		{Header: "ERROR", Key: "error"},
+		{Header: "SOURCE", Key: "source", Wide: true},
+		{Header: "KEY", Key: "key", Wide: true},
+		{Header: "VALUE", Key: "value", Wide: true},
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list <subscription>",
+	Short: "List the events moved to the dead-letter flow of a subscription",
+	Long: `List the events moved to the dead-letter flow of a subscription, oldest
+first, with why they were not copied. EVENT is their partition/offset in
+the dead-letter flow and SOURCE, with -o wide, where they come from in the
+flow subscribed to.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := printer.New(cmd)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "--output"))
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+		d := openDeadLetter(ctx, cmd, args)
+
+		streamCtx, stop := fnaa.Interruptible()
+		defer stop()
+		var items []map[string]string
+		cmdutil.CheckErr(d.each(streamCtx, func(m broker.Message) error {
+			items = append(items, item(m))
+			return nil
+		}))
+		cmdutil.CheckErr(p.PrintList(os.Stdout, kind, items))
+	},
+}
+
+// item describes a dead-lettered event from its headers.
+func item(m broker.Message) map[string]string {
+	header := func(key string) string {
+		value, _ := m.Header(key)
+		return string(value)
+	}
+	i := map[string]string{
+		"event":    strconv.Itoa(m.Partition) + "/" + strconv.FormatInt(m.Offset, 10),
+		"stage":    header(broker.HeaderStage),
+		"attempts": header(broker.HeaderAttempts),
+		"failed":   header(broker.HeaderFailedAt),
+		"error":    header(broker.HeaderError),
+		"source":   header(broker.HeaderSource),
+		"key":      string(m.Key),
+		"value":    string(m.Value),
+	}
+	if partition, ok := m.Header(broker.HeaderPartition); ok {
+		i["source"] += " " + string(partition) + "/" + header(broker.HeaderOffset)
+	}
+	if broker.Encrypted(m) {
+		i["value"] = "<encrypted for " + header(broker.HeaderRecipient) + ">"
+	}
+	if version, ok := m.Header(broker.HeaderSchemaVersion); ok {
+		i["schema_version"] = string(version)
+	}
+	if failed, err := time.Parse(time.RFC3339Nano, i["failed"]); err == nil {
+		i["failed"] = failed.Format(time.RFC3339)
+	} else if !m.Time.IsZero() {
+		// Events dead-lettered before the FNAA recorded when.
+		i["failed"] = m.Time.UTC().Format(time.RFC3339)
+	}
+	return i
+}
+
+func init() {
+	printer.AddFlags(listCmd)
+}
@@ -0,0 +1,33 @@
+package dlq
+
+import (
+	"flow/cmd/cmdutil"
+	"flow/fnaa"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var purgeCmd = &cobra.Command{
+	Use:   "purge <subscription>",
+	Short: "Drop every event of the dead-letter flow of a subscription",
+	Long: `Drop every event of the dead-letter flow of a subscription, for instance
+after replaying them. Kafka dead-letter flows are purged by deleting their
+topic, which the flow processor creates again with the next event it
+dead-letters. --yes is required, the events cannot be recovered.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		yes, _ := cmd.Flags().GetBool("yes")
+		if !yes {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "purging drops the events for good, confirm with --yes"))
+		}
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+		d := openDeadLetter(ctx, cmd, args)
+		cmdutil.CheckErr(d.purge(ctx))
+		fmt.Printf("Dead-letter flow %v purged.\n", d.flow)
+	},
+}
+
+func init() {
+	purgeCmd.Flags().Bool("yes", false, "Confirm the events are to be dropped")
+}
@@ -0,0 +1,50 @@
+package dlq
+
+import (
+	"broker"
+	"flow/cmd/cmdutil"
+	"flow/fnaa"
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <subscription>",
+	Short: "Write the events of the dead-letter flow of a subscription to it again",
+	Long: `Write the events of the dead-letter flow of a subscription to the
+subscription, oldest first and without the fnaa- headers explaining why
+they were dead-lettered, once what made them fail is fixed. Events are
+written as they were dead-lettered, not validated or projected again.
+
+The dead-letter flow is left as it is: purge it with flow dlq purge once
+the events replayed are no longer needed there.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+		d := openDeadLetter(ctx, cmd, args)
+		driver, descriptor, err := fnaa.OpenFlow(ctx, d.agent, d.subscription, d.opts)
+		cmdutil.CheckErr(err)
+
+		streamCtx, stop := fnaa.Interruptible()
+		defer stop()
+		// Subscriptions get their topic with the first event copied.
+		brokerOpts := d.opts.Broker()
+		brokerOpts.CreateTopics = true
+		producer, err := driver.Producer(streamCtx, descriptor, brokerOpts)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConnection, err, "connecting to the broker of "+d.subscription))
+		defer producer.Close()
+
+		replayed := 0
+		cmdutil.CheckErr(d.each(streamCtx, func(m broker.Message) error {
+			if err := producer.Produce(streamCtx, broker.Redelivery(m)); err != nil {
+				return cmdutil.Wrap(cmdutil.ExitConnection, err, "writing to "+d.subscription)
+			}
+			replayed++
+			return nil
+		}))
+		log.Printf("Replayed %v events of %v to %v", replayed, d.flow, d.subscription)
+		fmt.Printf("%v events replayed to %v.\n", replayed, d.subscription)
+	},
+}
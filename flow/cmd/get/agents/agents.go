@@ -1,22 +1,82 @@
 package agents
 
 import (
-	"fmt"
+	"flow/cmd/cmdutil"
+	"flow/cmd/printer"
+	"flow/fnaa"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
 
+var kind = printer.Kind{
+	Name:    "agent",
+	NameKey: "agent",
+	Columns: []printer.Column{
+		{Header: "NAME", Key: "agent"},
+		{Header: "FQDN", Key: "fqdn"},
+		{Header: "STATUS", Key: "status"},
+		{Header: "ENDPOINT", Key: "endpoint", Wide: true},
+		{Header: "VERSION", Key: "version", Wide: true},
+		{Header: "MECHANISMS", Key: "mechanisms", Wide: true},
+	},
+}
+
 var AgentsGetCmd = &cobra.Command{
-	Use:   "agents",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Use:     "agents",
+	Aliases: []string{"agent"},
+	Short:   "List the configured agents and whether they can be reached",
+	Long: `List the agents in the config file. Each agent is discovered through its
+SRV record and asked for its CAPABILITY, so the status shows whether the
+agent can be reached and authenticated with.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("get agents called")
+		p, err := printer.New(cmd)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "--output"))
+		opts, err := fnaa.OptionsFromFlags(cmd)
+		cmdutil.CheckErr(err)
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+
+		var items []map[string]string
+		for _, agent := range cfg.Agents {
+			item := map[string]string{
+				"agent":  agent.Name,
+				"fqdn":   agent.Fqdn,
+				"status": "Ready",
+			}
+			items = append(items, item)
+
+			session, err := fnaa.Dial(ctx, agent, opts)
+			if err != nil {
+				log.Printf("Error: agent %v: %v", agent.Name, err)
+				item["status"] = "Unreachable"
+				continue
+			}
+			item["endpoint"] = net.JoinHostPort(strings.TrimSuffix(session.Host, "."), strconv.Itoa(session.Port))
+
+			response, err := session.Command(ctx, "CAPABILITY")
+			session.Close()
+			if err != nil {
+				log.Printf("Error: agent %v: %v", agent.Name, err)
+				item["status"] = "Error"
+				continue
+			}
+			for _, capability := range fnaa.ParseItems(response) {
+				for key, value := range capability {
+					if key == "version" || key == "mechanisms" {
+						item[key] = value
+					}
+				}
+			}
+		}
 
+		cmdutil.CheckErr(p.PrintList(os.Stdout, kind, items))
 	},
 }
@@ -1,22 +1,43 @@
 package flows
 
 import (
-	"fmt"
+	"flow/cmd/cmdutil"
+	"flow/cmd/printer"
+	"flow/fnaa"
+	"os"
 
 	"github.com/spf13/cobra"
 )
 
-var FlowsGetCmd = &cobra.Command{
-	Use:   "flows",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+var kind = printer.Kind{
+	Name:    "flow",
+	NameKey: "flow",
+	Columns: []printer.Column{
+		{Header: "FLOW", Key: "flow"},
+		{Header: "NAMESPACE", Key: "namespace"},
+		{Header: "AGENT", Key: "agent"},
+	},
+}
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+var FlowsGetCmd = &cobra.Command{
+	Use:     "flows",
+	Aliases: []string{"flow", "fl"},
+	Short:   "List the flows hosted by the configured agents",
+	Long: `List the flows hosted by every agent in the config file, as reported by
+the FNAA of each agent with GET FLOWS.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("get flows called")
+		p, err := printer.New(cmd)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "--output"))
+		opts, err := fnaa.OptionsFromFlags(cmd)
+		cmdutil.CheckErr(err)
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
 
+		items, errs := fnaa.Collect(ctx, cfg.Agents, opts, "GET FLOWS")
+		cmdutil.CheckErr(p.PrintList(os.Stdout, kind, items))
+		cmdutil.CheckErrs(errs)
 	},
 }
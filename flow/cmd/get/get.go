@@ -4,6 +4,7 @@ import (
 	"flow/cmd/get/agents"
 	"flow/cmd/get/flows"
 	"flow/cmd/get/namespaces"
+	"flow/cmd/printer"
 
 	"fmt"
 
@@ -32,6 +33,9 @@ func init() {
 
 	GetCmd.AddCommand(agents.AgentsGetCmd)
 
+	printer.AddFlags(GetCmd)
+	GetCmd.PersistentFlags().String("nameserver", "", "Override system nameserver")
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
@@ -1,22 +1,43 @@
 package namespaces
 
 import (
-	"fmt"
+	"flow/cmd/cmdutil"
+	"flow/cmd/printer"
+	"flow/fnaa"
+	"os"
 
 	"github.com/spf13/cobra"
 )
 
-var NamespacesGetCmd = &cobra.Command{
-	Use:   "namespaces",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+var kind = printer.Kind{
+	Name:    "namespace",
+	NameKey: "namespace",
+	Columns: []printer.Column{
+		{Header: "NAMESPACE", Key: "namespace"},
+		{Header: "AGENT", Key: "agent"},
+		{Header: "BROKER", Key: "broker", Wide: true},
+	},
+}
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+var NamespacesGetCmd = &cobra.Command{
+	Use:     "namespaces",
+	Aliases: []string{"namespace", "ns"},
+	Short:   "List the namespaces managed by the configured agents",
+	Long: `List the namespaces managed by every agent in the config file, as reported by
+the FNAA of each agent with GET NAMESPACES.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("get namespace called")
+		p, err := printer.New(cmd)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "--output"))
+		opts, err := fnaa.OptionsFromFlags(cmd)
+		cmdutil.CheckErr(err)
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
 
+		items, errs := fnaa.Collect(ctx, cfg.Agents, opts, "GET NAMESPACES")
+		cmdutil.CheckErr(p.PrintList(os.Stdout, kind, items))
+		cmdutil.CheckErrs(errs)
 	},
 }
@@ -0,0 +1,126 @@
+package login
+
+import (
+	"bufio"
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"flow/credentials"
+	"flow/fnaa"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bgentry/speakeasy"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// stdin is shared by the prompts so none reads ahead of the others.
+var stdin = bufio.NewReader(os.Stdin)
+
+var LoginCmd = &cobra.Command{
+	Use:   "login [agent]",
+	Short: "Store the credentials of an agent in the encrypted keyring",
+	Long: `Ask for the username and password of an agent, check them against its FNAA
+and store them in the keyring, a file encrypted with a passphrase read from
+FLOW_KEYRING_PASSPHRASE or asked for on the terminal. The password is then
+removed from the agent entry of the config file.
+
+Without an agent name the agent of the current context is used.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too many arguments, only the agent name allowed"))
+		}
+		selected := ""
+		if len(args) == 1 {
+			selected = args[0]
+		}
+
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+		agent, err := fnaa.SelectAgent(cfg, selected)
+		cmdutil.CheckErr(err)
+
+		entry := credentials.Entry{}
+		entry.Username, _ = cmd.Flags().GetString("username")
+		if entry.Username == "" {
+			entry.Username, err = ask("Username", agent.Username)
+			cmdutil.CheckErr(err)
+		}
+		if entry.Username == "" {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "a username is required"))
+		}
+		if passwordStdin, _ := cmd.Flags().GetBool("password-stdin"); passwordStdin {
+			entry.Password, err = stdin.ReadString('\n')
+			if err != nil && entry.Password == "" {
+				cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "reading password from stdin"))
+			}
+			entry.Password = strings.TrimRight(entry.Password, "\r\n")
+		} else {
+			entry.Password, err = speakeasy.Ask("Password: ")
+			cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "reading password"))
+		}
+
+		if verify, _ := cmd.Flags().GetBool("verify"); verify {
+			opts, err := fnaa.OptionsFromFlags(cmd)
+			cmdutil.CheckErr(err)
+			ctx, cancel := fnaa.Context(cmd)
+			defer cancel()
+
+			candidate := agent
+			candidate.Username, candidate.Password, candidate.Exec = entry.Username, entry.Password, nil
+			session, err := fnaa.Dial(ctx, candidate, opts)
+			cmdutil.CheckErr(err)
+			session.Close()
+		}
+
+		path, err := credentials.KeyringPath()
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, err, "keyring"))
+		passphrase, err := credentials.NewPassphrase(path)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "keyring"))
+		keyring, err := credentials.OpenKeyring(path, passphrase)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitAuth, err, "opening keyring"))
+		keyring.Set(agent.Name, entry)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, keyring.Save(), "saving keyring"))
+
+		// The keyring only takes over once the plaintext password is gone.
+		err = config.Update(viper.ConfigFileUsed(), func(c *config.Config) error {
+			for i := range c.Agents {
+				if c.Agents[i].Name == agent.Name {
+					c.Agents[i].Username = entry.Username
+					c.Agents[i].Password = ""
+				}
+			}
+			return nil
+		})
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, err, "removing password from config file"))
+
+		fmt.Printf("Logged in to agent %q, credentials stored in %v.\n", agent.Name, path)
+		if agent.Credentials != "" || cfg.Current.Agent == agent.Name && cfg.Current.Credentials != "" {
+			fmt.Fprintf(os.Stderr, "Warning: credentials of the config file still apply to agent %q and take precedence over the keyring.\n", agent.Name)
+		}
+	},
+}
+
+// ask reads a line from the terminal, returning def if it is empty.
+func ask(prompt string, def string) (string, error) {
+	if def != "" {
+		prompt += " [" + def + "]"
+	}
+	fmt.Fprint(os.Stderr, prompt+": ")
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return def, nil
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line, nil
+	}
+	return def, nil
+}
+
+func init() {
+	LoginCmd.Flags().String("username", "", "Username, asked for when not given")
+	LoginCmd.Flags().Bool("password-stdin", false, "Read the password from stdin instead of the terminal")
+	LoginCmd.Flags().Bool("verify", true, "Authenticate to the FNAA of the agent before storing the credentials")
+	LoginCmd.Flags().String("nameserver", "", "Override system nameserver")
+}
@@ -0,0 +1,354 @@
+package printer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// template is a parsed jsonpath output template. It supports the subset
+// of the kubectl syntax that makes sense for flat items: field access
+// (.items), indexes ([0], [-1]), wildcards ([*]), filters
+// ([?(@.flow=="x")], [?(@.flow!="x")] and [?(@.flow)]), string literals
+// ("\n") and {range <path>}...{end} blocks. $ refers to the whole
+// document.
+type template struct {
+	nodes []node
+}
+
+// node is either literal text, a path to print, or a range over a path.
+type node struct {
+	text    string
+	path    []string
+	isRange bool
+	body    []node
+}
+
+func parseTemplate(text string) (*template, error) {
+	nodes, rest, err := parseNodes(text, false)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errors.New("unexpected {end}")
+	}
+	return &template{nodes: nodes}, nil
+}
+
+// parseNodes parses text until its end or, inside a range, until the
+// matching {end}. It returns what is left after the {end}.
+func parseNodes(text string, inRange bool) ([]node, string, error) {
+	var nodes []node
+	for text != "" {
+		open := strings.Index(text, "{")
+		if open < 0 {
+			nodes = append(nodes, node{text: text})
+			text = ""
+			break
+		}
+		if open > 0 {
+			nodes = append(nodes, node{text: text[:open]})
+		}
+		end := strings.Index(text[open:], "}")
+		if end < 0 {
+			return nil, "", errors.Errorf("unclosed action in %q", text[open:])
+		}
+		action := strings.TrimSpace(text[open+1 : open+end])
+		text = text[open+end+1:]
+
+		switch {
+		case action == "end":
+			if !inRange {
+				return nil, "", errors.New("{end} without {range}")
+			}
+			return nodes, text, nil
+
+		case strings.HasPrefix(action, "range "):
+			path, err := parsePath(strings.TrimSpace(strings.TrimPrefix(action, "range ")))
+			if err != nil {
+				return nil, "", err
+			}
+			body, rest, err := parseNodes(text, true)
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, node{path: path, isRange: true, body: body})
+			text = rest
+
+		case strings.HasPrefix(action, `"`):
+			literal, err := strconv.Unquote(action)
+			if err != nil {
+				return nil, "", errors.Errorf("invalid string literal %v", action)
+			}
+			nodes = append(nodes, node{text: literal})
+
+		default:
+			path, err := parsePath(action)
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, node{path: path})
+		}
+	}
+	if inRange {
+		return nil, "", errors.New("{range} without {end}")
+	}
+	return nodes, "", nil
+}
+
+// parsePath splits a path such as $.items[*].flow into its steps: "$",
+// field names and bracketed selectors.
+func parsePath(path string) ([]string, error) {
+	steps := []string{}
+	if strings.HasPrefix(path, "$") {
+		steps = append(steps, "$")
+		path = path[1:]
+	}
+	for path != "" {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+			i := strings.IndexAny(path, ".[")
+			if i < 0 {
+				i = len(path)
+			}
+			if i > 0 {
+				steps = append(steps, path[:i])
+			}
+			path = path[i:]
+		case '[':
+			// Filters hold paths with brackets of their own.
+			i := strings.Index(path, "]")
+			if strings.HasPrefix(path, "[?(") {
+				if i = strings.Index(path, ")]"); i >= 0 {
+					i++
+				}
+			}
+			if i < 0 {
+				return nil, errors.Errorf("unclosed [ in %q", path)
+			}
+			steps = append(steps, path[:i+1])
+			path = path[i+1:]
+		default:
+			i := strings.IndexAny(path, ".[")
+			if i < 0 {
+				i = len(path)
+			}
+			steps = append(steps, path[:i])
+			path = path[i:]
+		}
+	}
+	return steps, nil
+}
+
+func (t *template) execute(w io.Writer, document interface{}) error {
+	// Round trip through JSON so the template walks the same structure
+	// -o json prints.
+	data, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	return executeNodes(w, t.nodes, root, root)
+}
+
+func executeNodes(w io.Writer, nodes []node, root interface{}, current interface{}) error {
+	for _, n := range nodes {
+		if n.path == nil {
+			if _, err := io.WriteString(w, n.text); err != nil {
+				return err
+			}
+			continue
+		}
+
+		values, err := evaluate(n.path, root, current)
+		if err != nil {
+			return err
+		}
+
+		if n.isRange {
+			if len(values) == 1 {
+				if elements, ok := values[0].([]interface{}); ok {
+					values = elements
+				}
+			}
+			for _, value := range values {
+				if err := executeNodes(w, n.body, root, value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		var out []string
+		for _, value := range values {
+			out = append(out, format(value))
+		}
+		if _, err := io.WriteString(w, strings.Join(out, " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evaluate walks path from current, or from root if it starts with $.
+// Missing keys yield no values rather than an error, so a template can be
+// used against items that do not all carry the same keys.
+func evaluate(path []string, root interface{}, current interface{}) ([]interface{}, error) {
+	values := []interface{}{current}
+	for _, step := range path {
+		var next []interface{}
+		switch {
+		case step == "$":
+			next = []interface{}{root}
+
+		case step == "[*]":
+			for _, value := range values {
+				switch v := value.(type) {
+				case []interface{}:
+					next = append(next, v...)
+				case map[string]interface{}:
+					for _, key := range sortedKeys(v) {
+						next = append(next, v[key])
+					}
+				}
+			}
+
+		case strings.HasPrefix(step, "[?("):
+			f, err := parseFilter(step)
+			if err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				elements, ok := value.([]interface{})
+				if !ok {
+					continue
+				}
+				for _, element := range elements {
+					matched, err := f.match(root, element)
+					if err != nil {
+						return nil, err
+					}
+					if matched {
+						next = append(next, element)
+					}
+				}
+			}
+
+		case strings.HasPrefix(step, "["):
+			index, err := strconv.Atoi(strings.Trim(step, "[]"))
+			if err != nil {
+				return nil, errors.Errorf("unsupported selector %v", step)
+			}
+			for _, value := range values {
+				elements, ok := value.([]interface{})
+				if !ok {
+					continue
+				}
+				i := index
+				if i < 0 {
+					i += len(elements)
+				}
+				if i >= 0 && i < len(elements) {
+					next = append(next, elements[i])
+				}
+			}
+
+		default:
+			for _, value := range values {
+				if m, ok := value.(map[string]interface{}); ok {
+					if v, ok := m[step]; ok {
+						next = append(next, v)
+					}
+				}
+			}
+		}
+		values = next
+	}
+	return values, nil
+}
+
+// filter is a [?(@.path op value)] selector, keeping the elements whose
+// path has value, or has not for !=. Without op it keeps those having the
+// path.
+type filter struct {
+	path  []string
+	op    string
+	value string
+}
+
+func parseFilter(step string) (filter, error) {
+	if !strings.HasSuffix(step, ")]") {
+		return filter{}, errors.Errorf("unsupported selector %v", step)
+	}
+	expr := strings.TrimSpace(step[len("[?(") : len(step)-len(")]")])
+	var f filter
+	left := expr
+	for _, op := range []string{"==", "!="} {
+		if i := strings.Index(expr, op); i >= 0 {
+			left, f.op = strings.TrimSpace(expr[:i]), op
+			f.value = strings.TrimSpace(expr[i+len(op):])
+			if strings.HasPrefix(f.value, `"`) || strings.HasPrefix(f.value, "'") {
+				if len(f.value) < 2 || f.value[len(f.value)-1] != f.value[0] {
+					return filter{}, errors.Errorf("invalid string literal %v in %v", f.value, step)
+				}
+				f.value = f.value[1 : len(f.value)-1]
+			}
+			break
+		}
+	}
+	if !strings.HasPrefix(left, "@") {
+		return filter{}, errors.Errorf("filter %v must start with @", step)
+	}
+	path, err := parsePath(left[1:])
+	if err != nil {
+		return filter{}, err
+	}
+	f.path = path
+	return f, nil
+}
+
+func (f filter) match(root interface{}, element interface{}) (bool, error) {
+	values, err := evaluate(f.path, root, element)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for _, value := range values {
+		if f.op == "" || format(value) == f.value {
+			found = true
+		}
+	}
+	if f.op == "!=" {
+		return !found, nil
+	}
+	return found, nil
+}
+
+func format(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	out, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(out)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
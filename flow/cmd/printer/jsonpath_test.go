@@ -0,0 +1,109 @@
+package printer
+
+import (
+	"bytes"
+	"testing"
+)
+
+var document = map[string]interface{}{
+	"kind": "List",
+	"items": []map[string]interface{}{
+		{"flow": "time.flow.unix.ar", "schema": "json", "partitions": 3},
+		{"flow": "orders.flow.unix.ar", "partitions": 1},
+		{"flow": "dlq.orders.flow.unix.ar", "schema": "avro", "tags": []string{"dlq", "orders"}},
+	},
+	"counts": map[string]int{"b": 2, "a": 1},
+}
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{`{.kind}`, "List"},
+		{`{$.kind}`, "List"},
+		{`kind={.kind}.`, "kind=List."},
+		{`{.items[0].flow}`, "time.flow.unix.ar"},
+		{`{.items[-1].flow}`, "dlq.orders.flow.unix.ar"},
+		{`{.items[*].flow}`, "time.flow.unix.ar orders.flow.unix.ar dlq.orders.flow.unix.ar"},
+		{`{.items[0].partitions}`, "3"},
+		{`{.items[2].tags}`, `["dlq","orders"]`},
+		{`{.counts[*]}`, "1 2"},
+		{`{.counts}`, `{"a":1,"b":2}`},
+
+		// Missing keys and indexes print nothing.
+		{`{.missing}`, ""},
+		{`[{.items[*].schema}]`, "[json avro]"},
+		{`{.items[5].flow}`, ""},
+		{`{.items[-4].flow}`, ""},
+		{`{.kind[0]}`, ""},
+		{`{.items.flow}`, ""},
+
+		// Ranges, with paths relative to each element or to the
+		// document.
+		{`{range .items[*]}{.flow}{"\n"}{end}`, "time.flow.unix.ar\norders.flow.unix.ar\ndlq.orders.flow.unix.ar\n"},
+		{`{range .items}{.flow},{end}`, "time.flow.unix.ar,orders.flow.unix.ar,dlq.orders.flow.unix.ar,"},
+		{`{range .items[*]}{.flow}={.schema};{end}`, "time.flow.unix.ar=json;orders.flow.unix.ar=;dlq.orders.flow.unix.ar=avro;"},
+		{`{range .items[*]}{$.kind} {end}`, "List List List "},
+		{`{range .items[*]}{range .tags[*]}{$.kind}{end}{end}`, "ListList"},
+		{`{range .items[2].tags}<{$.items[0].flow}>{end}`, "<time.flow.unix.ar><time.flow.unix.ar>"},
+		{`{range .missing}x{end}`, ""},
+
+		// Filters.
+		{`{.items[?(@.schema=="json")].flow}`, "time.flow.unix.ar"},
+		{`{.items[?(@.schema == 'avro')].flow}`, "dlq.orders.flow.unix.ar"},
+		{`{.items[?(@.schema!="json")].flow}`, "orders.flow.unix.ar dlq.orders.flow.unix.ar"},
+		{`{.items[?(@.schema)].flow}`, "time.flow.unix.ar dlq.orders.flow.unix.ar"},
+		{`{.items[?(@.partitions==1)].flow}`, "orders.flow.unix.ar"},
+		{`{.items[?(@.tags[0]=="dlq")].flow}`, "dlq.orders.flow.unix.ar"},
+		{`{.items[?(@.schema=="protobuf")].flow}`, ""},
+		{`{range .items[?(@.partitions)]}{.flow} {end}`, "time.flow.unix.ar orders.flow.unix.ar "},
+		{`{.kind[?(@.schema)]}`, ""},
+	}
+	for _, test := range tests {
+		tmpl, err := parseTemplate(test.template)
+		if err != nil {
+			t.Errorf("%v: %v", test.template, err)
+			continue
+		}
+		var out bytes.Buffer
+		if err := tmpl.execute(&out, document); err != nil {
+			t.Errorf("%v: %v", test.template, err)
+			continue
+		}
+		if out.String() != test.want {
+			t.Errorf("%v printed %q, want %q", test.template, out.String(), test.want)
+		}
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	unparsed := []string{
+		`{.kind`,
+		`{.items[0}`,
+		`{end}`,
+		`{range .items[*]}{.flow}`,
+		`{"unclosed}`,
+	}
+	for _, text := range unparsed {
+		if _, err := parseTemplate(text); err == nil {
+			t.Errorf("%v parsed", text)
+		}
+	}
+	failing := []string{
+		`{.items[x]}`,
+		`{.items[1:2]}`,
+		`{.items[?(.schema=="json")]}`,
+		`{.items[?(@.schema=="json)]}`,
+		`{range .items[*]}{.tags[?(@ == "x"]}{end}`,
+	}
+	for _, text := range failing {
+		tmpl, err := parseTemplate(text)
+		if err != nil {
+			continue
+		}
+		if err := tmpl.execute(&bytes.Buffer{}, document); err == nil {
+			t.Errorf("%v executed", text)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package printer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats lists the values accepted by --output.
+var Formats = []string{"table", "wide", "json", "yaml", "name", "jsonpath=<template>"}
+
+// Column is a column of the table output, filled from the item key.
+// Wide columns are only shown with -o wide.
+type Column struct {
+	Header string
+	Key    string
+	Wide   bool
+}
+
+// Kind describes a resource the CLI prints. Name is the singular resource
+// name used by -o name, together with the item key holding the name of
+// each item.
+type Kind struct {
+	Name    string
+	NameKey string
+	Columns []Column
+}
+
+// list is the document json, yaml and jsonpath see when several items are
+// printed, so templates such as {.items[*].flow} work as in kubectl.
+type list struct {
+	Kind  string              `json:"kind" yaml:"kind"`
+	Items []map[string]string `json:"items" yaml:"items"`
+}
+
+// Printer writes items in the format selected with --output.
+type Printer struct {
+	format   string
+	template *template
+}
+
+// AddFlags registers the --output flag on cmd.
+func AddFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringP("output", "o", "table", "Output format, one of "+strings.Join(Formats, "|"))
+}
+
+// New returns the printer selected with the --output flag of cmd.
+func New(cmd *cobra.Command) (*Printer, error) {
+	format, _ := cmd.Flags().GetString("output")
+
+	if strings.HasPrefix(format, "jsonpath=") {
+		t, err := parseTemplate(strings.TrimPrefix(format, "jsonpath="))
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing jsonpath template")
+		}
+		return &Printer{format: "jsonpath", template: t}, nil
+	}
+
+	switch format {
+	case "table", "wide", "json", "yaml", "name":
+		return &Printer{format: format}, nil
+	case "jsonpath":
+		return nil, errors.New("jsonpath output requires a template, as in -o jsonpath='{.items[*].name}'")
+	}
+	return nil, errors.Errorf("unknown output format %q, use one of %v", format, strings.Join(Formats, "|"))
+}
+
+// PrintList writes a list of items of kind to w.
+func (p *Printer) PrintList(w io.Writer, kind Kind, items []map[string]string) error {
+	if items == nil {
+		items = []map[string]string{}
+	}
+
+	switch p.format {
+	case "table", "wide":
+		return printTable(w, kind.Columns, items, p.format == "wide")
+	case "name":
+		return printNames(w, kind, items)
+	}
+	return p.print(w, list{Kind: "List", Items: items})
+}
+
+// PrintObject writes a single item of kind to w.
+func (p *Printer) PrintObject(w io.Writer, kind Kind, item map[string]string) error {
+	switch p.format {
+	case "table", "wide":
+		return printTable(w, kind.Columns, []map[string]string{item}, p.format == "wide")
+	case "name":
+		return printNames(w, kind, []map[string]string{item})
+	}
+	return p.print(w, item)
+}
+
+func (p *Printer) print(w io.Writer, document interface{}) error {
+	switch p.format {
+	case "json":
+		out, err := json.MarshalIndent(document, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+
+	case "yaml":
+		out, err := yaml.Marshal(document)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+
+	case "jsonpath":
+		return p.template.execute(w, document)
+	}
+
+	return errors.Errorf("unknown output format %q", p.format)
+}
+
+func printNames(w io.Writer, kind Kind, items []map[string]string) error {
+	for _, item := range items {
+		if _, err := fmt.Fprintf(w, "%v/%v\n", kind.Name, item[kind.NameKey]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printTable(w io.Writer, columns []Column, items []map[string]string, wide bool) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+
+	var headers []string
+	for _, column := range columns {
+		if column.Wide && !wide {
+			continue
+		}
+		headers = append(headers, column.Header)
+	}
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+
+	for _, item := range items {
+		var cells []string
+		for _, column := range columns {
+			if column.Wide && !wide {
+				continue
+			}
+			value := item[column.Key]
+			if value == "" {
+				value = "<none>"
+			}
+			cells = append(cells, value)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,146 @@
+package printer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+var flows = Kind{
+	Name:    "flow",
+	NameKey: "flow",
+	Columns: []Column{
+		{Header: "FLOW", Key: "flow"},
+		{Header: "SCHEMA", Key: "schema"},
+		{Header: "SERVER", Key: "server", Wide: true},
+	},
+}
+
+var items = []map[string]string{
+	{"flow": "time.flow.unix.ar", "schema": "json", "server": "kf1.unix.ar:9092"},
+	{"flow": "orders.flow.unix.ar", "server": "kf1.unix.ar:9092"},
+}
+
+// newPrinter returns the printer of a command run with -o output.
+func newPrinter(t *testing.T, output string) (*Printer, error) {
+	t.Helper()
+	cmd := &cobra.Command{Use: "get"}
+	AddFlags(cmd)
+	if err := cmd.ParseFlags([]string{"-o", output}); err != nil {
+		t.Fatal(err)
+	}
+	return New(cmd)
+}
+
+func TestPrintList(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"table", "" +
+			"FLOW                  SCHEMA\n" +
+			"time.flow.unix.ar     json\n" +
+			"orders.flow.unix.ar   <none>\n"},
+		{"wide", "" +
+			"FLOW                  SCHEMA   SERVER\n" +
+			"time.flow.unix.ar     json     kf1.unix.ar:9092\n" +
+			"orders.flow.unix.ar   <none>   kf1.unix.ar:9092\n"},
+		{"name", "flow/time.flow.unix.ar\nflow/orders.flow.unix.ar\n"},
+		{"json", `{
+  "kind": "List",
+  "items": [
+    {
+      "flow": "time.flow.unix.ar",
+      "schema": "json",
+      "server": "kf1.unix.ar:9092"
+    },
+    {
+      "flow": "orders.flow.unix.ar",
+      "server": "kf1.unix.ar:9092"
+    }
+  ]
+}
+`},
+		{"yaml", `kind: List
+items:
+- flow: time.flow.unix.ar
+  schema: json
+  server: kf1.unix.ar:9092
+- flow: orders.flow.unix.ar
+  server: kf1.unix.ar:9092
+`},
+		{"jsonpath={.items[*].flow}", "time.flow.unix.ar orders.flow.unix.ar"},
+	}
+	for _, test := range tests {
+		p, err := newPrinter(t, test.output)
+		if err != nil {
+			t.Errorf("-o %v: %v", test.output, err)
+			continue
+		}
+		var out bytes.Buffer
+		if err := p.PrintList(&out, flows, items); err != nil {
+			t.Errorf("-o %v: %v", test.output, err)
+			continue
+		}
+		if out.String() != test.want {
+			t.Errorf("-o %v printed\n%v\nwant\n%v", test.output, out.String(), test.want)
+		}
+	}
+}
+
+func TestPrintObject(t *testing.T) {
+	tests := map[string]string{
+		"table":                      "FLOW                SCHEMA\ntime.flow.unix.ar   json\n",
+		"name":                       "flow/time.flow.unix.ar\n",
+		"json":                       "{\n  \"flow\": \"time.flow.unix.ar\",\n  \"schema\": \"json\",\n  \"server\": \"kf1.unix.ar:9092\"\n}\n",
+		"yaml":                       "flow: time.flow.unix.ar\nschema: json\nserver: kf1.unix.ar:9092\n",
+		"jsonpath={.server}":         "kf1.unix.ar:9092",
+		"jsonpath={$.flow}{\"\\n\"}": "time.flow.unix.ar\n",
+	}
+	for output, want := range tests {
+		p, err := newPrinter(t, output)
+		if err != nil {
+			t.Errorf("-o %v: %v", output, err)
+			continue
+		}
+		var out bytes.Buffer
+		if err := p.PrintObject(&out, flows, items[0]); err != nil {
+			t.Errorf("-o %v: %v", output, err)
+			continue
+		}
+		if out.String() != want {
+			t.Errorf("-o %v printed %q, want %q", output, out.String(), want)
+		}
+	}
+}
+
+func TestPrintEmptyList(t *testing.T) {
+	tests := map[string]string{
+		"table": "FLOW   SCHEMA\n",
+		"name":  "",
+		"json":  "{\n  \"kind\": \"List\",\n  \"items\": []\n}\n",
+		"yaml":  "kind: List\nitems: []\n",
+	}
+	for output, want := range tests {
+		p, err := newPrinter(t, output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := p.PrintList(&out, flows, nil); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != want {
+			t.Errorf("-o %v printed %q for no items, want %q", output, out.String(), want)
+		}
+	}
+}
+
+func TestNewRejects(t *testing.T) {
+	for _, output := range []string{"xml", "jsonpath", "jsonpath={.items", "jsonpath={range .items[*]}{.flow}", "jsonpath={end}"} {
+		if _, err := newPrinter(t, output); err == nil {
+			t.Errorf("-o %v accepted", output)
+		}
+	}
+}
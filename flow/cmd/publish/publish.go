@@ -0,0 +1,193 @@
+package publish
+
+import (
+	"broker"
+	"bufio"
+	"crypto/rand"
+	"flow/cmd/cmdutil"
+	"flow/fnaa"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// maxLine bounds the events read from stdin, one per line.
+const maxLine = 1024 * 1024
+
+var PublishCmd = &cobra.Command{
+	Use:   "publish <flow>",
+	Short: "Publish events to a flow",
+	Long: `Publish events to a flow, connecting to the broker its FNAA describes it
+in. Each line read from stdin is an event or, with --file, each file is.
+
+Events have no key unless one is given with --key, generated for each
+event with --generate-key or, with --key-separator, read from each line
+before the separator. In flows ordered per key, the default, events with
+the same key keep their order, or with the same --partition-key, which
+they are then partitioned by instead of their key and keep when copied
+to subscriptions. In totally ordered flows every event keeps its order,
+and in unordered ones none does.
+
+Events of flows in a CloudEvents content mode are wrapped in CloudEvents,
+structured or binary as the flow is described, with a random UUID as id
+and the flow as source. Their type is --event-type and their data content
+type --content-type, guessed from each event by default.
+
+--timeout bounds finding and describing the flow; events are then read
+until the end of the input or an interrupt.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too few arguments, specify flowName"))
+		} else if len(args) > 1 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too many arguments, only flowName allowed"))
+		}
+		files, _ := cmd.Flags().GetStringSlice("file")
+		key, _ := cmd.Flags().GetString("key")
+		generateKey, _ := cmd.Flags().GetBool("generate-key")
+		separator, _ := cmd.Flags().GetString("key-separator")
+		headerFlags, _ := cmd.Flags().GetStringSlice("header")
+		keyed := 0
+		for _, set := range []bool{key != "", generateKey, separator != ""} {
+			if set {
+				keyed++
+			}
+		}
+		if keyed > 1 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "--key, --generate-key and --key-separator are exclusive"))
+		}
+		headers, err := parseHeaders(headerFlags)
+		cmdutil.CheckErr(err)
+		if partitionKey, _ := cmd.Flags().GetString("partition-key"); partitionKey != "" {
+			headers = append(headers, broker.Header{Key: broker.HeaderPartitionKey, Value: []byte(partitionKey)})
+		}
+		eventType, _ := cmd.Flags().GetString("event-type")
+		contentType, _ := cmd.Flags().GetString("content-type")
+
+		opts, err := fnaa.OptionsFromFlags(cmd)
+		cmdutil.CheckErr(err)
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+		flowName := cfg.Qualify(args[0])
+
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+		selectedAgent, _ := cmd.Flags().GetString("agent")
+		agentConfig, err := fnaa.AgentForFlow(ctx, cfg, flowName, selectedAgent, opts)
+		cmdutil.CheckErr(err)
+		driver, descriptor, err := fnaa.OpenFlow(ctx, agentConfig, flowName, opts)
+		cmdutil.CheckErr(err)
+		mode, err := broker.ParseContentMode(descriptor.Options["cloudevents"])
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitError, err, "describing flow "+flowName))
+		if mode == broker.Plain && (cmd.Flags().Changed("event-type") || contentType != "") {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "flow %v is not in a CloudEvents content mode, --event-type and --content-type do not apply", flowName))
+		}
+
+		streamCtx, stop := fnaa.Interruptible()
+		defer stop()
+		brokerOpts := opts.Broker()
+		brokerOpts.Ordering = descriptor.Options["ordering"]
+		producer, err := driver.Producer(streamCtx, descriptor, brokerOpts)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConnection, err, "connecting to the broker of "+flowName))
+		defer producer.Close()
+
+		published := 0
+		publish := func(k []byte, value []byte) {
+			m := broker.Message{Key: k, Value: value, Headers: headers, Time: time.Now()}
+			if generateKey {
+				m.Key = newKey()
+			} else if key != "" {
+				m.Key = []byte(key)
+			}
+			if mode != broker.Plain {
+				e := broker.CloudEvent{ID: string(newKey()), Source: flowName, Type: eventType, Time: m.Time, DataContentType: contentType}
+				if e.DataContentType == "" {
+					e.DataContentType = broker.DataContentType(value)
+				}
+				var err error
+				m, err = broker.Wrap(m, mode, e)
+				cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "wrapping event"))
+			}
+			err := producer.Produce(streamCtx, m)
+			cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConnection, err, "publishing to "+flowName))
+			published++
+		}
+
+		if len(files) > 0 {
+			for _, file := range files {
+				value, err := readFile(file)
+				cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "reading "+file))
+				publish(nil, value)
+			}
+		} else {
+			scanner := bufio.NewScanner(os.Stdin)
+			scanner.Buffer(make([]byte, 64*1024), maxLine)
+			for scanner.Scan() {
+				line := scanner.Text()
+				var k []byte
+				if separator != "" {
+					parts := strings.SplitN(line, separator, 2)
+					if len(parts) != 2 {
+						cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "line %v has no key separator %q", published+1, separator))
+					}
+					k, line = []byte(parts[0]), parts[1]
+				}
+				publish(k, []byte(line))
+			}
+			cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, scanner.Err(), "reading stdin"))
+		}
+
+		log.Printf("Published %v events to topic %v", published, descriptor.Topic)
+		fmt.Printf("Published %v events to flow %v.\n", published, flowName)
+	},
+}
+
+// readFile reads a whole file, stdin if it is "-".
+func readFile(file string) ([]byte, error) {
+	if file == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// parseHeaders parses the key=value pairs given with --header.
+func parseHeaders(pairs []string) ([]broker.Header, error) {
+	var headers []broker.Header
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, cmdutil.Errorf(cmdutil.ExitUsage, "--header %q is not key=value", pair)
+		}
+		headers = append(headers, broker.Header{Key: kv[0], Value: []byte(kv[1])})
+	}
+	return headers, nil
+}
+
+// newKey returns a random version 4 UUID.
+func newKey() []byte {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitError, err, "generating key"))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return []byte(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+}
+
+func init() {
+	PublishCmd.Flags().StringSliceP("file", "f", nil, "Publish the content of each file as an event, - for stdin")
+	PublishCmd.Flags().String("key", "", "Key of every event")
+	PublishCmd.Flags().Bool("generate-key", false, "Give each event a random UUID as key")
+	PublishCmd.Flags().String("key-separator", "", "Read the key of each line before this separator")
+	PublishCmd.Flags().String("partition-key", "", "Partition every event by this key instead of its own")
+	PublishCmd.Flags().StringSlice("header", nil, "Header of every event, as key=value")
+	PublishCmd.Flags().String("event-type", broker.DefaultEventType, "Type of the CloudEvents events are wrapped in")
+	PublishCmd.Flags().String("content-type", "", "Data content type of the CloudEvents events are wrapped in")
+	PublishCmd.Flags().String("nameserver", "", "Override system nameserver")
+	PublishCmd.Flags().String("agent", "", "Select FNAA")
+}
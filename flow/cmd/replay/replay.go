@@ -0,0 +1,89 @@
+package replay
+
+import (
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"flow/cmd/printer"
+	"flow/fnaa"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var kind = printer.Kind{
+	Name:    "subscription",
+	NameKey: "subscription",
+	Columns: []printer.Column{
+		{Header: "SUBSCRIPTION", Key: "subscription"},
+		{Header: "FLOW", Key: "flow"},
+		{Header: "FROM", Key: "from"},
+		{Header: "AGENT", Key: "agent", Wide: true},
+	},
+}
+
+var ReplayCmd = &cobra.Command{
+	Use:   "replay <subscription>",
+	Short: "Copy the events of a flow to a subscription again",
+	Long: `Rewind a subscription, so the flow processor copying to it copies the
+events of its flow again from --from on. Subscriptions to remote flows are
+rewound by the FNAA of the flow, through the agent that subscribed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too few arguments, specify subscription"))
+		} else if len(args) > 1 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too many arguments, only subscription allowed"))
+		}
+		from, err := fnaa.FromOption(cmd)
+		cmdutil.CheckErr(err)
+		if from == "" {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "--from is required"))
+		}
+
+		p, err := printer.New(cmd)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "--output"))
+		opts, err := fnaa.OptionsFromFlags(cmd)
+		cmdutil.CheckErr(err)
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+		subscription := cfg.Qualify(args[0])
+
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+
+		// As with subscribe, the agent is the one chosen, the current or
+		// the only one, or else the FNAA of the subscription.
+		selectedAgent, _ := cmd.Flags().GetString("agent")
+		var agentConfig config.Agent
+		if selectedAgent != "" || cfg.Current.Agent != "" || len(cfg.Agents) == 1 {
+			agentConfig, err = fnaa.SelectAgent(cfg, selectedAgent)
+		} else {
+			agentConfig, err = fnaa.AgentForFlow(ctx, cfg, subscription, "", opts)
+		}
+		cmdutil.CheckErr(err)
+		cmdutil.CheckErr(fnaa.RequireCredentials(agentConfig, "REPLAY"))
+
+		log.Printf("Replaying subscription %v in agent %v", subscription, agentConfig.Name)
+		session, err := fnaa.Dial(ctx, agentConfig, opts)
+		cmdutil.CheckErr(err)
+		response, err := session.Command(ctx, "REPLAY "+subscription+" "+from)
+		session.Close()
+		cmdutil.CheckErr(err)
+
+		item := map[string]string{"subscription": subscription}
+		for _, fields := range fnaa.ParseItems(response) {
+			for key, value := range fields {
+				item[key] = value
+			}
+		}
+		item["agent"] = agentConfig.Name
+		cmdutil.CheckErr(p.PrintObject(os.Stdout, kind, item))
+	},
+}
+
+func init() {
+	ReplayCmd.Flags().String("nameserver", "", "Override system nameserver")
+	ReplayCmd.Flags().String("agent", "", "Select FNAA")
+	fnaa.AddFromFlag(ReplayCmd, "Copy the events of the flow again from this point")
+	printer.AddFlags(ReplayCmd)
+}
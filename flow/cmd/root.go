@@ -16,13 +16,25 @@ limitations under the License.
 package cmd
 
 import (
+	"flow/cmd/cache"
+	"flow/cmd/cmdutil"
 	"flow/cmd/config"
+	"flow/cmd/configure"
 	"flow/cmd/create"
 	"flow/cmd/describe"
+	"flow/cmd/dlq"
 	"flow/cmd/get"
+	"flow/cmd/login"
+	"flow/cmd/publish"
+	"flow/cmd/replay"
 	"flow/cmd/set"
 	"flow/cmd/subscribe"
+	"flow/cmd/tail"
+	"flow/cmd/update"
+	"flow/credentials"
 	"log"
+	"path/filepath"
+	"time"
 
 	"os"
 
@@ -62,7 +74,7 @@ var rootCmd = &cobra.Command{
 			log.Printf("Agent name: %v\n", agent.Name)
 			log.Printf("\tfqdn: %v\n", agent.Fqdn)
 			log.Printf("\tusername: %v\n", agent.Username)
-			log.Printf("\tpassword: %v\n", agent.Password)
+			log.Printf("\tpassword: %v\n", credentials.Redact(agent.Password))
 		}
 
 		for _, namespace := range config.Namespaces {
@@ -78,14 +90,13 @@ var rootCmd = &cobra.Command{
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		log.Println(err)
-		os.Exit(1)
+		// Cobra already printed the error and the usage.
+		os.Exit(cmdutil.ExitUsage)
 	}
 }
 
 func init() {
-	log.Println("Initializing rootCmd")
-	cobra.OnInitialize(initConfig)
+	cobra.OnInitialize(initLogging, initConfig)
 
 	/****** FLOW COMMANDS ******/
 	rootCmd.AddCommand(create.CreateCmd)
@@ -93,24 +104,49 @@ func init() {
 	rootCmd.AddCommand(set.SetCmd)
 	rootCmd.AddCommand(describe.DescribeCmd)
 	rootCmd.AddCommand(subscribe.SubscribeCmd)
+	rootCmd.AddCommand(configure.ConfigCmd)
+	rootCmd.AddCommand(login.LoginCmd)
+	rootCmd.AddCommand(cache.CacheCmd)
+	rootCmd.AddCommand(publish.PublishCmd)
+	rootCmd.AddCommand(tail.TailCmd)
+	rootCmd.AddCommand(update.UpdateCmd)
+	rootCmd.AddCommand(replay.ReplayCmd)
+	rootCmd.AddCommand(dlq.DlqCmd)
 
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.flow.yml)")
-	rootCmd.PersistentFlags().BoolP("debug", "d", false, "Enable debug")
+	rootCmd.PersistentFlags().String("context", "", "Context of the config file to use instead of the current one")
+	rootCmd.PersistentFlags().BoolP("debug", "d", false, "Enable debug, same as -vv")
+	rootCmd.PersistentFlags().CountP("verbose", "v", "Log the progress of commands to stderr, twice to trace the protocol")
+	rootCmd.PersistentFlags().String("dns-transport", "udp", "Transport of the DNS queries: udp, tcp, dot (DNS-over-TLS) or doh (DNS-over-HTTPS)")
+	rootCmd.PersistentFlags().String("nameserver-ca", "", "PEM file of the CA certificates trusted for DNS-over-TLS and DNS-over-HTTPS nameservers")
+	rootCmd.PersistentFlags().String("trust-anchor", "", "File of DNSKEY or DS records to validate DNS answers with DNSSEC against")
+	rootCmd.PersistentFlags().Duration("timeout", time.Minute, "Maximum time a command may take, 0 to wait forever")
+	rootCmd.PersistentFlags().Duration("dial-timeout", 5*time.Second, "Maximum time to establish a connection to a FNAA")
+	rootCmd.PersistentFlags().Duration("io-timeout", 30*time.Second, "Maximum time to wait on a single read or write to a FNAA")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	// rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-	rootCmd.Flags().BoolP("version", "v", false, "Flow version 0.01")
+	rootCmd.Flags().Bool("version", false, "Flow version 0.01")
 
 }
 
+// initLogging hides diagnostics unless asked for with --verbose or --debug,
+// so stdout and stderr only carry the output of the command and its errors.
+func initLogging() {
+	verbosity, _ := rootCmd.PersistentFlags().GetCount("verbose")
+	if debug, _ := rootCmd.PersistentFlags().GetBool("debug"); debug {
+		verbosity = 2
+	}
+	cmdutil.SetVerbosity(verbosity)
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	log.Println("Initializing initConfig")
 
 	if cfgFile != "" {
 		// Use config file from the flag.
@@ -119,14 +155,11 @@ func initConfig() {
 	} else {
 		// Find home directory.
 		home, err := homedir.Dir()
-		if err != nil {
-			log.Println(err)
-			os.Exit(1)
-		}
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, err, "finding home directory"))
 
-		// Search config in home directory with name ".flow" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigName(".flow.yml")
+		// Use ".flow.yml" in the home directory, even before it exists,
+		// so flow config can create it.
+		viper.SetConfigFile(filepath.Join(home, ".flow.yml"))
 	}
 
 	viper.AutomaticEnv() // read in environment variables that match
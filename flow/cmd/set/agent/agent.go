@@ -1,22 +1,73 @@
 package agent
 
 import (
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"flow/credentials"
 	"fmt"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
-var AgentSetCmd = &cobra.Command{
-	Use:   "namespaces",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+// NewAgentSetCmd returns the command that adds or updates an agent in the
+// config file, named use so it can serve both "flow set agent" and "flow
+// config set-agent".
+func NewAgentSetCmd(use string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use + " <name>",
+		Short: "Add an agent to the config file, or update it",
+		Long: `Add an agent to the config file, or update the fields given as flags of an
+existing one. The password is stored in the encrypted keyring, as flow login
+does, and removed from the config file.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "expected one argument, the agent name"))
+			}
+			agent := config.Agent{Name: args[0]}
+			agent.Fqdn, _ = cmd.Flags().GetString("fqdn")
+			agent.Username, _ = cmd.Flags().GetString("username")
+			password, _ := cmd.Flags().GetString("password")
+			agent.Prefix, _ = cmd.Flags().GetString("prefix")
+			agent.Credentials, _ = cmd.Flags().GetString("credentials")
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("get namespace called")
+			err := config.Update(viper.ConfigFileUsed(), func(c *config.Config) error {
+				existing, ok := c.Agent(agent.Name)
+				if !ok && agent.Fqdn == "" {
+					return cmdutil.Errorf(cmdutil.ExitUsage, "--fqdn is required for a new agent")
+				}
+				if _, ok := c.Credential(agent.Credentials); agent.Credentials != "" && !ok {
+					return cmdutil.Errorf(cmdutil.ExitConfig, "credentials %v not found", agent.Credentials)
+				}
+				if password != "" {
+					entry := credentials.Entry{Username: agent.Username, Password: password}
+					if entry.Username == "" {
+						entry.Username = existing.Username
+					}
+					if _, err := credentials.Store(agent.Name, entry); err != nil {
+						return cmdutil.Wrap(cmdutil.ExitConfig, err, "storing password in keyring")
+					}
+				}
+				c.SetAgent(agent)
+				// The keyring only takes over once the plaintext password is gone.
+				for i := range c.Agents {
+					if c.Agents[i].Name == agent.Name && password != "" {
+						c.Agents[i].Password = ""
+					}
+				}
+				return nil
+			})
+			cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConfig, err, "setting agent"))
+			fmt.Printf("Agent %q set.\n", agent.Name)
+		},
+	}
 
-	},
+	cmd.Flags().String("fqdn", "", "FQDN the FNAA of the agent is published under")
+	cmd.Flags().String("username", "", "Username to authenticate with")
+	cmd.Flags().String("password", "", "Password to authenticate with, stored in the encrypted keyring")
+	cmd.Flags().String("credentials", "", "Credentials of the config file to authenticate with")
+	cmd.Flags().String("prefix", "", "Prefix of the local copies of subscribed flows")
+	return cmd
 }
+
+var AgentSetCmd = NewAgentSetCmd("agent")
@@ -1,6 +1,7 @@
 package set
 
 import (
+	"flow/cmd/set/agent"
 	"fmt"
 
 	"github.com/spf13/cobra"
@@ -23,6 +24,7 @@ to quickly create a Cobra application.`,
 }
 
 func init() {
+	SetCmd.AddCommand(agent.AgentSetCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -1,210 +1,153 @@
 package subscribe
 
 import (
-	"flow/client"
+	"encoding/base64"
+	"flow/cmd/cmdutil"
 	"flow/cmd/config"
-	"fmt"
+	"flow/cmd/printer"
+	"flow/fnaa"
 	"log"
 	"os"
+	"strings"
 
-	"github.com/miekg/dns"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
+var kind = printer.Kind{
+	Name:    "subscription",
+	NameKey: "subscription",
+	Columns: []printer.Column{
+		{Header: "SUBSCRIPTION", Key: "subscription"},
+		{Header: "FLOW", Key: "flow"},
+		{Header: "AGENT", Key: "agent"},
+		{Header: "UPSTREAM", Key: "upstream", Wide: true},
+		{Header: "FILTER", Key: "filter", Wide: true},
+		{Header: "PROJECTION", Key: "projection", Wide: true},
+		{Header: "DELIVERY", Key: "delivery", Wide: true},
+		{Header: "RECIPIENT", Key: "recipient", Wide: true},
+	},
+}
+
 // createCmd represents the create command
 var SubscribeCmd = &cobra.Command{
 	Use:   "subscribe",
 	Short: "A brief description of your command",
-	Long:  `Subscribe`,
+	Long: `Subscribe to a flow, getting a copy of its events from then on.
+
+--filter only copies the events matching an expression on their JSON
+payload ($), key (@key), headers (@headers.<name>) or CloudEvents
+attributes (@ce.<attribute>), such as
+	$.amount > 100 && ($.country == "AR" || @headers.priority == "high")
+--project only copies some fields of their payload, such as
+	$.id, $.customer.name
+Both are applied by the FNAA of the flow, so the subscriber never gets
+the rest. Subscribing again changes them.
+
+--from seeds the subscription with the events of the flow from that
+point on; subscribing again with --from, or flow replay, rewinds it.
+
+--delivery exactly-once keeps the subscription free of duplicates when
+the flow processor writes again an event the broker had stored, or starts
+again after a failure. Copies then carry fnaa-source, fnaa-partition,
+fnaa-offset and fnaa-epoch headers, which the processor reads back to
+skip the events copied already; a rewind starts a new epoch, copying
+them again.
+
+--encrypt has the FNAA of the flow encrypt the payload of the copies for
+the X25519 key in --key-file, generated there if missing, so neither the
+operators of its broker nor anyone else but you can read them; flow tail
+--decrypt reads them with the same key file. RECIPIENT, with -o wide, is
+the ID of the key.
+
+--verify only subscribes if the namespace of the flow signs the events
+copied from it, publishing its key in DNS; flow tail --verify checks
+their signatures.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		debug, _ := cmd.Flags().GetBool("debug")
-		nameserver, _ := cmd.Flags().GetString("nameserver")
-
-		if len(nameserver) == 0 {
-			conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				os.Exit(2)
-			}
-			nameserver = conf.Servers[0]
-		}
-
-		// nameserver = string([]byte(nameserver)[0:]) // chop off @
-
-		log.Printf("*Debug %v", debug)
-
-		if debug {
-			log.Println("*Subscribe to flow")
-		}
-
-		cfg := config.Config{}
-		err := viper.Unmarshal(&cfg)
-		if err != nil {
-			log.Printf("unable to decode into struct, %v\n", err)
-		}
-		// fmt.Println("viper.GetString(\"agents\"))")
-		// for _, agent := range config.Agents {
-		// 	fmt.Printf("Agent name: %v\n", agent.Name)
-		// 	fmt.Printf("\tfqdn: %v\n", agent.Fqdn)
-		// 	fmt.Printf("\tusername: %v\n", agent.Username)
-		// 	fmt.Printf("\tpassword: %v\n", agent.Password)
-		// }
-
-		// for _, namespace := range config.Namespaces {
-		// 	fmt.Printf("Namespace name: %v\n", namespace.Name)
-		// 	fmt.Printf("\tagent: %v\n", namespace.AgentName)
-		// }
-
 		/*Start Check if flowName is included*/
-		argsNum := len(args)
-		if argsNum == 0 {
-			log.Println("Error: Too few arguments, specify flowName")
-			os.Exit(1)
-
-		} else if argsNum > 1 {
-			log.Println("Error: Too many arguments, only flowName allowed")
-			os.Exit(1)
+		if len(args) == 0 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too few arguments, specify flowName"))
+		} else if len(args) > 1 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too many arguments, only flowName allowed"))
 		}
-
 		flowNew := args[0]
-		if debug {
-			log.Printf("flow to create: %v", flowNew)
-		}
 		/*End Check if flowName is included*/
 
-		/* Start check if user specified agent */
-		// selectedAgent := viper.Get("agent")
+		p, err := printer.New(cmd)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "--output"))
+		filter, _ := cmd.Flags().GetString("filter")
+		projection, _ := cmd.Flags().GetString("project")
+		delivery, _ := cmd.Flags().GetString("delivery")
+		if delivery != "at-least-once" && delivery != "exactly-once" {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "unknown delivery %q, use at-least-once or exactly-once", delivery))
+		}
+		from, err := fnaa.FromOption(cmd)
+		cmdutil.CheckErr(err)
+		var encrypt, recipient string
+		if encrypted, _ := cmd.Flags().GetBool("encrypt"); encrypted {
+			encrypt, recipient, err = fnaa.EncryptOption(cmd)
+			cmdutil.CheckErr(err)
+		}
+		opts, err := fnaa.OptionsFromFlags(cmd)
+		cmdutil.CheckErr(err)
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+		flowNew = cfg.Qualify(flowNew)
+
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+
+		// The subscription is made by the agent chosen with --agent or the
+		// current context, or by the only configured one. Otherwise it is
+		// made directly in the FNAA of the flow, configured or discovered.
 		selectedAgent, _ := cmd.Flags().GetString("agent")
-
 		var agentConfig config.Agent
-		if selectedAgent != "" {
-			if debug {
-				log.Printf("agent selected: %v", selectedAgent)
-			}
-			//Find agent in config
-			agentExists := false
-			for _, agent := range cfg.Agents {
-				if agent.Name == selectedAgent {
-					agentExists = true
-					agentConfig = agent
-				}
-			}
-
-			if !agentExists {
-				log.Println("Error: Agent does not exists, add to config file")
-				os.Exit(1)
-			}
+		if selectedAgent != "" || cfg.Current.Agent != "" || len(cfg.Agents) == 1 {
+			agentConfig, err = fnaa.SelectAgent(cfg, selectedAgent)
 		} else {
-			if len(cfg.Agents) > 1 {
-				log.Println("Error: More than one agent in config file, select with --agent")
-				os.Exit(1)
-			} else {
-				agentConfig = cfg.Agents[0]
-			}
-		}
-
-		/* Start flow creation*/
-		if debug {
-			log.Printf("-----------------")
-			log.Printf("Creating new flow %v", flowNew)
-			log.Printf("Resolving FNAA FQDN %v", agentConfig.Fqdn)
-		}
-		// server, result := serviceResolve(agentConfig.Fqdn+".", "@172.17.0.2")
-		server, result := client.ServiceResolve(agentConfig.Fqdn+".", nameserver)
-
-		if !result {
-			log.Printf("Error: Could not resolve SRV RR for FQDN %v", agentConfig.Fqdn)
-			os.Exit(1)
+			agentConfig, err = fnaa.AgentForFlow(ctx, cfg, flowNew, "", opts)
 		}
+		cmdutil.CheckErr(err)
+		cmdutil.CheckErr(fnaa.RequireCredentials(agentConfig, "SUBSCRIBE"))
 
-		// log.Printf("DNS Resolution result: %v:%v", server.Host, server.Port)
+		/* EXECUTING COMMAND SUBSCRIBE FLOW */
+		subscription := agentConfig.Prefix + flowNew
+		log.Printf("Subscribing %v to flow %v in agent %v", subscription, flowNew, agentConfig.Name)
+		session, err := fnaa.Dial(ctx, agentConfig, opts)
+		cmdutil.CheckErr(err)
 
-		if debug {
-			log.Printf("FNAA FQDN Resolved to %v port %v", server.Host, server.Port)
+		command := "SUBSCRIBE " + flowNew + " LOCAL " + subscription
+		if filter != "" {
+			command += " FILTER " + base64.StdEncoding.EncodeToString([]byte(filter))
 		}
-		address, result := client.AddressResolve(server.Host, nameserver)
-		if !result {
-			log.Printf("Error: Could not resolve A RR for FQDN %v", server.Host)
-			os.Exit(1)
+		if projection != "" {
+			command += " PROJECT " + base64.StdEncoding.EncodeToString([]byte(projection))
 		}
-		// log.Printf("Connecting to %v port %v", address, server.Port)
-
-		// conn, rw, err := client.Client(address, server.Port)
-		conn, rw, err := client.Client(address, server.Port)
-
-		if err != nil {
-			log.Printf("Error: Connection to FNAA %v failed, %v", server.Host, err)
-			os.Exit(1)
+		if delivery != "at-least-once" {
+			command += " DELIVERY " + strings.ToUpper(delivery)
 		}
-
-		c := *conn
-		defer c.Close()
-
-		if debug {
-			log.Printf("Connected to FNAA")
-			log.Printf("Authenticating with PLAIN mechanism")
+		if encrypt != "" {
+			command += " " + encrypt
 		}
-		_, err = client.AuthenticatePlain(conn, rw, agentConfig.Username, agentConfig.Password)
-
-		if err != nil {
-			log.Printf("Error: Authentication to FNAA %v failed, %v", server.Host, err)
-			os.Exit(1)
+		if verify, _ := cmd.Flags().GetBool("verify"); verify {
+			command += " VERIFY"
 		}
-
-		if debug {
-			log.Printf("Authenticated")
+		if from != "" {
+			command += " " + from
 		}
+		response, err := session.Command(ctx, command)
+		session.Close()
+		cmdutil.CheckErr(err)
+		log.Printf("Server responded: %v", response)
 
-		/* EXECUTING COMMAND SUBSCRIBE FLOW */
-		if debug {
-			log.Printf("Executing command SUBSCRIBE " + flowNew + " LOCAL " + agentConfig.Prefix + flowNew)
+		// A local flow replies with the name of the copy, a remote one
+		// with the local flow and the copy made in the remote FNAA.
+		item := map[string]string{"subscription": response, "flow": flowNew, "agent": agentConfig.Name, "filter": filter, "projection": projection, "delivery": delivery, "recipient": recipient}
+		if parts := strings.SplitN(response, " SUBSCRIBED TO ", 2); len(parts) == 2 {
+			item["subscription"] = parts[0]
+			item["upstream"] = parts[1]
 		}
-		command := "SUBSCRIBE " + flowNew + " LOCAL " + agentConfig.Prefix + flowNew
-		response, err := client.SendCommand(conn, rw, command)
 
-		if err != nil {
-			log.Printf("Error: Subscribe to Flow %v in FNAA %v failed, %v", flowNew, server.Host, err)
-			os.Exit(1)
-		}
-
-		if debug {
-			log.Printf("Flow %v subscription created successfully", agentConfig.Prefix+flowNew)
-			log.Printf("Server responded: %v", response)
-
-		}
-		// /* EXECUTING COMMAND DESCRIBE FLOW */
-		// if debug {
-		// 	log.Printf("Executing command DESCRIBE FLOW " + flowNew)
-		// }
-		// command = "DESCRIBE FLOW " + flowNew
-		// response, err = client.SendCommand(conn, rw, command)
-
-		// if err != nil {
-		// 	log.Printf("Error: Describe Flow %v in FNAA %v failed, %v", flowNew, server.Host, err)
-		// 	os.Exit(1)
-		// }
-		// log.Printf("Flow %v description:\n%v", flowNew, response)
-
-		// log.Printf("Flow %v described successfully", flowNew)
-
-		// // log.Printf("Got: 220 DATA")
-		// // log.Printf("Got: 220 OK")
-		// /* End flow creation*/
-
-		log.Printf("Quitting")
-		command = "QUIT"
-		response, err = client.SendCommand(conn, rw, command)
-		if err != nil {
-			log.Printf("Error: Send command %v to FNAA %v failed, %v", command, server.Host, err)
-			os.Exit(1)
-		}
-
-		c.Close()
-
-		if debug {
-			log.Printf("Connection closed")
-		}
+		cmdutil.CheckErr(p.PrintObject(os.Stdout, kind, item))
 	},
 }
 
@@ -220,5 +163,13 @@ func init() {
 	// is called directly, e.g.:
 	SubscribeCmd.Flags().String("nameserver", "", "Override system nameserver")
 	SubscribeCmd.Flags().String("agent", "", "Select FNAA")
+	SubscribeCmd.Flags().String("filter", "", "Only copy the events matching this expression")
+	SubscribeCmd.Flags().String("project", "", "Only copy these comma separated payload fields")
+	SubscribeCmd.Flags().String("delivery", "at-least-once", "Copy events at-least-once or exactly-once")
+	SubscribeCmd.Flags().Bool("encrypt", false, "Encrypt the payload of the copies for the key in --key-file")
+	fnaa.AddKeyFileFlag(SubscribeCmd)
+	SubscribeCmd.Flags().Bool("verify", false, "Only subscribe if the copies are signed by the namespace of the flow")
+	fnaa.AddFromFlag(SubscribeCmd, "Copy the events of the flow from this point")
+	printer.AddFlags(SubscribeCmd)
 
 }
@@ -0,0 +1,206 @@
+package tail
+
+import (
+	"broker"
+	"bufio"
+	"encoding/json"
+	"flow/cmd/cmdutil"
+	"flow/fnaa"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// event is an event as -o json prints it, one per line.
+type event struct {
+	Flow      string            `json:"flow"`
+	Partition int               `json:"partition"`
+	Offset    int64             `json:"offset"`
+	Time      time.Time         `json:"time"`
+	Key       string            `json:"key,omitempty"`
+	Value     string            `json:"value"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	// CloudEvent holds the attributes and the data of CloudEvents.
+	CloudEvent map[string]string `json:"cloudevent,omitempty"`
+	// Origin is the flow a verified event comes from.
+	Origin string `json:"origin,omitempty"`
+}
+
+var TailCmd = &cobra.Command{
+	Use:   "tail <flow>",
+	Short: "Print the events of a flow",
+	Long: `Print the events of a flow, connecting to the broker its FNAA describes it
+in. Events are printed one per line, their value only or, with -o json, as
+JSON objects with their partition, offset, time, key and headers. The
+attributes and data of CloudEvents, structured or binary, are added as a
+cloudevent object.
+
+--decrypt decrypts the payload of events encrypted for the key in
+--key-file, as subscriptions made with flow subscribe --encrypt are, and
+fails on events encrypted for another key.
+
+--verify checks that every event is signed by the namespace of the flow
+it comes from, with a key the namespace publishes in DNS, and fails on
+the first one that is not. -o json adds that flow as origin.
+
+By default only the events published from now on are printed, waiting
+for them until interrupted. With --from-beginning or --offset the events
+already in the flow are printed too, stopping at the last one unless
+--follow is given. --limit stops after that many events.
+
+--timeout bounds finding and describing the flow, not the wait for events.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too few arguments, specify flowName"))
+		} else if len(args) > 1 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too many arguments, only flowName allowed"))
+		}
+		follow, _ := cmd.Flags().GetBool("follow")
+		fromBeginning, _ := cmd.Flags().GetBool("from-beginning")
+		offset, _ := cmd.Flags().GetInt64("offset")
+		limit, _ := cmd.Flags().GetInt("limit")
+		output, _ := cmd.Flags().GetString("output")
+		if output != "raw" && output != "json" {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "unknown output format %q, use raw or json", output))
+		}
+		verify, _ := cmd.Flags().GetBool("verify")
+		var private []byte
+		if decrypt, _ := cmd.Flags().GetBool("decrypt"); decrypt {
+			var err error
+			private, err = fnaa.LoadKey(cmd, false)
+			cmdutil.CheckErr(err)
+		}
+
+		start := broker.End
+		switch {
+		case fromBeginning && cmd.Flags().Changed("offset"):
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "--from-beginning and --offset are exclusive"))
+		case fromBeginning:
+			start = broker.Beginning
+		case cmd.Flags().Changed("offset"):
+			if offset < 0 {
+				cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "--offset must not be negative"))
+			}
+			start = offset
+		default:
+			// There is nothing to print before the end.
+			follow = true
+		}
+
+		opts, err := fnaa.OptionsFromFlags(cmd)
+		cmdutil.CheckErr(err)
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+		flowName := cfg.Qualify(args[0])
+
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+		selectedAgent, _ := cmd.Flags().GetString("agent")
+		agentConfig, err := fnaa.AgentForFlow(ctx, cfg, flowName, selectedAgent, opts)
+		cmdutil.CheckErr(err)
+		driver, descriptor, err := fnaa.OpenFlow(ctx, agentConfig, flowName, opts)
+		cmdutil.CheckErr(err)
+
+		streamCtx, stop := fnaa.Interruptible()
+		defer stop()
+		brokerOpts := opts.Broker()
+		brokerOpts.Start, brokerOpts.Follow = start, follow
+		consumer, err := driver.Consumer(streamCtx, descriptor, brokerOpts)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConnection, err, "connecting to the broker of "+flowName))
+		defer consumer.Close()
+
+		verifier := fnaa.NewVerifier(opts)
+		out := bufio.NewWriter(os.Stdout)
+		defer out.Flush()
+		for printed := 0; limit <= 0 || printed < limit; printed++ {
+			m, err := consumer.Next(streamCtx)
+			if err == io.EOF || streamCtx.Err() != nil {
+				return
+			}
+			if err != nil {
+				out.Flush()
+				cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitConnection, err, "reading "+flowName))
+			}
+			// Signatures cover the payload as written, encrypted or not.
+			origin := ""
+			if verify {
+				if origin, err = verifier.Verify(streamCtx, m); err != nil {
+					out.Flush()
+					cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitError, err, fmt.Sprintf("verifying event %v/%v of %v", m.Partition, m.Offset, flowName)))
+				}
+			}
+			if private != nil {
+				decrypted, err := broker.Decrypt(m, private)
+				if err != nil {
+					out.Flush()
+					cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitError, err, fmt.Sprintf("decrypting event %v/%v of %v", m.Partition, m.Offset, flowName)))
+				}
+				m = decrypted
+			}
+			cmdutil.CheckErr(printEvent(out, output, flowName, origin, m))
+			if follow {
+				out.Flush()
+			}
+		}
+	},
+}
+
+func printEvent(w io.Writer, output string, flow string, origin string, m broker.Message) error {
+	if output == "raw" {
+		_, err := fmt.Fprintf(w, "%s\n", m.Value)
+		return err
+	}
+	e := event{Flow: flow, Partition: m.Partition, Offset: m.Offset, Time: m.Time, Key: string(m.Key), Value: string(m.Value), Origin: origin}
+	for _, h := range m.Headers {
+		if e.Headers == nil {
+			e.Headers = map[string]string{}
+		}
+		e.Headers[h.Key] = string(h.Value)
+	}
+	if broker.Encrypted(m) {
+		// Neither the payload nor the attributes in it can be read.
+		return json.NewEncoder(w).Encode(e)
+	}
+	ce, data, ok, err := broker.Unwrap(m)
+	if err != nil {
+		log.Printf("Event %v/%v of %v is not a valid CloudEvent: %v", m.Partition, m.Offset, flow, err)
+	} else if ok {
+		e.CloudEvent = map[string]string{
+			"specversion": broker.SpecVersion,
+			"id":          ce.ID,
+			"source":      ce.Source,
+			"type":        ce.Type,
+			"data":        string(data),
+		}
+		for name, value := range ce.Extensions {
+			e.CloudEvent[name] = value
+		}
+		if ce.Subject != "" {
+			e.CloudEvent["subject"] = ce.Subject
+		}
+		if !ce.Time.IsZero() {
+			e.CloudEvent["time"] = ce.Time.Format(time.RFC3339Nano)
+		}
+		if ce.DataContentType != "" {
+			e.CloudEvent["datacontenttype"] = ce.DataContentType
+		}
+	}
+	return json.NewEncoder(w).Encode(e)
+}
+
+func init() {
+	TailCmd.Flags().BoolP("follow", "f", false, "Keep waiting for new events after the last one")
+	TailCmd.Flags().Bool("from-beginning", false, "Start from the oldest event kept")
+	TailCmd.Flags().Int64("offset", 0, "Start from this offset in every partition")
+	TailCmd.Flags().IntP("limit", "n", 0, "Stop after this many events, 0 for no limit")
+	TailCmd.Flags().StringP("output", "o", "raw", "Output format, raw or json")
+	TailCmd.Flags().String("nameserver", "", "Override system nameserver")
+	TailCmd.Flags().String("agent", "", "Select FNAA")
+	TailCmd.Flags().Bool("decrypt", false, "Decrypt events encrypted for the key in --key-file")
+	TailCmd.Flags().Bool("verify", false, "Fail on events not signed by the namespace they come from")
+	fnaa.AddKeyFileFlag(TailCmd)
+}
@@ -0,0 +1,107 @@
+package flow
+
+import (
+	"flow/cmd/cmdutil"
+	"flow/cmd/printer"
+	"flow/fnaa"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var kind = printer.Kind{
+	Name:    "flow",
+	NameKey: "flow",
+	Columns: []printer.Column{
+		{Header: "FLOW", Key: "flow"},
+		{Header: "SCHEMA", Key: "schema_type"},
+		{Header: "VERSION", Key: "schema_version"},
+		{Header: "COMPATIBILITY", Key: "schema_compatibility"},
+		{Header: "VALIDATION", Key: "schema_validation"},
+		{Header: "CLOUDEVENTS", Key: "cloudevents"},
+		{Header: "ORDERING", Key: "ordering"},
+		{Header: "AGENT", Key: "agent", Wide: true},
+	},
+}
+
+var FlowUpdateCmd = &cobra.Command{
+	Use:   "flow <flow>",
+	Short: "Change the schema, the CloudEvents content mode or the ordering of a flow",
+	Long: `Change the schema, the CloudEvents content mode or the ordering policy of a flow. A new --schema becomes its next version, once
+the FNAA checked it is compatible with the latest one: backward compatible
+versions read the events of the previous one, forward compatible ones
+write events the previous one reads, and full ones do both. Registering
+the latest version again changes nothing.
+
+--compatibility changes the mode new versions are checked with, this
+version included, and --validate what flow processors do with the events
+that do not conform to the latest version.
+
+--cloudevents changes the content mode events published to the flow are
+wrapped in: off, structured or binary. --ordering changes which events
+keep the order they were published in, in the flow and its subscriptions:
+per-key those with the same partition key, none no event and total every
+event, at the cost of writing them all to a single partition. Flow
+processors copy with the new policy once they connect again. Only the
+flows of the namespaces of its FNAA have a content mode and an ordering
+policy.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too few arguments, specify flowName"))
+		} else if len(args) > 1 {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "too many arguments, only flowName allowed"))
+		}
+
+		p, err := printer.New(cmd)
+		cmdutil.CheckErr(cmdutil.Wrap(cmdutil.ExitUsage, err, "--output"))
+		schemaOptions, err := fnaa.SchemaOptions(cmd)
+		cmdutil.CheckErr(err)
+		cloudEventsOption, err := fnaa.CloudEventsOption(cmd)
+		cmdutil.CheckErr(err)
+		orderingOption, err := fnaa.OrderingOption(cmd)
+		cmdutil.CheckErr(err)
+		options := strings.TrimSpace(strings.Join([]string{schemaOptions, cloudEventsOption, orderingOption}, " "))
+		if options == "" {
+			cmdutil.CheckErr(cmdutil.Errorf(cmdutil.ExitUsage, "nothing to update, give --schema, --compatibility, --validate, --cloudevents or --ordering"))
+		}
+		opts, err := fnaa.OptionsFromFlags(cmd)
+		cmdutil.CheckErr(err)
+		cfg, err := fnaa.LoadConfig(cmd)
+		cmdutil.CheckErr(err)
+		flowName := cfg.Qualify(args[0])
+
+		ctx, cancel := fnaa.Context(cmd)
+		defer cancel()
+		selectedAgent, _ := cmd.Flags().GetString("agent")
+		agentConfig, err := fnaa.AgentForFlow(ctx, cfg, flowName, selectedAgent, opts)
+		cmdutil.CheckErr(err)
+		cmdutil.CheckErr(fnaa.RequireCredentials(agentConfig, "UPDATE FLOW"))
+
+		log.Printf("Updating flow %v in agent %v", flowName, agentConfig.Name)
+		session, err := fnaa.Dial(ctx, agentConfig, opts)
+		cmdutil.CheckErr(err)
+		response, err := session.Command(ctx, "UPDATE FLOW "+flowName+" "+options)
+		session.Close()
+		cmdutil.CheckErr(err)
+
+		item := map[string]string{"flow": flowName}
+		for _, fields := range fnaa.ParseItems(response) {
+			for key, value := range fields {
+				item[key] = value
+			}
+		}
+		item["agent"] = agentConfig.Name
+		cmdutil.CheckErr(p.PrintObject(os.Stdout, kind, item))
+	},
+}
+
+func init() {
+	FlowUpdateCmd.Flags().String("nameserver", "", "Override system nameserver")
+	FlowUpdateCmd.Flags().String("agent", "", "Select FNAA")
+	fnaa.AddSchemaFlags(FlowUpdateCmd)
+	fnaa.AddCloudEventsFlag(FlowUpdateCmd)
+	fnaa.AddOrderingFlag(FlowUpdateCmd)
+	printer.AddFlags(FlowUpdateCmd)
+}
@@ -0,0 +1,17 @@
+package update
+
+import (
+	"flow/cmd/update/flow"
+
+	"github.com/spf13/cobra"
+)
+
+// UpdateCmd groups the commands that change existing resources.
+var UpdateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Change an existing resource",
+}
+
+func init() {
+	UpdateCmd.AddCommand(flow.FlowUpdateCmd)
+}
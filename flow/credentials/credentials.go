@@ -0,0 +1,100 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flow/cmd/config"
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// keyring is opened once per process, so the passphrase is asked for at
+// most once even when several agents are contacted.
+var keyring *Keyring
+
+// For returns the username and password to authenticate to agent with,
+// obtained in order from its credential plugin, its entry in the config
+// file and the keyring, from the entry its credentials refer to or else
+// the one flow login filled for the agent.
+func For(ctx context.Context, agent config.Agent) (string, string, error) {
+	if agent.Exec != nil {
+		return Exec(ctx, agent)
+	}
+	if agent.Password != "" {
+		return agent.Username, agent.Password, nil
+	}
+
+	path, err := KeyringPath()
+	if err != nil {
+		return "", "", err
+	}
+	if keyring == nil {
+		if !Exists(path) && agent.Keyring != "" {
+			return "", "", errors.Errorf("keyring %v of agent %v does not exist, set its password with flow config set-credentials", path, agent.Name)
+		}
+		if !Exists(path) {
+			return "", "", errors.Errorf("no credentials for agent %v, run flow login %v", agent.Name, agent.Name)
+		}
+		passphrase, err := Passphrase()
+		if err != nil {
+			return "", "", err
+		}
+		if keyring, err = OpenKeyring(path, passphrase); err != nil {
+			return "", "", err
+		}
+	}
+	if agent.Keyring != "" {
+		entry, ok := keyring.Get(agent.Keyring)
+		if !ok {
+			return "", "", errors.Errorf("keyring entry %v of agent %v not found, set its password with flow config set-credentials", agent.Keyring, agent.Name)
+		}
+		if entry.Username == "" {
+			entry.Username = agent.Username
+		}
+		return entry.Username, entry.Password, nil
+	}
+	entry, ok := keyring.Get(agent.Name)
+	if !ok {
+		return "", "", errors.Errorf("no credentials for agent %v, run flow login %v", agent.Name, agent.Name)
+	}
+	return entry.Username, entry.Password, nil
+}
+
+// Exec runs the credential plugin of agent. The plugin gets the agent in
+// FLOW_AGENT and FLOW_AGENT_FQDN besides the configured environment, may
+// prompt on the terminal through its standard error and input, and must
+// print {"username": "...", "password": "..."} on its standard output.
+func Exec(ctx context.Context, agent config.Agent) (string, string, error) {
+	cmd := exec.CommandContext(ctx, agent.Exec.Command, agent.Exec.Args...)
+	cmd.Env = append(os.Environ(), "FLOW_AGENT="+agent.Name, "FLOW_AGENT_FQDN="+agent.Fqdn)
+	for name, value := range agent.Exec.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	var out bytes.Buffer
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", "", errors.Wrap(err, "credential plugin "+agent.Exec.Command)
+	}
+	var entry Entry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		return "", "", errors.Wrap(err, "decoding output of credential plugin "+agent.Exec.Command)
+	}
+	if entry.Username == "" {
+		entry.Username = agent.Username
+	}
+	return entry.Username, entry.Password, nil
+}
+
+// Redact hides a secret in logs and output.
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
@@ -0,0 +1,95 @@
+package credentials
+
+import (
+	"context"
+	"flow/cmd/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useKeyring points For at a keyring at path holding entries, opened
+// with the passphrase from the environment, and returns a function
+// restoring the environment.
+func useKeyring(t *testing.T, path string, entries map[string]Entry) func() {
+	t.Helper()
+	k, err := OpenKeyring(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, entry := range entries {
+		k.Set(name, entry)
+	}
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+	keyring = nil
+	os.Setenv(KeyringEnv, path)
+	os.Setenv(PassphraseEnv, "correct horse")
+	return func() {
+		keyring = nil
+		os.Unsetenv(KeyringEnv)
+		os.Unsetenv(PassphraseEnv)
+	}
+}
+
+func TestForPrecedence(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	defer useKeyring(t, filepath.Join(dir, "keyring"), map[string]Entry{
+		"fnaa-unix": {Username: "keyring-user", Password: "keyring-password"},
+		"shared":    {Password: "shared-password"},
+	})()
+
+	plugin := &config.Exec{
+		Command: "sh",
+		Args:    []string{"-c", `echo "{\"username\": \"$FLOW_AGENT-$SUFFIX\", \"password\": \"exec-password\"}"`},
+		Env:     map[string]string{"SUFFIX": "exec"},
+	}
+	tests := []struct {
+		name               string
+		agent              config.Agent
+		username, password string
+	}{
+		{"exec over password", config.Agent{Name: "fnaa-unix", Username: "config-user", Password: "config-password", Exec: plugin}, "fnaa-unix-exec", "exec-password"},
+		{"password over keyring", config.Agent{Name: "fnaa-unix", Username: "config-user", Password: "config-password"}, "config-user", "config-password"},
+		{"keyring of the agent", config.Agent{Name: "fnaa-unix", Username: "config-user"}, "keyring-user", "keyring-password"},
+		{"keyring entry of the credentials", config.Agent{Name: "fnaa-unix", Username: "config-user", Keyring: "shared"}, "config-user", "shared-password"},
+	}
+	for _, test := range tests {
+		username, password, err := For(context.Background(), test.agent)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if username != test.username || password != test.password {
+			t.Errorf("%v: got %v/%v, want %v/%v", test.name, username, password, test.username, test.password)
+		}
+	}
+
+	for name, agent := range map[string]config.Agent{
+		"agent without entry": {Name: "fnaa-emiliano"},
+		"missing entry":       {Name: "fnaa-unix", Keyring: "missing"},
+		"failing plugin":      {Name: "fnaa-unix", Password: "config-password", Exec: &config.Exec{Command: "false"}},
+		"plugin without json": {Name: "fnaa-unix", Exec: &config.Exec{Command: "echo", Args: []string{"password"}}},
+	} {
+		if username, password, err := For(context.Background(), agent); err == nil {
+			t.Errorf("%v: got %v/%v", name, username, password)
+		}
+	}
+}
+
+func TestForWithoutKeyring(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	keyring = nil
+	os.Setenv(KeyringEnv, filepath.Join(dir, "missing"))
+	defer os.Unsetenv(KeyringEnv)
+
+	if _, _, err := For(context.Background(), config.Agent{Name: "fnaa-unix"}); err == nil {
+		t.Error("credentials found without a keyring")
+	}
+	if _, _, err := For(context.Background(), config.Agent{Name: "fnaa-unix", Keyring: "shared"}); err == nil {
+		t.Error("keyring entry found without a keyring")
+	}
+}
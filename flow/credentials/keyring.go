@@ -0,0 +1,214 @@
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"flow/cmd/config"
+	"io/ioutil"
+	"os"
+
+	"github.com/bgentry/speakeasy"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PassphraseEnv names the variable the keyring passphrase is read from
+// before prompting for it, for non interactive use.
+const PassphraseEnv = "FLOW_KEYRING_PASSPHRASE"
+
+// KeyringEnv names the variable that overrides the keyring file path.
+const KeyringEnv = "FLOW_KEYRING"
+
+// scrypt parameters recommended for interactive logins.
+const (
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+)
+
+// Entry holds the credentials stored for an agent.
+type Entry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// sealed is the keyring file: the entries, keyed by agent name, encrypted
+// with AES-256-GCM under a key derived from the passphrase with scrypt.
+type sealed struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Keyring is the encrypted file flow login stores credentials in.
+type Keyring struct {
+	Path       string
+	passphrase string
+	entries    map[string]Entry
+}
+
+// KeyringPath returns the path of the keyring file, ~/.flow.credentials
+// unless FLOW_KEYRING is set.
+func KeyringPath() (string, error) {
+	if path := os.Getenv(KeyringEnv); path != "" {
+		return path, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", errors.Wrap(err, "finding home directory")
+	}
+	return home + "/.flow.credentials", nil
+}
+
+// Passphrase returns the keyring passphrase from FLOW_KEYRING_PASSPHRASE,
+// or asks for it on the terminal.
+func Passphrase() (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	passphrase, err := speakeasy.Ask("Keyring passphrase: ")
+	if err != nil {
+		return "", errors.Wrap(err, "reading keyring passphrase")
+	}
+	if passphrase == "" {
+		return "", errors.New("empty keyring passphrase")
+	}
+	return passphrase, nil
+}
+
+// NewPassphrase returns the keyring passphrase, asking for it twice when
+// the keyring at path is about to be created so a typo does not lock it.
+func NewPassphrase(path string) (string, error) {
+	passphrase, err := Passphrase()
+	if err != nil || Exists(path) || os.Getenv(PassphraseEnv) != "" {
+		return passphrase, err
+	}
+	again, err := speakeasy.Ask("Repeat keyring passphrase: ")
+	if err != nil {
+		return "", errors.Wrap(err, "reading keyring passphrase")
+	}
+	if again != passphrase {
+		return "", errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// Store saves entry in the keyring under name, creating the keyring if it
+// does not exist yet, and returns the path of the keyring.
+func Store(name string, entry Entry) (string, error) {
+	path, err := KeyringPath()
+	if err != nil {
+		return "", err
+	}
+	passphrase, err := NewPassphrase(path)
+	if err != nil {
+		return "", err
+	}
+	k, err := OpenKeyring(path, passphrase)
+	if err != nil {
+		return "", err
+	}
+	k.Set(name, entry)
+	return path, errors.Wrap(k.Save(), "saving keyring")
+}
+
+// Exists reports whether the keyring file at path has been created.
+func Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// OpenKeyring reads and decrypts the keyring at path. A file that does not
+// exist yet yields an empty keyring that Save creates.
+func OpenKeyring(path string, passphrase string) (*Keyring, error) {
+	k := &Keyring{Path: path, passphrase: passphrase, entries: map[string]Entry{}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading keyring")
+	}
+
+	var s sealed
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.Wrap(err, "decoding keyring "+path)
+	}
+	if s.Version != 1 || s.KDF != "scrypt" {
+		return nil, errors.Errorf("keyring %v: unsupported version %v", path, s.Version)
+	}
+	aead, err := newAEAD(passphrase, s.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, s.Nonce, s.Data, nil)
+	if err != nil {
+		return nil, errors.Errorf("keyring %v: wrong passphrase or corrupted file", path)
+	}
+	if err := json.Unmarshal(plain, &k.entries); err != nil {
+		return nil, errors.Wrap(err, "decoding keyring "+path)
+	}
+	return k, nil
+}
+
+// Get returns the credentials stored for agent.
+func (k *Keyring) Get(agent string) (Entry, bool) {
+	entry, ok := k.entries[agent]
+	return entry, ok
+}
+
+// Set stores the credentials of agent.
+func (k *Keyring) Set(agent string, entry Entry) {
+	k.entries[agent] = entry
+}
+
+// Delete removes the credentials of agent.
+func (k *Keyring) Delete(agent string) {
+	delete(k.entries, agent)
+}
+
+// Save encrypts the keyring with a fresh salt and nonce and writes it.
+func (k *Keyring) Save() error {
+	plain, err := json.Marshal(k.entries)
+	if err != nil {
+		return errors.Wrap(err, "encoding keyring")
+	}
+
+	s := sealed{Version: 1, KDF: "scrypt", Salt: make([]byte, 16)}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return errors.Wrap(err, "generating keyring salt")
+	}
+	aead, err := newAEAD(k.passphrase, s.Salt)
+	if err != nil {
+		return err
+	}
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return errors.Wrap(err, "generating keyring nonce")
+	}
+	s.Data = aead.Seal(nil, s.Nonce, plain, nil)
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "encoding keyring")
+	}
+	return config.WriteFile(k.Path, data)
+}
+
+// newAEAD returns the AES-256-GCM cipher keyed from passphrase and salt.
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "deriving keyring key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "keyring cipher")
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,111 @@
+package credentials
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempDir returns a new directory and a function removing it.
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	path := filepath.Join(dir, "keyring")
+
+	k, err := OpenKeyring(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Exists(path) {
+		t.Fatal("keyring created before it is saved")
+	}
+	k.Set("fnaa-unix", Entry{Username: "test", Password: "s3cret"})
+	k.Set("fnaa-emiliano", Entry{Username: "emiliano", Password: "other"})
+	k.Delete("fnaa-emiliano")
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"s3cret", "test", "fnaa-unix"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("keyring file holds %q in the clear", secret)
+		}
+	}
+
+	k, err = OpenKeyring(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := k.Get("fnaa-unix"); !ok || entry != (Entry{Username: "test", Password: "s3cret"}) {
+		t.Errorf("read back %+v, %v", entry, ok)
+	}
+	if _, ok := k.Get("fnaa-emiliano"); ok {
+		t.Error("deleted entry read back")
+	}
+}
+
+func TestKeyringWrongPassphrase(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	path := filepath.Join(dir, "keyring")
+	k, err := OpenKeyring(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Set("fnaa-unix", Entry{Username: "test", Password: "s3cret"})
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenKeyring(path, "battery staple"); err == nil {
+		t.Error("keyring opened with the wrong passphrase")
+	}
+	if err := ioutil.WriteFile(path, []byte("not a keyring"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenKeyring(path, "correct horse"); err == nil {
+		t.Error("corrupted keyring opened")
+	}
+}
+
+func TestKeyringFileMode(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	path := filepath.Join(dir, "keyring")
+	k, err := OpenKeyring(path, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Set("fnaa-unix", Entry{Username: "test", Password: "s3cret"})
+	// A keyring made readable by others is locked down again when saved.
+	for i := 0; i < 2; i++ {
+		if err := k.Save(); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("keyring saved with mode %v, want 0600", mode)
+		}
+		if err := os.Chmod(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
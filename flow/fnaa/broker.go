@@ -0,0 +1,89 @@
+package fnaa
+
+import (
+	"broker"
+	"context"
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"log"
+	"net"
+	"strconv"
+)
+
+// Describe asks the FNAA of agent where the events of flow are kept, with
+// DESCRIBE FLOW, and returns the fields of the answer.
+func Describe(ctx context.Context, agent config.Agent, flow string, opts Options) (map[string]string, error) {
+	return DescribeVersion(ctx, agent, flow, 0, opts)
+}
+
+// DescribeVersion is Describe with the schema of the flow described at
+// version, or at its latest version if version is 0.
+func DescribeVersion(ctx context.Context, agent config.Agent, flow string, version int, opts Options) (map[string]string, error) {
+	session, err := Dial(ctx, agent, opts)
+	if err != nil {
+		return nil, err
+	}
+	command := "DESCRIBE FLOW " + flow
+	if version > 0 {
+		command += " VERSION " + strconv.Itoa(version)
+	}
+	response, err := session.Command(ctx, command)
+	session.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// The description comes as one key=value pair per line.
+	description := map[string]string{"flow": flow}
+	for _, item := range ParseItems(response) {
+		for key, value := range item {
+			description[key] = value
+		}
+	}
+	return description, nil
+}
+
+// OpenFlow describes flow in the FNAA of agent and returns the driver of
+// its broker with the descriptor to connect to it.
+func OpenFlow(ctx context.Context, agent config.Agent, flow string, opts Options) (broker.Driver, broker.Descriptor, error) {
+	description, err := Describe(ctx, agent, flow, opts)
+	if err != nil {
+		return nil, broker.Descriptor{}, err
+	}
+	d, err := broker.ParseDescriptor(description)
+	if err != nil {
+		return nil, d, cmdutil.Wrap(cmdutil.ExitError, err, "describing flow "+flow)
+	}
+	log.Printf("Flow %v is topic %v in %v broker %v", flow, d.Topic, d.Type, d.Servers)
+	driver, err := broker.Open(d)
+	if err != nil {
+		return nil, d, cmdutil.Wrap(cmdutil.ExitError, err, "opening flow "+flow)
+	}
+	return driver, d, nil
+}
+
+// Broker returns the options broker drivers connect with: broker hosts
+// are resolved with the nameservers FNAAs are discovered with.
+func (o Options) Broker() broker.Options {
+	dialer := &net.Dialer{Timeout: o.Timeouts.Dial}
+	return broker.Options{
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := o.Resolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				var conn net.Conn
+				conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
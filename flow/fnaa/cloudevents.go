@@ -0,0 +1,29 @@
+package fnaa
+
+import (
+	"broker"
+	"flow/cmd/cmdutil"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// AddCloudEventsFlag adds the flag CloudEventsOption reads to cmd.
+func AddCloudEventsFlag(cmd *cobra.Command) {
+	cmd.Flags().String("cloudevents", "", "CloudEvents content mode events are wrapped in: "+strings.Join(broker.ContentModes, ", "))
+}
+
+// CloudEventsOption returns the CLOUDEVENTS option of a CREATE FLOW or
+// UPDATE FLOW command from the flag AddCloudEventsFlag added, empty if it
+// is not set.
+func CloudEventsOption(cmd *cobra.Command) (string, error) {
+	mode, _ := cmd.Flags().GetString("cloudevents")
+	if mode == "" {
+		return "", nil
+	}
+	mode, err := broker.ParseContentMode(mode)
+	if err != nil {
+		return "", cmdutil.Wrap(cmdutil.ExitUsage, err, "--cloudevents")
+	}
+	return "CLOUDEVENTS " + mode, nil
+}
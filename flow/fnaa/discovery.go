@@ -0,0 +1,70 @@
+package fnaa
+
+import (
+	"context"
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"log"
+	"resolver"
+	"strings"
+
+	"github.com/miekg/dns"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+// cachePath is where the answers of the nameservers are kept between
+// commands, see resolver.FileCache.
+const cachePath = "~/.flow.discovery"
+
+var answers *resolver.FileCache
+
+// Cache returns the cache of DNS answers shared by the commands, read on
+// first use, or nil if the home directory cannot be found.
+func Cache() *resolver.FileCache {
+	if answers != nil {
+		return answers
+	}
+	path, err := homedir.Expand(cachePath)
+	if err != nil {
+		log.Printf("Discovery cache disabled: %v", err)
+		return nil
+	}
+	answers = resolver.OpenFileCache(path)
+	return answers
+}
+
+// Discover finds the FNAA of the namespace flow belongs to through the
+// _fnaa._tcp.<namespace> SRV record its FNAA publishes, trying the parent
+// domains of flow from the closest one, so no agent needs to be
+// configured. A configured agent with the same FQDN is returned as is, so
+// its credentials are used; any other FNAA is authenticated to with the
+// credentials of the current context, or contacted anonymously if it has
+// none, see config.Discovered.
+func Discover(ctx context.Context, cfg config.Config, flow string, opts Options) (config.Agent, error) {
+	labels := dns.SplitDomainName(flow)
+	for i := 1; i < len(labels)-1; i++ {
+		namespace := strings.Join(labels[i:], ".")
+		name := "_fnaa._tcp." + namespace
+		records, err := opts.Resolver.LookupSRV(ctx, name)
+		if resolver.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return config.Agent{}, cmdutil.Wrap(cmdutil.ExitDiscovery, err, "discovering the FNAA of "+flow)
+		}
+		log.Printf("Flow %v belongs to namespace %v served by FNAA %v port %v", flow, namespace, records[0].Target, records[0].Port)
+
+		// Any target of the namespace being a configured agent is
+		// enough to pick its credentials.
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			for _, agent := range cfg.Agents {
+				if strings.TrimSuffix(agent.Fqdn, ".") == host {
+					return agent, nil
+				}
+			}
+		}
+		return cfg.Discovered(strings.TrimSuffix(records[0].Target, "."), name), nil
+	}
+	return config.Agent{}, cmdutil.Errorf(cmdutil.ExitDiscovery, "no FNAA found for %v, no _fnaa._tcp SRV record in its parent domains", flow)
+}
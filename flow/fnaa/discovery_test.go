@@ -0,0 +1,206 @@
+package fnaa
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"flow/client"
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"net"
+	"resolver"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serveZone answers the queries for records over UDP, with NXDOMAIN for
+// the names it does not have, and returns its address.
+func serveZone(t *testing.T, records ...string) (string, func()) {
+	t.Helper()
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		found := false
+		for _, rr := range rrs {
+			if strings.EqualFold(rr.Header().Name, q.Name) {
+				found = true
+				if rr.Header().Rrtype == q.Qtype {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+		}
+		if !found {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+// serveFNAA runs a FNAA accepting user and password, which only lets
+// authenticated sessions subscribe, and returns its port.
+func serveFNAA(t *testing.T, user string, password string) (int, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+				reply := func(lines ...string) {
+					for _, line := range lines {
+						rw.WriteString(line + "\r\n")
+					}
+					rw.Flush()
+				}
+				reply("220 fnaa.unix.ar FNAA")
+				authenticated := false
+				for {
+					line, err := rw.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					switch {
+					case len(fields) == 0:
+					case fields[0] == "AUTHENTICATE":
+						reply("220 OK")
+						encoded, _ := rw.ReadString('\n')
+						plain, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+						if authenticated = string(plain) == "\x00"+user+"\x00"+password; authenticated {
+							reply("220 Authenticated")
+						} else {
+							reply("535 Authentication failed")
+						}
+					case fields[0] == "SUBSCRIBE" && !authenticated:
+						reply("530 Authentication required")
+					case fields[0] == "SUBSCRIBE":
+						reply("220 DATA", "fnaa-unix-ar."+fields[1], "220 OK")
+					default:
+						reply("500 Unknown command")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, func() { l.Close() }
+}
+
+// discoveryConfig returns a config without agents, in a context with
+// the given credentials, if any.
+func discoveryConfig(t *testing.T, credentials []config.Credential) config.Config {
+	t.Helper()
+	cfg := config.Config{Credentials: credentials, CurrentContext: "default", Contexts: []config.Context{{Name: "default"}}}
+	if len(credentials) > 0 {
+		cfg.Contexts[0].Credentials = credentials[0].Name
+	}
+	if err := cfg.Use(""); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestSubscribeThroughDiscovery(t *testing.T) {
+	port, stopFNAA := serveFNAA(t, "tu", "secret")
+	defer stopFNAA()
+	addr, stopDNS := serveZone(t,
+		"_fnaa._tcp.unix.ar. 300 IN SRV 10 0 "+strconv.Itoa(port)+" fnaa.unix.ar.",
+		"fnaa.unix.ar. 300 IN A 127.0.0.1",
+	)
+	defer stopDNS()
+	opts := Options{Resolver: resolver.New(addr), Timeouts: client.Timeouts{Dial: time.Second, Read: time.Second, Write: time.Second}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// With the credentials of the current context the discovered FNAA is
+	// authenticated to, and lets the subscription through.
+	cfg := discoveryConfig(t, []config.Credential{{Name: "tu", Username: "tu", Password: "secret"}})
+	agent, err := AgentForFlow(ctx, cfg, "time.flow.unix.ar", "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.Anonymous || agent.Name != "fnaa.unix.ar" {
+		t.Fatalf("discovered agent %+v, want fnaa.unix.ar with credentials", agent)
+	}
+	if err := RequireCredentials(agent, "SUBSCRIBE"); err != nil {
+		t.Fatal(err)
+	}
+	session, err := Dial(ctx, agent, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := session.Command(ctx, "SUBSCRIBE time.flow.unix.ar LOCAL time.flow.unix.ar")
+	session.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "fnaa-unix-ar.time.flow.unix.ar" {
+		t.Errorf("subscription %q, want fnaa-unix-ar.time.flow.unix.ar", response)
+	}
+
+	// Without them it is anonymous, and subscribing fails before asking.
+	cfg = discoveryConfig(t, nil)
+	if agent, err = Discover(ctx, cfg, "time.flow.unix.ar", opts); err != nil {
+		t.Fatal(err)
+	}
+	if !agent.Anonymous {
+		t.Fatalf("discovered agent %+v has credentials, want anonymous", agent)
+	}
+	if err := RequireCredentials(agent, "SUBSCRIBE"); cmdutil.Code(err) != cmdutil.ExitAuth {
+		t.Errorf("anonymous subscription gave %v, want exit code %v", err, cmdutil.ExitAuth)
+	}
+	session, err = Dial(ctx, agent, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = session.Command(ctx, "SUBSCRIBE time.flow.unix.ar LOCAL time.flow.unix.ar")
+	session.Close()
+	if err == nil {
+		t.Error("anonymous session subscribed")
+	}
+}
+
+func TestDiscoverConfiguredAgent(t *testing.T) {
+	addr, stopDNS := serveZone(t,
+		"_fnaa._tcp.unix.ar. 300 IN SRV 10 0 61000 fnaa.unix.ar.",
+	)
+	defer stopDNS()
+	opts := Options{Resolver: resolver.New(addr)}
+	cfg := discoveryConfig(t, nil)
+	cfg.Agents = []config.Agent{{Name: "fnaa-unix", Fqdn: "fnaa.unix.ar", Username: "test"}}
+	agent, err := Discover(context.Background(), cfg, "a.b.unix.ar", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.Name != "fnaa-unix" || agent.Anonymous {
+		t.Errorf("discovered %+v, want the configured agent fnaa-unix", agent)
+	}
+	if _, err := Discover(context.Background(), cfg, "time.flow.emiliano.ar", opts); cmdutil.Code(err) != cmdutil.ExitDiscovery {
+		t.Errorf("flow without FNAA gave %v, want exit code %v", err, cmdutil.ExitDiscovery)
+	}
+}
@@ -0,0 +1,70 @@
+package fnaa
+
+import (
+	"broker"
+	"encoding/base64"
+	"flow/cmd/cmdutil"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+)
+
+// keyPath is where the X25519 key subscriptions are encrypted for is kept
+// unless --key-file says otherwise.
+const keyPath = "~/.flow.key"
+
+// AddKeyFileFlag adds the flag LoadKey reads to cmd.
+func AddKeyFileFlag(cmd *cobra.Command) {
+	cmd.Flags().String("key-file", keyPath, "File holding the X25519 private key of encrypted subscriptions")
+}
+
+// LoadKey returns the private key in the file of the flag AddKeyFileFlag
+// added. When create is true a new key is generated and saved if the file
+// does not exist.
+func LoadKey(cmd *cobra.Command, create bool) ([]byte, error) {
+	path, _ := cmd.Flags().GetString("key-file")
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, cmdutil.Wrap(cmdutil.ExitUsage, err, "--key-file")
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		private, _, err := broker.GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(private) + "\n"
+		if err := ioutil.WriteFile(path, []byte(encoded), 0600); err != nil {
+			return nil, cmdutil.Wrap(cmdutil.ExitError, err, "saving the key")
+		}
+		log.Printf("Generated a key in %v", path)
+		return private, nil
+	}
+	if err != nil {
+		return nil, cmdutil.Wrap(cmdutil.ExitError, err, "reading the key")
+	}
+	private, err := broker.ParseKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, cmdutil.Wrap(cmdutil.ExitError, err, "reading the key in "+path)
+	}
+	return private, nil
+}
+
+// EncryptOption returns the ENCRYPT option of a SUBSCRIBE command, with
+// the public key in the file of the flag AddKeyFileFlag added, generated
+// if need be, and the ID of that key.
+func EncryptOption(cmd *cobra.Command) (string, string, error) {
+	private, err := LoadKey(cmd, true)
+	if err != nil {
+		return "", "", err
+	}
+	public, err := broker.PublicKey(private)
+	if err != nil {
+		return "", "", cmdutil.Wrap(cmdutil.ExitError, err, "reading the key")
+	}
+	return "ENCRYPT " + base64.StdEncoding.EncodeToString(public), broker.KeyID(public), nil
+}
@@ -0,0 +1,339 @@
+package fnaa
+
+import (
+	"bufio"
+	"context"
+	"flow/client"
+	"flow/cmd/cmdutil"
+	"flow/cmd/config"
+	"flow/credentials"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"resolver"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Options holds the settings used to reach a FNAA.
+type Options struct {
+	Resolver *resolver.Resolver
+	Timeouts client.Timeouts
+	Debug    bool
+}
+
+// OptionsFromFlags reads the connection options from the command flags.
+// Names are resolved with the nameservers given with --nameserver, comma
+// separated, or else with all the system ones, over the transport chosen
+// with --dns-transport. DNS-over-TLS and DNS-over-HTTPS need --nameserver,
+// a host or a URL, and trust the system CAs or --nameserver-ca. With
+// --trust-anchor the answers are validated with DNSSEC and unsigned or
+// bogus ones refused.
+func OptionsFromFlags(cmd *cobra.Command) (Options, error) {
+	debug, _ := cmd.Flags().GetBool("debug")
+	nameserver, _ := cmd.Flags().GetString("nameserver")
+	trustAnchor, _ := cmd.Flags().GetString("trust-anchor")
+	dnsTransport, _ := cmd.Flags().GetString("dns-transport")
+	nameserverCA, _ := cmd.Flags().GetString("nameserver-ca")
+	dialTimeout, _ := cmd.Flags().GetDuration("dial-timeout")
+	ioTimeout, _ := cmd.Flags().GetDuration("io-timeout")
+
+	transport, err := resolver.ParseTransport(dnsTransport)
+	if err != nil {
+		return Options{}, cmdutil.Wrap(cmdutil.ExitUsage, err, "--dns-transport")
+	}
+	var r *resolver.Resolver
+	if len(nameserver) == 0 {
+		if transport == resolver.TransportDoT || transport == resolver.TransportDoH {
+			return Options{}, cmdutil.Errorf(cmdutil.ExitUsage, "--dns-transport %v needs the nameserver endpoint given with --nameserver", transport)
+		}
+		r, err = resolver.FromResolvConf("/etc/resolv.conf")
+		if err != nil {
+			return Options{}, cmdutil.Wrap(cmdutil.ExitDiscovery, err, "reading system nameservers")
+		}
+	} else {
+		r = resolver.New(strings.Split(nameserver, ",")...)
+	}
+	r.Logger = client.Logger
+	r.Transport = transport
+	if cache := Cache(); cache != nil {
+		r.Cache = cache
+	}
+	if nameserverCA != "" {
+		if r.TLSConfig, err = resolver.TLSConfigFromCA(nameserverCA); err != nil {
+			return Options{}, cmdutil.Wrap(cmdutil.ExitConfig, err, "--nameserver-ca")
+		}
+	}
+	if trustAnchor != "" {
+		anchors, err := resolver.ReadTrustAnchors(trustAnchor)
+		if err != nil {
+			return Options{}, cmdutil.Wrap(cmdutil.ExitConfig, err, "--trust-anchor")
+		}
+		r.TrustAnchors = anchors
+		log.Printf("Validating DNS answers with %v trust anchors from %v", len(anchors), trustAnchor)
+	}
+
+	return Options{
+		Resolver: r,
+		Timeouts: client.Timeouts{Dial: dialTimeout, Read: ioTimeout, Write: ioTimeout},
+		Debug:    debug,
+	}, nil
+}
+
+// Context returns the context a command runs under, bounded by --timeout.
+func Context(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// Interruptible returns a context cancelled when the command is
+// interrupted, for the commands that stream events for as long as asked.
+func Interruptible() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
+// LoadConfig decodes the config file read at startup and puts the context
+// selected with --context, or the current one, in effect.
+func LoadConfig(cmd *cobra.Command) (config.Config, error) {
+	cfg := config.Config{}
+	if err := viper.Unmarshal(&cfg); err != nil {
+		return cfg, cmdutil.Wrap(cmdutil.ExitConfig, err, "decoding config file")
+	}
+	context, _ := cmd.Flags().GetString("context")
+	if err := cfg.Use(context); err != nil {
+		return cfg, cmdutil.Wrap(cmdutil.ExitConfig, err, "selecting context")
+	}
+	return cfg, nil
+}
+
+// AgentForFlow returns the agent that manages the namespace flow belongs
+// to. If selected is set, that agent is used and must manage it. A flow
+// outside the configured namespaces is looked up in DNS, see Discover.
+func AgentForFlow(ctx context.Context, cfg config.Config, flow string, selected string, opts Options) (config.Agent, error) {
+	var agentName string
+	for _, namespace := range cfg.Namespaces {
+		if selected != "" && namespace.AgentName != selected {
+			continue
+		}
+		if strings.HasSuffix(flow, "."+namespace.Name) {
+			agentName = namespace.AgentName
+			log.Printf("Flow %v belongs to namespace %v managed by agent %v", flow, namespace.Name, agentName)
+			break
+		}
+	}
+
+	if agentName == "" {
+		if selected != "" {
+			return config.Agent{}, cmdutil.Errorf(cmdutil.ExitConfig, "agent %v does not manage the namespace of %v", selected, flow)
+		}
+		return Discover(ctx, cfg, flow, opts)
+	}
+
+	agent, ok := cfg.Agent(agentName)
+	if !ok {
+		return config.Agent{}, cmdutil.Errorf(cmdutil.ExitConfig, "agent %v does not exist, add it to the config file", agentName)
+	}
+	return agent, nil
+}
+
+// SelectAgent returns the agent named selected or, if it is empty, the
+// agent of the current context or the only agent in the config file.
+func SelectAgent(cfg config.Config, selected string) (config.Agent, error) {
+	if selected == "" {
+		selected = cfg.Current.Agent
+	}
+	if selected != "" {
+		agent, ok := cfg.Agent(selected)
+		if !ok {
+			return config.Agent{}, cmdutil.Errorf(cmdutil.ExitConfig, "agent %v does not exist, add it to the config file", selected)
+		}
+		return agent, nil
+	}
+
+	switch len(cfg.Agents) {
+	case 0:
+		return config.Agent{}, cmdutil.Errorf(cmdutil.ExitConfig, "no agent in config file")
+	case 1:
+		return cfg.Agents[0], nil
+	}
+	return config.Agent{}, cmdutil.Errorf(cmdutil.ExitUsage, "more than one agent in config file, select one with --agent or flow config use-context")
+}
+
+// RequireCredentials fails, with the authentication exit code, when agent
+// is a discovered FNAA contacted anonymously, for commands the FNAA only
+// runs for authenticated users.
+func RequireCredentials(agent config.Agent, command string) error {
+	if !agent.Anonymous {
+		return nil
+	}
+	return cmdutil.Errorf(cmdutil.ExitAuth, "%v needs credentials for FNAA %v, found through DNS: add it as an agent and run flow login, or give the current context credentials with flow config set-context --credentials", command, agent.Name)
+}
+
+// Session is an authenticated connection to a FNAA.
+type Session struct {
+	Agent config.Agent
+	Host  string
+	Port  int
+
+	conn *net.Conn
+	rw   *bufio.ReadWriter
+}
+
+// Dial discovers the FNAA of agent through its SRV records, connects to
+// the first of their targets that accepts the connection and authenticates
+// with the agent credentials, see credentials.For. Anonymous agents are not
+// authenticated to.
+func Dial(ctx context.Context, agent config.Agent, opts Options) (*Session, error) {
+	var username, password string
+	if !agent.Anonymous {
+		var err error
+		username, password, err = credentials.For(ctx, agent)
+		if err != nil {
+			return nil, cmdutil.Wrap(cmdutil.ExitAuth, err, "credentials for agent "+agent.Name)
+		}
+	}
+
+	if opts.Debug {
+		log.Printf("Resolving FNAA FQDN %v", agent.Fqdn)
+	}
+	records, err := opts.Resolver.LookupSRV(ctx, agent.Fqdn)
+	if err != nil {
+		return nil, cmdutil.Wrap(cmdutil.ExitDiscovery, err, "could not resolve SRV RR for FQDN "+agent.Fqdn)
+	}
+	endpoints, err := opts.Resolver.Endpoints(ctx, records)
+	if err != nil {
+		return nil, cmdutil.Wrap(cmdutil.ExitDiscovery, err, "could not resolve the address of FNAA "+agent.Fqdn)
+	}
+
+	// Endpoints come in RFC 2782 order, so the next one is only tried
+	// when the previous one cannot be connected to.
+	var (
+		endpoint resolver.Endpoint
+		conn     *net.Conn
+		rw       *bufio.ReadWriter
+	)
+	for _, endpoint = range endpoints {
+		if opts.Debug {
+			log.Printf("FNAA FQDN Resolved to %v port %v, connecting to %v", endpoint.Target, endpoint.Port, endpoint.IP)
+		}
+		conn, rw, err = client.Client(ctx, endpoint.IP.String(), endpoint.Port, opts.Timeouts)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		log.Printf("Connection to FNAA %v failed: %v", endpoint.Address(), err)
+	}
+	if err != nil {
+		return nil, cmdutil.Wrap(cmdutil.ExitConnection, err, "connection to FNAA "+endpoint.Target+" failed")
+	}
+
+	if opts.Debug {
+		log.Printf("Connected to FNAA")
+	}
+	if !agent.Anonymous {
+		if opts.Debug {
+			log.Printf("Authenticating with PLAIN mechanism")
+		}
+		_, err = client.AuthenticatePlain(ctx, conn, rw, username, password)
+		if err != nil {
+			(*conn).Close()
+			return nil, cmdutil.Wrap(classify(err, cmdutil.ExitAuth), err, "authentication to FNAA "+endpoint.Target+" failed")
+		}
+	}
+
+	return &Session{Agent: agent, Host: endpoint.Target, Port: endpoint.Port, conn: conn, rw: rw}, nil
+}
+
+// Command executes command and returns the data the FNAA replied with.
+func (s *Session) Command(ctx context.Context, command string) (string, error) {
+	response, err := client.SendCommand(ctx, s.conn, s.rw, command)
+	if err != nil {
+		return "", cmdutil.Wrap(classify(err, cmdutil.ExitRefused), err, "command "+command+" in FNAA "+s.Host+" failed")
+	}
+	return response, nil
+}
+
+// Close says goodbye to the FNAA and closes the connection.
+func (s *Session) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.SendCommand(ctx, s.conn, s.rw, "QUIT")
+	(*s.conn).Close()
+	return err
+}
+
+// classify returns refused if err is the FNAA turning a command down and
+// ExitConnection if the exchange itself failed.
+func classify(err error, refused int) int {
+	if _, ok := errors.Cause(err).(*client.ReplyError); ok {
+		return refused
+	}
+	return cmdutil.ExitConnection
+}
+
+// ParseItems parses a reply made of one item per line, each a list of
+// space separated key=value pairs.
+func ParseItems(response string) []map[string]string {
+	var items []map[string]string
+	for _, line := range strings.Split(response, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		item := map[string]string{}
+		for _, field := range strings.Fields(line) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 {
+				item[kv[0]] = kv[1]
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// Collect runs command against every agent and merges the items they
+// reply with, recording in the "agent" key where each came from. Agents
+// that fail are skipped and reported in the returned errors.
+func Collect(ctx context.Context, agents []config.Agent, opts Options, command string) ([]map[string]string, []error) {
+	var items []map[string]string
+	var errs []error
+	for _, agent := range agents {
+		session, err := Dial(ctx, agent, opts)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "agent %v", agent.Name))
+			continue
+		}
+		response, err := session.Command(ctx, command)
+		session.Close()
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "agent %v", agent.Name))
+			continue
+		}
+		for _, item := range ParseItems(response) {
+			item["agent"] = agent.Name
+			items = append(items, item)
+		}
+	}
+	return items, errs
+}
@@ -0,0 +1,29 @@
+package fnaa
+
+import (
+	"broker"
+	"flow/cmd/cmdutil"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// AddOrderingFlag adds the flag OrderingOption reads to cmd.
+func AddOrderingFlag(cmd *cobra.Command) {
+	cmd.Flags().String("ordering", "", "Events keeping the order they were published in: "+strings.Join(broker.Orderings, ", "))
+}
+
+// OrderingOption returns the ORDERING option of a CREATE FLOW or UPDATE
+// FLOW command from the flag AddOrderingFlag added, empty if it is not
+// set.
+func OrderingOption(cmd *cobra.Command) (string, error) {
+	ordering, _ := cmd.Flags().GetString("ordering")
+	if ordering == "" {
+		return "", nil
+	}
+	ordering, err := broker.ParseOrdering(ordering)
+	if err != nil {
+		return "", cmdutil.Wrap(cmdutil.ExitUsage, err, "--ordering")
+	}
+	return "ORDERING " + ordering, nil
+}
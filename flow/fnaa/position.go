@@ -0,0 +1,39 @@
+package fnaa
+
+import (
+	"flow/cmd/cmdutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// AddFromFlag adds the flag FromOption reads to cmd.
+func AddFromFlag(cmd *cobra.Command, usage string) {
+	cmd.Flags().String("from", "", usage+": earliest, latest, an offset, an RFC 3339 time or a duration ago such as 2h")
+}
+
+// FromOption returns the FROM option of a SUBSCRIBE or REPLAY command
+// from the flag AddFromFlag added, empty if it is not set.
+func FromOption(cmd *cobra.Command) (string, error) {
+	from, _ := cmd.Flags().GetString("from")
+	switch strings.ToLower(from) {
+	case "":
+		return "", nil
+	case "earliest", "beginning":
+		return "FROM EARLIEST", nil
+	case "latest", "end":
+		return "FROM LATEST", nil
+	}
+	if offset, err := strconv.ParseInt(from, 10, 64); err == nil && offset >= 0 {
+		return "FROM OFFSET " + from, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, from); err == nil {
+		return "FROM TIMESTAMP " + t.UTC().Format(time.RFC3339Nano), nil
+	}
+	if ago, err := time.ParseDuration(from); err == nil && ago >= 0 {
+		return "FROM TIMESTAMP " + time.Now().Add(-ago).UTC().Format(time.RFC3339Nano), nil
+	}
+	return "", cmdutil.Errorf(cmdutil.ExitUsage, "--from %q is not earliest, latest, an offset, an RFC 3339 time or a duration", from)
+}
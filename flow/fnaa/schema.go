@@ -0,0 +1,79 @@
+package fnaa
+
+import (
+	"encoding/base64"
+	"flow/cmd/cmdutil"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// maxSchema is the largest schema, base64 encoded, a command line can
+// carry.
+const maxSchema = 48 * 1024
+
+// schemaTypes maps schema file extensions to the schema type they hold.
+var schemaTypes = map[string]string{
+	".json":     "json",
+	".avsc":     "avro",
+	".pb":       "protobuf",
+	".desc":     "protobuf",
+	".protoset": "protobuf",
+}
+
+// AddSchemaFlags adds the flags SchemaOptions reads to cmd.
+func AddSchemaFlags(cmd *cobra.Command) {
+	cmd.Flags().String("schema", "", "Schema file events are described with")
+	cmd.Flags().String("schema-type", "", "Schema type, json, avro or protobuf, guessed from the --schema extension by default")
+	cmd.Flags().String("schema-message", "", "Message events are, for protobuf descriptor sets")
+	cmd.Flags().String("compatibility", "", "What new schema versions must be compatible for: backward, forward, full or none")
+	cmd.Flags().String("validate", "", "What flow processors do with events not conforming to the schema: off, drop or dead-letter")
+}
+
+// SchemaOptions returns the schema options of a CREATE FLOW or UPDATE FLOW
+// command from the flags AddSchemaFlags added. The schema file is a JSON
+// Schema document, an Avro schema or a Protobuf descriptor set, as
+// protoc --descriptor_set_out --include_imports writes it.
+func SchemaOptions(cmd *cobra.Command) (string, error) {
+	path, _ := cmd.Flags().GetString("schema")
+	typ, _ := cmd.Flags().GetString("schema-type")
+	message, _ := cmd.Flags().GetString("schema-message")
+	compatibility, _ := cmd.Flags().GetString("compatibility")
+	validate, _ := cmd.Flags().GetString("validate")
+
+	var options []string
+	if path != "" {
+		if typ == "" {
+			typ = schemaTypes[strings.ToLower(filepath.Ext(path))]
+			if typ == "" {
+				return "", cmdutil.Errorf(cmdutil.ExitUsage, "cannot tell the type of schema %v, use --schema-type", path)
+			}
+		}
+		if typ == "protobuf" && message == "" {
+			return "", cmdutil.Errorf(cmdutil.ExitUsage, "--schema-message is needed for protobuf schemas")
+		}
+		definition, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", cmdutil.Wrap(cmdutil.ExitUsage, err, "--schema")
+		}
+		encoded := base64.StdEncoding.EncodeToString(definition)
+		if len(encoded) > maxSchema {
+			return "", cmdutil.Errorf(cmdutil.ExitUsage, "schema %v is too large, at most %v bytes once base64 encoded", path, maxSchema)
+		}
+		options = append(options, "SCHEMA", typ, encoded)
+		if message != "" {
+			options = append(options, "MESSAGE", message)
+		}
+	} else if typ != "" || message != "" {
+		return "", cmdutil.Errorf(cmdutil.ExitUsage, "--schema-type and --schema-message need --schema")
+	}
+	if compatibility != "" {
+		options = append(options, "COMPATIBILITY", compatibility)
+	}
+	if validate != "" {
+		options = append(options, "VALIDATE", validate)
+	}
+	return strings.Join(options, " "), nil
+}
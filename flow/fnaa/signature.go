@@ -0,0 +1,38 @@
+package fnaa
+
+import (
+	"broker"
+	"context"
+	"crypto/ed25519"
+	"flow/cmd/cmdutil"
+	"resolver"
+)
+
+// Verifier checks the signatures of events against the keys their
+// namespace publishes in DNS, looked up once per namespace.
+type Verifier struct {
+	opts Options
+	keys map[string][]ed25519.PublicKey
+}
+
+// NewVerifier returns a Verifier looking keys up with the resolver of
+// opts.
+func NewVerifier(opts Options) *Verifier {
+	return &Verifier{opts: opts, keys: map[string][]ed25519.PublicKey{}}
+}
+
+// Verify checks the signature of m, which must be signed. It returns the
+// flow m comes from.
+func (v *Verifier) Verify(ctx context.Context, m broker.Message) (string, error) {
+	if signer, ok := broker.Signer(m); ok {
+		if _, found := v.keys[signer]; !found {
+			texts, err := v.opts.Resolver.LookupTXT(ctx, broker.SigningKeyName(signer))
+			if err != nil && !resolver.IsNotFound(err) {
+				return "", cmdutil.Wrap(cmdutil.ExitDiscovery, err, "looking up the signing keys of "+signer)
+			}
+			v.keys[signer] = broker.SigningKeys(texts)
+		}
+		return broker.Verify(m, v.keys[signer])
+	}
+	return broker.Verify(m, nil)
+}
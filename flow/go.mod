@@ -3,9 +3,18 @@ module flow
 go 1.13
 
 require (
-	github.com/miekg/dns v1.0.14
+	broker v0.0.0
+	github.com/bgentry/speakeasy v0.1.0
+	github.com/miekg/dns v1.1.41
 	github.com/mitchellh/go-homedir v1.0.0
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.2.1
 	github.com/spf13/viper v1.8.1
+	golang.org/x/crypto v0.14.0
+	gopkg.in/yaml.v2 v2.4.0
+	resolver v0.0.0
 )
+
+replace broker => ../broker
+
+replace resolver => ../resolver
@@ -17,10 +17,8 @@ package main
 
 import (
 	"flow/cmd"
-	"log"
 )
 
 func main() {
-	log.Println("Initializing main")
 	cmd.Execute()
 }
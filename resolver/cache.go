@@ -0,0 +1,208 @@
+package resolver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// maxCacheTTL bounds how long an answer is kept, whatever its TTL.
+const maxCacheTTL = 24 * time.Hour
+
+// Cache keeps the answers of Query until their TTL runs out. Keys tell
+// apart the name, type, whether the answer was validated with DNSSEC and
+// the nameservers and transport it was asked with, so resolvers sharing
+// a cache do not see each other's answers.
+type Cache interface {
+	Get(key string) (*dns.Msg, bool)
+	Set(key string, m *dns.Msg, ttl time.Duration)
+}
+
+func (r *Resolver) cacheKey(name string, qtype uint16) string {
+	transport := r.Transport
+	if transport == "" {
+		transport = TransportUDP
+	}
+	key := strings.ToLower(dns.Fqdn(name)) + " " + dns.TypeToString[qtype] + " " + transport + " " + strings.Join(r.Servers, ",")
+	if r.validating() {
+		key += " +dnssec"
+	}
+	return key
+}
+
+// cacheTTL returns how long in may be cached: the lowest TTL of the
+// answer or, for a negative answer, the one of the SOA record in the
+// authority section as RFC 2308 asks. Answers that are neither are not
+// cached, nor are negative answers without SOA.
+func cacheTTL(in *dns.Msg) time.Duration {
+	var ttl uint32
+	switch {
+	case in.Rcode == dns.RcodeSuccess && len(in.Answer) > 0:
+		ttl = minTTL(in.Answer)
+	case in.Rcode == dns.RcodeSuccess || in.Rcode == dns.RcodeNameError:
+		for _, rr := range in.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+			}
+		}
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > maxCacheTTL {
+		d = maxCacheTTL
+	}
+	return d
+}
+
+func minTTL(rrs []dns.RR) uint32 {
+	ttl := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// cacheEntry is an answer kept in a cache, packed so a FileCache can save
+// it as is.
+type cacheEntry struct {
+	Msg     []byte    `json:"msg"`
+	Expires time.Time `json:"expires"`
+}
+
+// unpack returns the answer with its TTLs lowered by the time it spent
+// in the cache.
+func (e cacheEntry) unpack(now time.Time) (*dns.Msg, bool) {
+	m := new(dns.Msg)
+	if err := m.Unpack(e.Msg); err != nil {
+		return nil, false
+	}
+	left := uint32(e.Expires.Sub(now) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > left {
+				rr.Header().Ttl = left
+			}
+		}
+	}
+	return m, true
+}
+
+// MemoryCache is a Cache living as long as the process, shared by the
+// resolvers it is given to.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// NewMemoryCache returns an empty MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: map[string]cacheEntry{}}
+}
+
+// Get returns the answer kept for key, if it has not expired.
+func (c *MemoryCache) Get(key string) (*dns.Msg, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	now := time.Now()
+	if !ok || now.After(e.Expires) {
+		return nil, false
+	}
+	return e.unpack(now)
+}
+
+// Set keeps m for ttl, dropping the entries that expired meanwhile.
+func (c *MemoryCache) Set(key string, m *dns.Msg, ttl time.Duration) {
+	data, err := m.Pack()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if now.After(e.Expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[key] = cacheEntry{Msg: data, Expires: now.Add(ttl)}
+}
+
+// Clear drops every entry.
+func (c *MemoryCache) Clear() {
+	c.mu.Lock()
+	c.entries = map[string]cacheEntry{}
+	c.mu.Unlock()
+}
+
+// FileCache is a MemoryCache saved to a file after every change, so
+// answers outlive the process that asked for them.
+type FileCache struct {
+	MemoryCache
+	path string
+}
+
+// OpenFileCache reads the cache saved at path. A file that is missing or
+// cannot be read starts an empty cache, as a cache only saves queries.
+func OpenFileCache(path string) *FileCache {
+	c := &FileCache{MemoryCache: MemoryCache{entries: map[string]cacheEntry{}}, path: path}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if json.Unmarshal(data, &c.entries) != nil {
+			c.entries = map[string]cacheEntry{}
+		}
+	}
+	return c
+}
+
+// Set keeps m for ttl and saves the cache. Failing to save only loses
+// the entry for the next processes, so it is logged and not returned.
+func (c *FileCache) Set(key string, m *dns.Msg, ttl time.Duration) {
+	c.MemoryCache.Set(key, m, ttl)
+	if err := c.save(); err != nil {
+		log.Printf("Could not save the DNS cache in %v: %v", c.path, err)
+	}
+}
+
+// Clear drops every entry and removes the file.
+func (c *FileCache) Clear() error {
+	c.MemoryCache.Clear()
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing "+c.path)
+	}
+	return nil
+}
+
+func (c *FileCache) save() error {
+	c.mu.Lock()
+	data, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,199 @@
+package resolver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// message returns an answer holding the record rr.
+func message(t *testing.T, rr string) *dns.Msg {
+	t.Helper()
+	record, err := dns.NewRR(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(record.Header().Name, record.Header().Rrtype)
+	m.Answer = []dns.RR{record}
+	return m
+}
+
+func TestCacheKey(t *testing.T) {
+	udp := New("192.0.2.1")
+	tcp := New("192.0.2.1")
+	tcp.Transport = TransportTCP
+	other := New("192.0.2.2")
+	validating := New("192.0.2.1")
+	validating.TrustAnchors = []dns.RR{&dns.DS{}}
+
+	if udp.cacheKey("Unix.AR", dns.TypeSRV) != udp.cacheKey("unix.ar.", dns.TypeSRV) {
+		t.Error("keys differ by case or trailing dot")
+	}
+	keys := map[string]string{}
+	for name, key := range map[string]string{
+		"udp":        udp.cacheKey("unix.ar", dns.TypeSRV),
+		"tcp":        tcp.cacheKey("unix.ar", dns.TypeSRV),
+		"other":      other.cacheKey("unix.ar", dns.TypeSRV),
+		"validating": validating.cacheKey("unix.ar", dns.TypeSRV),
+		"txt":        udp.cacheKey("unix.ar", dns.TypeTXT),
+	} {
+		if previous, ok := keys[key]; ok {
+			t.Errorf("%v and %v share key %q", previous, name, key)
+		}
+		keys[key] = name
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	positive := message(t, "fnaa.unix.ar. 300 IN A 192.0.2.1")
+	if got := cacheTTL(positive); got != 300*time.Second {
+		t.Errorf("positive answer cached for %v, want 5m", got)
+	}
+
+	negative := new(dns.Msg)
+	negative.SetQuestion("missing.unix.ar.", dns.TypeA)
+	negative.Rcode = dns.RcodeNameError
+	soa, _ := dns.NewRR("unix.ar. 3600 IN SOA ns.unix.ar. hostmaster.unix.ar. 1 7200 900 1209600 60")
+	negative.Ns = []dns.RR{soa}
+	if got := cacheTTL(negative); got != 60*time.Second {
+		t.Errorf("negative answer cached for %v, want the SOA minimum of 1m", got)
+	}
+
+	negative.Ns = nil
+	if got := cacheTTL(negative); got != 0 {
+		t.Errorf("negative answer without SOA cached for %v", got)
+	}
+
+	long := message(t, "fnaa.unix.ar. 604800 IN A 192.0.2.1")
+	if got := cacheTTL(long); got != maxCacheTTL {
+		t.Errorf("week long answer cached for %v, want %v", got, maxCacheTTL)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache()
+	c.Set("a", message(t, "fnaa.unix.ar. 300 IN A 192.0.2.1"), 100*time.Second)
+	c.Set("expired", message(t, "fnaa.unix.ar. 300 IN A 192.0.2.1"), -time.Second)
+
+	in, ok := c.Get("a")
+	if !ok {
+		t.Fatal("answer not found")
+	}
+	if ttl := in.Answer[0].Header().Ttl; ttl > 100 {
+		t.Errorf("TTL %v not lowered to the time left", ttl)
+	}
+	if _, ok := c.Get("expired"); ok {
+		t.Error("expired answer found")
+	}
+	if _, ok := c.Get("missing"); ok {
+		t.Error("missing answer found")
+	}
+
+	c.Clear()
+	if _, ok := c.Get("a"); ok {
+		t.Error("answer found after Clear")
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache")
+
+	c := OpenFileCache(path)
+	c.Set("a", message(t, "fnaa.unix.ar. 300 IN A 192.0.2.1"), time.Minute)
+
+	in, ok := OpenFileCache(path).Get("a")
+	if !ok {
+		t.Fatal("answer not saved")
+	}
+	if a, ok := in.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Errorf("saved answer is %v", in.Answer[0])
+	}
+
+	if err := c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("cache file not removed: %v", err)
+	}
+	if err := c.Clear(); err != nil {
+		t.Errorf("clearing a removed cache: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := OpenFileCache(path).Get("a"); ok {
+		t.Error("answer found in a corrupt cache")
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	var queries int32
+	addr, stop := serve(t, "udp", answerA(&queries), nil)
+	defer stop()
+	ctx, cancel := testContext()
+	defer cancel()
+
+	r := New(addr)
+	r.Cache = NewMemoryCache()
+	for i := 0; i < 3; i++ {
+		lookupA(t, r)
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%v queries sent, want 1", n)
+	}
+
+	// Resolvers sharing the cache with other nameservers or another
+	// transport do not get the answers of the first one.
+	tcp := New(addr)
+	tcp.Transport = TransportTCP
+	tcp.Cache = r.Cache
+	if _, ok := tcp.Cache.Get(tcp.cacheKey("fnaa.unix.ar", dns.TypeA)); ok {
+		t.Error("answer over UDP found for TCP")
+	}
+	other := New("127.0.0.1:1", addr)
+	other.Cache = r.Cache
+	if _, err := other.Lookup(ctx, "fnaa.unix.ar", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("%v queries sent, want 2", n)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	var queries int32
+	addr, stop := serve(t, "udp", dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNameError)
+		soa, _ := dns.NewRR("unix.ar. 300 IN SOA ns.unix.ar. hostmaster.unix.ar. 1 7200 900 1209600 60")
+		m.Ns = []dns.RR{soa}
+		w.WriteMsg(m)
+	}), nil)
+	defer stop()
+	ctx, cancel := testContext()
+	defer cancel()
+
+	r := New(addr)
+	r.Cache = NewMemoryCache()
+	for i := 0; i < 2; i++ {
+		if _, err := r.Lookup(ctx, "missing.unix.ar", dns.TypeA); !IsNotFound(err) {
+			t.Fatalf("lookup gave %v, want not found", err)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%v queries sent, want 1", n)
+	}
+}
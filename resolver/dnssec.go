@@ -0,0 +1,456 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInsecure is returned by a validating resolver for answers that
+	// are not signed or whose keys do not chain up to a trust anchor.
+	ErrInsecure = errors.New("DNSSEC: answer is not secure")
+	// ErrBogus is returned by a validating resolver for answers whose
+	// signatures or proofs of non existence do not check.
+	ErrBogus = errors.New("DNSSEC: answer is bogus")
+)
+
+// ReadTrustAnchors reads the DNSKEY and DS records of a file in zone file
+// format, the keys answers are validated against.
+func ReadTrustAnchors(path string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading trust anchors")
+	}
+	defer f.Close()
+
+	var anchors []dns.RR
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.(type) {
+		case *dns.DNSKEY, *dns.DS:
+			anchors = append(anchors, rr)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading trust anchors")
+	}
+	if len(anchors) == 0 {
+		return nil, errors.Errorf("no DNSKEY or DS record in %v", path)
+	}
+	return anchors, nil
+}
+
+// validating reports whether answers are checked with DNSSEC.
+func (r *Resolver) validating() bool {
+	return len(r.TrustAnchors) > 0
+}
+
+// Verify checks the DNSSEC signatures of the answer and authority sections
+// of in, and for a negative answer the NSEC or NSEC3 records proving the
+// name or type asked for does not exist. Keys are fetched from the
+// nameservers and must chain up to one of the trust anchors.
+func (r *Resolver) Verify(ctx context.Context, in *dns.Msg) error {
+	if len(in.Question) == 0 {
+		return errors.Wrap(ErrBogus, "no question")
+	}
+	q := in.Question[0]
+
+	for _, set := range rrsets(in.Answer) {
+		if err := r.verifyRRset(ctx, set, in.Answer); err != nil {
+			return err
+		}
+	}
+	for _, set := range rrsets(in.Ns) {
+		// Delegations are not signed by the parent zone.
+		if set[0].Header().Rrtype == dns.TypeNS {
+			continue
+		}
+		if err := r.verifyRRset(ctx, set, in.Ns); err != nil {
+			return err
+		}
+	}
+
+	records, name := answer(in.Answer, dns.Fqdn(q.Name), q.Qtype)
+	if len(records) > 0 {
+		return nil
+	}
+	if in.Rcode == dns.RcodeSuccess && !strings.EqualFold(name, q.Name) {
+		// The answer ends at a CNAME target that is queried next.
+		return nil
+	}
+	return denial(in, name, q.Qtype)
+}
+
+// rrsets groups rrs, leaving the signatures out, by owner name and type.
+func rrsets(rrs []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+next:
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		for i, set := range sets {
+			if set[0].Header().Rrtype == rr.Header().Rrtype && strings.EqualFold(set[0].Header().Name, rr.Header().Name) {
+				sets[i] = append(set, rr)
+				continue next
+			}
+		}
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
+
+// verifyRRset checks that one of the signatures of set found in section
+// is valid and made with a trusted key of its zone.
+func (r *Resolver) verifyRRset(ctx context.Context, set []dns.RR, section []dns.RR) error {
+	h := set[0].Header()
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == h.Rrtype && strings.EqualFold(sig.Hdr.Name, h.Name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	if len(sigs) == 0 {
+		return errors.Wrapf(ErrInsecure, "no RRSIG for %v IN %v", h.Name, dns.TypeToString[h.Rrtype])
+	}
+
+	lastErr := errors.Wrapf(ErrBogus, "no valid RRSIG for %v IN %v", h.Name, dns.TypeToString[h.Rrtype])
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, h.Name) {
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now().UTC()) {
+			lastErr = errors.Wrapf(ErrBogus, "RRSIG for %v IN %v expired", h.Name, dns.TypeToString[h.Rrtype])
+			continue
+		}
+		keys, err := r.zoneKeys(ctx, sig.SignerName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && sig.Verify(key, set) == nil {
+				r.Logger.Printf("DNSSEC: %v IN %v validates with DNSKEY %v/%v", h.Name, dns.TypeToString[h.Rrtype], key.Hdr.Name, key.KeyTag())
+				return nil
+			}
+		}
+	}
+	return lastErr
+}
+
+// zoneKeys returns the DNSKEY RRset of zone once it is validated: it must
+// be signed by a key that is a trust anchor or that matches a validated DS
+// record of the parent zone.
+func (r *Resolver) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	r.mu.Lock()
+	keys, ok := r.keys[zone]
+	r.mu.Unlock()
+	if ok {
+		return keys, nil
+	}
+
+	in, err := r.exchangeDO(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var set []dns.RR
+	for _, rr := range in.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(key.Hdr.Name, zone) {
+			keys = append(keys, key)
+			set = append(set, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.Wrapf(ErrInsecure, "no DNSKEY for %v", zone)
+	}
+
+	trusted, err := r.trustedKeys(ctx, zone, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range in.Answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || sig.TypeCovered != dns.TypeDNSKEY || !sig.ValidityPeriod(time.Now().UTC()) {
+			continue
+		}
+		for _, key := range trusted {
+			if key.KeyTag() == sig.KeyTag && sig.Verify(key, set) == nil {
+				r.mu.Lock()
+				if r.keys == nil {
+					r.keys = map[string][]*dns.DNSKEY{}
+				}
+				r.keys[zone] = keys
+				r.mu.Unlock()
+				return keys, nil
+			}
+		}
+	}
+	return nil, errors.Wrapf(ErrBogus, "DNSKEY of %v not signed by a trusted key", zone)
+}
+
+// trustedKeys returns the keys of zone that are trust anchors or, when the
+// zone has no anchor, that match its DS records in the parent zone.
+func (r *Resolver) trustedKeys(ctx context.Context, zone string, keys []*dns.DNSKEY) ([]*dns.DNSKEY, error) {
+	var anchors []dns.RR
+	for _, anchor := range r.TrustAnchors {
+		if strings.EqualFold(anchor.Header().Name, zone) {
+			anchors = append(anchors, anchor)
+		}
+	}
+
+	if len(anchors) == 0 {
+		if zone == "." {
+			return nil, errors.Wrap(ErrInsecure, "no trust anchor for the chain of trust")
+		}
+		in, err := r.exchangeDO(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range in.Answer {
+			if _, ok := rr.(*dns.DS); ok && strings.EqualFold(rr.Header().Name, zone) {
+				anchors = append(anchors, rr)
+			}
+		}
+		if len(anchors) == 0 {
+			return nil, errors.Wrapf(ErrInsecure, "no DS for %v, it is not signed or not delegated securely", zone)
+		}
+		if err := r.verifyRRset(ctx, anchors, in.Answer); err != nil {
+			return nil, err
+		}
+	}
+
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, anchor := range anchors {
+			if matchAnchor(key, anchor) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, errors.Wrapf(ErrBogus, "no DNSKEY of %v matches its trust anchors or DS records", zone)
+	}
+	return trusted, nil
+}
+
+// matchAnchor reports whether key is anchor, or is the key anchor is the
+// digest of.
+func matchAnchor(key *dns.DNSKEY, anchor dns.RR) bool {
+	switch anchor := anchor.(type) {
+	case *dns.DNSKEY:
+		return key.Algorithm == anchor.Algorithm && key.Flags == anchor.Flags && key.PublicKey == anchor.PublicKey
+	case *dns.DS:
+		if key.KeyTag() != anchor.KeyTag || key.Algorithm != anchor.Algorithm {
+			return false
+		}
+		ds := key.ToDS(anchor.DigestType)
+		return ds != nil && strings.EqualFold(ds.Digest, anchor.Digest)
+	}
+	return false
+}
+
+// exchangeDO queries name for qtype asking for the DNSSEC records.
+func (r *Resolver) exchangeDO(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+	m.SetEdns0(4096, true)
+	return r.Exchange(ctx, m)
+}
+
+// denial checks the proof, in the authority section of in, that name does
+// not exist or has no records of type qtype.
+func denial(in *dns.Msg, name string, qtype uint16) error {
+	var (
+		nsec  []*dns.NSEC
+		nsec3 []*dns.NSEC3
+	)
+	for _, rr := range in.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsec = append(nsec, rr)
+		case *dns.NSEC3:
+			nsec3 = append(nsec3, rr)
+		}
+	}
+	switch {
+	case len(nsec) > 0:
+		return denialNSEC(nsec, in.Rcode, name, qtype)
+	case len(nsec3) > 0:
+		return denialNSEC3(nsec3, in.Rcode, name, qtype)
+	}
+	return errors.Wrapf(ErrInsecure, "no NSEC or NSEC3 proof that %v IN %v does not exist", name, dns.TypeToString[qtype])
+}
+
+// denialNSEC checks an NSEC proof: for no data an NSEC of name without
+// qtype in its bitmap, for a name error NSECs covering name and the
+// wildcard that could have produced it.
+func denialNSEC(nsec []*dns.NSEC, rcode int, name string, qtype uint16) error {
+	switch rcode {
+	case dns.RcodeSuccess:
+		for _, rr := range nsec {
+			if !strings.EqualFold(rr.Hdr.Name, name) {
+				continue
+			}
+			if hasType(rr.TypeBitMap, qtype) || hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return errors.Wrapf(ErrBogus, "NSEC of %v lists type %v", name, dns.TypeToString[qtype])
+			}
+			return nil
+		}
+		// An empty non-terminal has no NSEC of its own but is covered
+		// by the one leading to the names below it.
+		for _, rr := range nsec {
+			if covers(rr, name) && dns.IsSubDomain(name, rr.NextDomain) && !strings.EqualFold(name, rr.NextDomain) {
+				return nil
+			}
+		}
+		return errors.Wrapf(ErrBogus, "no NSEC of %v proving there is no %v", name, dns.TypeToString[qtype])
+	case dns.RcodeNameError:
+		var cover *dns.NSEC
+		for _, rr := range nsec {
+			if covers(rr, name) {
+				cover = rr
+				break
+			}
+		}
+		if cover == nil {
+			return errors.Wrapf(ErrBogus, "no NSEC covering %v", name)
+		}
+		// The closest encloser is the longest ancestor of name that
+		// exists, the one shared with the names around it.
+		ce := name
+		for _, other := range []string{cover.Hdr.Name, cover.NextDomain} {
+			if n := dns.CompareDomainName(name, other); n < dns.CountLabel(ce) {
+				ce = ancestor(name, n)
+			}
+		}
+		wildcard := "*." + ce
+		if ce == "." {
+			wildcard = "*."
+		}
+		for _, rr := range nsec {
+			if covers(rr, wildcard) {
+				return nil
+			}
+		}
+		return errors.Wrapf(ErrBogus, "no NSEC covering wildcard %v", wildcard)
+	}
+	return nil
+}
+
+// denialNSEC3 checks an NSEC3 proof, as in RFC 5155 section 8.
+func denialNSEC3(nsec3 []*dns.NSEC3, rcode int, name string, qtype uint16) error {
+	switch rcode {
+	case dns.RcodeSuccess:
+		for _, rr := range nsec3 {
+			if !rr.Match(name) {
+				continue
+			}
+			if hasType(rr.TypeBitMap, qtype) || hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return errors.Wrapf(ErrBogus, "NSEC3 of %v lists type %v", name, dns.TypeToString[qtype])
+			}
+			return nil
+		}
+		return errors.Wrapf(ErrBogus, "no NSEC3 matching %v", name)
+	case dns.RcodeNameError:
+		indx := dns.Split(name)
+		var ce, nc string // closest encloser and next closer
+	ClosestEncloser:
+		for i := 0; i < len(indx); i++ {
+			for _, rr := range nsec3 {
+				if rr.Match(name[indx[i]:]) {
+					ce = name[indx[i]:]
+					if i == 0 {
+						nc = name
+					} else {
+						nc = name[indx[i-1]:]
+					}
+					break ClosestEncloser
+				}
+			}
+		}
+		if ce == "" {
+			return errors.Wrapf(ErrBogus, "no NSEC3 closest encloser for %v", name)
+		}
+		covered := 0 // both the next closer and the wildcard must be
+		for _, wanted := range []string{nc, "*." + ce} {
+			for _, rr := range nsec3 {
+				if rr.Cover(wanted) {
+					covered++
+					break
+				}
+			}
+		}
+		if covered != 2 {
+			return errors.Wrapf(ErrBogus, "NSEC3 records do not cover %v and its wildcard", name)
+		}
+	}
+	return nil
+}
+
+func hasType(bitmap []uint16, qtype uint16) bool {
+	for _, t := range bitmap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether name falls between the owner and next name of
+// rr in canonical order, the last NSEC of a zone wrapping to its apex.
+func covers(rr *dns.NSEC, name string) bool {
+	if canonicalLess(rr.Hdr.Name, rr.NextDomain) {
+		return canonicalLess(rr.Hdr.Name, name) && canonicalLess(name, rr.NextDomain)
+	}
+	return canonicalLess(rr.Hdr.Name, name) && dns.IsSubDomain(rr.NextDomain, name)
+}
+
+// canonicalLess orders names as RFC 4034 section 6.1 does, comparing
+// the octets of their labels, escapes decoded and letters lowered, from
+// the rightmost label.
+func canonicalLess(a, b string) bool {
+	la, lb := labelOctets(a), labelOctets(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := bytes.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c < 0
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// labelOctets returns the labels of name in wire format, lowercased.
+func labelOctets(name string) [][]byte {
+	wire := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), wire, 0, nil, false)
+	if err != nil {
+		// Names that do not pack are compared as written.
+		var labels [][]byte
+		for _, label := range dns.SplitDomainName(strings.ToLower(name)) {
+			labels = append(labels, []byte(label))
+		}
+		return labels
+	}
+	var labels [][]byte
+	for off := 0; off < n && wire[off] != 0; off += int(wire[off]) + 1 {
+		labels = append(labels, bytes.ToLower(wire[off+1:off+1+int(wire[off])]))
+	}
+	return labels
+}
+
+// ancestor returns the suffix of name made of its last n labels.
+func ancestor(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n >= len(labels) {
+		return dns.Fqdn(name)
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
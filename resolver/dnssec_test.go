@@ -0,0 +1,340 @@
+package resolver
+
+import (
+	"crypto"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func nsec(t *testing.T, owner, next string, types ...uint16) *dns.NSEC {
+	t.Helper()
+	// Type bitmaps are packed in order, without duplicates.
+	bitmap := []uint16{dns.TypeNSEC, dns.TypeRRSIG}
+	for _, qtype := range types {
+		if !hasType(bitmap, qtype) {
+			bitmap = append(bitmap, qtype)
+		}
+	}
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next,
+		TypeBitMap: bitmap,
+	}
+}
+
+func TestCanonicalLess(t *testing.T) {
+	// The canonical order of the names of RFC 4034 section 6.1.
+	names := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "\\001.z.example.", "*.z.example.", "\\200.z.example.",
+	}
+	for i := 0; i < len(names)-1; i++ {
+		if !canonicalLess(names[i], names[i+1]) {
+			t.Errorf("%v not before %v", names[i], names[i+1])
+		}
+		if canonicalLess(names[i+1], names[i]) {
+			t.Errorf("%v before %v", names[i+1], names[i])
+		}
+	}
+}
+
+func TestDenialNSEC(t *testing.T) {
+	chain := []*dns.NSEC{
+		nsec(t, "unix.ar.", "a.flow.unix.ar.", dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY),
+		nsec(t, "a.flow.unix.ar.", "fnaa.unix.ar.", dns.TypeTXT),
+		nsec(t, "fnaa.unix.ar.", "unix.ar.", dns.TypeA),
+	}
+	for _, tc := range []struct {
+		name  string
+		nsec  []*dns.NSEC
+		rcode int
+		qname string
+		qtype uint16
+		ok    bool
+	}{
+		{"no data", chain, dns.RcodeSuccess, "fnaa.unix.ar.", dns.TypeAAAA, true},
+		{"type exists", chain, dns.RcodeSuccess, "fnaa.unix.ar.", dns.TypeA, false},
+		{"no NSEC of the name", chain[:2], dns.RcodeSuccess, "fnaa.unix.ar.", dns.TypeAAAA, false},
+		{"empty non-terminal", chain, dns.RcodeSuccess, "flow.unix.ar.", dns.TypeA, true},
+		{"name error", chain, dns.RcodeNameError, "missing.unix.ar.", dns.TypeA, true},
+		{"no wildcard proof", chain[2:], dns.RcodeNameError, "missing.unix.ar.", dns.TypeA, false},
+		{"no cover", chain[:1], dns.RcodeNameError, "missing.unix.ar.", dns.TypeA, false},
+	} {
+		err := denialNSEC(tc.nsec, tc.rcode, tc.qname, tc.qtype)
+		if tc.ok && err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%v: proof accepted", tc.name)
+		}
+	}
+}
+
+// nsec3Chain returns the NSEC3 records of the names of zone, each with the
+// types given, hashed with the parameters of RFC 5155 appendix A.
+func nsec3Chain(zone string, names map[string][]uint16) []*dns.NSEC3 {
+	const salt = "AABBCCDD"
+	type hashed struct {
+		hash  string
+		types []uint16
+	}
+	var hashes []hashed
+	for name, types := range names {
+		hashes = append(hashes, hashed{dns.HashName(name, dns.SHA1, 12, salt), types})
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].hash < hashes[j].hash })
+	var chain []*dns.NSEC3
+	for i, h := range hashes {
+		chain = append(chain, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(h.hash) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Iterations: 12,
+			Salt:       salt,
+			SaltLength: 4,
+			NextDomain: hashes[(i+1)%len(hashes)].hash,
+			HashLength: 20,
+			TypeBitMap: h.types,
+		})
+	}
+	return chain
+}
+
+func TestDenialNSEC3(t *testing.T) {
+	chain := nsec3Chain("unix.ar.", map[string][]uint16{
+		"unix.ar.":      {dns.TypeSOA, dns.TypeNS},
+		"fnaa.unix.ar.": {dns.TypeA},
+		"flow.unix.ar.": {dns.TypeTXT},
+	})
+	without := func(name string) []*dns.NSEC3 {
+		var rest []*dns.NSEC3
+		for _, rr := range chain {
+			if !rr.Match(name) && !rr.Cover(name) {
+				rest = append(rest, rr)
+			}
+		}
+		return rest
+	}
+
+	if err := denialNSEC3(chain, dns.RcodeSuccess, "fnaa.unix.ar.", dns.TypeAAAA); err != nil {
+		t.Errorf("no data: %v", err)
+	}
+	if err := denialNSEC3(chain, dns.RcodeSuccess, "fnaa.unix.ar.", dns.TypeA); err == nil {
+		t.Error("no data proof accepted for a type that exists")
+	}
+	if err := denialNSEC3(without("fnaa.unix.ar."), dns.RcodeSuccess, "fnaa.unix.ar.", dns.TypeAAAA); err == nil {
+		t.Error("no data proof accepted without the NSEC3 of the name")
+	}
+
+	if err := denialNSEC3(chain, dns.RcodeNameError, "missing.unix.ar.", dns.TypeA); err != nil {
+		t.Errorf("name error: %v", err)
+	}
+	if err := denialNSEC3(without("missing.unix.ar."), dns.RcodeNameError, "missing.unix.ar.", dns.TypeA); err == nil {
+		t.Error("name error proof accepted without the next closer")
+	}
+	if err := denialNSEC3(without("*.unix.ar."), dns.RcodeNameError, "missing.unix.ar.", dns.TypeA); err == nil {
+		t.Error("name error proof accepted without the wildcard")
+	}
+	if err := denialNSEC3(without("unix.ar."), dns.RcodeNameError, "missing.unix.ar.", dns.TypeA); err == nil {
+		t.Error("name error proof accepted without the closest encloser")
+	}
+}
+
+// signedZone is a zone signed with a single key, answering with its
+// records, their signatures and NSEC proofs of non existence.
+type signedZone struct {
+	t       *testing.T
+	apex    string
+	key     *dns.DNSKEY
+	private crypto.Signer
+	rrs     []dns.RR
+	// tamper, when set, changes the answers once they are signed.
+	tamper func(m *dns.Msg)
+}
+
+func newSignedZone(t *testing.T, apex string, records ...string) *signedZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: apex, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	private, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := &signedZone{t: t, apex: apex, key: key, private: private.(crypto.Signer)}
+	z.rrs = append(z.rrs, key)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.rrs = append(z.rrs, rr)
+	}
+
+	// The NSEC chain, in canonical order and wrapping to the apex.
+	types := map[string][]uint16{}
+	var names []string
+	for _, rr := range z.rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		if _, ok := types[name]; !ok {
+			names = append(names, name)
+		}
+		types[name] = append(types[name], rr.Header().Rrtype)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalLess(names[i], names[j]) })
+	for i, name := range names {
+		z.rrs = append(z.rrs, nsec(t, name, names[(i+1)%len(names)], types[name]...))
+	}
+	return z
+}
+
+// sign returns set with its signature. It runs in the goroutines of the
+// nameserver, so failures are reported with Error.
+func (z *signedZone) sign(set []dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: set[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.apex,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.private, set); err != nil {
+		z.t.Error(err)
+	}
+	return append(append([]dns.RR{}, set...), sig)
+}
+
+// records returns the records of name, of type qtype unless it is 0.
+func (z *signedZone) records(name string, qtype uint16) []dns.RR {
+	var set []dns.RR
+	for _, rr := range z.rrs {
+		if equalNames(rr.Header().Name, name) && (qtype == 0 || rr.Header().Rrtype == qtype) {
+			set = append(set, rr)
+		}
+	}
+	return set
+}
+
+func (z *signedZone) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+	switch {
+	case len(z.records(q.Name, q.Qtype)) > 0:
+		m.Answer = z.sign(z.records(q.Name, q.Qtype))
+	case len(z.records(q.Name, 0)) > 0:
+		m.Ns = z.sign(z.records(q.Name, dns.TypeNSEC))
+	default:
+		m.Rcode = dns.RcodeNameError
+		for _, rr := range z.rrs {
+			if n, ok := rr.(*dns.NSEC); ok && (covers(n, q.Name) || covers(n, "*."+z.apex)) {
+				m.Ns = append(m.Ns, z.sign([]dns.RR{n})...)
+			}
+		}
+	}
+	if z.tamper != nil {
+		z.tamper(m)
+	}
+	w.WriteMsg(m)
+}
+
+func TestVerify(t *testing.T) {
+	z := newSignedZone(t, "unix.ar.",
+		"_fnaa._tcp.unix.ar. 300 IN SRV 10 0 61000 fnaa.unix.ar.",
+		"fnaa.unix.ar. 300 IN A 192.0.2.1",
+	)
+	addr, stop := serve(t, "udp", z, nil)
+	defer stop()
+	r := New(addr)
+	r.TrustAnchors = []dns.RR{z.key.ToDS(dns.SHA256)}
+	ctx, cancel := testContext()
+	defer cancel()
+
+	records, err := r.LookupSRV(ctx, "_fnaa._tcp.unix.ar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Target != "fnaa.unix.ar." {
+		t.Errorf("records %v", records)
+	}
+	if _, err := r.Lookup(ctx, "fnaa.unix.ar", dns.TypeAAAA); !IsNotFound(err) {
+		t.Errorf("signed no data gave %v, want not found", err)
+	}
+	if _, err := r.Lookup(ctx, "missing.unix.ar", dns.TypeA); !IsNotFound(err) {
+		t.Errorf("signed name error gave %v, want not found", err)
+	}
+
+	// Keys that do not match the trust anchor are not trusted.
+	other := New(addr)
+	other.TrustAnchors = []dns.RR{newSignedZone(t, "unix.ar.").key}
+	if _, err := other.LookupSRV(ctx, "_fnaa._tcp.unix.ar"); err == nil {
+		t.Error("answer validated against another key")
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		tamper func(m *dns.Msg)
+		want   error
+	}{
+		{"changed answer", "fnaa.unix.ar", dns.TypeA, func(m *dns.Msg) {
+			for _, rr := range m.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					a.A = a.A.To4()
+					a.A[3] = 66
+				}
+			}
+		}, ErrBogus},
+		{"stripped signatures", "fnaa.unix.ar", dns.TypeA, func(m *dns.Msg) {
+			if m.Question[0].Qtype == dns.TypeA {
+				m.Answer = m.Answer[:1]
+			}
+		}, ErrInsecure},
+		{"stripped denial", "missing.unix.ar", dns.TypeA, func(m *dns.Msg) {
+			if m.Rcode == dns.RcodeNameError {
+				m.Ns = nil
+			}
+		}, ErrInsecure},
+		{"partial denial", "missing.unix.ar", dns.TypeA, func(m *dns.Msg) {
+			if m.Rcode == dns.RcodeNameError {
+				var ns []dns.RR
+				for i := 0; i+1 < len(m.Ns); i += 2 {
+					if !covers(m.Ns[i].(*dns.NSEC), "*.unix.ar.") {
+						ns = append(ns, m.Ns[i], m.Ns[i+1])
+					}
+				}
+				m.Ns = ns
+			}
+		}, ErrBogus},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			z := newSignedZone(t, "unix.ar.", "fnaa.unix.ar. 300 IN A 192.0.2.1", "z.unix.ar. 300 IN A 192.0.2.2")
+			z.tamper = tc.tamper
+			addr, stop := serve(t, "udp", z, nil)
+			defer stop()
+			r := New(addr)
+			r.TrustAnchors = []dns.RR{z.key}
+			ctx, cancel := testContext()
+			defer cancel()
+
+			_, err := r.Lookup(ctx, tc.qname, tc.qtype)
+			if err == nil || IsNotFound(err) {
+				t.Fatalf("tampered answer gave %v", err)
+			}
+			if !strings.Contains(err.Error(), tc.want.Error()) {
+				t.Errorf("error %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+module resolver
+
+go 1.13
+
+require (
+	github.com/miekg/dns v1.1.41
+	github.com/pkg/errors v0.9.1
+)
@@ -0,0 +1,272 @@
+// Package resolver looks up the DNS records FNAAs are found through. It is
+// shared by the flow CLI and the FNAA, so both discover agents the same
+// way: SRV targets are tried in RFC 2782 order, hosts are resolved to IPv4
+// and IPv6 addresses following CNAMEs, every nameserver configured is
+// tried before giving up and, given trust anchors, answers are validated
+// with DNSSEC. Queries go over UDP, TCP, DNS-over-TLS or DNS-over-HTTPS
+// and their answers may be cached until their TTL runs out.
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned when the name or the records asked for do not
+// exist, as opposed to the nameservers failing to answer.
+var ErrNotFound = errors.New("no such record")
+
+// maxCNAME bounds the CNAME chains followed, so loops end.
+const maxCNAME = 8
+
+// Resolver sends queries to a list of nameservers, in order, moving on to
+// the next one when a nameserver fails or cannot answer.
+type Resolver struct {
+	// Servers are the nameservers, as host:port addresses or, for
+	// DNS-over-HTTPS, URLs. The port defaults to the one of Transport.
+	Servers []string
+	// Transport is the protocol queries are sent with, TransportUDP when
+	// empty.
+	Transport string
+	// TLSConfig is used by DNS-over-TLS and DNS-over-HTTPS, to trust a
+	// private CA for instance. When nil the system roots are used.
+	TLSConfig *tls.Config
+	// Timeout bounds each query.
+	Timeout time.Duration
+	// Attempts is the number of rounds over Servers before giving up.
+	Attempts int
+	// Logger receives a trace of the queries.
+	Logger *log.Logger
+	// TrustAnchors, DNSKEY or DS records, turn DNSSEC validation on:
+	// answers that are not signed with keys chaining up to them are
+	// refused with ErrInsecure or ErrBogus.
+	TrustAnchors []dns.RR
+	// Cache, when set, keeps answers until their TTL runs out.
+	Cache Cache
+
+	mu   sync.Mutex
+	keys map[string][]*dns.DNSKEY // validated DNSKEY RRsets by zone
+	http *http.Client             // shared by DNS-over-HTTPS queries
+}
+
+// New returns a resolver that queries servers over UDP. Servers are
+// addresses with or without a port, or URLs for DNS-over-HTTPS.
+func New(servers ...string) *Resolver {
+	return &Resolver{
+		Servers:  servers,
+		Timeout:  5 * time.Second,
+		Attempts: 2,
+		Logger:   log.New(ioutil.Discard, "", 0),
+	}
+}
+
+// FromResolvConf returns a resolver for all the nameservers of a
+// resolv.conf(5) file, with its timeout and attempts.
+func FromResolvConf(path string) (*Resolver, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading "+path)
+	}
+	if len(conf.Servers) == 0 {
+		return nil, errors.Errorf("no nameserver in %v", path)
+	}
+	r := New()
+	for _, server := range conf.Servers {
+		r.Servers = append(r.Servers, net.JoinHostPort(server, conf.Port))
+	}
+	if conf.Timeout > 0 {
+		r.Timeout = time.Duration(conf.Timeout) * time.Second
+	}
+	if conf.Attempts > 0 {
+		r.Attempts = conf.Attempts
+	}
+	return r, nil
+}
+
+// Address adds the DNS port to a nameserver unless it already has one.
+func Address(server string) string {
+	return withPort(server, "53")
+}
+
+func withPort(server string, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), port)
+}
+
+// Exchange sends m to the nameservers until one answers it, over the
+// transport of the resolver. A nameserver failing with SERVFAIL, REFUSED
+// or NOTIMP is skipped like one that does not reply; if all of them do,
+// the last such answer is returned.
+func (r *Resolver) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if len(r.Servers) == 0 {
+		return nil, errors.New("no nameserver configured")
+	}
+	attempts := r.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var (
+		failed  *dns.Msg
+		lastErr error
+	)
+	for attempt := 0; attempt < attempts; attempt++ {
+		for _, server := range r.Servers {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			in, err := r.exchange(ctx, m, server)
+			if err != nil {
+				r.Logger.Printf("Query %v to %v failed: %v", questionString(m), server, err)
+				lastErr = err
+				continue
+			}
+			switch in.Rcode {
+			case dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeNotImplemented:
+				r.Logger.Printf("Query %v to %v failed: %v", questionString(m), server, dns.RcodeToString[in.Rcode])
+				failed = in
+				continue
+			}
+			return in, nil
+		}
+	}
+	if failed != nil {
+		return failed, nil
+	}
+	return nil, errors.Wrap(lastErr, "querying "+questionString(m))
+}
+
+// Query asks the nameservers for the records of type qtype of name. With
+// trust anchors set the answer is validated, see Verify. Answers, negative
+// ones included, are kept in the cache if there is one.
+func (r *Resolver) Query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	key := r.cacheKey(name, qtype)
+	if r.Cache != nil {
+		if in, ok := r.Cache.Get(key); ok {
+			r.Logger.Printf("Answer for %v IN %v found in cache", dns.Fqdn(name), dns.TypeToString[qtype])
+			return in, nil
+		}
+	}
+
+	in, err := r.query(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if r.Cache != nil {
+		if ttl := cacheTTL(in); ttl > 0 {
+			r.Cache.Set(key, in, ttl)
+		}
+	}
+	return in, nil
+}
+
+func (r *Resolver) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	if !r.validating() {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(name), qtype)
+		m.RecursionDesired = true
+		return r.Exchange(ctx, m)
+	}
+
+	in, err := r.exchangeDO(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode == dns.RcodeSuccess || in.Rcode == dns.RcodeNameError {
+		if err := r.Verify(ctx, in); err != nil {
+			return nil, errors.Wrapf(err, "validating %v IN %v", dns.Fqdn(name), dns.TypeToString[qtype])
+		}
+	}
+	return in, nil
+}
+
+// Lookup returns the records of type qtype of name, following the CNAMEs
+// it is an alias through, in the answer or with further queries. It fails
+// with ErrNotFound when name or its records do not exist.
+func (r *Resolver) Lookup(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	name = dns.Fqdn(name)
+	for hops := 0; hops <= maxCNAME; hops++ {
+		in, err := r.Query(ctx, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		switch in.Rcode {
+		case dns.RcodeSuccess:
+		case dns.RcodeNameError:
+			return nil, errors.Wrapf(ErrNotFound, "%v IN %v", name, dns.TypeToString[qtype])
+		default:
+			return nil, errors.Errorf("querying %v IN %v: %v", name, dns.TypeToString[qtype], dns.RcodeToString[in.Rcode])
+		}
+
+		records, target := answer(in.Answer, name, qtype)
+		if len(records) > 0 {
+			return records, nil
+		}
+		if target == name {
+			return nil, errors.Wrapf(ErrNotFound, "%v IN %v", name, dns.TypeToString[qtype])
+		}
+		r.Logger.Printf("%v is an alias of %v", name, target)
+		name = target
+	}
+	return nil, errors.Errorf("%v IN %v: more than %v CNAMEs", name, dns.TypeToString[qtype], maxCNAME)
+}
+
+// LookupTXT returns the strings of the TXT records of name, each record
+// joined into one string.
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	rrs, err := r.Lookup(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var texts []string
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok {
+			texts = append(texts, strings.Join(txt.Txt, ""))
+		}
+	}
+	return texts, nil
+}
+
+// answer returns the records of type qtype of name in rrs, following the
+// CNAMEs there, and the name the chain ends at.
+func answer(rrs []dns.RR, name string, qtype uint16) ([]dns.RR, string) {
+	for hops := 0; hops <= maxCNAME; hops++ {
+		var records []dns.RR
+		alias := ""
+		for _, rr := range rrs {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				records = append(records, rr)
+			} else if cname, ok := rr.(*dns.CNAME); ok && qtype != dns.TypeCNAME {
+				alias = cname.Target
+			}
+		}
+		if len(records) > 0 || alias == "" {
+			return records, name
+		}
+		name = alias
+	}
+	return nil, name
+}
+
+func questionString(m *dns.Msg) string {
+	if len(m.Question) == 0 {
+		return "(empty)"
+	}
+	q := m.Question[0]
+	return q.Name + " IN " + dns.TypeToString[q.Qtype]
+}
@@ -0,0 +1,168 @@
+package resolver
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// LookupSRV returns the SRV records of name in the order their targets
+// should be tried, see Order. A single record with target "." means the
+// service is decidedly not available and yields ErrNotFound.
+func (r *Resolver) LookupSRV(ctx context.Context, name string) ([]*dns.SRV, error) {
+	rrs, err := r.Lookup(ctx, name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	var records []*dns.SRV
+	for _, rr := range rrs {
+		if srv, ok := rr.(*dns.SRV); ok && srv.Target != "." {
+			records = append(records, srv)
+		}
+	}
+	if len(records) == 0 {
+		return nil, errors.Wrapf(ErrNotFound, "%v IN SRV: service not available", name)
+	}
+	return Order(records), nil
+}
+
+// Order sorts SRV records as RFC 2782 asks clients to try them: by
+// ascending priority and, within a priority, by a weighted random pick in
+// which records with weight 0 have a small chance of going first.
+func Order(records []*dns.SRV) []*dns.SRV {
+	sorted := make([]*dns.SRV, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+
+	ordered := make([]*dns.SRV, 0, len(sorted))
+	for start := 0; start < len(sorted); {
+		end := start
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		ordered = append(ordered, weighted(sorted[start:end])...)
+		start = end
+	}
+	return ordered
+}
+
+// weighted orders records of the same priority: the ones with weight 0
+// first, then repeatedly the record whose running sum of weights is the
+// first to reach a random number between 0 and the total.
+func weighted(records []*dns.SRV) []*dns.SRV {
+	var pending []*dns.SRV
+	for _, srv := range records {
+		if srv.Weight == 0 {
+			pending = append(pending, srv)
+		}
+	}
+	for _, srv := range records {
+		if srv.Weight != 0 {
+			pending = append(pending, srv)
+		}
+	}
+
+	ordered := make([]*dns.SRV, 0, len(pending))
+	for len(pending) > 0 {
+		total := 0
+		for _, srv := range pending {
+			total += int(srv.Weight)
+		}
+		pick := rand.Intn(total + 1)
+		sum := 0
+		for i, srv := range pending {
+			sum += int(srv.Weight)
+			if sum >= pick {
+				ordered = append(ordered, srv)
+				pending = append(pending[:i], pending[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+// Endpoint is an address a FNAA listens on.
+type Endpoint struct {
+	// Target is the host name of the FNAA, without the trailing dot.
+	Target string
+	IP     net.IP
+	Port   int
+}
+
+// Address returns the endpoint as host:port, fit for dialing.
+func (e Endpoint) Address() string {
+	return net.JoinHostPort(e.IP.String(), strconv.Itoa(e.Port))
+}
+
+// Endpoints resolves the targets of records, kept in order, into the
+// addresses to try connecting to. Targets that do not resolve are skipped;
+// it fails only if none does.
+func (r *Resolver) Endpoints(ctx context.Context, records []*dns.SRV) ([]Endpoint, error) {
+	var (
+		endpoints []Endpoint
+		lastErr   error
+	)
+	for _, srv := range records {
+		ips, err := r.LookupHost(ctx, srv.Target)
+		if err != nil {
+			r.Logger.Printf("Skipping SRV target %v: %v", srv.Target, err)
+			lastErr = err
+			continue
+		}
+		for _, ip := range ips {
+			endpoints = append(endpoints, Endpoint{Target: strings.TrimSuffix(srv.Target, "."), IP: ip, Port: int(srv.Port)})
+		}
+	}
+	if len(endpoints) == 0 {
+		if lastErr == nil {
+			lastErr = errors.Wrap(ErrNotFound, "no SRV target")
+		}
+		return nil, lastErr
+	}
+	return endpoints, nil
+}
+
+// LookupHost returns the IPv4 and then the IPv6 addresses of host,
+// following CNAMEs. Literal addresses are returned as they are.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	var (
+		ips     []net.IP
+		lastErr error
+	)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		rrs, err := r.Lookup(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, lastErr
+	}
+	return ips, nil
+}
+
+// IsNotFound reports whether err means the records looked up do not
+// exist.
+func IsNotFound(err error) bool {
+	return errors.Cause(err) == ErrNotFound
+}
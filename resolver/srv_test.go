@@ -0,0 +1,185 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// zone answers the queries for the records it holds, written in zone file
+// syntax, with NXDOMAIN for the names it does not have. CNAMEs are
+// answered for every type, leaving it to the resolver to chase them.
+func zone(t *testing.T, records ...string) dns.HandlerFunc {
+	t.Helper()
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		m := new(dns.Msg)
+		m.SetReply(req)
+		found := false
+		for _, rr := range rrs {
+			if !equalNames(rr.Header().Name, q.Name) {
+				continue
+			}
+			found = true
+			if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		if !found {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func equalNames(a, b string) bool {
+	return dns.CanonicalName(a) == dns.CanonicalName(b)
+}
+
+func srv(priority, weight uint16, target string) *dns.SRV {
+	return &dns.SRV{Priority: priority, Weight: weight, Port: 7000, Target: target}
+}
+
+func TestOrderPriority(t *testing.T) {
+	records := []*dns.SRV{srv(20, 5, "c."), srv(10, 0, "a."), srv(30, 1, "d."), srv(10, 50, "b.")}
+	for i := 0; i < 100; i++ {
+		ordered := Order(records)
+		if len(ordered) != len(records) {
+			t.Fatalf("%v records ordered, want %v", len(ordered), len(records))
+		}
+		seen := map[string]bool{}
+		for j, record := range ordered {
+			if j > 0 && record.Priority < ordered[j-1].Priority {
+				t.Fatalf("priority %v after %v", record.Priority, ordered[j-1].Priority)
+			}
+			if seen[record.Target] {
+				t.Fatalf("%v ordered twice", record.Target)
+			}
+			seen[record.Target] = true
+		}
+	}
+	if records[0].Target != "c." {
+		t.Error("Order changed the records it was given")
+	}
+}
+
+func TestOrderWeight(t *testing.T) {
+	const runs = 10000
+	records := []*dns.SRV{srv(10, 90, "heavy."), srv(10, 10, "light."), srv(10, 0, "zero.")}
+	first := map[string]int{}
+	for i := 0; i < runs; i++ {
+		first[Order(records)[0].Target]++
+	}
+	// RFC 2782 picks heavy first 90 times out of 101, light 10 times
+	// and zero once.
+	for target, want := range map[string]float64{"heavy.": 90.0 / 101, "light.": 10.0 / 101, "zero.": 1.0 / 101} {
+		got := float64(first[target]) / runs
+		if got < want-0.03 || got > want+0.03 {
+			t.Errorf("%v first %.3f of the time, want about %.3f", target, got, want)
+		}
+	}
+}
+
+func TestOrderZeroWeights(t *testing.T) {
+	// With every weight 0 the running sum reaches the pick, 0, at the
+	// first record, so the RFC 2782 selection keeps their order.
+	records := []*dns.SRV{srv(10, 0, "a."), srv(10, 0, "b."), srv(10, 0, "c.")}
+	for i := 0; i < 100; i++ {
+		ordered := Order(records)
+		for j, record := range ordered {
+			if record != records[j] {
+				t.Fatalf("records of weight 0 reordered: %v", ordered)
+			}
+		}
+	}
+}
+
+func TestLookupSRV(t *testing.T) {
+	addr, stop := serve(t, "udp", zone(t,
+		"_fnaa._tcp.unix.ar. 300 IN SRV 20 0 7000 backup.unix.ar.",
+		"_fnaa._tcp.unix.ar. 300 IN SRV 10 0 61000 fnaa.unix.ar.",
+		"_fnaa._tcp.down.ar. 300 IN SRV 0 0 0 .",
+		"fnaa.unix.ar. 300 IN CNAME host.unix.ar.",
+		"host.unix.ar. 300 IN A 192.0.2.1",
+		"host.unix.ar. 300 IN AAAA 2001:db8::1",
+		"backup.unix.ar. 300 IN A 192.0.2.2",
+	), nil)
+	defer stop()
+	r := New(addr)
+	ctx, cancel := testContext()
+	defer cancel()
+
+	records, err := r.LookupSRV(ctx, "_fnaa._tcp.unix.ar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Target != "fnaa.unix.ar." || records[1].Target != "backup.unix.ar." {
+		t.Fatalf("records %v not in priority order", records)
+	}
+
+	endpoints, err := r.Endpoints(ctx, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Endpoint{
+		{Target: "fnaa.unix.ar", IP: net.ParseIP("192.0.2.1"), Port: 61000},
+		{Target: "fnaa.unix.ar", IP: net.ParseIP("2001:db8::1"), Port: 61000},
+		{Target: "backup.unix.ar", IP: net.ParseIP("192.0.2.2"), Port: 7000},
+	}
+	if len(endpoints) != len(want) {
+		t.Fatalf("endpoints %v, want %v", endpoints, want)
+	}
+	for i := range want {
+		if endpoints[i].Target != want[i].Target || !endpoints[i].IP.Equal(want[i].IP) || endpoints[i].Port != want[i].Port {
+			t.Errorf("endpoint %v is %v, want %v", i, endpoints[i], want[i])
+		}
+	}
+
+	if _, err := r.LookupSRV(ctx, "_fnaa._tcp.down.ar"); !IsNotFound(err) {
+		t.Errorf("target \".\" gave %v, want not found", err)
+	}
+	if _, err := r.LookupSRV(ctx, "_fnaa._tcp.missing.ar"); !IsNotFound(err) {
+		t.Errorf("missing name gave %v, want not found", err)
+	}
+}
+
+func TestEndpointsSkipUnresolved(t *testing.T) {
+	addr, stop := serve(t, "udp", zone(t, "fnaa.unix.ar. 300 IN A 192.0.2.1"), nil)
+	defer stop()
+	r := New(addr)
+	ctx, cancel := testContext()
+	defer cancel()
+
+	endpoints, err := r.Endpoints(ctx, []*dns.SRV{srv(10, 0, "gone.unix.ar."), srv(20, 0, "fnaa.unix.ar.")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0].Target != "fnaa.unix.ar" {
+		t.Errorf("endpoints %v, want only fnaa.unix.ar", endpoints)
+	}
+	if _, err := r.Endpoints(ctx, []*dns.SRV{srv(10, 0, "gone.unix.ar.")}); !IsNotFound(err) {
+		t.Errorf("no target resolving gave %v, want not found", err)
+	}
+}
+
+func TestLookupCNAMELoop(t *testing.T) {
+	addr, stop := serve(t, "udp", zone(t,
+		"a.unix.ar. 300 IN CNAME b.unix.ar.",
+		"b.unix.ar. 300 IN CNAME a.unix.ar.",
+	), nil)
+	defer stop()
+	ctx, cancel := testContext()
+	defer cancel()
+	if _, err := New(addr).LookupHost(ctx, "a.unix.ar"); err == nil {
+		t.Error("CNAME loop resolved")
+	}
+}
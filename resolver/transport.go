@@ -0,0 +1,143 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// The transports queries can be sent with.
+const (
+	TransportUDP = "udp" // plain DNS over UDP, retried over TCP when truncated
+	TransportTCP = "tcp" // plain DNS over TCP
+	TransportDoT = "dot" // DNS-over-TLS, RFC 7858, port 853 by default
+	TransportDoH = "doh" // DNS-over-HTTPS, RFC 8484, POSTing to a URL
+)
+
+// dohPath is where DNS-over-HTTPS servers given without a path answer.
+const dohPath = "/dns-query"
+
+// ParseTransport checks that name is one of the transports, the empty
+// name meaning TransportUDP.
+func ParseTransport(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", TransportUDP:
+		return TransportUDP, nil
+	case TransportTCP, TransportDoT, TransportDoH:
+		return strings.ToLower(name), nil
+	}
+	return "", errors.Errorf("unknown DNS transport %q, use udp, tcp, dot or doh", name)
+}
+
+// TLSConfigFromCA returns a TLS configuration trusting only the PEM
+// certificates in the file at path, for nameservers whose certificate is
+// issued by a private CA.
+func TLSConfigFromCA(path string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading nameserver CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no PEM certificate in %v", path)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// exchange sends m to server over the transport of the resolver.
+func (r *Resolver) exchange(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+	switch r.Transport {
+	case "", TransportUDP:
+		in, err := r.exchangeConn(ctx, m, Address(server), "udp")
+		if err == nil && in.Truncated {
+			r.Logger.Printf("Answer from %v truncated, retrying over TCP", server)
+			in, err = r.exchangeConn(ctx, m, Address(server), "tcp")
+		}
+		return in, err
+	case TransportTCP:
+		return r.exchangeConn(ctx, m, Address(server), "tcp")
+	case TransportDoT:
+		return r.exchangeConn(ctx, m, withPort(server, "853"), "tcp-tls")
+	case TransportDoH:
+		return r.exchangeHTTPS(ctx, m, dohURL(server))
+	}
+	return nil, errors.Errorf("unknown DNS transport %q", r.Transport)
+}
+
+func (r *Resolver) exchangeConn(ctx context.Context, m *dns.Msg, server string, network string) (*dns.Msg, error) {
+	c := &dns.Client{Net: network, Timeout: r.Timeout, TLSConfig: r.TLSConfig}
+	r.Logger.Printf("Querying %v at %v over %v", questionString(m), server, network)
+	in, _, err := c.ExchangeContext(ctx, m, server)
+	return in, err
+}
+
+// exchangeHTTPS POSTs m to url in wire format, as RFC 8484 describes.
+func (r *Resolver) exchangeHTTPS(ctx context.Context, m *dns.Msg, url string) (*dns.Msg, error) {
+	r.Logger.Printf("Querying %v at %v over https", questionString(m), url)
+	// The ID is 0 so the answers can be cached by HTTP.
+	q := m.Copy()
+	q.Id = 0
+	data, err := q.Pack()
+	if err != nil {
+		return nil, errors.Wrap(err, "packing query")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%v replied %v", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading answer")
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, errors.Wrap(err, "unpacking answer")
+	}
+	in.Id = m.Id
+	return in, nil
+}
+
+func (r *Resolver) httpClient() *http.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.http == nil {
+		r.http = &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			TLSClientConfig:   r.TLSConfig,
+			ForceAttemptHTTP2: true,
+		}}
+	}
+	return r.http
+}
+
+// dohURL turns a DNS-over-HTTPS server given as a host into the URL of
+// its well-known path.
+func dohURL(server string) string {
+	if strings.Contains(server, "://") {
+		return server
+	}
+	return "https://" + server + dohPath
+}
@@ -0,0 +1,381 @@
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testTimeout bounds every test query, so a broken transport fails the
+// test instead of hanging it.
+const testTimeout = 5 * time.Second
+
+func testContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), testTimeout)
+}
+
+// answerA answers every A query with 192.0.2.1 and counts the queries.
+func answerA(queries *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = []dns.RR{rr}
+		w.WriteMsg(m)
+	}
+}
+
+// answerRcode answers every query with rcode.
+func answerRcode(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, rcode)
+		w.WriteMsg(m)
+	}
+}
+
+// serve starts a nameserver answering with handler on a free local port
+// over network, "udp", "tcp" or "tcp-tls" with certificate. It returns
+// its address and a function stopping it.
+func serve(t *testing.T, network string, handler dns.Handler, certificate *tls.Certificate) (string, func()) {
+	t.Helper()
+	server := &dns.Server{Net: network, Handler: handler}
+	switch network {
+	case "udp":
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.PacketConn = pc
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener = l
+	case "tcp-tls":
+		l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{*certificate}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener = l
+	}
+	return startServer(t, server)
+}
+
+func startServer(t *testing.T, server *dns.Server) (string, func()) {
+	t.Helper()
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	<-started
+	addr := ""
+	if server.PacketConn != nil {
+		addr = server.PacketConn.LocalAddr().String()
+	} else {
+		addr = server.Listener.Addr().String()
+	}
+	return addr, func() { server.Shutdown() }
+}
+
+// selfSigned returns a certificate for 127.0.0.1 and a TLS configuration
+// trusting it.
+func selfSigned(t *testing.T) (*tls.Certificate, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, &tls.Config{RootCAs: pool}
+}
+
+// serveHTTPS starts a DNS-over-HTTPS server answering with handler. It
+// returns its URL and a TLS configuration trusting it.
+func serveHTTPS(t *testing.T, handler dns.HandlerFunc) (*httptest.Server, *tls.Config) {
+	t.Helper()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err == nil {
+			err = req.Unpack(data)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rec := &recorder{}
+		handler(rec, req)
+		out, err := rec.msg.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	return ts, &tls.Config{RootCAs: pool}
+}
+
+// recorder is a dns.ResponseWriter keeping the answer written to it.
+type recorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+	r.msg = m
+	return nil
+}
+
+func lookupA(t *testing.T, r *Resolver) {
+	t.Helper()
+	ctx, cancel := testContext()
+	defer cancel()
+	rrs, err := r.Lookup(ctx, "fnaa.unix.ar", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || rrs[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("answer is %v, want fnaa.unix.ar A 192.0.2.1", rrs)
+	}
+}
+
+func TestTransports(t *testing.T) {
+	certificate, clientTLS := selfSigned(t)
+	for _, tc := range []struct {
+		transport string
+		network   string
+	}{
+		{TransportUDP, "udp"},
+		{TransportTCP, "tcp"},
+		{TransportDoT, "tcp-tls"},
+	} {
+		t.Run(tc.transport, func(t *testing.T) {
+			var queries int32
+			addr, stop := serve(t, tc.network, answerA(&queries), certificate)
+			defer stop()
+			r := New(addr)
+			r.Transport = tc.transport
+			r.TLSConfig = clientTLS
+			lookupA(t, r)
+			if n := atomic.LoadInt32(&queries); n != 1 {
+				t.Errorf("%v queries, want 1", n)
+			}
+		})
+	}
+
+	t.Run(TransportDoH, func(t *testing.T) {
+		var queries int32
+		ts, clientTLS := serveHTTPS(t, answerA(&queries))
+		defer ts.Close()
+		r := New(ts.URL + dohPath)
+		r.Transport = TransportDoH
+		r.TLSConfig = clientTLS
+		lookupA(t, r)
+		if n := atomic.LoadInt32(&queries); n != 1 {
+			t.Errorf("%v queries, want 1", n)
+		}
+	})
+}
+
+func TestDoTUntrusted(t *testing.T) {
+	certificate, _ := selfSigned(t)
+	var queries int32
+	addr, stop := serve(t, "tcp-tls", answerA(&queries), certificate)
+	defer stop()
+
+	r := New(addr)
+	r.Transport = TransportDoT
+	r.Attempts = 1
+	r.TLSConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+	ctx, cancel := testContext()
+	defer cancel()
+	if _, err := r.Lookup(ctx, "fnaa.unix.ar", dns.TypeA); err == nil {
+		t.Fatal("nameserver with an untrusted certificate answered")
+	}
+	if n := atomic.LoadInt32(&queries); n != 0 {
+		t.Errorf("%v queries reached the nameserver", n)
+	}
+}
+
+func TestDoHErrorStatus(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	r := New(ts.URL + dohPath)
+	r.Transport = TransportDoH
+	r.Attempts = 1
+	r.TLSConfig = &tls.Config{RootCAs: pool}
+	ctx, cancel := testContext()
+	defer cancel()
+	if _, err := r.Lookup(ctx, "fnaa.unix.ar", dns.TypeA); err == nil {
+		t.Fatal("lookup succeeded against a failing DNS-over-HTTPS server")
+	}
+}
+
+func TestTruncatedRetriedOverTCP(t *testing.T) {
+	var tcpQueries int32
+	// The UDP and TCP servers share a port, as a nameserver does.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Skip("UDP port of the TCP listener taken:", err)
+	}
+	_, stopTCP := startServer(t, &dns.Server{Net: "tcp", Listener: l, Handler: answerA(&tcpQueries)})
+	defer stopTCP()
+	addr, stopUDP := startServer(t, &dns.Server{Net: "udp", PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Truncated = true
+		w.WriteMsg(m)
+	})})
+	defer stopUDP()
+
+	lookupA(t, New(addr))
+	if n := atomic.LoadInt32(&tcpQueries); n != 1 {
+		t.Errorf("%v queries over TCP, want 1", n)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	var queries int32
+	failing, stopFailing := serve(t, "udp", answerRcode(dns.RcodeServerFailure), nil)
+	defer stopFailing()
+	working, stopWorking := serve(t, "udp", answerA(&queries), nil)
+	defer stopWorking()
+
+	lookupA(t, New(failing, working))
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%v queries to the working nameserver, want 1", n)
+	}
+
+	// When every nameserver fails, the last failure is the answer.
+	r := New(failing)
+	ctx, cancel := testContext()
+	defer cancel()
+	m := new(dns.Msg)
+	m.SetQuestion("fnaa.unix.ar.", dns.TypeA)
+	in, err := r.Exchange(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode %v, want SERVFAIL", dns.RcodeToString[in.Rcode])
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// A nameserver that never answers.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	r := New(pc.LocalAddr().String())
+	r.Timeout = 100 * time.Millisecond
+	r.Attempts = 2
+	ctx, cancel := testContext()
+	defer cancel()
+	start := time.Now()
+	_, err = r.Lookup(ctx, "fnaa.unix.ar", dns.TypeA)
+	if err == nil {
+		t.Fatal("lookup succeeded without an answer")
+	}
+	if IsNotFound(err) {
+		t.Errorf("timeout reported as not found: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("lookup gave up after %v, want about %v", elapsed, 2*r.Timeout)
+	}
+}
+
+func TestCanceled(t *testing.T) {
+	var queries int32
+	addr, stop := serve(t, "udp", answerA(&queries), nil)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := New(addr).Lookup(ctx, "fnaa.unix.ar", dns.TypeA); err == nil {
+		t.Fatal("canceled lookup succeeded")
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	for name, want := range map[string]string{"": TransportUDP, "UDP": TransportUDP, "tcp": TransportTCP, "DoT": TransportDoT, "doh": TransportDoH} {
+		got, err := ParseTransport(name)
+		if err != nil || got != want {
+			t.Errorf("ParseTransport(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseTransport("quic"); err == nil {
+		t.Error("ParseTransport accepted quic")
+	}
+
+	r := New("127.0.0.1")
+	r.Transport = "quic"
+	r.Attempts = 1
+	ctx, cancel := testContext()
+	defer cancel()
+	if _, err := r.Lookup(ctx, "fnaa.unix.ar", dns.TypeA); err == nil {
+		t.Error("lookup over an unknown transport succeeded")
+	}
+}
+
+func TestDoHURL(t *testing.T) {
+	if got := dohURL("dns.unix.ar"); got != "https://dns.unix.ar/dns-query" {
+		t.Errorf("dohURL(dns.unix.ar) = %v", got)
+	}
+	if got := dohURL("https://dns.unix.ar/q"); got != "https://dns.unix.ar/q" {
+		t.Errorf("dohURL kept no URL, got %v", got)
+	}
+}